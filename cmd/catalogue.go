@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/online-shop/internal/config"
+	"github.com/online-shop/internal/product"
+	"github.com/online-shop/pkg/log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// buildProductService creates the product service used by the catalogue commands, whose search index is
+// only kept up to date by servers.
+func buildProductService(cfg *config.Config, logger log.Logger) (product.Service, error) {
+	db, err := buildMysqlClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	blobs, err := buildBlobStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+	// the changes are invalidated in the shared cache, and expire from the caches of the servers
+	products, err := buildProductRepository(cfg, *db, nil, logger)
+	if err != nil {
+		return nil, err
+	}
+	return product.NewService(products, product.NewSearchIndex(), blobs, logger), nil
+}
+
+// catalogueFormat returns the given format, or else the format of the given file according to its extension.
+func catalogueFormat(format, path string) string {
+	if format != "" {
+		return format
+	}
+	if ext := strings.TrimPrefix(filepath.Ext(path), "."); ext == product.FormatJSONL || ext == "ndjson" {
+		return product.FormatJSONL
+	}
+	return product.FormatCSV
+}
+
+// importProducts imports a catalogue file: import-products [-dry-run] [-format csv|jsonl] FILE.
+// The import report is written to the standard output as JSON.
+func importProducts(cfg *config.Config, logger log.Logger) error {
+	flags := flag.NewFlagSet("import-products", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "report the changes without making them")
+	format := flags.String("format", "", "csv or jsonl, guessed from the file extension by default")
+	if err := flags.Parse(os.Args[2:]); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: import-products [-dry-run] [-format csv|jsonl] FILE")
+	}
+
+	service, err := buildProductService(cfg, logger)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	report, err := service.Import(context.Background(), file, catalogueFormat(*format, file.Name()), *dryRun)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(report)
+}
+
+// exportProducts exports the catalogue: export-products [-format csv|jsonl] [FILE].
+// The catalogue is written to the standard output when no file is given.
+func exportProducts(cfg *config.Config, logger log.Logger) error {
+	flags := flag.NewFlagSet("export-products", flag.ContinueOnError)
+	format := flags.String("format", "", "csv or jsonl, guessed from the file extension by default")
+	if err := flags.Parse(os.Args[2:]); err != nil {
+		return err
+	}
+	if flags.NArg() > 1 {
+		return fmt.Errorf("usage: export-products [-format csv|jsonl] [FILE]")
+	}
+
+	service, err := buildProductService(cfg, logger)
+	if err != nil {
+		return err
+	}
+	*format = catalogueFormat(*format, flags.Arg(0))
+	if flags.NArg() == 0 {
+		return service.Export(context.Background(), os.Stdout, *format)
+	}
+	file, err := os.Create(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if err := service.Export(context.Background(), file, *format); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
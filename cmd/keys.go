@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"github.com/online-shop/internal/config"
+	"github.com/online-shop/pkg/jwk"
+	"github.com/online-shop/pkg/log"
+	"time"
+)
+
+const (
+	// keyActivationDelay is how long a new JWT signing key is only published before it starts signing tokens.
+	// It leaves time to every server to reload the keys, and to other services to refresh their cached JWKS.
+	keyActivationDelay = 15 * time.Minute
+	// keyReloadInterval is how often servers reload the JWT signing keys, to pick up rotated keys.
+	keyReloadInterval = time.Minute
+)
+
+// loadKeys loads the JWT signing keys. A first key is generated if there is none yet.
+func loadKeys(cfg *config.Config, logger log.Logger) (*jwk.Set, error) {
+	keys, err := jwk.LoadDir(cfg.JWTKeysDir)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		key, err := jwk.Generate(cfg.JWTAlgorithm, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		if err := jwk.Save(cfg.JWTKeysDir, key); err != nil {
+			return nil, err
+		}
+		logger.Infof("generated the first JWT signing key %s", key.ID)
+		keys = append(keys, key)
+	}
+	return jwk.NewSet(keyActivationDelay, keys...), nil
+}
+
+// reloadKeys periodically reloads the JWT signing keys, so that rotated keys get picked up without restarting.
+func reloadKeys(keys *jwk.Set, cfg *config.Config, logger log.Logger) {
+	for range time.Tick(keyReloadInterval) {
+		loaded, err := jwk.LoadDir(cfg.JWTKeysDir)
+		if err != nil || len(loaded) == 0 {
+			logger.Errorf("failed to reload JWT signing keys, keeping the current ones: %v", err)
+			continue
+		}
+		keys.Update(loaded)
+	}
+}
+
+// rotateKeys introduces a new JWT signing key, and removes the keys which no longer verify any valid token.
+// The new key starts signing tokens after keyActivationDelay; tokens signed by the previous key stay valid until they expire.
+func rotateKeys(cfg *config.Config, logger log.Logger) error {
+	retention := time.Duration(cfg.JWTExpiration) * time.Hour
+	key, removed, err := jwk.Rotate(cfg.JWTKeysDir, cfg.JWTAlgorithm, keyActivationDelay, retention, time.Now())
+	if err != nil {
+		return err
+	}
+	logger.Infof("added JWT signing key %s, signing tokens from %s", key.ID, key.Created().Add(keyActivationDelay).Format(time.RFC3339))
+	for _, id := range removed {
+		logger.Infof("removed expired JWT signing key %s", id)
+	}
+	return nil
+}
@@ -1,29 +1,92 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"github.com/jmoiron/sqlx"
+	"github.com/online-shop/internal/audit"
 	"github.com/online-shop/internal/auth"
+	"github.com/online-shop/internal/category"
 	"github.com/online-shop/internal/config"
 	"github.com/online-shop/internal/errors"
 	"github.com/online-shop/internal/healthcheck"
+	"github.com/online-shop/internal/inventory"
 	"github.com/online-shop/internal/order"
 	"github.com/online-shop/internal/product"
+	"github.com/online-shop/internal/review"
 	"github.com/online-shop/pkg/accesslog"
+	"github.com/online-shop/pkg/blob"
+	"github.com/online-shop/pkg/cache"
+	"github.com/online-shop/pkg/httpcache"
+	"github.com/online-shop/pkg/jwk"
 	"github.com/online-shop/pkg/log"
+	"github.com/online-shop/pkg/mailer"
+	"github.com/online-shop/pkg/metrics"
 	"github.com/online-shop/pkg/mysql"
+	"github.com/online-shop/pkg/oidc"
+	"github.com/online-shop/pkg/password"
+	"github.com/online-shop/pkg/ratelimit"
+	"github.com/online-shop/pkg/tracing"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	routing "github.com/go-ozzo/ozzo-routing/v2"
 	"github.com/go-ozzo/ozzo-routing/v2/content"
 	"github.com/go-ozzo/ozzo-routing/v2/cors"
+	"github.com/go-ozzo/ozzo-routing/v2/file"
 	_ "github.com/go-sql-driver/mysql"
 )
 
 var Version = "0.1.0"
 
+// serviceName identifies this service in traces.
+const serviceName = "online-shop"
+
+const (
+	// healthCheckTimeout bounds every readiness check run by /readyz.
+	healthCheckTimeout = 2 * time.Second
+	// shutdownDelay is how long the server keeps serving after it stops reporting itself as ready,
+	// giving load balancers the chance to take it out of rotation.
+	shutdownDelay = 5 * time.Second
+	// shutdownTimeout is how long the server waits for hanging HTTP handlers when shutting down.
+	shutdownTimeout = 10 * time.Second
+	// oidcTimeout bounds every request sent to OpenID Connect providers.
+	oidcTimeout = 10 * time.Second
+	// blobTimeout bounds every request sent to the S3-compatible blob store.
+	blobTimeout = 30 * time.Second
+	// searchIndexInterval is how often servers rebuild their product search index, to pick up the changes made
+	// through other servers.
+	searchIndexInterval = 10 * time.Minute
+	// catalogueMaxAge is how long clients and shared caches may keep the public catalogue responses.
+	catalogueMaxAge = time.Minute
+	// cacheTimeout bounds every command sent to the shared cache, which is skipped when slower.
+	cacheTimeout = 500 * time.Millisecond
+	// reservationSweepInterval is how often servers release the stock reservations which expired.
+	reservationSweepInterval = time.Minute
+)
+
+var (
+	// apiRateLimit is the number of API requests a single IP address may send.
+	apiRateLimit = ratelimit.PerSecond(20, 40)
+	// loginRateLimit is the number of login attempts a single IP address may make.
+	loginRateLimit = ratelimit.PerMinute(10, 5)
+	// userRateLimit is the number of authenticated requests a single user may send, from any IP address.
+	userRateLimit = ratelimit.PerSecond(10, 20)
+)
+
+// commands are the maintenance tasks which can be run instead of the server, by passing their name as the first argument.
+var commands = map[string]func(cfg *config.Config, logger log.Logger) error{
+	"rotate-keys":     rotateKeys,
+	"import-products": importProducts,
+	"export-products": exportProducts,
+}
+
 func Execute() {
 	logger := log.New().With(nil, "version", Version)
 
@@ -34,70 +97,306 @@ func Execute() {
 		os.Exit(-1)
 	}
 
+	if len(os.Args) > 1 {
+		command, ok := commands[os.Args[1]]
+		if !ok {
+			logger.Errorf("unknown command %q", os.Args[1])
+			os.Exit(2)
+		}
+		if err := command(cfg, logger); err != nil {
+			logger.Errorf("%s failed: %s", os.Args[1], err)
+			os.Exit(-1)
+		}
+		return
+	}
+
+	exporter, err := tracing.NewExporter(context.Background(), cfg.TraceExporter, cfg.OTLPEndpoint)
+	if err != nil {
+		logger.Errorf("failed to create trace exporter: %s", err)
+		os.Exit(-1)
+	}
+	tracerProvider := tracing.NewProvider(exporter, serviceName, Version)
+	tracing.Init(tracerProvider)
+
 	db, err := buildMysqlClient(cfg)
 	if err != nil {
 		logger.Error(err)
 		os.Exit(-1)
 	}
 
+	keys, err := loadKeys(cfg, logger)
+	if err != nil {
+		logger.Errorf("failed to load JWT signing keys: %s", err)
+		os.Exit(-1)
+	}
+	go reloadKeys(keys, cfg, logger)
+
+	mail, err := buildMailer(cfg)
+	if err != nil {
+		logger.Errorf("failed to create mailer: %s", err)
+		os.Exit(-1)
+	}
+
+	passwords, policy, err := buildPasswords(cfg)
+	if err != nil {
+		logger.Errorf("failed to set up password hashing: %s", err)
+		os.Exit(-1)
+	}
+
+	blobs, err := buildBlobStore(cfg)
+	if err != nil {
+		logger.Errorf("failed to create blob store: %s", err)
+		os.Exit(-1)
+	}
+
+	checker := healthcheck.NewChecker(healthCheckTimeout)
+
+	products, err := buildProductRepository(cfg, *db, checker, logger)
+	if err != nil {
+		logger.Errorf("failed to create product cache: %s", err)
+		os.Exit(-1)
+	}
+
 	// build HTTP server
 	address := fmt.Sprintf(":%v", cfg.ServerPort)
 	hs := &http.Server{
 		Addr:    address,
-		Handler: buildHandler(logger, cfg, *db),
+		Handler: buildHandler(logger, cfg, *db, keys, mail, passwords, policy, blobs, products, checker),
 	}
 
 	// start the HTTP server with graceful shutdown
-	go routing.GracefulShutdown(hs, 10*time.Second, logger.Infof)
+	go gracefulShutdown(hs, checker, logger)
 	logger.Infof("server %v is running at %v", Version, address)
 	if err := hs.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		logger.Error(err)
 		os.Exit(-1)
 	}
+
+	// flush the spans still buffered by the batcher
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := tracerProvider.Shutdown(ctx); err != nil {
+		logger.Errorf("failed to shut down tracer provider: %v", err)
+	}
 }
 
 // buildHandler sets up the HTTP routing and builds an HTTP handler.
-func buildHandler(logger log.Logger, cfg *config.Config, db mysql.BaseRepository) http.Handler {
+func buildHandler(logger log.Logger, cfg *config.Config, db mysql.BaseRepository, keys *jwk.Set, mail mailer.Mailer,
+	passwords *password.Hasher, policy password.Policy, blobs product.BlobStore, products *product.CachedRepository,
+	checker *healthcheck.Checker) http.Handler {
 	router := routing.New()
 
 	router.Use(
+		tracing.Handler(serviceName),
 		accesslog.Handler(logger),
+		metrics.Handler(),
 		errors.Handler(logger),
 		content.TypeNegotiator(content.JSON),
 		cors.Handler(cors.AllowAll),
 	)
 
-	healthcheck.RegisterHandlers(router, Version)
+	checker.Register("mysql.master", db.MasterDB.PingContext)
+	checker.Register("mysql.slave", db.SlaveDB.PingContext)
+	healthcheck.RegisterHandlers(router, Version, checker)
+	router.Get("/metrics", metrics.Endpoint())
+	router.Get("/.well-known/jwks.json", jwk.Handler(keys))
+	if cfg.BlobStore == "file" {
+		router.Get("/media/*", file.Server(file.PathMap{"/media/": "/"}, file.ServerOptions{RootPath: cfg.BlobDir}))
+	}
+
+	limiterStore := buildRateLimitStore(cfg, db)
 
 	rg := router.Group("/v1")
+	rg.Use(
+		ratelimit.Handler(limiterStore, "api", apiRateLimit, ratelimit.ByIP, logger),
+		audit.Handler(audit.NewRepository(db, logger), logger),
+	)
 
-	authHandler := auth.Handler(cfg.JWTSigningKey)
+	authService := auth.NewService(auth.NewRepository(db, logger), keys, cfg.JWTExpiration,
+		mail, cfg.AppURL, cfg.RequireVerifiedEmail, passwords, policy, buildIdentityProviders(cfg), logger)
+	authHandler := auth.APIKeyHandler(authService, limiterStore, auth.Handler(keys, authService), logger)
+	// authenticated requests are limited per user, after their authentication
+	userLimiter := ratelimit.Handler(limiterStore, "user", userRateLimit, auth.ByUser, logger)
+	authenticated := func(c *routing.Context) error {
+		if err := authHandler(c); err != nil {
+			return err
+		}
+		return userLimiter(c)
+	}
 
-	product.RegisterHandlers(rg.Group(""),
-		product.NewService(product.NewRepository(db, logger), logger),
-		authHandler, logger,
+	// the catalogue is browsed anonymously through the public group, and changed through the protected one;
+	// groups created with handlers do not inherit those of their parent, hence the calls to Use
+	public := rg.Group("")
+	public.Use(auth.Optional(authHandler), httpcache.Public(catalogueMaxAge, auth.CredentialHeaders...),
+		httpcache.ETag())
+	protected := rg.Group("")
+	protected.Use(authenticated)
+
+	productService := product.NewService(products, product.NewSearchIndex(), blobs, logger)
+	go indexProducts(productService, logger)
+	product.RegisterHandlers(public, protected, productService, logger)
+
+	category.RegisterHandlers(public, protected,
+		category.NewService(category.NewRepository(db, logger), productService, logger),
+		logger,
+	)
+
+	review.RegisterHandlers(public, protected,
+		review.NewService(review.NewRepository(db, logger), products, logger),
+		logger,
 	)
 
+	inventoryService := inventory.NewService(inventory.NewRepository(db, logger), products,
+		time.Duration(cfg.StockReservationTTL)*time.Minute, logger)
+	go releaseExpiredReservations(inventoryService, logger)
+	inventory.RegisterHandlers(protected, inventoryService, logger)
+
 	order.RegisterHandlers(rg.Group(""),
-		order.NewService(order.NewRepository(db, logger), logger),
-		authHandler, logger,
+		order.NewService(order.NewRepository(db, logger), inventoryService, logger),
+		authenticated, logger,
 	)
 
 	auth.RegisterHandlers(rg.Group(""),
-		auth.NewService(auth.NewRepository(db, logger), cfg.JWTSigningKey, cfg.JWTExpiration, logger),
+		authService,
+		authHandler,
+		ratelimit.Handler(limiterStore, "login", loginRateLimit, ratelimit.ByIP, logger),
 		logger,
 	)
 
 	return router
 }
 
+// indexProducts builds the product search index, then rebuilds it periodically.
+func indexProducts(service product.Service, logger log.Logger) {
+	for {
+		if err := service.BuildIndex(context.Background()); err != nil {
+			logger.Errorf("failed to build the product search index: %v", err)
+		}
+		time.Sleep(searchIndexInterval)
+	}
+}
+
+// releaseExpiredReservations periodically gives back the stock reserved by the orders which were not paid in time.
+func releaseExpiredReservations(service inventory.Service, logger log.Logger) {
+	for range time.Tick(reservationSweepInterval) {
+		if _, err := service.ReleaseExpired(context.Background()); err != nil {
+			logger.Errorf("failed to release the expired stock reservations: %v", err)
+		}
+	}
+}
+
+// buildRateLimitStore creates the store keeping rate limit buckets, as configured.
+func buildRateLimitStore(cfg *config.Config, db mysql.BaseRepository) ratelimit.Store {
+	if cfg.RateLimitStore == "mysql" {
+		return ratelimit.NewMySQLStore(&db)
+	}
+	return ratelimit.NewMemoryStore()
+}
+
+// buildProductRepository creates the product repository, caching product reads in memory and, if configured, in the
+// shared cache, whose availability is then checked by the given readiness checker, if any.
+func buildProductRepository(cfg *config.Config, db mysql.BaseRepository, checker *healthcheck.Checker,
+	logger log.Logger) (*product.CachedRepository, error) {
+	ttl := time.Duration(cfg.ProductCacheTTL) * time.Second
+	var shared cache.Shared
+	if cfg.RedisURL != "" {
+		redis, err := cache.NewRedisCache(cfg.RedisURL, cacheTimeout)
+		if err != nil {
+			return nil, err
+		}
+		if checker != nil {
+			checker.Register("redis", redis.Ping)
+		}
+		shared = redis
+	}
+	c := cache.New("products", cache.NewLRU(cfg.ProductCacheSize, ttl), shared, ttl, logger)
+	return product.NewCachedRepository(product.NewRepository(db, logger), c), nil
+}
+
+// buildBlobStore creates the store keeping product images, as configured.
+func buildBlobStore(cfg *config.Config) (product.BlobStore, error) {
+	if cfg.BlobStore == "s3" {
+		credentials := blob.Credentials{AccessKey: cfg.S3AccessKey, SecretKey: cfg.S3SecretKey}
+		return blob.NewS3Store(&http.Client{Timeout: blobTimeout}, cfg.S3Endpoint, cfg.S3Region, cfg.S3Bucket, credentials, cfg.BlobURL), nil
+	}
+	return blob.NewFileStore(cfg.BlobDir, cfg.BlobURL)
+}
+
+// buildMailer creates the mailer sending emails to users, as configured.
+func buildMailer(cfg *config.Config) (mailer.Mailer, error) {
+	if cfg.Mailer == "smtp" {
+		return mailer.NewSMTPMailer(cfg.SMTPHost, cfg.SMTPPort, cfg.SMTPUsername, cfg.SMTPPassword, cfg.MailFrom), nil
+	}
+	return mailer.NewFileMailer(cfg.MailDir, cfg.MailFrom)
+}
+
+// buildPasswords sets up the hashing of passwords with the configured algorithm, still verifying hashes of the
+// other one, and the policy new passwords must follow.
+func buildPasswords(cfg *config.Config) (*password.Hasher, password.Policy, error) {
+	policy := password.DefaultPolicy
+	policy.MinLength = cfg.PasswordMinLength
+	if cfg.BreachedPasswordsFile != "" {
+		breached, err := password.LoadBreached(cfg.BreachedPasswordsFile)
+		if err != nil {
+			return nil, policy, err
+		}
+		policy.Breached = breached
+	}
+
+	switch cfg.PasswordHasher {
+	case "argon2id":
+		return password.NewHasher(password.DefaultArgon2id, password.DefaultBcrypt), policy, nil
+	case "bcrypt":
+		return password.NewHasher(password.DefaultBcrypt, password.DefaultArgon2id), policy, nil
+	}
+	return nil, policy, fmt.Errorf("unknown password hasher %q", cfg.PasswordHasher)
+}
+
+// buildIdentityProviders sets up the clients of the configured OpenID Connect providers.
+// Providers redirect users back to the API, which is expected to be served under AppURL.
+func buildIdentityProviders(cfg *config.Config) map[string]auth.IdentityProvider {
+	providers := map[string]auth.IdentityProvider{}
+	for _, p := range cfg.OIDCProviders {
+		providers[p.Name] = oidc.NewClient(oidc.Config{
+			Issuer:       p.Issuer,
+			ClientID:     p.ClientID,
+			ClientSecret: p.ClientSecret,
+			RedirectURL:  strings.TrimSuffix(cfg.AppURL, "/") + "/v1/oidc/" + p.Name + "/callback",
+		}, &http.Client{Timeout: oidcTimeout})
+	}
+	return providers
+}
+
 func buildMysqlClient(cfg *config.Config) (*mysql.BaseRepository, error) {
 	db, err := sqlx.Connect("mysql", cfg.DSN)
 	if err != nil {
 		return nil, err
 	}
+	prometheus.MustRegister(collectors.NewDBStatsCollector(db.DB, "shop"))
 	return &mysql.BaseRepository{
 		MasterDB: db,
 		SlaveDB:  db,
 	}, nil
 }
+
+// gracefulShutdown shuts down the given HTTP server gracefully when receiving an os.Interrupt or syscall.SIGTERM signal.
+// The server stops reporting itself as ready first, and keeps serving for shutdownDelay before shutting down.
+func gracefulShutdown(hs *http.Server, checker *healthcheck.Checker, logger log.Logger) {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+
+	checker.Shutdown()
+	logger.Infof("server is no longer ready, shutting down in %s", shutdownDelay)
+	time.Sleep(shutdownDelay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	logger.Infof("shutting down server with %s timeout", shutdownTimeout)
+	if err := hs.Shutdown(ctx); err != nil {
+		logger.Errorf("error while shutting down server: %v", err)
+	} else {
+		logger.Infof("server was shut down gracefully")
+	}
+}
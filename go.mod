@@ -5,6 +5,7 @@ go 1.15
 
 require (
 	github.com/ClickHouse/clickhouse-go v1.5.0 // indirect
+	github.com/asaskevich/govalidator v0.0.0-20200108200545-475eaeb16496 // indirect
 	github.com/denisenkom/go-mssqldb v0.11.0 // indirect
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/go-ozzo/ozzo-routing/v2 v2.3.0
@@ -15,8 +16,15 @@ require (
 	github.com/joho/godotenv v1.4.0
 	github.com/lib/pq v1.10.3 // indirect
 	github.com/pressly/goose/v3 v3.1.0 // indirect
+	github.com/prometheus/client_golang v1.11.0
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	github.com/stretchr/testify v1.7.0
 	github.com/ziutek/mymysql v1.5.4
+	go.opentelemetry.io/otel v1.0.1
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.0.1
+	go.opentelemetry.io/otel/exporters/stdout/stdouttrace v1.0.1
+	go.opentelemetry.io/otel/sdk v1.0.1
+	go.opentelemetry.io/otel/trace v1.0.1
 	go.uber.org/multierr v1.6.0
 	go.uber.org/zap v1.19.1
 	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519
@@ -0,0 +1,57 @@
+// Package audit keeps track of the changes staff members make, including those made while impersonating users.
+package audit
+
+import (
+	routing "github.com/go-ozzo/ozzo-routing/v2"
+	"github.com/go-ozzo/ozzo-routing/v2/access"
+	"github.com/online-shop/internal/auth"
+	"github.com/online-shop/internal/entity"
+	"github.com/online-shop/pkg/log"
+	"net/http"
+	"time"
+)
+
+// Handler returns a middleware recording the requests changing data which are made by staff members,
+// or by staff members impersonating a user. Requests are recorded once handled, whether they succeeded or not.
+func Handler(repo Repository, logger log.Logger) routing.Handler {
+	return func(c *routing.Context) error {
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			return c.Next()
+		}
+
+		rw := &access.LogResponseWriter{ResponseWriter: c.Response, Status: http.StatusOK}
+		c.Response = rw
+		err := c.Next()
+
+		// the identity is only known once the authentication middleware of the route ran
+		ctx := c.Request.Context()
+		identity := auth.CurrentUser(ctx)
+		if identity == nil || identity.GetActorID() == "" && identity.GetRole() != entity.RoleAdmin {
+			return err
+		}
+		record := entity.AuditRecord{
+			ID:        entity.GenerateID(),
+			UserID:    identity.GetID(),
+			ActorID:   identity.GetActorID(),
+			Action:    c.Request.Method + " " + c.Request.URL.Path,
+			Status:    statusOf(rw.Status, err),
+			CreatedAt: time.Now(),
+		}
+		if e := repo.Create(ctx, record); e != nil {
+			logger.With(ctx, "action", record.Action).Errorf("failed to save audit record: %v", e)
+		}
+		return err
+	}
+}
+
+// statusOf returns the status of the response to a request, the error it failed with being written later on.
+func statusOf(status int, err error) int {
+	if err == nil {
+		return status
+	}
+	if e, ok := err.(interface{ StatusCode() int }); ok {
+		return e.StatusCode()
+	}
+	return http.StatusInternalServerError
+}
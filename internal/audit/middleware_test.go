@@ -0,0 +1,61 @@
+package audit
+
+import (
+	"context"
+	stderrors "errors"
+	routing "github.com/go-ozzo/ozzo-routing/v2"
+	"github.com/online-shop/internal/auth"
+	"github.com/online-shop/internal/entity"
+	"github.com/online-shop/internal/errors"
+	"github.com/online-shop/internal/test"
+	"github.com/online-shop/pkg/log"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+type mockRepository struct {
+	records []entity.AuditRecord
+	err     error
+}
+
+func (m *mockRepository) Create(ctx context.Context, record entity.AuditRecord) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.records = append(m.records, record)
+	return nil
+}
+
+func TestHandler(t *testing.T) {
+	logger, entries := log.NewForTest()
+	repo := &mockRepository{}
+	router := test.MockRouter(logger)
+	rg := router.Group("/v1")
+	rg.Use(Handler(repo, logger))
+	ok := func(c *routing.Context) error { return c.WriteWithStatus("ok", http.StatusCreated) }
+	rg.Get("/orders", auth.MockAuthHandler, ok)
+	rg.Post("/orders", auth.MockAuthHandler, ok)
+	rg.Put("/orders", auth.MockAuthHandler, func(c *routing.Context) error { return errors.Forbidden("") })
+
+	test.Endpoint(t, router, test.APITestCase{Name: "customer", Method: "POST", URL: "/v1/orders", Header: auth.MockAuthHeader(), WantStatus: http.StatusCreated})
+	test.Endpoint(t, router, test.APITestCase{Name: "read", Method: "GET", URL: "/v1/orders", Header: auth.MockImpersonationAuthHeader(), WantStatus: http.StatusCreated})
+	assert.Empty(t, repo.records)
+
+	test.Endpoint(t, router, test.APITestCase{Name: "impersonated", Method: "POST", URL: "/v1/orders", Header: auth.MockImpersonationAuthHeader(), WantStatus: http.StatusCreated})
+	test.Endpoint(t, router, test.APITestCase{Name: "failed", Method: "PUT", URL: "/v1/orders", Header: auth.MockImpersonationAuthHeader(), WantStatus: http.StatusForbidden})
+	test.Endpoint(t, router, test.APITestCase{Name: "staff", Method: "POST", URL: "/v1/orders", Header: auth.MockAdminAuthHeader(), WantStatus: http.StatusCreated})
+	if assert.Len(t, repo.records, 3) {
+		assert.Equal(t, entity.AuditRecord{ID: repo.records[0].ID, UserID: "100", ActorID: "1", Action: "POST /v1/orders",
+			Status: http.StatusCreated, CreatedAt: repo.records[0].CreatedAt}, repo.records[0])
+		assert.Equal(t, http.StatusForbidden, repo.records[1].Status)
+		assert.Equal(t, "1", repo.records[2].UserID)
+		assert.Empty(t, repo.records[2].ActorID)
+	}
+
+	// failing to record a request does not fail it
+	repo.err = stderrors.New("db down")
+	entries.TakeAll()
+	test.Endpoint(t, router, test.APITestCase{Name: "unrecorded", Method: "POST", URL: "/v1/orders", Header: auth.MockAdminAuthHeader(), WantStatus: http.StatusCreated})
+	assert.Equal(t, 2, entries.Len())
+}
@@ -0,0 +1,38 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+	"github.com/online-shop/internal/entity"
+	"github.com/online-shop/pkg/log"
+	"github.com/online-shop/pkg/mysql"
+)
+
+// Repository persists audit records.
+type Repository interface {
+	// Create saves a new audit record.
+	Create(ctx context.Context, record entity.AuditRecord) error
+}
+
+// repository persists audit records in database
+type repository struct {
+	db     mysql.BaseRepository
+	logger log.Logger
+}
+
+// NewRepository creates a new audit repository
+func NewRepository(db mysql.BaseRepository, logger log.Logger) Repository {
+	return repository{db, logger}
+}
+
+func (r repository) Create(ctx context.Context, record entity.AuditRecord) error {
+	q := fmt.Sprintf("insert into audit_record (id, user_id, actor_id, action, status, created_at) " +
+		"values (:id, :user_id, :actor_id, :action, :status, :created_at)")
+
+	_, err := r.db.Exec(ctx, q, record)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -2,38 +2,140 @@ package auth
 
 import (
 	routing "github.com/go-ozzo/ozzo-routing/v2"
+	"github.com/online-shop/internal/entity"
 	"github.com/online-shop/internal/errors"
 	"github.com/online-shop/internal/response"
 	"github.com/online-shop/pkg/log"
 	"net/http"
+	"path"
 )
 
+// oidcStateCookie is the cookie keeping the state token of an OIDC login while the user is at the identity provider.
+const oidcStateCookie = "oidc_state"
+
 // RegisterHandlers registers handlers for different HTTP requests.
-func RegisterHandlers(rg *routing.RouteGroup, service Service, logger log.Logger) {
-	rg.Post("/login", login(service, logger))
+// Staff members impersonating a user cannot change their credentials or account.
+// The login limiter is applied to login and password reset requests, to slow down password guessing and mail flooding.
+func RegisterHandlers(rg *routing.RouteGroup, service Service, authHandler, loginLimiter routing.Handler, logger log.Logger) {
+	rg.Post("/login", loginLimiter, login(service, logger))
+	rg.Post("/login/mfa", loginLimiter, loginMFA(service, logger))
 	rg.Post("/register", register(service, logger))
+	rg.Get("/oidc/<provider>/login", loginLimiter, startOIDCLogin(service))
+	rg.Get("/oidc/<provider>/callback", loginLimiter, oidcCallback(service))
+	rg.Post("/users/<id>/unlock", authHandler, RejectAPIKeys, RequireRole(entity.RoleAdmin), unlock(service, logger))
+	rg.Post("/service-accounts", authHandler, RejectAPIKeys, RequireRole(entity.RoleAdmin), createServiceAccount(service, logger))
+	rg.Post("/users/<id>/impersonate", authHandler, RejectAPIKeys, RequireRole(entity.RoleAdmin), impersonate(service))
+
+	rg.Get("/me", authHandler, RejectAPIKeys, getProfile(service))
+	rg.Patch("/me", authHandler, RejectAPIKeys, updateProfile(service, logger))
+	rg.Delete("/me", authHandler, RejectAPIKeys, RejectImpersonation, deleteAccount(service, logger))
+	rg.Put("/me/password", authHandler, RejectAPIKeys, RejectImpersonation, changePassword(service, logger))
+	rg.Put("/me/email", authHandler, RejectAPIKeys, RejectImpersonation, changeEmail(service, logger))
+	rg.Post("/me/email/verification", authHandler, RejectAPIKeys, resendVerificationEmail(service))
+
+	rg.Get("/me/sessions", authHandler, RejectAPIKeys, listSessions(service))
+	rg.Delete("/me/sessions/<id>", authHandler, RejectAPIKeys, RejectImpersonation, revokeSession(service))
+
+	rg.Post("/me/2fa", authHandler, RejectAPIKeys, RejectImpersonation, enrollTOTP(service))
+	rg.Post("/me/2fa/confirm", authHandler, RejectAPIKeys, RejectImpersonation, confirmTOTP(service, logger))
+	rg.Delete("/me/2fa", authHandler, RejectAPIKeys, RejectImpersonation, disableTOTP(service, logger))
+	rg.Post("/me/2fa/recovery-codes", authHandler, RejectAPIKeys, RejectImpersonation, regenerateRecoveryCodes(service, logger))
+
+	rg.Post("/api-keys", authHandler, RejectAPIKeys, RejectImpersonation, createAPIKey(service, logger))
+	rg.Get("/api-keys", authHandler, RejectAPIKeys, listAPIKeys(service))
+	rg.Delete("/api-keys/<id>", authHandler, RejectAPIKeys, RejectImpersonation, revokeAPIKey(service))
+
+	rg.Post("/email/verify", verifyEmail(service, logger))
+	rg.Post("/password/forgot", loginLimiter, forgotPassword(service, logger))
+	rg.Post("/password/reset", loginLimiter, resetPassword(service, logger))
 }
 
 // login returns a handler that handles user login request.
 func login(service Service, logger log.Logger) routing.Handler {
 	return func(c *routing.Context) error {
-		var req struct {
-			Username string `json:"username"`
-			Password string `json:"password"`
+		var req LoginRequest
+		if err := c.Read(&req); err != nil {
+			logger.With(c.Request.Context()).Errorf("invalid request: %v", err)
+			return errors.BadRequest("")
+		}
+		if err := req.Validate(); err != nil {
+			return err
 		}
 
+		result, err := service.Login(withClient(c), req.Username, req.Password)
+		if err != nil {
+			return err
+		}
+		return c.Write(result)
+	}
+}
+
+// loginMFA returns a handler that completes a login with a second factor.
+func loginMFA(service Service, logger log.Logger) routing.Handler {
+	return func(c *routing.Context) error {
+		var req MFALoginRequest
 		if err := c.Read(&req); err != nil {
 			logger.With(c.Request.Context()).Errorf("invalid request: %v", err)
 			return errors.BadRequest("")
 		}
+		if err := req.Validate(); err != nil {
+			return err
+		}
 
-		token, err := service.Login(c.Request.Context(), req.Username, req.Password)
+		result, err := service.LoginMFA(withClient(c), req)
+		if err != nil {
+			return err
+		}
+		return c.Write(result)
+	}
+}
+
+// startOIDCLogin returns a handler that sends the user to log in at an external identity provider.
+func startOIDCLogin(service Service) routing.Handler {
+	return func(c *routing.Context) error {
+		login, err := service.StartOIDCLogin(c.Request.Context(), c.Param("provider"))
 		if err != nil {
 			return err
 		}
-		return c.Write(struct {
-			Token string `json:"token"`
-		}{token})
+
+		http.SetCookie(c.Response, &http.Cookie{
+			Name:     oidcStateCookie,
+			Value:    login.StateToken,
+			Path:     path.Dir(c.Request.URL.Path),
+			MaxAge:   int(oidcStateExpiration.Seconds()),
+			Secure:   true,
+			HttpOnly: true,
+			// the cookie must come along when the provider redirects the user back
+			SameSite: http.SameSiteLaxMode,
+		})
+		http.Redirect(c.Response, c.Request, login.URL, http.StatusFound)
+		return nil
+	}
+}
+
+// oidcCallback returns a handler that completes a login with an external identity provider.
+func oidcCallback(service Service) routing.Handler {
+	return func(c *routing.Context) error {
+		input := OIDCCallbackRequest{
+			Provider: c.Param("provider"),
+			Code:     c.Query("code"),
+			State:    c.Query("state"),
+			Error:    c.Query("error"),
+		}
+		if cookie, err := c.Request.Cookie(oidcStateCookie); err == nil {
+			input.StateToken = cookie.Value
+		}
+		// the state token is single use
+		http.SetCookie(c.Response, &http.Cookie{Name: oidcStateCookie, Path: path.Dir(c.Request.URL.Path), MaxAge: -1, Secure: true, HttpOnly: true})
+		if err := input.Validate(); err != nil {
+			return err
+		}
+
+		result, err := service.LoginOIDC(withClient(c), input)
+		if err != nil {
+			return err
+		}
+		return c.Write(result)
 	}
 }
 
@@ -45,6 +147,9 @@ func register(service Service, logger log.Logger) routing.Handler {
 			logger.With(c.Request.Context()).Info(err)
 			return errors.BadRequest("")
 		}
+		if err := input.Validate(); err != nil {
+			return err
+		}
 		err := service.CreateUser(c.Request.Context(), input)
 		if err != nil {
 			return err
@@ -54,3 +159,353 @@ func register(service Service, logger log.Logger) routing.Handler {
 	}
 
 }
+
+// unlock returns a handler that lifts the lockout of a user account.
+func unlock(service Service, logger log.Logger) routing.Handler {
+	return func(c *routing.Context) error {
+		if err := service.Unlock(c.Request.Context(), c.Param("id")); err != nil {
+			return err
+		}
+
+		return c.Write(response.SuccessResponse())
+	}
+}
+
+// impersonate returns a handler that lets the current staff member act as another user.
+func impersonate(service Service) routing.Handler {
+	return func(c *routing.Context) error {
+		impersonation, err := service.Impersonate(withClient(c), c.Param("id"))
+		if err != nil {
+			return err
+		}
+
+		return c.WriteWithStatus(impersonation, http.StatusCreated)
+	}
+}
+
+// getProfile returns a handler that responds with the profile of the current user.
+func getProfile(service Service) routing.Handler {
+	return func(c *routing.Context) error {
+		profile, err := service.GetProfile(c.Request.Context())
+		if err != nil {
+			return err
+		}
+
+		return c.Write(profile)
+	}
+}
+
+// updateProfile returns a handler that updates the profile of the current user.
+func updateProfile(service Service, logger log.Logger) routing.Handler {
+	return func(c *routing.Context) error {
+		var input UpdateProfileRequest
+		if err := c.Read(&input); err != nil {
+			logger.With(c.Request.Context()).Info(err)
+			return errors.BadRequest("")
+		}
+		if err := input.Validate(); err != nil {
+			return err
+		}
+
+		profile, err := service.UpdateProfile(c.Request.Context(), input)
+		if err != nil {
+			return err
+		}
+
+		return c.Write(profile)
+	}
+}
+
+// changePassword returns a handler that changes the password of the current user.
+func changePassword(service Service, logger log.Logger) routing.Handler {
+	return func(c *routing.Context) error {
+		var input ChangePasswordRequest
+		if err := c.Read(&input); err != nil {
+			logger.With(c.Request.Context()).Info(err)
+			return errors.BadRequest("")
+		}
+		if err := input.Validate(); err != nil {
+			return err
+		}
+
+		if err := service.ChangePassword(c.Request.Context(), input); err != nil {
+			return err
+		}
+
+		return c.Write(response.SuccessResponse())
+	}
+}
+
+// changeEmail returns a handler that changes the email address of the current user.
+func changeEmail(service Service, logger log.Logger) routing.Handler {
+	return func(c *routing.Context) error {
+		var input ChangeEmailRequest
+		if err := c.Read(&input); err != nil {
+			logger.With(c.Request.Context()).Info(err)
+			return errors.BadRequest("")
+		}
+		if err := input.Validate(); err != nil {
+			return err
+		}
+
+		profile, err := service.ChangeEmail(c.Request.Context(), input)
+		if err != nil {
+			return err
+		}
+
+		return c.Write(profile)
+	}
+}
+
+// deleteAccount returns a handler that deletes the account of the current user.
+func deleteAccount(service Service, logger log.Logger) routing.Handler {
+	return func(c *routing.Context) error {
+		var input DeleteAccountRequest
+		if err := c.Read(&input); err != nil {
+			logger.With(c.Request.Context()).Info(err)
+			return errors.BadRequest("")
+		}
+		if err := input.Validate(); err != nil {
+			return err
+		}
+
+		if err := service.DeleteAccount(c.Request.Context(), input); err != nil {
+			return err
+		}
+
+		return c.Write(response.SuccessResponse())
+	}
+}
+
+// resendVerificationEmail returns a handler that mails a new email verification link to the current user.
+func resendVerificationEmail(service Service) routing.Handler {
+	return func(c *routing.Context) error {
+		if err := service.ResendVerificationEmail(c.Request.Context()); err != nil {
+			return err
+		}
+
+		return c.WriteWithStatus(response.SuccessResponse(), http.StatusAccepted)
+	}
+}
+
+// verifyEmail returns a handler that confirms an email address with a verification token.
+func verifyEmail(service Service, logger log.Logger) routing.Handler {
+	return func(c *routing.Context) error {
+		var input VerifyEmailRequest
+		if err := c.Read(&input); err != nil {
+			logger.With(c.Request.Context()).Info(err)
+			return errors.BadRequest("")
+		}
+		if err := input.Validate(); err != nil {
+			return err
+		}
+
+		if err := service.VerifyEmail(c.Request.Context(), input); err != nil {
+			return err
+		}
+
+		return c.Write(response.SuccessResponse())
+	}
+}
+
+// forgotPassword returns a handler that mails a password reset link.
+func forgotPassword(service Service, logger log.Logger) routing.Handler {
+	return func(c *routing.Context) error {
+		var input ForgotPasswordRequest
+		if err := c.Read(&input); err != nil {
+			logger.With(c.Request.Context()).Info(err)
+			return errors.BadRequest("")
+		}
+		if err := input.Validate(); err != nil {
+			return err
+		}
+
+		if err := service.RequestPasswordReset(c.Request.Context(), input); err != nil {
+			return err
+		}
+
+		return c.WriteWithStatus(response.SuccessResponse(), http.StatusAccepted)
+	}
+}
+
+// resetPassword returns a handler that sets a new password with a password reset token.
+func resetPassword(service Service, logger log.Logger) routing.Handler {
+	return func(c *routing.Context) error {
+		var input ResetPasswordRequest
+		if err := c.Read(&input); err != nil {
+			logger.With(c.Request.Context()).Info(err)
+			return errors.BadRequest("")
+		}
+		if err := input.Validate(); err != nil {
+			return err
+		}
+
+		if err := service.ResetPassword(c.Request.Context(), input); err != nil {
+			return err
+		}
+
+		return c.Write(response.SuccessResponse())
+	}
+}
+
+// enrollTOTP returns a handler that starts the enrollment of an authenticator app.
+func enrollTOTP(service Service) routing.Handler {
+	return func(c *routing.Context) error {
+		enrollment, err := service.EnrollTOTP(c.Request.Context())
+		if err != nil {
+			return err
+		}
+
+		return c.Write(enrollment)
+	}
+}
+
+// confirmTOTP returns a handler that enables two-factor authentication.
+func confirmTOTP(service Service, logger log.Logger) routing.Handler {
+	return func(c *routing.Context) error {
+		var input TOTPCodeRequest
+		if err := c.Read(&input); err != nil {
+			logger.With(c.Request.Context()).Info(err)
+			return errors.BadRequest("")
+		}
+		if err := input.Validate(); err != nil {
+			return err
+		}
+
+		codes, err := service.ConfirmTOTP(c.Request.Context(), input)
+		if err != nil {
+			return err
+		}
+
+		return c.Write(codes)
+	}
+}
+
+// disableTOTP returns a handler that disables two-factor authentication.
+func disableTOTP(service Service, logger log.Logger) routing.Handler {
+	return func(c *routing.Context) error {
+		var input DisableTOTPRequest
+		if err := c.Read(&input); err != nil {
+			logger.With(c.Request.Context()).Info(err)
+			return errors.BadRequest("")
+		}
+		if err := input.Validate(); err != nil {
+			return err
+		}
+
+		if err := service.DisableTOTP(c.Request.Context(), input); err != nil {
+			return err
+		}
+
+		return c.Write(response.SuccessResponse())
+	}
+}
+
+// regenerateRecoveryCodes returns a handler that replaces the recovery codes of the current user.
+func regenerateRecoveryCodes(service Service, logger log.Logger) routing.Handler {
+	return func(c *routing.Context) error {
+		var input TOTPCodeRequest
+		if err := c.Read(&input); err != nil {
+			logger.With(c.Request.Context()).Info(err)
+			return errors.BadRequest("")
+		}
+		if err := input.Validate(); err != nil {
+			return err
+		}
+
+		codes, err := service.RegenerateRecoveryCodes(c.Request.Context(), input)
+		if err != nil {
+			return err
+		}
+
+		return c.Write(codes)
+	}
+}
+
+// createServiceAccount returns a handler that creates a service account.
+func createServiceAccount(service Service, logger log.Logger) routing.Handler {
+	return func(c *routing.Context) error {
+		var input ServiceAccountRequest
+		if err := c.Read(&input); err != nil {
+			logger.With(c.Request.Context()).Info(err)
+			return errors.BadRequest("")
+		}
+		if err := input.Validate(); err != nil {
+			return err
+		}
+
+		account, err := service.CreateServiceAccount(c.Request.Context(), input)
+		if err != nil {
+			return err
+		}
+
+		return c.WriteWithStatus(account, http.StatusCreated)
+	}
+}
+
+// createAPIKey returns a handler that creates an API key.
+func createAPIKey(service Service, logger log.Logger) routing.Handler {
+	return func(c *routing.Context) error {
+		var input CreateAPIKeyRequest
+		if err := c.Read(&input); err != nil {
+			logger.With(c.Request.Context()).Info(err)
+			return errors.BadRequest("")
+		}
+		if err := input.Validate(); err != nil {
+			return err
+		}
+
+		key, err := service.CreateAPIKey(c.Request.Context(), input)
+		if err != nil {
+			return err
+		}
+
+		return c.WriteWithStatus(key, http.StatusCreated)
+	}
+}
+
+// listAPIKeys returns a handler that lists API keys. Administrators can list the keys of a service account with the owner_id query parameter.
+func listAPIKeys(service Service) routing.Handler {
+	return func(c *routing.Context) error {
+		keys, err := service.ListAPIKeys(c.Request.Context(), c.Query("owner_id"))
+		if err != nil {
+			return err
+		}
+
+		return c.Write(keys)
+	}
+}
+
+// revokeAPIKey returns a handler that revokes an API key.
+func revokeAPIKey(service Service) routing.Handler {
+	return func(c *routing.Context) error {
+		if err := service.RevokeAPIKey(c.Request.Context(), c.Param("id")); err != nil {
+			return err
+		}
+
+		return c.Write(response.SuccessResponse())
+	}
+}
+
+// listSessions returns a handler that lists the sessions of the current user.
+func listSessions(service Service) routing.Handler {
+	return func(c *routing.Context) error {
+		sessions, err := service.ListSessions(c.Request.Context())
+		if err != nil {
+			return err
+		}
+
+		return c.Write(sessions)
+	}
+}
+
+// revokeSession returns a handler that logs the current user out of one of their sessions.
+func revokeSession(service Service) routing.Handler {
+	return func(c *routing.Context) error {
+		if err := service.RevokeSession(c.Request.Context(), c.Param("id")); err != nil {
+			return err
+		}
+
+		return c.Write(response.SuccessResponse())
+	}
+}
@@ -0,0 +1,295 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	stderrors "errors"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/online-shop/internal/entity"
+	"github.com/online-shop/internal/errors"
+	"github.com/online-shop/pkg/mysql"
+	"github.com/online-shop/pkg/tracing"
+	"strings"
+	"time"
+)
+
+// The scopes API keys can be restricted to.
+const (
+	ScopeProductsRead = "products:read"
+	ScopeOrdersRead   = "orders:read"
+	ScopeOrdersWrite  = "orders:write"
+)
+
+// scopes lists every scope, for validation.
+var scopes = []interface{}{ScopeProductsRead, ScopeOrdersRead, ScopeOrdersWrite}
+
+const (
+	// apiKeyPrefix starts every API key, so that leaked keys are easy to recognize.
+	apiKeyPrefix = "sk_"
+	// apiKeyIDLength is the length of the public part of API keys, including apiKeyPrefix.
+	apiKeyIDLength = len(apiKeyPrefix) + 12
+	// defaultAPIKeyRateLimit is the number of requests per minute allowed with an API key, unless set otherwise.
+	defaultAPIKeyRateLimit = 600
+	maxAPIKeyRateLimit     = 6000
+	// apiKeyTouchInterval is how often the last use of an API key is recorded, to spare the database.
+	apiKeyTouchInterval = time.Minute
+)
+
+// CreateAPIKeyRequest represents the creation of an API key.
+type CreateAPIKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// RateLimit is the number of requests per minute allowed with the key. Defaults to 600.
+	RateLimit int        `json:"rate_limit"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	// OwnerID lets administrators create keys for service accounts. It defaults to the current user.
+	OwnerID string `json:"owner_id"`
+}
+
+// Validate validates the CreateAPIKeyRequest fields.
+func (r CreateAPIKeyRequest) Validate() error {
+	return validation.ValidateStruct(&r,
+		validation.Field(&r.Name, validation.Required, validation.Length(0, 100)),
+		validation.Field(&r.Scopes, validation.Required, validation.Each(validation.In(scopes...))),
+		validation.Field(&r.RateLimit, validation.Min(0), validation.Max(maxAPIKeyRateLimit)),
+		validation.Field(&r.ExpiresAt, validation.Min(time.Now()).Error("must be in the future")),
+	)
+}
+
+// ServiceAccountRequest represents the creation of a service account.
+type ServiceAccountRequest struct {
+	Username string `json:"username"`
+	FullName string `json:"fullname"`
+}
+
+// Validate validates the ServiceAccountRequest fields.
+func (r ServiceAccountRequest) Validate() error {
+	return validation.ValidateStruct(&r,
+		validation.Field(&r.Username, validation.Required, validation.Length(3, 32),
+			validation.Match(usernameFormat).Error("must contain only letters, digits, dots, dashes and underscores")),
+		validation.Field(&r.FullName, validation.Required, validation.Length(0, 100)),
+	)
+}
+
+// APIKey is the information about an API key its owner can see. The secret part of the key is never shown again after its creation.
+type APIKey struct {
+	ID         string     `json:"id"`
+	OwnerID    string     `json:"owner_id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	RateLimit  int        `json:"rate_limit"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+}
+
+// newAPIKey creates the information about the given API key.
+func newAPIKey(key entity.APIKey) APIKey {
+	return APIKey{
+		ID:         key.ID,
+		OwnerID:    key.OwnerID,
+		Name:       key.Name,
+		Prefix:     key.Prefix,
+		Scopes:     strings.Split(key.Scopes, ","),
+		RateLimit:  key.RateLimit,
+		CreatedAt:  key.CreatedAt,
+		ExpiresAt:  key.ExpiresAt,
+		LastUsedAt: key.LastUsedAt,
+		RevokedAt:  key.RevokedAt,
+	}
+}
+
+// CreatedAPIKey is a newly created API key, along with the key itself.
+type CreatedAPIKey struct {
+	APIKey
+	Key string `json:"key"`
+}
+
+// CreateAPIKey creates an API key owned by the current user, or by a service account if an administrator asks so.
+// API keys cannot be used to create other API keys.
+func (s service) CreateAPIKey(ctx context.Context, input CreateAPIKeyRequest) (CreatedAPIKey, error) {
+	ctx, span := tracing.StartSpan(ctx, "auth.Service.CreateAPIKey")
+	defer span.End()
+
+	owner, err := s.apiKeyOwner(ctx, input.OwnerID)
+	if err != nil {
+		return CreatedAPIKey{}, err
+	}
+
+	public := make([]byte, (apiKeyIDLength-len(apiKeyPrefix))/2)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(public); err != nil {
+		return CreatedAPIKey{}, err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return CreatedAPIKey{}, err
+	}
+	prefix := apiKeyPrefix + hex.EncodeToString(public)
+	plain := prefix + "_" + base64.RawURLEncoding.EncodeToString(secret)
+
+	rateLimit := input.RateLimit
+	if rateLimit == 0 {
+		rateLimit = defaultAPIKeyRateLimit
+	}
+	key := entity.APIKey{
+		ID:        entity.GenerateID(),
+		OwnerID:   owner.ID,
+		Name:      input.Name,
+		Prefix:    prefix,
+		Hash:      hashToken(plain),
+		Scopes:    strings.Join(input.Scopes, ","),
+		RateLimit: rateLimit,
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+		ExpiresAt: input.ExpiresAt,
+	}
+	if err := s.repo.CreateAPIKey(ctx, key); err != nil {
+		return CreatedAPIKey{}, err
+	}
+	s.logger.With(ctx, "owner", owner.Username, "api_key", key.Prefix).Infof("API key created")
+	return CreatedAPIKey{APIKey: newAPIKey(key), Key: plain}, nil
+}
+
+// apiKeyOwner returns the user whose API keys are managed: the current user, or the given service account
+// if the current user is an administrator.
+func (s service) apiKeyOwner(ctx context.Context, ownerID string) (entity.User, error) {
+	identity := CurrentUser(ctx)
+	if identity == nil {
+		return entity.User{}, errors.Unauthorized("")
+	}
+	if CurrentAPIKey(ctx) != nil {
+		return entity.User{}, errors.Forbidden("API keys cannot manage API keys.")
+	}
+	if ownerID == "" || ownerID == identity.GetID() {
+		return s.currentUser(ctx)
+	}
+
+	if identity.GetRole() != entity.RoleAdmin || !authenticatedWithMFA(ctx) {
+		return entity.User{}, errors.Forbidden("")
+	}
+	owner, err := s.repo.Get(ctx, ownerID)
+	if err != nil {
+		if stderrors.Is(err, sql.ErrNoRows) {
+			return entity.User{}, errors.NotFound("")
+		}
+		return entity.User{}, err
+	}
+	if owner.Role != entity.RoleService {
+		return entity.User{}, errors.Forbidden("Administrators can only manage the API keys of service accounts.")
+	}
+	return owner, nil
+}
+
+// ListAPIKeys returns the API keys of the current user, or of the given service account if the current user is an administrator.
+func (s service) ListAPIKeys(ctx context.Context, ownerID string) ([]APIKey, error) {
+	ctx, span := tracing.StartSpan(ctx, "auth.Service.ListAPIKeys")
+	defer span.End()
+
+	owner, err := s.apiKeyOwner(ctx, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := s.repo.ListAPIKeys(ctx, owner.ID)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]APIKey, len(keys))
+	for i, key := range keys {
+		items[i] = newAPIKey(key)
+	}
+	return items, nil
+}
+
+// RevokeAPIKey revokes an API key of the current user, or of a service account if the current user is an administrator.
+func (s service) RevokeAPIKey(ctx context.Context, id string) error {
+	ctx, span := tracing.StartSpan(ctx, "auth.Service.RevokeAPIKey")
+	defer span.End()
+
+	key, err := s.repo.GetAPIKey(ctx, id)
+	if err != nil {
+		if stderrors.Is(err, sql.ErrNoRows) {
+			return errors.NotFound("")
+		}
+		return err
+	}
+	owner, err := s.apiKeyOwner(ctx, key.OwnerID)
+	if err != nil {
+		// do not reveal the keys of other users
+		if res, ok := err.(errors.ErrorResponse); ok && res.Status == errors.Forbidden("").Status {
+			return errors.NotFound("")
+		}
+		return err
+	}
+
+	if err := s.repo.RevokeAPIKey(ctx, key.ID, time.Now()); err != nil {
+		return err
+	}
+	s.logger.With(ctx, "owner", owner.Username, "api_key", key.Prefix).Infof("API key revoked")
+	return nil
+}
+
+// AuthenticateAPIKey returns the owner of the given API key, along with the key, if it is valid.
+func (s service) AuthenticateAPIKey(ctx context.Context, plain string) (entity.User, entity.APIKey, error) {
+	ctx, span := tracing.StartSpan(ctx, "auth.Service.AuthenticateAPIKey")
+	defer span.End()
+
+	if len(plain) <= apiKeyIDLength || !strings.HasPrefix(plain, apiKeyPrefix) || plain[apiKeyIDLength] != '_' {
+		return entity.User{}, entity.APIKey{}, errors.Unauthorized("")
+	}
+	key, err := s.repo.FindAPIKeyByPrefix(ctx, plain[:apiKeyIDLength])
+	if err != nil {
+		if stderrors.Is(err, sql.ErrNoRows) {
+			return entity.User{}, entity.APIKey{}, errors.Unauthorized("")
+		}
+		return entity.User{}, entity.APIKey{}, err
+	}
+
+	now := time.Now()
+	if subtle.ConstantTimeCompare([]byte(hashToken(plain)), []byte(key.Hash)) != 1 ||
+		key.RevokedAt != nil || (key.ExpiresAt != nil && !key.ExpiresAt.After(now)) {
+		return entity.User{}, entity.APIKey{}, errors.Unauthorized("")
+	}
+	owner, err := s.repo.Get(ctx, key.OwnerID)
+	if err != nil {
+		if stderrors.Is(err, sql.ErrNoRows) {
+			return entity.User{}, entity.APIKey{}, errors.Unauthorized("")
+		}
+		return entity.User{}, entity.APIKey{}, err
+	}
+
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) >= apiKeyTouchInterval {
+		if err := s.repo.TouchAPIKey(ctx, key.ID, now); err != nil {
+			s.logger.With(ctx, "api_key", key.Prefix).Errorf("failed to record the use of API key: %v", err)
+		}
+		key.LastUsedAt = &now
+	}
+	return owner, key, nil
+}
+
+// CreateServiceAccount creates an account for an integration, which can only authenticate with API keys.
+func (s service) CreateServiceAccount(ctx context.Context, input ServiceAccountRequest) (Profile, error) {
+	ctx, span := tracing.StartSpan(ctx, "auth.Service.CreateServiceAccount")
+	defer span.End()
+
+	account := entity.User{
+		ID:       entity.GenerateID(),
+		Username: input.Username,
+		FullName: input.FullName,
+		// service accounts have no mailbox, but email addresses must be unique
+		Email: input.Username + "@service.invalid",
+		Role:  entity.RoleService,
+	}
+	if err := s.repo.CreateUser(ctx, account); err != nil {
+		if dbErr := mysql.Classify(err); dbErr != nil && dbErr.Kind == mysql.DuplicateKey {
+			return Profile{}, errors.Conflict("", uniqueUserFields[dbErr.Key])
+		}
+		return Profile{}, err
+	}
+	s.logger.With(ctx, "account", account.Username).Infof("service account created")
+	return newProfile(account), nil
+}
@@ -0,0 +1,146 @@
+package auth
+
+import (
+	"context"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/online-shop/internal/entity"
+	"github.com/online-shop/internal/errors"
+	"github.com/online-shop/internal/test"
+	"github.com/online-shop/pkg/log"
+	"github.com/online-shop/pkg/ratelimit"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestService_APIKeys(t *testing.T) {
+	s, repo, ctx := newProfileTestService(t)
+
+	created, err := s.CreateAPIKey(ctx, CreateAPIKeyRequest{Name: "warehouse", Scopes: []string{ScopeOrdersRead}})
+	assert.Nil(t, err)
+	assert.Equal(t, "100", created.OwnerID)
+	assert.Equal(t, defaultAPIKeyRateLimit, created.RateLimit)
+	assert.Equal(t, []string{ScopeOrdersRead}, created.Scopes)
+	assert.Regexp(t, `^sk_[0-9a-f]{12}_`, created.Key)
+	assert.NotContains(t, repo.apiKeys[created.ID].Hash, created.Key)
+
+	owner, key, err := s.AuthenticateAPIKey(context.Background(), created.Key)
+	assert.Nil(t, err)
+	assert.Equal(t, "demo", owner.Username)
+	assert.Equal(t, created.ID, key.ID)
+	assert.NotNil(t, repo.apiKeys[created.ID].LastUsedAt)
+
+	keys, err := s.ListAPIKeys(ctx, "")
+	assert.Nil(t, err)
+	assert.Len(t, keys, 1)
+
+	// other users cannot see or revoke the key
+	otherCtx := WithUser(context.Background(), "200", "other")
+	keys, _ = s.ListAPIKeys(otherCtx, "")
+	assert.Empty(t, keys)
+	err = s.RevokeAPIKey(otherCtx, created.ID)
+	assert.Equal(t, http.StatusNotFound, err.(errors.ErrorResponse).Status)
+
+	assert.Nil(t, s.RevokeAPIKey(ctx, created.ID))
+	_, _, err = s.AuthenticateAPIKey(context.Background(), created.Key)
+	assert.Equal(t, http.StatusUnauthorized, err.(errors.ErrorResponse).Status)
+}
+
+func TestService_AuthenticateAPIKey_invalid(t *testing.T) {
+	s, _, ctx := newProfileTestService(t)
+	yesterday := time.Now().Add(-24 * time.Hour)
+
+	expired, _ := s.CreateAPIKey(ctx, CreateAPIKeyRequest{Name: "old", Scopes: []string{ScopeOrdersRead}, ExpiresAt: &yesterday})
+	valid, _ := s.CreateAPIKey(ctx, CreateAPIKeyRequest{Name: "valid", Scopes: []string{ScopeOrdersRead}})
+
+	for _, key := range []string{
+		"",
+		"garbage",
+		expired.Key,
+		valid.Key[:apiKeyIDLength] + "_wrongsecret",
+		"sk_000000000000_" + valid.Key[apiKeyIDLength+1:],
+	} {
+		_, _, err := s.AuthenticateAPIKey(context.Background(), key)
+		if assert.NotNil(t, err, key) {
+			assert.Equal(t, http.StatusUnauthorized, err.(errors.ErrorResponse).Status, key)
+		}
+	}
+}
+
+func TestService_APIKeys_serviceAccount(t *testing.T) {
+	s, repo, ctx := newProfileTestService(t)
+	adminCtx := withMFA(withIdentity(context.Background(), entity.User{ID: "1", Username: "admin", Role: entity.RoleAdmin}))
+
+	account, err := s.CreateServiceAccount(adminCtx, ServiceAccountRequest{Username: "erp", FullName: "ERP"})
+	assert.Nil(t, err)
+	assert.Equal(t, entity.RoleService, repo.users[account.ID].Role)
+
+	created, err := s.CreateAPIKey(adminCtx, CreateAPIKeyRequest{Name: "erp", Scopes: []string{ScopeProductsRead}, OwnerID: account.ID})
+	assert.Nil(t, err)
+	assert.Equal(t, account.ID, created.OwnerID)
+	keys, _ := s.ListAPIKeys(adminCtx, account.ID)
+	assert.Len(t, keys, 1)
+
+	// customers cannot manage the keys of service accounts, nor administrators the keys of customers
+	_, err = s.CreateAPIKey(ctx, CreateAPIKeyRequest{Name: "erp", Scopes: []string{ScopeProductsRead}, OwnerID: account.ID})
+	assert.Equal(t, http.StatusForbidden, err.(errors.ErrorResponse).Status)
+	_, err = s.ListAPIKeys(adminCtx, "100")
+	assert.Equal(t, http.StatusForbidden, err.(errors.ErrorResponse).Status)
+
+	// service accounts cannot log in with a password
+	_, err = s.Login(context.Background(), "erp", "")
+	assert.NotNil(t, err)
+
+	// API keys cannot create API keys
+	owner, key, _ := s.AuthenticateAPIKey(context.Background(), created.Key)
+	keyCtx := context.WithValue(withIdentity(context.Background(), owner), apiKeyKey, key)
+	_, err = s.CreateAPIKey(keyCtx, CreateAPIKeyRequest{Name: "more", Scopes: []string{ScopeOrdersWrite}})
+	assert.Equal(t, http.StatusForbidden, err.(errors.ErrorResponse).Status)
+}
+
+func TestAPIKeyHandler(t *testing.T) {
+	s, _, ctx := newProfileTestService(t)
+	logger, _ := log.NewForTest()
+	created, _ := s.CreateAPIKey(ctx, CreateAPIKeyRequest{Name: "warehouse", Scopes: []string{ScopeOrdersRead}, RateLimit: 2})
+	handler := APIKeyHandler(s, ratelimit.NewMemoryStore(), MockAuthHandler, logger)
+
+	// requests without an API key fall back to the other authentication
+	req, _ := http.NewRequest("GET", "http://example.com", nil)
+	req.Header = MockAuthHeader()
+	c, _ := test.MockRoutingContext(req)
+	assert.Nil(t, handler(c))
+	assert.Nil(t, CurrentAPIKey(c.Request.Context()))
+	assert.Nil(t, RequireScope(ScopeOrdersWrite)(c))
+	assert.Nil(t, RejectAPIKeys(c))
+
+	req.Header = http.Header{}
+	req.Header.Set(apiKeyHeader, created.Key)
+	c, res := test.MockRoutingContext(req)
+	assert.Nil(t, handler(c))
+	assert.Equal(t, "100", CurrentUser(c.Request.Context()).GetID())
+	assert.Equal(t, "2", res.Header().Get("X-RateLimit-Limit"))
+	assert.Nil(t, RequireScope(ScopeOrdersRead)(c))
+	assert.Equal(t, http.StatusForbidden, RequireScope(ScopeOrdersWrite)(c).(errors.ErrorResponse).Status)
+	assert.Equal(t, http.StatusForbidden, RejectAPIKeys(c).(errors.ErrorResponse).Status)
+
+	// each key has its own rate limit
+	c, _ = test.MockRoutingContext(req)
+	assert.Nil(t, handler(c))
+	c, _ = test.MockRoutingContext(req)
+	assert.NotNil(t, handler(c))
+
+	req.Header.Set(apiKeyHeader, "sk_garbage")
+	c, _ = test.MockRoutingContext(req)
+	assert.Equal(t, http.StatusUnauthorized, handler(c).(errors.ErrorResponse).Status)
+}
+
+func TestCreateAPIKeyRequest_Validate(t *testing.T) {
+	assert.Nil(t, CreateAPIKeyRequest{Name: "erp", Scopes: []string{ScopeOrdersRead, ScopeOrdersWrite}}.Validate())
+	errs := CreateAPIKeyRequest{Scopes: []string{"everything"}, RateLimit: maxAPIKeyRateLimit + 1}.Validate().(validation.Errors)
+	assert.Contains(t, errs, "name")
+	assert.Contains(t, errs, "scopes")
+	assert.Contains(t, errs, "rate_limit")
+	past := time.Now().Add(-time.Hour)
+	assert.Contains(t, CreateAPIKeyRequest{Name: "erp", Scopes: []string{ScopeOrdersRead}, ExpiresAt: &past}.Validate().(validation.Errors), "expires_at")
+}
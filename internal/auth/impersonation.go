@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"context"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/online-shop/internal/entity"
+	"github.com/online-shop/internal/errors"
+	"github.com/online-shop/pkg/tracing"
+	"time"
+)
+
+// impersonationExpiration is how long staff members can act as another user before asking again.
+const impersonationExpiration = 15 * time.Minute
+
+// errImpersonating is returned for the actions staff members cannot take on behalf of a user.
+var errImpersonating = errors.Forbidden("This action cannot be performed while impersonating a user.")
+
+// Impersonation is the token letting a staff member act as another user.
+type Impersonation struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// impersonation is the identity of a user impersonated by a staff member.
+type impersonation struct {
+	entity.User
+	actorID string
+}
+
+// GetActorID returns the ID of the staff member impersonating the user.
+func (i impersonation) GetActorID() string {
+	return i.actorID
+}
+
+// ForbidImpersonation returns an error if the user in the given context is impersonated by a staff member.
+func ForbidImpersonation(ctx context.Context) error {
+	if identity := CurrentUser(ctx); identity != nil && identity.GetActorID() != "" {
+		return errImpersonating
+	}
+	return nil
+}
+
+// actorOf returns the subject of the actor claim of an impersonation token, as defined by RFC 8693,
+// and whether the token has one.
+func actorOf(claims jwt.MapClaims) (string, bool) {
+	act, ok := claims["act"]
+	if !ok {
+		return "", false
+	}
+	actor, _ := act.(map[string]interface{})
+	sub, _ := actor["sub"].(string)
+	return sub, true
+}
+
+// Impersonate lets the current staff member act as the given customer. The token it returns belongs to a new
+// session of the staff member, who can end it like any other, and never grants more than the customer has.
+func (s service) Impersonate(ctx context.Context, userID string) (Impersonation, error) {
+	ctx, span := tracing.StartSpan(ctx, "auth.Service.Impersonate")
+	defer span.End()
+
+	actor := CurrentUser(ctx)
+	if actor == nil || currentSession(ctx) == "" {
+		return Impersonation{}, errors.Unauthorized("")
+	}
+	if err := ForbidImpersonation(ctx); err != nil {
+		return Impersonation{}, err
+	}
+	user, err := s.repo.Get(ctx, userID)
+	if err != nil {
+		return Impersonation{}, err
+	}
+	if user.Role != entity.RoleCustomer {
+		return Impersonation{}, errors.Forbidden("Only customers can be impersonated.")
+	}
+
+	now := time.Now()
+	c := currentClient(ctx)
+	session := entity.Session{
+		ID:         entity.GenerateID(),
+		UserID:     actor.GetID(),
+		UserAgent:  c.UserAgent,
+		IP:         c.IP,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(impersonationExpiration),
+	}
+	if err := s.repo.CreateSession(ctx, session); err != nil {
+		return Impersonation{}, err
+	}
+	token, err := s.keys.Sign(jwt.MapClaims{
+		"id":   user.ID,
+		"name": user.Username,
+		"role": user.Role,
+		"act":  map[string]interface{}{"sub": actor.GetID()},
+		"sid":  session.ID,
+		"exp":  session.ExpiresAt.Unix(),
+	})
+	if err != nil {
+		return Impersonation{}, err
+	}
+	s.logger.With(ctx, "user", user.Username, "target_id", user.ID).Infof("impersonation started")
+	return Impersonation{Token: token, ExpiresAt: session.ExpiresAt}, nil
+}
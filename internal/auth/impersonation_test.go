@@ -0,0 +1,113 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"github.com/dgrijalva/jwt-go"
+	routing "github.com/go-ozzo/ozzo-routing/v2"
+	"github.com/online-shop/internal/entity"
+	"github.com/online-shop/internal/errors"
+	"github.com/online-shop/internal/test"
+	"github.com/online-shop/pkg/log"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestService_Impersonate(t *testing.T) {
+	s, repo, ctx := newProfileTestService(t)
+	repo.users["1"] = entity.User{ID: "1", Username: "admin", Role: entity.RoleAdmin}
+	repo.users["300"] = entity.User{ID: "300", Username: "warehouse", Role: entity.RoleService}
+	staff := withSession(withMFA(withIdentity(context.Background(), repo.users["1"])), "s1")
+
+	result, err := s.Impersonate(staff, "100")
+	assert.Nil(t, err)
+	assert.WithinDuration(t, time.Now().Add(impersonationExpiration), result.ExpiresAt, time.Second)
+
+	// the token belongs to a new session of the staff member
+	token, err := s.(service).keys.Parse(result.Token)
+	if !assert.Nil(t, err) {
+		return
+	}
+	claims := token.Claims.(jwt.MapClaims)
+	assert.Equal(t, "100", claims["id"])
+	assert.Equal(t, map[string]interface{}{"sub": "1"}, claims["act"])
+	assert.NotContains(t, claims, "mfa")
+	assert.Equal(t, "1", repo.sessions[claims["sid"].(string)].UserID)
+
+	req, _ := http.NewRequest("GET", "http://example.com", nil)
+	c, _ := test.MockRoutingContext(req)
+	assert.Nil(t, handleToken(c, token, s))
+	identity := CurrentUser(c.Request.Context())
+	assert.Equal(t, "100", identity.GetID())
+	assert.Equal(t, "1", identity.GetActorID())
+	assert.Equal(t, errImpersonating, ForbidImpersonation(c.Request.Context()))
+
+	// impersonation ends with the session
+	assert.Nil(t, s.RevokeSession(staff, claims["sid"].(string)))
+	c, _ = test.MockRoutingContext(req)
+	assert.Equal(t, http.StatusUnauthorized, handleToken(c, token, s).(errors.ErrorResponse).Status)
+
+	_, err = s.Impersonate(staff, "unknown")
+	assert.Equal(t, sql.ErrNoRows, err)
+	_, err = s.Impersonate(staff, "300")
+	assert.Equal(t, http.StatusForbidden, err.(errors.ErrorResponse).Status)
+	_, err = s.Impersonate(withSession(ctx, "s2"), "1")
+	assert.Equal(t, http.StatusForbidden, err.(errors.ErrorResponse).Status)
+	_, err = s.Impersonate(withSession(withIdentity(context.Background(), impersonation{repo.users["100"], "1"}), "s1"), "200")
+	assert.Equal(t, errImpersonating, err)
+	_, err = s.Impersonate(withIdentity(context.Background(), repo.users["1"]), "100")
+	assert.Equal(t, http.StatusUnauthorized, err.(errors.ErrorResponse).Status)
+}
+
+func Test_handleToken_impersonation(t *testing.T) {
+	sessions := mockSessions{"s1": "100", "s2": "1"}
+	req, _ := http.NewRequest("GET", "http://example.com", nil)
+
+	// the session must be the one of the actor, who gets none of their privileges
+	c, _ := test.MockRoutingContext(req)
+	err := handleToken(c, &jwt.Token{Claims: jwt.MapClaims{
+		"id": "100", "name": "test", "sid": "s2", "mfa": true, "act": map[string]interface{}{"sub": "1"},
+	}}, sessions)
+	assert.Nil(t, err)
+	assert.Equal(t, "1", CurrentUser(c.Request.Context()).GetActorID())
+	assert.False(t, authenticatedWithMFA(c.Request.Context()))
+
+	for _, claims := range []jwt.MapClaims{
+		{"id": "100", "name": "test", "sid": "s1", "act": map[string]interface{}{"sub": "1"}},
+		{"id": "100", "name": "test", "sid": "s2", "act": "1"},
+	} {
+		c, _ = test.MockRoutingContext(req)
+		err = handleToken(c, &jwt.Token{Claims: claims}, sessions)
+		assert.Equal(t, http.StatusUnauthorized, err.(errors.ErrorResponse).Status)
+	}
+}
+
+func TestAPI_impersonation(t *testing.T) {
+	s, repo, _ := newProfileTestService(t)
+	hash := repo.users["100"].Password
+	logger, entries := log.NewForTest()
+	router := test.MockRouter(logger)
+	noLimit := func(c *routing.Context) error { return nil }
+	RegisterHandlers(router.Group("/v1"), s, MockAuthHandler, noLimit, logger)
+
+	test.Endpoint(t, router, test.APITestCase{
+		Name: "customer", Method: "POST", URL: "/v1/users/200/impersonate", Header: MockAuthHeader(), WantStatus: http.StatusForbidden,
+	})
+	test.Endpoint(t, router, test.APITestCase{
+		Name: "password change", Method: "PUT", URL: "/v1/me/password", Body: `{"old_password":"pass","new_password":"n3w-passw0rd"}`,
+		Header: MockImpersonationAuthHeader(), WantStatus: http.StatusForbidden,
+	})
+	test.Endpoint(t, router, test.APITestCase{
+		Name: "api key", Method: "POST", URL: "/v1/api-keys", Body: `{"name":"mine"}`,
+		Header: MockImpersonationAuthHeader(), WantStatus: http.StatusForbidden,
+	})
+	assert.Equal(t, "1", entries.All()[1].ContextMap()["actor_id"])
+	assert.Equal(t, hash, repo.users["100"].Password)
+
+	test.Endpoint(t, router, test.APITestCase{
+		Name: "profile", Method: "GET", URL: "/v1/me", Header: MockImpersonationAuthHeader(), WantStatus: http.StatusOK,
+		WantResponse: `*"username":"demo"*`,
+	})
+}
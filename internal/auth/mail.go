@@ -0,0 +1,47 @@
+package auth
+
+import (
+	"github.com/online-shop/pkg/mailer"
+	"time"
+)
+
+// mailData is the data the email templates are rendered with.
+type mailData struct {
+	Name    string
+	Link    string
+	Expires time.Duration
+}
+
+var verificationMail = mailer.MustTemplate("email_verification",
+	"Please verify your email address",
+	`Hi {{.Name}},
+
+please confirm that this is your email address by opening the link below:
+
+{{.Link}}
+
+The link is valid for {{.Expires}}. If you did not create an account or change your email address, you can ignore this email.
+`,
+	`<p>Hi {{.Name}},</p>
+<p>please confirm that this is your email address by clicking the link below:</p>
+<p><a href="{{.Link}}">Verify my email address</a></p>
+<p>The link is valid for {{.Expires}}. If you did not create an account or change your email address, you can ignore this email.</p>
+`,
+)
+
+var passwordResetMail = mailer.MustTemplate("password_reset",
+	"Reset your password",
+	`Hi {{.Name}},
+
+someone asked to reset the password of your account. To choose a new password, open the link below:
+
+{{.Link}}
+
+The link is valid for {{.Expires}}. If you did not ask for it, you can ignore this email: your password stays unchanged.
+`,
+	`<p>Hi {{.Name}},</p>
+<p>someone asked to reset the password of your account. To choose a new password, click the link below:</p>
+<p><a href="{{.Link}}">Reset my password</a></p>
+<p>The link is valid for {{.Expires}}. If you did not ask for it, you can ignore this email: your password stays unchanged.</p>
+`,
+)
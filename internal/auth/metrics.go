@@ -0,0 +1,11 @@
+package auth
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var loginFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "auth_login_failures_total",
+	Help: "Number of failed login attempts, labeled by the reason of the failure.",
+}, []string{"reason"})
@@ -0,0 +1,347 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	stderrors "errors"
+	"github.com/dgrijalva/jwt-go"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/online-shop/internal/entity"
+	"github.com/online-shop/internal/errors"
+	"github.com/online-shop/pkg/totp"
+	"github.com/online-shop/pkg/tracing"
+	"github.com/skip2/go-qrcode"
+	"math/big"
+	"strings"
+	"time"
+)
+
+const (
+	// totpIssuer is the name authenticator apps show next to the codes of this shop.
+	totpIssuer = "Online Shop"
+	// mfaTokenExpiration is how long a user has to enter their second factor after their password.
+	mfaTokenExpiration = 5 * time.Minute
+	// mfaTokenPurpose tells MFA challenge tokens apart from the tokens authenticating requests.
+	mfaTokenPurpose = "mfa"
+	// recoveryCodeCount is the number of recovery codes a user gets.
+	recoveryCodeCount = 10
+	// qrCodeSize is the width and height of the enrollment QR code, in pixels.
+	qrCodeSize = 256
+)
+
+// recoveryCodeAlphabet avoids characters which are easily mistaken for one another.
+const recoveryCodeAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+
+// MFALoginRequest represents the second step of a login with two-factor authentication.
+type MFALoginRequest struct {
+	MFAToken string `json:"mfa_token"`
+	// Code is either a code of the authenticator app or a recovery code.
+	Code string `json:"code"`
+}
+
+// Validate validates the MFALoginRequest fields.
+func (r MFALoginRequest) Validate() error {
+	return validation.ValidateStruct(&r,
+		validation.Field(&r.MFAToken, validation.Required),
+		validation.Field(&r.Code, validation.Required, validation.Length(0, 32)),
+	)
+}
+
+// TOTPCodeRequest represents a code of the authenticator app.
+type TOTPCodeRequest struct {
+	Code string `json:"code"`
+}
+
+// Validate validates the TOTPCodeRequest fields.
+func (r TOTPCodeRequest) Validate() error {
+	return validation.ValidateStruct(&r,
+		validation.Field(&r.Code, validation.Required, validation.Length(totp.Digits, totp.Digits)),
+	)
+}
+
+// DisableTOTPRequest represents the deactivation of two-factor authentication.
+// It must be confirmed with the password and a code of the authenticator app or a recovery code.
+type DisableTOTPRequest struct {
+	Password string `json:"password"`
+	Code     string `json:"code"`
+}
+
+// Validate validates the DisableTOTPRequest fields.
+func (r DisableTOTPRequest) Validate() error {
+	return validation.ValidateStruct(&r,
+		validation.Field(&r.Password, validation.Required),
+		validation.Field(&r.Code, validation.Required, validation.Length(0, 32)),
+	)
+}
+
+// TOTPEnrollment is what a user needs to set up their authenticator app.
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	// URI is the otpauth:// URI encoded in the QR code.
+	URI string `json:"uri"`
+	// QRCode is a PNG image of the QR code, as a data URI.
+	QRCode string `json:"qr_code"`
+}
+
+// RecoveryCodes are the codes a user can log in with when they lose their authenticator app.
+// They are only shown once.
+type RecoveryCodes struct {
+	Codes []string `json:"recovery_codes"`
+}
+
+// errInvalidCode reports that a second factor code is wrong.
+var errInvalidCode = validation.Errors{"code": stderrors.New("is invalid")}
+
+// LoginMFA completes the login of a user having enabled two-factor authentication, checking the code
+// of their authenticator app or one of their recovery codes. Wrong codes count as failed logins.
+func (s service) LoginMFA(ctx context.Context, input MFALoginRequest) (LoginResult, error) {
+	ctx, span := tracing.StartSpan(ctx, "auth.Service.LoginMFA")
+	defer span.End()
+
+	id, err := s.parseMFAToken(input.MFAToken)
+	if err != nil {
+		return LoginResult{}, errors.Unauthorized("")
+	}
+	user, err := s.repo.Get(ctx, id)
+	if err != nil {
+		if stderrors.Is(err, sql.ErrNoRows) {
+			return LoginResult{}, errors.Unauthorized("")
+		}
+		return LoginResult{}, err
+	}
+
+	now := time.Now()
+	if err := s.checkLocked(ctx, user, now); err != nil {
+		return LoginResult{}, err
+	}
+	ok, err := s.verifySecondFactor(ctx, &user, input.Code, now)
+	if err != nil {
+		return LoginResult{}, err
+	}
+	if !ok {
+		loginFailures.WithLabelValues("invalid_mfa_code").Inc()
+		s.logger.With(ctx, "user", user.Username).Infof("two-factor authentication failed")
+		return LoginResult{}, s.loginFailed(ctx, user, now)
+	}
+	return s.loginSucceeded(ctx, user, entity.User{ID: user.ID, Username: user.Username, Role: user.Role}, true)
+}
+
+// verifySecondFactor checks the given code of the authenticator app, or recovery code, of the given user.
+// Accepted codes are used up.
+func (s service) verifySecondFactor(ctx context.Context, user *entity.User, code string, now time.Time) (bool, error) {
+	if !user.TOTPEnabled {
+		return false, nil
+	}
+	if len(code) == totp.Digits {
+		step, ok := totp.Validate(user.TOTPSecret, code, now, user.TOTPLastStep)
+		if !ok {
+			return false, nil
+		}
+		user.TOTPLastStep = step
+		return true, s.repo.UpdateTOTP(ctx, *user)
+	}
+
+	err := s.repo.UseRecoveryCode(ctx, user.ID, hashToken(normalizeRecoveryCode(code)), now)
+	if err != nil {
+		if stderrors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+	s.logger.With(ctx, "user", user.Username).Infof("recovery code used")
+	return true, nil
+}
+
+// EnrollTOTP generates a new TOTP secret for the current user. Two-factor authentication
+// is only enabled once the user confirms it with a code of their authenticator app.
+func (s service) EnrollTOTP(ctx context.Context) (TOTPEnrollment, error) {
+	ctx, span := tracing.StartSpan(ctx, "auth.Service.EnrollTOTP")
+	defer span.End()
+
+	user, err := s.currentUser(ctx)
+	if err != nil {
+		return TOTPEnrollment{}, err
+	}
+	if user.TOTPEnabled {
+		return TOTPEnrollment{}, errors.BadRequest("Two-factor authentication is already enabled.")
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return TOTPEnrollment{}, err
+	}
+	user.TOTPSecret, user.TOTPLastStep = secret, 0
+	if err := s.repo.UpdateTOTP(ctx, user); err != nil {
+		return TOTPEnrollment{}, err
+	}
+
+	account := user.Email
+	if account == "" {
+		account = user.Username
+	}
+	uri := totp.URI(totpIssuer, account, secret)
+	png, err := qrcode.Encode(uri, qrcode.Medium, qrCodeSize)
+	if err != nil {
+		return TOTPEnrollment{}, err
+	}
+	return TOTPEnrollment{
+		Secret: secret,
+		URI:    uri,
+		QRCode: "data:image/png;base64," + base64.StdEncoding.EncodeToString(png),
+	}, nil
+}
+
+// ConfirmTOTP enables two-factor authentication for the current user, checking a code of the secret
+// generated by EnrollTOTP. It returns the recovery codes of the user.
+func (s service) ConfirmTOTP(ctx context.Context, input TOTPCodeRequest) (RecoveryCodes, error) {
+	ctx, span := tracing.StartSpan(ctx, "auth.Service.ConfirmTOTP")
+	defer span.End()
+
+	user, err := s.currentUser(ctx)
+	if err != nil {
+		return RecoveryCodes{}, err
+	}
+	if user.TOTPEnabled {
+		return RecoveryCodes{}, errors.BadRequest("Two-factor authentication is already enabled.")
+	}
+	if user.TOTPSecret == "" {
+		return RecoveryCodes{}, errors.BadRequest("Two-factor authentication must be enrolled first.")
+	}
+	step, ok := totp.Validate(user.TOTPSecret, input.Code, time.Now(), user.TOTPLastStep)
+	if !ok {
+		return RecoveryCodes{}, errInvalidCode
+	}
+
+	user.TOTPEnabled, user.TOTPLastStep = true, step
+	if err := s.repo.UpdateTOTP(ctx, user); err != nil {
+		return RecoveryCodes{}, err
+	}
+	s.logger.With(ctx, "user", user.Username).Infof("two-factor authentication enabled")
+	return s.replaceRecoveryCodes(ctx, user)
+}
+
+// DisableTOTP disables two-factor authentication for the current user, after checking their password
+// and second factor. Administrators cannot disable it.
+func (s service) DisableTOTP(ctx context.Context, input DisableTOTPRequest) error {
+	ctx, span := tracing.StartSpan(ctx, "auth.Service.DisableTOTP")
+	defer span.End()
+
+	user, err := s.currentUser(ctx)
+	if err != nil {
+		return err
+	}
+	if user.Role == entity.RoleAdmin {
+		return errors.Forbidden("Two-factor authentication is mandatory for staff accounts.")
+	}
+	if !user.TOTPEnabled {
+		return errors.BadRequest("Two-factor authentication is not enabled.")
+	}
+	if err := s.verifyPassword(input.Password, user.Password); err != nil {
+		return errIncorrectPassword("password")
+	}
+	ok, err := s.verifySecondFactor(ctx, &user, input.Code, time.Now())
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errInvalidCode
+	}
+
+	user.TOTPSecret, user.TOTPEnabled, user.TOTPLastStep = "", false, 0
+	if err := s.repo.UpdateTOTP(ctx, user); err != nil {
+		return err
+	}
+	if err := s.repo.ReplaceRecoveryCodes(ctx, user.ID, nil); err != nil {
+		return err
+	}
+	s.logger.With(ctx, "user", user.Username).Infof("two-factor authentication disabled")
+	return nil
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of the current user, checking a code of their authenticator app.
+func (s service) RegenerateRecoveryCodes(ctx context.Context, input TOTPCodeRequest) (RecoveryCodes, error) {
+	ctx, span := tracing.StartSpan(ctx, "auth.Service.RegenerateRecoveryCodes")
+	defer span.End()
+
+	user, err := s.currentUser(ctx)
+	if err != nil {
+		return RecoveryCodes{}, err
+	}
+	if !user.TOTPEnabled {
+		return RecoveryCodes{}, errors.BadRequest("Two-factor authentication is not enabled.")
+	}
+	step, ok := totp.Validate(user.TOTPSecret, input.Code, time.Now(), user.TOTPLastStep)
+	if !ok {
+		return RecoveryCodes{}, errInvalidCode
+	}
+	user.TOTPLastStep = step
+	if err := s.repo.UpdateTOTP(ctx, user); err != nil {
+		return RecoveryCodes{}, err
+	}
+	return s.replaceRecoveryCodes(ctx, user)
+}
+
+// replaceRecoveryCodes generates new recovery codes for the given user, invalidating the previous ones.
+func (s service) replaceRecoveryCodes(ctx context.Context, user entity.User) (RecoveryCodes, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		code, err := newRecoveryCode()
+		if err != nil {
+			return RecoveryCodes{}, err
+		}
+		codes[i], hashes[i] = code, hashToken(normalizeRecoveryCode(code))
+	}
+	if err := s.repo.ReplaceRecoveryCodes(ctx, user.ID, hashes); err != nil {
+		return RecoveryCodes{}, err
+	}
+	return RecoveryCodes{Codes: codes}, nil
+}
+
+// newRecoveryCode generates a random recovery code formatted as two groups of five characters.
+func newRecoveryCode() (string, error) {
+	// characters are drawn uniformly, which the modulo of random bytes would not do
+	max := big.NewInt(int64(len(recoveryCodeAlphabet)))
+	code := make([]byte, 0, 11)
+	for i := 0; i < 10; i++ {
+		if i == 5 {
+			code = append(code, '-')
+		}
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code = append(code, recoveryCodeAlphabet[n.Int64()])
+	}
+	return string(code), nil
+}
+
+// normalizeRecoveryCode ignores the case, dashes and spaces of a typed recovery code.
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// generateMFAToken generates the short-lived token proving that a user passed the password check.
+func (s service) generateMFAToken(user entity.User) (string, error) {
+	return s.keys.Sign(jwt.MapClaims{
+		"id":      user.ID,
+		"purpose": mfaTokenPurpose,
+		"exp":     time.Now().Add(mfaTokenExpiration).Unix(),
+	})
+}
+
+// parseMFAToken verifies an MFA challenge token and returns the ID of the user it was issued to.
+func (s service) parseMFAToken(tokenString string) (string, error) {
+	token, err := s.keys.Parse(tokenString)
+	if err != nil {
+		return "", err
+	}
+	claims := token.Claims.(jwt.MapClaims)
+	id, _ := claims["id"].(string)
+	if claims["purpose"] != mfaTokenPurpose || id == "" {
+		return "", stderrors.New("not an MFA challenge token")
+	}
+	return id, nil
+}
@@ -0,0 +1,159 @@
+package auth
+
+import (
+	"context"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/online-shop/internal/entity"
+	"github.com/online-shop/internal/errors"
+	"github.com/online-shop/pkg/totp"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// enrollTestTOTP enables two-factor authentication for the user of the given context, returning its secret and recovery codes.
+func enrollTestTOTP(t *testing.T, s Service, ctx context.Context) (string, []string) {
+	enrollment, err := s.EnrollTOTP(ctx)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	assert.True(t, strings.HasPrefix(enrollment.QRCode, "data:image/png;base64,"))
+	assert.Contains(t, enrollment.URI, "secret="+enrollment.Secret)
+
+	code, _ := totp.Code(enrollment.Secret, totp.Step(time.Now())-1)
+	codes, err := s.ConfirmTOTP(ctx, TOTPCodeRequest{Code: code})
+	assert.Nil(t, err)
+	assert.Len(t, codes.Codes, recoveryCodeCount)
+	return enrollment.Secret, codes.Codes
+}
+
+func TestService_ConfirmTOTP(t *testing.T) {
+	s, repo, ctx := newProfileTestService(t)
+
+	_, err := s.ConfirmTOTP(ctx, TOTPCodeRequest{Code: "123456"})
+	assert.Equal(t, http.StatusBadRequest, err.(errors.ErrorResponse).Status)
+
+	enrollment, err := s.EnrollTOTP(ctx)
+	assert.Nil(t, err)
+	assert.False(t, repo.users["100"].TOTPEnabled)
+
+	code, _ := totp.Code(enrollment.Secret, totp.Step(time.Now())+5)
+	_, err = s.ConfirmTOTP(ctx, TOTPCodeRequest{Code: code})
+	assert.Equal(t, errInvalidCode, err)
+
+	code, _ = totp.Code(enrollment.Secret, totp.Step(time.Now()))
+	_, err = s.ConfirmTOTP(ctx, TOTPCodeRequest{Code: code})
+	assert.Nil(t, err)
+	assert.True(t, repo.users["100"].TOTPEnabled)
+
+	profile, _ := s.GetProfile(ctx)
+	assert.True(t, profile.TwoFactor)
+
+	_, err = s.EnrollTOTP(ctx)
+	assert.Equal(t, http.StatusBadRequest, err.(errors.ErrorResponse).Status)
+}
+
+func TestService_LoginMFA(t *testing.T) {
+	s, repo, ctx := newProfileTestService(t)
+	secret, recoveryCodes := enrollTestTOTP(t, s, ctx)
+
+	result, err := s.Login(context.Background(), "demo", "pass")
+	assert.Nil(t, err)
+	assert.True(t, result.MFARequired)
+	assert.Empty(t, result.Token)
+
+	// the challenge token does not authenticate requests
+	_, err = s.LoginMFA(context.Background(), MFALoginRequest{MFAToken: "garbage", Code: "123456"})
+	assert.Equal(t, http.StatusUnauthorized, err.(errors.ErrorResponse).Status)
+
+	code, _ := totp.Code(secret, totp.Step(time.Now()))
+	mfaResult, err := s.LoginMFA(context.Background(), MFALoginRequest{MFAToken: result.MFAToken, Code: code})
+	assert.Nil(t, err)
+	assert.NotEmpty(t, mfaResult.Token)
+
+	// a code cannot be replayed, and wrong codes count as failed logins
+	_, err = s.LoginMFA(context.Background(), MFALoginRequest{MFAToken: result.MFAToken, Code: code})
+	assert.Equal(t, http.StatusUnauthorized, err.(errors.ErrorResponse).Status)
+	assert.Equal(t, 1, repo.users["100"].FailedLogins)
+
+	// recovery codes are accepted once, whatever their case and dashes
+	recovery := strings.ToUpper(strings.Replace(recoveryCodes[0], "-", "", 1))
+	_, err = s.LoginMFA(context.Background(), MFALoginRequest{MFAToken: result.MFAToken, Code: recovery})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, repo.users["100"].FailedLogins)
+	_, err = s.LoginMFA(context.Background(), MFALoginRequest{MFAToken: result.MFAToken, Code: recoveryCodes[0]})
+	assert.Equal(t, http.StatusUnauthorized, err.(errors.ErrorResponse).Status)
+}
+
+func TestService_LoginMFA_tokens(t *testing.T) {
+	s, _, ctx := newProfileTestService(t)
+	enrollTestTOTP(t, s, ctx)
+	svc := s.(service)
+
+	result, _ := s.Login(context.Background(), "demo", "pass")
+	id, err := svc.parseMFAToken(result.MFAToken)
+	assert.Nil(t, err)
+	assert.Equal(t, "100", id)
+
+	// access tokens cannot be used as challenge tokens
+	accessToken, _ := svc.generateJWT(entity.User{ID: "100", Username: "demo"}, false, entity.Session{ID: "1", ExpiresAt: time.Now().Add(time.Hour)})
+	_, err = svc.parseMFAToken(accessToken)
+	assert.NotNil(t, err)
+
+	// tokens signed with another key are refused
+	other := NewService(svc.repo, newTestKeys(t), 100, svc.mailer, svc.appURL, false, svc.passwords, svc.policy, svc.providers, svc.logger).(service)
+	_, err = other.parseMFAToken(result.MFAToken)
+	assert.NotNil(t, err)
+}
+
+func TestService_DisableTOTP(t *testing.T) {
+	s, repo, ctx := newProfileTestService(t)
+	secret, _ := enrollTestTOTP(t, s, ctx)
+	code, _ := totp.Code(secret, totp.Step(time.Now()))
+
+	err := s.DisableTOTP(ctx, DisableTOTPRequest{Password: "wrong", Code: code})
+	assert.Contains(t, err.(validation.Errors), "password")
+	err = s.DisableTOTP(ctx, DisableTOTPRequest{Password: "pass", Code: "000000"})
+	assert.Equal(t, errInvalidCode, err)
+
+	assert.Nil(t, s.DisableTOTP(ctx, DisableTOTPRequest{Password: "pass", Code: code}))
+	assert.False(t, repo.users["100"].TOTPEnabled)
+	assert.Empty(t, repo.users["100"].TOTPSecret)
+	assert.Empty(t, repo.recoveryCodes)
+
+	result, err := s.Login(context.Background(), "demo", "pass")
+	assert.Nil(t, err)
+	assert.NotEmpty(t, result.Token)
+
+	// staff accounts cannot opt out
+	admin := repo.users["100"]
+	admin.Role, admin.TOTPEnabled = entity.RoleAdmin, true
+	repo.users["100"] = admin
+	err = s.DisableTOTP(ctx, DisableTOTPRequest{Password: "pass", Code: code})
+	assert.Equal(t, http.StatusForbidden, err.(errors.ErrorResponse).Status)
+}
+
+func TestService_RegenerateRecoveryCodes(t *testing.T) {
+	s, _, ctx := newProfileTestService(t)
+	secret, old := enrollTestTOTP(t, s, ctx)
+
+	code, _ := totp.Code(secret, totp.Step(time.Now()))
+	codes, err := s.RegenerateRecoveryCodes(ctx, TOTPCodeRequest{Code: code})
+	assert.Nil(t, err)
+	assert.Len(t, codes.Codes, recoveryCodeCount)
+
+	result, _ := s.Login(context.Background(), "demo", "pass")
+	_, err = s.LoginMFA(context.Background(), MFALoginRequest{MFAToken: result.MFAToken, Code: old[0]})
+	assert.Equal(t, http.StatusUnauthorized, err.(errors.ErrorResponse).Status)
+	_, err = s.LoginMFA(context.Background(), MFALoginRequest{MFAToken: result.MFAToken, Code: codes.Codes[0]})
+	assert.Nil(t, err)
+}
+
+func Test_newRecoveryCode(t *testing.T) {
+	code, err := newRecoveryCode()
+	assert.Nil(t, err)
+	assert.Regexp(t, `^[a-z2-9]{5}-[a-z2-9]{5}$`, code)
+	assert.Equal(t, strings.Replace(code, "-", "", 1), normalizeRecoveryCode(" "+strings.ToUpper(code)))
+}
@@ -7,41 +7,261 @@ import (
 	"github.com/go-ozzo/ozzo-routing/v2/auth"
 	"github.com/online-shop/internal/entity"
 	"github.com/online-shop/internal/errors"
+	"github.com/online-shop/pkg/jwk"
+	"github.com/online-shop/pkg/log"
+	"github.com/online-shop/pkg/ratelimit"
 	"net/http"
+	"strings"
 )
 
-// Handler returns a JWT-based authentication middleware.
-func Handler(verificationKey string) routing.Handler {
-	return auth.JWT(verificationKey, auth.JWTOptions{TokenHandler: handleToken})
+// Handler returns a JWT-based authentication middleware. Tokens are verified with the key of the given set
+// their kid header refers to, and must belong to a session the validator deems active.
+func Handler(keys *jwk.Set, sessions SessionValidator) routing.Handler {
+	return func(c *routing.Context) error {
+		header := c.Request.Header.Get("Authorization")
+		message := ""
+		if strings.HasPrefix(header, "Bearer ") {
+			token, err := keys.Parse(header[7:])
+			if err == nil && token.Valid {
+				err = handleToken(c, token, sessions)
+				if _, ok := err.(errors.ErrorResponse); err != nil && !ok {
+					// the session could not be checked, this is no reason to log the user out
+					return err
+				}
+			}
+			if err == nil {
+				return nil
+			}
+			message = err.Error()
+		}
+
+		c.Response.Header().Set("WWW-Authenticate", `Bearer realm="`+auth.DefaultRealm+`"`)
+		if message != "" {
+			return routing.NewHTTPError(http.StatusUnauthorized, message)
+		}
+		return routing.NewHTTPError(http.StatusUnauthorized)
+	}
+}
+
+// apiKeyHeader is the request header carrying API keys.
+const apiKeyHeader = "X-API-Key"
+
+// APIKeyAuthenticator authenticates API keys.
+type APIKeyAuthenticator interface {
+	// AuthenticateAPIKey returns the owner of the given API key, along with the key, if it is valid.
+	AuthenticateAPIKey(ctx context.Context, key string) (entity.User, entity.APIKey, error)
+}
+
+// APIKeyHandler returns an authentication middleware accepting the API keys sent in the X-API-Key header,
+// and limiting the rate of requests per key. Requests without an API key are authenticated by the given
+// fallback middleware instead, typically the one returned by Handler.
+func APIKeyHandler(authenticator APIKeyAuthenticator, store ratelimit.Store, fallback routing.Handler, logger log.Logger) routing.Handler {
+	limiter := ratelimit.HandlerFunc(store, "api_key", byAPIKey, logger)
+	return func(c *routing.Context) error {
+		plain := c.Request.Header.Get(apiKeyHeader)
+		if plain == "" {
+			return fallback(c)
+		}
+
+		owner, key, err := authenticator.AuthenticateAPIKey(c.Request.Context(), plain)
+		if err != nil {
+			return err
+		}
+		ctx := withIdentity(c.Request.Context(), entity.User{ID: owner.ID, Username: owner.Username, Role: owner.Role})
+		ctx = context.WithValue(ctx, apiKeyKey, key)
+		c.Request = c.Request.WithContext(ctx)
+		return limiter(c)
+	}
+}
+
+// CredentialHeaders are the request headers carrying credentials, either a bearer token or an API key.
+var CredentialHeaders = []string{"Authorization", apiKeyHeader}
+
+// Optional returns a middleware letting anonymous requests through, and authenticating the requests having
+// credentials with the given authentication middleware. Invalid credentials are refused rather than ignored,
+// so that clients learn that they must log in again.
+func Optional(authHandler routing.Handler) routing.Handler {
+	return func(c *routing.Context) error {
+		for _, header := range CredentialHeaders {
+			if c.Request.Header.Get(header) != "" {
+				return authHandler(c)
+			}
+		}
+		return nil
+	}
+}
+
+// byAPIKey identifies clients by their API key, each key having its own rate limit.
+func byAPIKey(c *routing.Context) (string, ratelimit.Limit) {
+	key := CurrentAPIKey(c.Request.Context())
+	if key == nil {
+		return "", ratelimit.Limit{}
+	}
+	return key.ID, ratelimit.PerMinute(key.RateLimit, key.RateLimit)
+}
+
+// RequireScope returns a middleware which only lets through the requests authenticated with an API key
+// having the given scope. Requests authenticated otherwise are not restricted.
+// It must be used after the authentication middleware.
+func RequireScope(scope string) routing.Handler {
+	return func(c *routing.Context) error {
+		key := CurrentAPIKey(c.Request.Context())
+		if key == nil {
+			return nil
+		}
+		for _, s := range strings.Split(key.Scopes, ",") {
+			if s == scope {
+				return nil
+			}
+		}
+		return errors.Forbidden("The API key lacks the " + scope + " scope.")
+	}
+}
+
+// RejectAPIKeys is a middleware refusing the requests authenticated with an API key,
+// for the actions users must take themselves, such as managing their account.
+// It must be used after the authentication middleware.
+func RejectAPIKeys(c *routing.Context) error {
+	if CurrentAPIKey(c.Request.Context()) != nil {
+		return errors.Forbidden("This action cannot be performed with an API key.")
+	}
+	return nil
+}
+
+// RejectImpersonation is a middleware refusing the requests made by staff members impersonating a user,
+// for the sensitive actions only users may take, such as changing their credentials.
+// It must be used after the authentication middleware.
+func RejectImpersonation(c *routing.Context) error {
+	return ForbidImpersonation(c.Request.Context())
 }
 
 // handleToken stores the user identity in the request context so that it can be accessed elsewhere.
-func handleToken(c *routing.Context, token *jwt.Token) error {
-	ctx := WithUser(
-		c.Request.Context(),
-		token.Claims.(jwt.MapClaims)["id"].(string),
-		token.Claims.(jwt.MapClaims)["name"].(string),
-	)
+// Tokens issued for another purpose than authenticating requests, such as MFA challenge tokens, are refused,
+// and so are tokens whose session was terminated.
+func handleToken(c *routing.Context, token *jwt.Token, sessions SessionValidator) error {
+	claims := token.Claims.(jwt.MapClaims)
+	if _, ok := claims["purpose"]; ok {
+		return errors.Unauthorized("")
+	}
+	id, _ := claims["id"].(string)
+	sid, _ := claims["sid"].(string)
+	if id == "" || sid == "" {
+		return errors.Unauthorized("")
+	}
+	// impersonation tokens belong to a session of the acting staff member
+	actorID, impersonated := actorOf(claims)
+	owner := id
+	if impersonated {
+		if actorID == "" {
+			return errors.Unauthorized("")
+		}
+		owner = actorID
+	}
+	if err := sessions.ValidateSession(c.Request.Context(), owner, sid); err != nil {
+		return err
+	}
+	role, _ := claims["role"].(string)
+	user := entity.User{
+		ID:       id,
+		Username: claims["name"].(string),
+		Role:     role,
+	}
+	var ctx context.Context
+	if impersonated {
+		ctx = withIdentity(c.Request.Context(), impersonation{user, actorID})
+	} else {
+		ctx = withIdentity(c.Request.Context(), user)
+	}
+	ctx = withSession(ctx, sid)
+	if mfa, _ := claims["mfa"].(bool); mfa && !impersonated {
+		ctx = withMFA(ctx)
+	}
 	c.Request = c.Request.WithContext(ctx)
 	return nil
 }
 
+// RequireRole returns a middleware which only lets through authenticated users having one of the given roles.
+// Administrators must moreover have logged in with two-factor authentication.
+// It must be used after the authentication middleware.
+func RequireRole(roles ...string) routing.Handler {
+	return func(c *routing.Context) error {
+		return CheckRole(c.Request.Context(), roles...)
+	}
+}
+
+// CheckRole returns an error unless the user in the given context has one of the given roles, like RequireRole
+// does for routes. It lets services check roles themselves when what users may do depends on the resource.
+func CheckRole(ctx context.Context, roles ...string) error {
+	identity := CurrentUser(ctx)
+	if identity == nil {
+		return errors.Unauthorized("")
+	}
+	for _, role := range roles {
+		if identity.GetRole() != role {
+			continue
+		}
+		if role == entity.RoleAdmin && !authenticatedWithMFA(ctx) {
+			return errors.Forbidden("Two-factor authentication is required for staff accounts.")
+		}
+		return nil
+	}
+	return errors.Forbidden("")
+}
+
+// ByUser identifies clients by the ID of the authenticated user, for rate limiting purposes.
+// It must be used after the authentication middleware. Anonymous requests are not identified.
+func ByUser(c *routing.Context) string {
+	if identity := CurrentUser(c.Request.Context()); identity != nil {
+		return identity.GetID()
+	}
+	return ""
+}
+
 type contextKey int
 
 const (
 	userKey contextKey = iota
+	mfaKey
+	apiKeyKey
+	sessionKey
+	clientKey
 )
 
 // WithUser returns a context that contains the user identity from the given JWT.
 func WithUser(ctx context.Context, id, name string) context.Context {
-	return context.WithValue(ctx, userKey, entity.User{ID: id, Username: name})
+	return withIdentity(ctx, entity.User{ID: id, Username: name})
+}
+
+// withIdentity returns a context that contains the given user identity, which log messages then record.
+func withIdentity(ctx context.Context, identity Identity) context.Context {
+	return log.WithIdentity(context.WithValue(ctx, userKey, identity), identity)
+}
+
+// withMFA returns a context telling that the user authenticated with a second factor.
+func withMFA(ctx context.Context) context.Context {
+	return context.WithValue(ctx, mfaKey, true)
+}
+
+// authenticatedWithMFA tells whether the user in the given context authenticated with a second factor.
+func authenticatedWithMFA(ctx context.Context) bool {
+	mfa, _ := ctx.Value(mfaKey).(bool)
+	return mfa
+}
+
+// CurrentAPIKey returns the API key the request in the given context was authenticated with.
+// Nil is returned if the request was not authenticated with an API key.
+func CurrentAPIKey(ctx context.Context) *entity.APIKey {
+	if key, ok := ctx.Value(apiKeyKey).(entity.APIKey); ok {
+		return &key
+	}
+	return nil
 }
 
 // CurrentUser returns the user identity from the given context.
 // Nil is returned if no user identity is found in the context.
 func CurrentUser(ctx context.Context) Identity {
-	if user, ok := ctx.Value(userKey).(entity.User); ok {
-		return user
+	if identity, ok := ctx.Value(userKey).(Identity); ok {
+		return identity
 	}
 	return nil
 }
@@ -49,19 +269,71 @@ func CurrentUser(ctx context.Context) Identity {
 // MockAuthHandler creates a mock authentication middleware for testing purpose.
 // If the request contains an Authorization header whose value is "TEST", then
 // it considers the user is authenticated as "Tester" whose ID is "100".
+// If the value is "ADMIN", the user is authenticated as the administrator "Admin" whose ID is "1",
+// with two-factor authentication. If the value is "IMPERSONATE", "Admin" is impersonating "Tester", and if it is
+// "APIKEY", "Tester" is authenticated with an API key restricted to the products:read scope.
 // It fails the authentication otherwise.
 func MockAuthHandler(c *routing.Context) error {
-	if c.Request.Header.Get("Authorization") != "TEST" {
+	var identity Identity
+	user := entity.User{ID: "100", Username: "Tester", Role: entity.RoleCustomer}
+	switch c.Request.Header.Get("Authorization") {
+	case "TEST":
+		identity = user
+	case "ADMIN":
+		user = entity.User{ID: "1", Username: "Admin", Role: entity.RoleAdmin}
+		identity = user
+	case "IMPERSONATE":
+		identity = impersonation{user, "1"}
+	case "APIKEY":
+		identity = user
+		ctx := context.WithValue(c.Request.Context(), apiKeyKey, entity.APIKey{ID: "key", OwnerID: user.ID, Scopes: ScopeProductsRead})
+		c.Request = c.Request.WithContext(ctx)
+	default:
 		return errors.Unauthorized("")
 	}
-	ctx := WithUser(c.Request.Context(), "100", "Tester")
+	ctx := withIdentity(c.Request.Context(), identity)
+	if user.Role == entity.RoleAdmin {
+		ctx = withMFA(ctx)
+	}
 	c.Request = c.Request.WithContext(ctx)
 	return nil
 }
 
+// MockRouteGroups returns the public and protected route groups of the given group, authenticating requests
+// with MockAuthHandler, optionally for the public group.
+func MockRouteGroups(rg *routing.RouteGroup) (*routing.RouteGroup, *routing.RouteGroup) {
+	public, protected := rg.Group(""), rg.Group("")
+	public.Use(Optional(MockAuthHandler))
+	protected.Use(MockAuthHandler)
+	return public, protected
+}
+
 // MockAuthHeader returns an HTTP header that can pass the authentication check by MockAuthHandler.
 func MockAuthHeader() http.Header {
 	header := http.Header{}
 	header.Add("Authorization", "TEST")
 	return header
 }
+
+// MockAdminAuthHeader returns an HTTP header that passes the authentication check by MockAuthHandler as an administrator.
+func MockAdminAuthHeader() http.Header {
+	header := http.Header{}
+	header.Add("Authorization", "ADMIN")
+	return header
+}
+
+// MockImpersonationAuthHeader returns an HTTP header that passes the authentication check by MockAuthHandler
+// as the administrator impersonating "Tester".
+func MockImpersonationAuthHeader() http.Header {
+	header := http.Header{}
+	header.Add("Authorization", "IMPERSONATE")
+	return header
+}
+
+// MockAPIKeyAuthHeader returns an HTTP header that passes the authentication check by MockAuthHandler
+// as "Tester" using an API key restricted to the products:read scope.
+func MockAPIKeyAuthHeader() http.Header {
+	header := http.Header{}
+	header.Add("Authorization", "APIKEY")
+	return header
+}
@@ -3,6 +3,9 @@ package auth
 import (
 	"context"
 	"github.com/dgrijalva/jwt-go"
+	routing "github.com/go-ozzo/ozzo-routing/v2"
+	"github.com/online-shop/internal/entity"
+	"github.com/online-shop/internal/errors"
 	"github.com/online-shop/internal/test"
 	"github.com/stretchr/testify/assert"
 	"net/http"
@@ -20,11 +23,54 @@ func TestCurrentUser(t *testing.T) {
 	}
 }
 
+// mockSessions maps the IDs of active sessions to the IDs of their users.
+type mockSessions map[string]string
+
+func (m mockSessions) ValidateSession(ctx context.Context, userID, sessionID string) error {
+	if id, ok := m[sessionID]; ok && id == userID {
+		return nil
+	}
+	return errors.Unauthorized("")
+}
+
 func TestHandler(t *testing.T) {
-	assert.NotNil(t, Handler("test"))
+	keys := newTestKeys(t)
+	handler := Handler(keys, mockSessions{"s1": "100"})
+	signed, _ := keys.Sign(jwt.MapClaims{"id": "100", "name": "test", "role": entity.RoleCustomer, "sid": "s1"})
+
+	req, _ := http.NewRequest("GET", "http://example.com", nil)
+	req.Header.Set("Authorization", "Bearer "+signed)
+	ctx, _ := test.MockRoutingContext(req)
+	assert.Nil(t, handler(ctx))
+	assert.Equal(t, "100", CurrentUser(ctx.Request.Context()).GetID())
+	assert.Equal(t, "s1", currentSession(ctx.Request.Context()))
+
+	// tokens of terminated sessions are refused
+	revoked, _ := keys.Sign(jwt.MapClaims{"id": "100", "name": "test", "sid": "s2"})
+	req.Header.Set("Authorization", "Bearer "+revoked)
+	ctx, _ = test.MockRoutingContext(req)
+	err := handler(ctx)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, http.StatusUnauthorized, err.(routing.HTTPError).StatusCode())
+	}
+
+	// tokens signed by a key which is not in the set are refused
+	other, _ := newTestKeys(t).Sign(jwt.MapClaims{"id": "100", "name": "test", "sid": "s1"})
+	req.Header.Set("Authorization", "Bearer "+other)
+	ctx, res := test.MockRoutingContext(req)
+	err = handler(ctx)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, http.StatusUnauthorized, err.(routing.HTTPError).StatusCode())
+	}
+	assert.NotEmpty(t, res.Header().Get("WWW-Authenticate"))
+
+	req.Header.Del("Authorization")
+	ctx, _ = test.MockRoutingContext(req)
+	assert.NotNil(t, handler(ctx))
 }
 
 func Test_handleToken(t *testing.T) {
+	sessions := mockSessions{"s1": "100", "s2": "1"}
 	req, _ := http.NewRequest("GET", "http://example.com", nil)
 	ctx, _ := test.MockRoutingContext(req)
 	assert.Nil(t, CurrentUser(ctx.Request.Context()))
@@ -33,16 +79,118 @@ func Test_handleToken(t *testing.T) {
 		Claims: jwt.MapClaims{
 			"id":   "100",
 			"name": "test",
+			"sid":  "s1",
 		},
-	})
+	}, sessions)
 	assert.Nil(t, err)
 	identity := CurrentUser(ctx.Request.Context())
 	if assert.NotNil(t, identity) {
 		assert.Equal(t, "100", identity.GetID())
 		assert.Equal(t, "test", identity.GetUsername())
+		assert.Empty(t, identity.GetRole())
+	}
+
+	err = handleToken(ctx, &jwt.Token{
+		Claims: jwt.MapClaims{
+			"id":   "1",
+			"name": "admin",
+			"role": entity.RoleAdmin,
+			"sid":  "s2",
+		},
+	}, sessions)
+	assert.Nil(t, err)
+	assert.Equal(t, entity.RoleAdmin, CurrentUser(ctx.Request.Context()).GetRole())
+	assert.False(t, authenticatedWithMFA(ctx.Request.Context()))
+
+	ctx, _ = test.MockRoutingContext(req)
+	err = handleToken(ctx, &jwt.Token{
+		Claims: jwt.MapClaims{
+			"id":   "1",
+			"name": "admin",
+			"role": entity.RoleAdmin,
+			"mfa":  true,
+			"sid":  "s2",
+		},
+	}, sessions)
+	assert.Nil(t, err)
+	assert.True(t, authenticatedWithMFA(ctx.Request.Context()))
+
+	// MFA challenge tokens do not authenticate requests
+	ctx, _ = test.MockRoutingContext(req)
+	err = handleToken(ctx, &jwt.Token{
+		Claims: jwt.MapClaims{
+			"id":      "1",
+			"purpose": mfaTokenPurpose,
+		},
+	}, sessions)
+	assert.Equal(t, http.StatusUnauthorized, err.(errors.ErrorResponse).Status)
+	assert.Nil(t, CurrentUser(ctx.Request.Context()))
+
+	// tokens without session, or whose session belongs to another user, are refused
+	for _, claims := range []jwt.MapClaims{
+		{"id": "100", "name": "test"},
+		{"id": "100", "name": "test", "sid": "s2"},
+	} {
+		ctx, _ = test.MockRoutingContext(req)
+		err = handleToken(ctx, &jwt.Token{Claims: claims}, sessions)
+		assert.Equal(t, http.StatusUnauthorized, err.(errors.ErrorResponse).Status)
+		assert.Nil(t, CurrentUser(ctx.Request.Context()))
 	}
 }
 
+func TestRequireRole(t *testing.T) {
+	handler := RequireRole(entity.RoleAdmin)
+
+	req, _ := http.NewRequest("GET", "http://example.com", nil)
+	ctx, _ := test.MockRoutingContext(req)
+	assert.Equal(t, http.StatusUnauthorized, handler(ctx).(errors.ErrorResponse).Status)
+
+	req.Header = MockAuthHeader()
+	ctx, _ = test.MockRoutingContext(req)
+	assert.Nil(t, MockAuthHandler(ctx))
+	assert.Equal(t, http.StatusForbidden, handler(ctx).(errors.ErrorResponse).Status)
+
+	req.Header = MockAdminAuthHeader()
+	ctx, _ = test.MockRoutingContext(req)
+	assert.Nil(t, MockAuthHandler(ctx))
+	assert.Nil(t, handler(ctx))
+
+	// administrators must have logged in with a second factor
+	ctx, _ = test.MockRoutingContext(req)
+	ctx.Request = ctx.Request.WithContext(withIdentity(ctx.Request.Context(), entity.User{ID: "1", Role: entity.RoleAdmin}))
+	assert.Equal(t, http.StatusForbidden, handler(ctx).(errors.ErrorResponse).Status)
+}
+
+func TestOptional(t *testing.T) {
+	handler := Optional(MockAuthHandler)
+
+	req, _ := http.NewRequest("GET", "http://example.com", nil)
+	ctx, _ := test.MockRoutingContext(req)
+	assert.Nil(t, handler(ctx))
+	assert.Nil(t, CurrentUser(ctx.Request.Context()))
+
+	req.Header = MockAuthHeader()
+	ctx, _ = test.MockRoutingContext(req)
+	assert.Nil(t, handler(ctx))
+	assert.Equal(t, "100", CurrentUser(ctx.Request.Context()).GetID())
+
+	// invalid credentials are refused rather than ignored
+	req.Header = http.Header{"X-Api-Key": {"unknown"}}
+	ctx, _ = test.MockRoutingContext(req)
+	assert.NotNil(t, handler(ctx))
+}
+
+func TestByUser(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://example.com", nil)
+	ctx, _ := test.MockRoutingContext(req)
+	assert.Empty(t, ByUser(ctx))
+
+	req.Header = MockAuthHeader()
+	ctx, _ = test.MockRoutingContext(req)
+	assert.Nil(t, MockAuthHandler(ctx))
+	assert.Equal(t, "100", ByUser(ctx))
+}
+
 func TestMocks(t *testing.T) {
 	req, _ := http.NewRequest("GET", "http://example.com", nil)
 	ctx, _ := test.MockRoutingContext(req)
@@ -0,0 +1,276 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	stderrors "errors"
+	"github.com/dgrijalva/jwt-go"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/online-shop/internal/entity"
+	"github.com/online-shop/internal/errors"
+	"github.com/online-shop/pkg/mysql"
+	"github.com/online-shop/pkg/oidc"
+	"github.com/online-shop/pkg/tracing"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// oidcStateExpiration is how long a user has to log in at the identity provider.
+	oidcStateExpiration = 10 * time.Minute
+	// oidcStatePurpose tells OIDC state tokens apart from the tokens authenticating requests.
+	oidcStatePurpose = "oidc"
+	// maxUsernameAttempts is how many random usernames are tried for a new user before giving up.
+	maxUsernameAttempts = 3
+)
+
+// usernameUnsafe matches the characters of email addresses which usernames cannot contain.
+var usernameUnsafe = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+// IdentityProvider authenticates users on behalf of the shop with the OpenID Connect authorization code flow.
+// It is implemented by oidc.Client.
+type IdentityProvider interface {
+	// AuthCodeURL returns the URL to send users to, in order to log in at the provider.
+	AuthCodeURL(ctx context.Context, state, nonce, challenge string) (string, error)
+	// Exchange trades an authorization code for the verified claims of an ID token carrying the given nonce.
+	Exchange(ctx context.Context, code, verifier, nonce string) (oidc.Claims, error)
+}
+
+// OIDCLogin is a login started with an external identity provider.
+type OIDCLogin struct {
+	// URL is where to send the user to log in at the provider.
+	URL string
+	// StateToken holds the secrets of the login until the user comes back. It must be kept by the user agent,
+	// typically in a cookie, and never be sent to the provider.
+	StateToken string
+}
+
+// OIDCCallbackRequest represents the return of a user from an external identity provider.
+type OIDCCallbackRequest struct {
+	Provider   string
+	Code       string
+	State      string
+	StateToken string
+	// Error is the error reported by the provider, if the login failed there.
+	Error string
+}
+
+// Validate validates the OIDCCallbackRequest fields.
+func (r OIDCCallbackRequest) Validate() error {
+	return validation.ValidateStruct(&r,
+		validation.Field(&r.Code, validation.Required.When(r.Error == "")),
+		validation.Field(&r.State, validation.Required),
+		validation.Field(&r.StateToken, validation.Required.Error("the login was not started from this browser or has expired")),
+	)
+}
+
+// errOIDCLoginFailed reports a login which could not be completed with the identity provider.
+var errOIDCLoginFailed = errors.Unauthorized("The login with the identity provider failed.")
+
+// oidcState are the secrets of an OIDC login in progress.
+type oidcState struct {
+	Provider string `json:"provider"`
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	Purpose  string `json:"purpose"`
+	jwt.StandardClaims
+}
+
+// StartOIDCLogin starts a login with an external identity provider, returning where to send the user
+// along with a state token to keep until they come back.
+func (s service) StartOIDCLogin(ctx context.Context, provider string) (OIDCLogin, error) {
+	ctx, span := tracing.StartSpan(ctx, "auth.Service.StartOIDCLogin")
+	defer span.End()
+
+	p, ok := s.providers[provider]
+	if !ok {
+		return OIDCLogin{}, errors.NotFound("")
+	}
+	state := oidcState{
+		Provider:       provider,
+		Purpose:        oidcStatePurpose,
+		StandardClaims: jwt.StandardClaims{ExpiresAt: time.Now().Add(oidcStateExpiration).Unix()},
+	}
+	for _, v := range []*string{&state.State, &state.Nonce, &state.Verifier} {
+		var err error
+		if *v, err = oidc.NewVerifier(); err != nil {
+			return OIDCLogin{}, err
+		}
+	}
+
+	url, err := p.AuthCodeURL(ctx, state.State, state.Nonce, oidc.Challenge(state.Verifier))
+	if err != nil {
+		return OIDCLogin{}, err
+	}
+	token, err := s.keys.Sign(state)
+	if err != nil {
+		return OIDCLogin{}, err
+	}
+	return OIDCLogin{URL: url, StateToken: token}, nil
+}
+
+// LoginOIDC completes a login with an external identity provider. The user is the one the provider identity
+// is linked to; otherwise the identity is linked to the user having the same verified email address, or to a new user.
+func (s service) LoginOIDC(ctx context.Context, input OIDCCallbackRequest) (LoginResult, error) {
+	ctx, span := tracing.StartSpan(ctx, "auth.Service.LoginOIDC")
+	defer span.End()
+
+	logger := s.logger.With(ctx, "provider", input.Provider)
+	p, ok := s.providers[input.Provider]
+	if !ok {
+		return LoginResult{}, errors.NotFound("")
+	}
+	state, err := s.parseOIDCState(input.StateToken)
+	if err != nil || state.Provider != input.Provider || subtle.ConstantTimeCompare([]byte(state.State), []byte(input.State)) != 1 {
+		loginFailures.WithLabelValues("oidc_state").Inc()
+		logger.Infof("OIDC login refused: invalid state")
+		return LoginResult{}, errOIDCLoginFailed
+	}
+	if input.Error != "" {
+		loginFailures.WithLabelValues("oidc_denied").Inc()
+		logger.Infof("OIDC login refused by provider: %s", input.Error)
+		return LoginResult{}, errOIDCLoginFailed
+	}
+
+	claims, err := p.Exchange(ctx, input.Code, state.Verifier, state.Nonce)
+	if err != nil {
+		loginFailures.WithLabelValues("oidc_exchange").Inc()
+		logger.Infof("OIDC login failed: %v", err)
+		return LoginResult{}, errOIDCLoginFailed
+	}
+	user, err := s.oidcUser(ctx, input.Provider, claims)
+	if err != nil {
+		return LoginResult{}, err
+	}
+	logger.With(ctx, "user", user.Username).Infof("authentication successful")
+	return s.finishLogin(ctx, user, entity.User{ID: user.ID, Username: user.Username, Role: user.Role})
+}
+
+// oidcUser returns the user a provider identity belongs to, linking it first if needed.
+func (s service) oidcUser(ctx context.Context, provider string, claims oidc.Claims) (entity.User, error) {
+	identity, err := s.repo.GetIdentity(ctx, provider, claims.Subject)
+	if err == nil {
+		user, err := s.repo.Get(ctx, identity.UserID)
+		if stderrors.Is(err, sql.ErrNoRows) {
+			// the account was deleted
+			return entity.User{}, errOIDCLoginFailed
+		}
+		return user, err
+	}
+	if !stderrors.Is(err, sql.ErrNoRows) {
+		return entity.User{}, err
+	}
+	if claims.Email == "" {
+		return entity.User{}, errors.BadRequest("The identity provider did not share your email address.")
+	}
+
+	user, err := s.repo.FindByEmail(ctx, claims.Email)
+	switch {
+	case err == nil:
+		// someone could have registered with the address of the user, or the provider may let anyone claim any address:
+		// both sides must have verified the address before the accounts are linked
+		if !claims.EmailVerified || !user.EmailVerified || user.Role == entity.RoleService {
+			return entity.User{}, errors.Conflict("An account already uses this email address. "+
+				"Log in with your password and verify your email address to link it.", "email")
+		}
+	case stderrors.Is(err, sql.ErrNoRows):
+		if user, err = s.createOIDCUser(ctx, claims); err != nil {
+			return entity.User{}, err
+		}
+	default:
+		return entity.User{}, err
+	}
+
+	identity = entity.UserIdentity{
+		Provider:  provider,
+		Subject:   claims.Subject,
+		UserID:    user.ID,
+		Email:     claims.Email,
+		CreatedAt: time.Now(),
+	}
+	if err := s.repo.CreateIdentity(ctx, identity); err != nil {
+		return entity.User{}, err
+	}
+	s.logger.With(ctx, "user", user.Username, "provider", provider).Infof("identity linked")
+	return user, nil
+}
+
+// createOIDCUser creates a user for a provider identity. The user has no password, and gets a username
+// derived from their email address.
+func (s service) createOIDCUser(ctx context.Context, claims oidc.Claims) (entity.User, error) {
+	user := entity.User{
+		ID:            entity.GenerateID(),
+		FullName:      claims.Name,
+		Email:         claims.Email,
+		EmailVerified: claims.EmailVerified,
+		Role:          entity.RoleCustomer,
+	}
+	for i := 0; ; i++ {
+		username, err := newUsername(claims.Email)
+		if err != nil {
+			return entity.User{}, err
+		}
+		user.Username = username
+		err = s.repo.CreateUser(ctx, user)
+		if err == nil {
+			break
+		}
+		dbErr := mysql.Classify(err)
+		if dbErr == nil || dbErr.Kind != mysql.DuplicateKey {
+			return entity.User{}, err
+		}
+		if dbErr.Key != "uq_user_username" || i+1 == maxUsernameAttempts {
+			return entity.User{}, errors.Conflict("", uniqueUserFields[dbErr.Key])
+		}
+	}
+	// the user row only has the columns of a registration, the verification status is set apart
+	if user.EmailVerified {
+		if err := s.repo.Update(ctx, user); err != nil {
+			return entity.User{}, err
+		}
+	}
+	s.logger.With(ctx, "user", user.Username).Infof("user created from identity provider")
+	return user, nil
+}
+
+// newUsername derives a username from an email address, with a random suffix as the local part may well be taken.
+func newUsername(email string) (string, error) {
+	name := usernameUnsafe.ReplaceAllString(strings.SplitN(email, "@", 2)[0], "")
+	if len(name) > 20 {
+		name = name[:20]
+	}
+	if len(name) < 3 {
+		name = "user"
+	}
+	suffix := make([]byte, 3)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	return name + "-" + hex.EncodeToString(suffix), nil
+}
+
+// parseOIDCState verifies an OIDC state token and returns the secrets of the login it holds.
+func (s service) parseOIDCState(tokenString string) (oidcState, error) {
+	var state oidcState
+	token, err := s.keys.Parse(tokenString)
+	if err != nil {
+		return state, err
+	}
+	claims := token.Claims.(jwt.MapClaims)
+	if claims["purpose"] != oidcStatePurpose {
+		return state, stderrors.New("not an OIDC state token")
+	}
+	state.Provider, _ = claims["provider"].(string)
+	state.State, _ = claims["state"].(string)
+	state.Nonce, _ = claims["nonce"].(string)
+	state.Verifier, _ = claims["verifier"].(string)
+	if state.State == "" || state.Nonce == "" || state.Verifier == "" {
+		return state, stderrors.New("incomplete OIDC state token")
+	}
+	return state, nil
+}
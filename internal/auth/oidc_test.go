@@ -0,0 +1,205 @@
+package auth
+
+import (
+	"context"
+	routing "github.com/go-ozzo/ozzo-routing/v2"
+	"github.com/online-shop/internal/entity"
+	"github.com/online-shop/internal/errors"
+	"github.com/online-shop/internal/test"
+	"github.com/online-shop/pkg/log"
+	"github.com/online-shop/pkg/mailer"
+	"github.com/online-shop/pkg/oidc"
+	"github.com/online-shop/pkg/oidc/oidctest"
+	"github.com/online-shop/pkg/password"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// newOIDCTestService creates a service whose users can log in with the given provider, named "test".
+func newOIDCTestService(t *testing.T, provider *oidctest.Provider) (Service, *mockRepository) {
+	logger, _ := log.NewForTest()
+	repo := newMockRepository(t, entity.User{ID: "100", Username: "demo", Email: "demo@example.com", EmailVerified: true, Role: entity.RoleCustomer}, "pass")
+	client := oidc.NewClient(oidc.Config{
+		Issuer:       provider.Issuer(),
+		ClientID:     provider.ClientID,
+		ClientSecret: provider.ClientSecret,
+		RedirectURL:  "https://shop.test/v1/oidc/test/callback",
+	}, provider.Client())
+	s := NewService(repo, newTestKeys(t), 100, mailer.NewMemoryMailer(""), "https://shop.test", false, newTestHasher(), password.DefaultPolicy,
+		map[string]IdentityProvider{"test": client}, logger)
+	return s, repo
+}
+
+// loginOIDC runs the whole OIDC login of the user the provider currently authenticates.
+func loginOIDC(t *testing.T, s Service, provider *oidctest.Provider) (LoginResult, error) {
+	login, err := s.StartOIDCLogin(context.Background(), "test")
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	callback, err := provider.Authorize(login.URL)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	return s.LoginOIDC(context.Background(), OIDCCallbackRequest{
+		Provider:   "test",
+		Code:       callback.Get("code"),
+		State:      callback.Get("state"),
+		StateToken: login.StateToken,
+		Error:      callback.Get("error"),
+	})
+}
+
+func TestService_LoginOIDC_newUser(t *testing.T) {
+	provider := oidctest.NewProvider("shop", "s3cret")
+	defer provider.Close()
+	s, repo := newOIDCTestService(t, provider)
+	provider.Login(oidctest.User{Subject: "u1", Email: "new.user+shop@example.com", EmailVerified: true, Name: "New User"})
+
+	result, err := loginOIDC(t, s, provider)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, result.Token)
+	if assert.Len(t, repo.identities, 1) {
+		user := repo.users[repo.identities[0].UserID]
+		assert.Equal(t, "New User", user.FullName)
+		assert.True(t, user.EmailVerified)
+		assert.Empty(t, user.Password)
+		assert.True(t, strings.HasPrefix(user.Username, "new.usershop-"), user.Username)
+		assert.Equal(t, entity.RoleCustomer, user.Role)
+	}
+
+	// the next login finds the linked user
+	_, err = loginOIDC(t, s, provider)
+	assert.Nil(t, err)
+	assert.Len(t, repo.users, 2)
+	assert.Len(t, repo.identities, 1)
+
+	// users without password cannot log in with one
+	_, err = s.Login(context.Background(), repo.users[repo.identities[0].UserID].Username, "")
+	assert.Equal(t, errors.Unauthorized(""), err)
+}
+
+func TestService_LoginOIDC_linking(t *testing.T) {
+	provider := oidctest.NewProvider("shop", "s3cret")
+	defer provider.Close()
+	s, repo := newOIDCTestService(t, provider)
+
+	// an address the provider did not verify does not take over an account
+	provider.Login(oidctest.User{Subject: "u1", Email: "demo@example.com"})
+	_, err := loginOIDC(t, s, provider)
+	assert.Equal(t, http.StatusConflict, err.(errors.ErrorResponse).Status)
+	assert.Empty(t, repo.identities)
+
+	// nor does an account whose address was not verified
+	user := repo.users["100"]
+	user.EmailVerified = false
+	repo.users["100"] = user
+	provider.Login(oidctest.User{Subject: "u1", Email: "demo@example.com", EmailVerified: true})
+	_, err = loginOIDC(t, s, provider)
+	assert.Equal(t, http.StatusConflict, err.(errors.ErrorResponse).Status)
+
+	user.EmailVerified = true
+	repo.users["100"] = user
+	_, err = loginOIDC(t, s, provider)
+	assert.Nil(t, err)
+	if assert.Len(t, repo.identities, 1) {
+		assert.Equal(t, entity.UserIdentity{Provider: "test", Subject: "u1", UserID: "100", Email: "demo@example.com",
+			CreatedAt: repo.identities[0].CreatedAt}, repo.identities[0])
+	}
+	assert.Len(t, repo.users, 1)
+}
+
+func TestService_LoginOIDC_mfa(t *testing.T) {
+	provider := oidctest.NewProvider("shop", "s3cret")
+	defer provider.Close()
+	s, repo := newOIDCTestService(t, provider)
+	user := repo.users["100"]
+	user.TOTPEnabled = true
+	repo.users["100"] = user
+
+	// the provider replaces the password, not the second factor
+	provider.Login(oidctest.User{Subject: "u1", Email: "demo@example.com", EmailVerified: true})
+	result, err := loginOIDC(t, s, provider)
+	assert.Nil(t, err)
+	assert.True(t, result.MFARequired)
+	assert.Empty(t, result.Token)
+}
+
+func TestService_LoginOIDC_invalid(t *testing.T) {
+	provider := oidctest.NewProvider("shop", "s3cret")
+	defer provider.Close()
+	s, _ := newOIDCTestService(t, provider)
+	ctx := context.Background()
+
+	_, err := s.StartOIDCLogin(ctx, "unknown")
+	assert.Equal(t, errors.NotFound(""), err)
+
+	// the provider denied the login
+	_, err = loginOIDC(t, s, provider)
+	assert.Equal(t, errOIDCLoginFailed, err)
+
+	provider.Login(oidctest.User{Subject: "u1", Email: "someone@example.com", EmailVerified: true})
+	login, _ := s.StartOIDCLogin(ctx, "test")
+	callback, _ := provider.Authorize(login.URL)
+	other, _ := s.StartOIDCLogin(ctx, "test")
+	// the state token must be the one of the login
+	_, err = s.LoginOIDC(ctx, OIDCCallbackRequest{Provider: "test", Code: callback.Get("code"), State: callback.Get("state"), StateToken: other.StateToken})
+	assert.Equal(t, errOIDCLoginFailed, err)
+	// access tokens are no state tokens
+	result, _ := s.Login(ctx, "demo", "pass")
+	_, err = s.LoginOIDC(ctx, OIDCCallbackRequest{Provider: "test", Code: callback.Get("code"), State: callback.Get("state"), StateToken: result.Token})
+	assert.Equal(t, errOIDCLoginFailed, err)
+
+	// OIDC state tokens do not authenticate requests
+	req, _ := http.NewRequest("GET", "http://example.com", nil)
+	req.Header.Set("Authorization", "Bearer "+login.StateToken)
+	c, _ := test.MockRoutingContext(req)
+	assert.NotNil(t, Handler(s.(service).keys, s)(c))
+}
+
+func TestAPI_oidc(t *testing.T) {
+	provider := oidctest.NewProvider("shop", "s3cret")
+	defer provider.Close()
+	s, _ := newOIDCTestService(t, provider)
+	provider.Login(oidctest.User{Subject: "u1", Email: "demo@example.com", EmailVerified: true})
+	logger, _ := log.NewForTest()
+	router := test.MockRouter(logger)
+	noLimit := func(c *routing.Context) error { return nil }
+	RegisterHandlers(router.Group("/v1"), s, MockAuthHandler, noLimit, logger)
+
+	req, _ := http.NewRequest("GET", "/v1/oidc/test/login", nil)
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusFound, res.Code)
+	cookies := res.Result().Cookies()
+	if !assert.Len(t, cookies, 1) {
+		return
+	}
+	assert.Equal(t, oidcStateCookie, cookies[0].Name)
+	assert.Equal(t, "/v1/oidc/test", cookies[0].Path)
+	assert.True(t, cookies[0].HttpOnly)
+	callback, err := provider.Authorize(res.Header().Get("Location"))
+	assert.Nil(t, err)
+
+	callbackURL := "/v1/oidc/test/callback?" + url.Values{"code": {callback.Get("code")}, "state": {callback.Get("state")}}.Encode()
+	test.Endpoint(t, router, test.APITestCase{
+		Name: "no state cookie", Method: "GET", URL: callbackURL, WantStatus: http.StatusBadRequest,
+	})
+
+	req, _ = http.NewRequest("GET", callbackURL, nil)
+	req.AddCookie(cookies[0])
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Contains(t, res.Body.String(), `"token":`)
+	if cleared := res.Result().Cookies(); assert.Len(t, cleared, 1) {
+		assert.Equal(t, -1, cleared[0].MaxAge)
+	}
+
+	test.Endpoint(t, router, test.APITestCase{
+		Name: "unknown provider", Method: "GET", URL: "/v1/oidc/other/login", WantStatus: http.StatusNotFound,
+	})
+}
@@ -0,0 +1,233 @@
+package auth
+
+import (
+	"context"
+	stderrors "errors"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/go-ozzo/ozzo-validation/v4/is"
+	"github.com/online-shop/internal/entity"
+	"github.com/online-shop/internal/errors"
+	"github.com/online-shop/pkg/mysql"
+	"github.com/online-shop/pkg/tracing"
+	"time"
+)
+
+// Profile is the account information a user can see and edit about themselves.
+type Profile struct {
+	ID            string `json:"id"`
+	Username      string `json:"username"`
+	FullName      string `json:"fullname"`
+	Phone         string `json:"phone"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Role          string `json:"role"`
+	// TwoFactor tells whether the user logs in with a second factor.
+	TwoFactor bool `json:"two_factor"`
+}
+
+// newProfile creates the profile of the given user.
+func newProfile(user entity.User) Profile {
+	return Profile{
+		ID:            user.ID,
+		Username:      user.Username,
+		FullName:      user.FullName,
+		Phone:         user.Phone,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified,
+		Role:          user.Role,
+		TwoFactor:     user.TOTPEnabled,
+	}
+}
+
+// UpdateProfileRequest represents a partial update of the profile. Omitted fields are left unchanged.
+type UpdateProfileRequest struct {
+	FullName *string `json:"fullname"`
+	Phone    *string `json:"phone"`
+}
+
+// Validate validates the UpdateProfileRequest fields.
+func (r UpdateProfileRequest) Validate() error {
+	return validation.ValidateStruct(&r,
+		validation.Field(&r.FullName, validation.NilOrNotEmpty, validation.Length(0, 100)),
+		validation.Field(&r.Phone, validation.Match(phoneFormat).Error("must be a valid phone number")),
+	)
+}
+
+// ChangePasswordRequest represents a password change.
+type ChangePasswordRequest struct {
+	OldPassword string `json:"old_password"`
+	NewPassword string `json:"new_password"`
+}
+
+// Validate validates the ChangePasswordRequest fields.
+func (r ChangePasswordRequest) Validate() error {
+	return validation.ValidateStruct(&r,
+		validation.Field(&r.OldPassword, validation.Required),
+		validation.Field(&r.NewPassword, passwordRules...),
+	)
+}
+
+// ChangeEmailRequest represents an email address change. It must be confirmed with the current password.
+type ChangeEmailRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+// Validate validates the ChangeEmailRequest fields.
+func (r ChangeEmailRequest) Validate() error {
+	return validation.ValidateStruct(&r,
+		validation.Field(&r.Email, validation.Required, validation.Length(0, 254), is.Email),
+		validation.Field(&r.Password, validation.Required),
+	)
+}
+
+// DeleteAccountRequest represents an account deletion. It must be confirmed with the current password.
+type DeleteAccountRequest struct {
+	Password string `json:"password"`
+}
+
+// Validate validates the DeleteAccountRequest fields.
+func (r DeleteAccountRequest) Validate() error {
+	return validation.ValidateStruct(&r,
+		validation.Field(&r.Password, validation.Required),
+	)
+}
+
+// errIncorrectPassword reports that the password confirming a sensitive change is wrong.
+func errIncorrectPassword(field string) error {
+	return validation.Errors{field: stderrors.New("is incorrect")}
+}
+
+// currentUser loads the user authenticated in the given context.
+func (s service) currentUser(ctx context.Context) (entity.User, error) {
+	identity := CurrentUser(ctx)
+	if identity == nil {
+		return entity.User{}, errors.Unauthorized("")
+	}
+	return s.repo.Get(ctx, identity.GetID())
+}
+
+// GetProfile returns the profile of the current user.
+func (s service) GetProfile(ctx context.Context) (Profile, error) {
+	ctx, span := tracing.StartSpan(ctx, "auth.Service.GetProfile")
+	defer span.End()
+
+	user, err := s.currentUser(ctx)
+	if err != nil {
+		return Profile{}, err
+	}
+	return newProfile(user), nil
+}
+
+// UpdateProfile updates the full name and/or phone number of the current user.
+func (s service) UpdateProfile(ctx context.Context, input UpdateProfileRequest) (Profile, error) {
+	ctx, span := tracing.StartSpan(ctx, "auth.Service.UpdateProfile")
+	defer span.End()
+
+	user, err := s.currentUser(ctx)
+	if err != nil {
+		return Profile{}, err
+	}
+
+	if input.FullName != nil {
+		user.FullName = *input.FullName
+	}
+	if input.Phone != nil {
+		user.Phone = *input.Phone
+	}
+	if err := s.repo.Update(ctx, user); err != nil {
+		return Profile{}, err
+	}
+	return newProfile(user), nil
+}
+
+// ChangePassword replaces the password of the current user after checking the old one.
+func (s service) ChangePassword(ctx context.Context, input ChangePasswordRequest) error {
+	ctx, span := tracing.StartSpan(ctx, "auth.Service.ChangePassword")
+	defer span.End()
+
+	user, err := s.currentUser(ctx)
+	if err != nil {
+		return err
+	}
+	if err := s.verifyPassword(input.OldPassword, user.Password); err != nil {
+		return errIncorrectPassword("old_password")
+	}
+
+	hashedPassword, err := s.hashPassword("new_password", input.NewPassword)
+	if err != nil {
+		return err
+	}
+	user.Password = hashedPassword
+	if err := s.repo.Update(ctx, user); err != nil {
+		return err
+	}
+	s.logger.With(ctx, "user", user.Username).Infof("password changed")
+	// whoever knew the old password is logged out
+	return s.revokeOtherSessions(ctx, user)
+}
+
+// ChangeEmail replaces the email address of the current user after checking their password.
+// The new address is unverified until its owner proves they can receive mail there.
+func (s service) ChangeEmail(ctx context.Context, input ChangeEmailRequest) (Profile, error) {
+	ctx, span := tracing.StartSpan(ctx, "auth.Service.ChangeEmail")
+	defer span.End()
+
+	user, err := s.currentUser(ctx)
+	if err != nil {
+		return Profile{}, err
+	}
+	if err := s.verifyPassword(input.Password, user.Password); err != nil {
+		return Profile{}, errIncorrectPassword("password")
+	}
+	if input.Email == user.Email {
+		return newProfile(user), nil
+	}
+
+	user.Email = input.Email
+	user.EmailVerified = false
+	if err := s.repo.Update(ctx, user); err != nil {
+		if dbErr := mysql.Classify(err); dbErr != nil && dbErr.Kind == mysql.DuplicateKey {
+			return Profile{}, errors.Conflict("", uniqueUserFields[dbErr.Key])
+		}
+		return Profile{}, err
+	}
+	s.logger.With(ctx, "user", user.Username).Infof("email changed")
+	if err := s.sendVerificationEmail(ctx, user); err != nil {
+		s.logger.With(ctx, "user", user.Username).Errorf("failed to send verification email: %v", err)
+	}
+	return newProfile(user), nil
+}
+
+// DeleteAccount deletes the account of the current user after checking their password.
+// The user row is kept so that their orders stay intact for accounting, but every piece of
+// personally identifiable information is erased and the account can no longer log in.
+func (s service) DeleteAccount(ctx context.Context, input DeleteAccountRequest) error {
+	ctx, span := tracing.StartSpan(ctx, "auth.Service.DeleteAccount")
+	defer span.End()
+
+	user, err := s.currentUser(ctx)
+	if err != nil {
+		return err
+	}
+	if err := s.verifyPassword(input.Password, user.Password); err != nil {
+		return errIncorrectPassword("password")
+	}
+
+	now := time.Now()
+	anonymized := entity.User{
+		ID:        user.ID,
+		Username:  "deleted-" + user.ID,
+		Email:     "deleted-" + user.ID + "@deleted.invalid",
+		Role:      user.Role,
+		DeletedAt: &now,
+	}
+	if err := s.repo.Update(ctx, anonymized); err != nil {
+		return err
+	}
+	if err := s.repo.RevokeSessions(ctx, user.ID, "", now); err != nil {
+		return err
+	}
+	s.logger.With(ctx, "user", user.ID).Infof("account deleted")
+	return nil
+}
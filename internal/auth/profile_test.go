@@ -0,0 +1,101 @@
+package auth
+
+import (
+	"context"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/online-shop/internal/entity"
+	"github.com/online-shop/internal/errors"
+	"github.com/online-shop/pkg/log"
+	"github.com/online-shop/pkg/mailer"
+	"github.com/online-shop/pkg/password"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func newProfileTestService(t *testing.T) (Service, *mockRepository, context.Context) {
+	logger, _ := log.NewForTest()
+	repo := newMockRepository(t, entity.User{
+		ID:            "100",
+		Username:      "demo",
+		FullName:      "Demo User",
+		Email:         "demo@example.com",
+		EmailVerified: true,
+		Role:          entity.RoleCustomer,
+	}, "pass")
+	repo.users["200"] = entity.User{ID: "200", Username: "other", Email: "other@example.com"}
+	ctx := WithUser(context.Background(), "100", "demo")
+	return NewService(repo, newTestKeys(t), 100, mailer.NewMemoryMailer(""), "https://shop.test", false, newTestHasher(), password.DefaultPolicy, nil, logger), repo, ctx
+}
+
+func TestService_GetProfile(t *testing.T) {
+	s, _, ctx := newProfileTestService(t)
+
+	profile, err := s.GetProfile(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "demo", profile.Username)
+	assert.Equal(t, "demo@example.com", profile.Email)
+	assert.True(t, profile.EmailVerified)
+
+	_, err = s.GetProfile(context.Background())
+	assert.Equal(t, http.StatusUnauthorized, err.(errors.ErrorResponse).Status)
+}
+
+func TestService_UpdateProfile(t *testing.T) {
+	s, repo, ctx := newProfileTestService(t)
+
+	phone := "+6281234567890"
+	profile, err := s.UpdateProfile(ctx, UpdateProfileRequest{Phone: &phone})
+	assert.Nil(t, err)
+	assert.Equal(t, phone, profile.Phone)
+	assert.Equal(t, "Demo User", repo.users["100"].FullName)
+	assert.Equal(t, phone, repo.users["100"].Phone)
+}
+
+func TestService_ChangePassword(t *testing.T) {
+	s, repo, ctx := newProfileTestService(t)
+
+	err := s.ChangePassword(ctx, ChangePasswordRequest{OldPassword: "wrong", NewPassword: "secret123"})
+	assert.Contains(t, err.(validation.Errors), "old_password")
+
+	assert.Nil(t, s.ChangePassword(ctx, ChangePasswordRequest{OldPassword: "pass", NewPassword: "secret123"}))
+	assert.Nil(t, s.(service).verifyPassword("secret123", repo.users["100"].Password))
+}
+
+func TestService_ChangeEmail(t *testing.T) {
+	s, repo, ctx := newProfileTestService(t)
+
+	_, err := s.ChangeEmail(ctx, ChangeEmailRequest{Email: "new@example.com", Password: "wrong"})
+	assert.Contains(t, err.(validation.Errors), "password")
+
+	_, err = s.ChangeEmail(ctx, ChangeEmailRequest{Email: "other@example.com", Password: "pass"})
+	assert.Equal(t, errors.Conflict("", "email"), err)
+
+	profile, err := s.ChangeEmail(ctx, ChangeEmailRequest{Email: "new@example.com", Password: "pass"})
+	assert.Nil(t, err)
+	assert.Equal(t, "new@example.com", profile.Email)
+	assert.False(t, profile.EmailVerified)
+	assert.False(t, repo.users["100"].EmailVerified)
+}
+
+func TestService_DeleteAccount(t *testing.T) {
+	s, repo, ctx := newProfileTestService(t)
+
+	err := s.DeleteAccount(ctx, DeleteAccountRequest{Password: "wrong"})
+	assert.Contains(t, err.(validation.Errors), "password")
+
+	assert.Nil(t, s.DeleteAccount(ctx, DeleteAccountRequest{Password: "pass"}))
+	user := repo.users["100"]
+	assert.NotNil(t, user.DeletedAt)
+	assert.Equal(t, "deleted-100", user.Username)
+	assert.Empty(t, user.FullName)
+	assert.Empty(t, user.Password)
+	assert.NotContains(t, user.Email, "demo")
+}
+
+func TestUpdateProfileRequest_Validate(t *testing.T) {
+	empty, invalid := "", "call me"
+	assert.Nil(t, UpdateProfileRequest{}.Validate())
+	assert.Contains(t, UpdateProfileRequest{FullName: &empty}.Validate().(validation.Errors), "fullname")
+	assert.Contains(t, UpdateProfileRequest{Phone: &invalid}.Validate().(validation.Errors), "phone")
+}
@@ -2,15 +2,54 @@ package auth
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
 	"github.com/online-shop/internal/entity"
 	"github.com/online-shop/pkg/log"
 	"github.com/online-shop/pkg/mysql"
+	"time"
 )
 
 type Repository interface {
+	Get(ctx context.Context, id string) (entity.User, error)
 	CreateUser(ctx context.Context, user entity.User) error
 	FindByUsername(ctx context.Context, username string) (entity.User, error)
+	FindByEmail(ctx context.Context, email string) (entity.User, error)
+	Update(ctx context.Context, user entity.User) error
+	UpdateLoginAttempts(ctx context.Context, user entity.User) error
+	// AddFailedLogin increments the number of consecutive failed logins of a user, and returns it. The user stays
+	// locked until the end of the transaction, if any.
+	AddFailedLogin(ctx context.Context, id string) (int, error)
+	CreateToken(ctx context.Context, token entity.UserToken) error
+	// ConsumeToken marks the unused and unexpired token having the given hash and purpose as used, and returns it.
+	// It returns sql.ErrNoRows if there is no such token.
+	ConsumeToken(ctx context.Context, hash, purpose string, now time.Time) (entity.UserToken, error)
+	UpdateTOTP(ctx context.Context, user entity.User) error
+	// ReplaceRecoveryCodes replaces all the recovery codes of a user by the ones having the given hashes.
+	ReplaceRecoveryCodes(ctx context.Context, userID string, hashes []string) error
+	// UseRecoveryCode marks the unused recovery code of a user having the given hash as used.
+	// It returns sql.ErrNoRows if there is no such code.
+	UseRecoveryCode(ctx context.Context, userID, hash string, now time.Time) error
+	CreateAPIKey(ctx context.Context, key entity.APIKey) error
+	GetAPIKey(ctx context.Context, id string) (entity.APIKey, error)
+	FindAPIKeyByPrefix(ctx context.Context, prefix string) (entity.APIKey, error)
+	// ListAPIKeys returns the API keys of the given owner, newest first.
+	ListAPIKeys(ctx context.Context, ownerID string) ([]entity.APIKey, error)
+	RevokeAPIKey(ctx context.Context, id string, now time.Time) error
+	TouchAPIKey(ctx context.Context, id string, now time.Time) error
+	CreateSession(ctx context.Context, session entity.Session) error
+	GetSession(ctx context.Context, id string) (entity.Session, error)
+	// ListSessions returns the unrevoked and unexpired sessions of a user, most recently seen first.
+	ListSessions(ctx context.Context, userID string, now time.Time) ([]entity.Session, error)
+	RevokeSession(ctx context.Context, id string, now time.Time) error
+	// RevokeSessions revokes all the sessions of a user but the one having the given ID, which may be empty.
+	RevokeSessions(ctx context.Context, userID, exceptID string, now time.Time) error
+	TouchSession(ctx context.Context, id string, now time.Time) error
+	GetIdentity(ctx context.Context, provider, subject string) (entity.UserIdentity, error)
+	CreateIdentity(ctx context.Context, identity entity.UserIdentity) error
+	// Transaction runs fn in a transaction, which the repository calls made with the context given to fn are
+	// part of.
+	Transaction(ctx context.Context, fn func(ctx context.Context) error) error
 }
 
 // repository persists users in database
@@ -25,8 +64,8 @@ func NewRepository(db mysql.BaseRepository, logger log.Logger) Repository {
 }
 
 func (r repository) CreateUser(ctx context.Context, user entity.User) error {
-	q := fmt.Sprintf("insert into user (id, username, fullname, phone, email, password, token) " +
-		"values (:id, :username, :fullname, :phone, :email, :password, :token)")
+	q := fmt.Sprintf("insert into user (id, username, fullname, phone, email, password, token, role) " +
+		"values (:id, :username, :fullname, :phone, :email, :password, :token, :role)")
 
 	_, err := r.db.Exec(ctx, q, user)
 	if err != nil {
@@ -36,8 +75,21 @@ func (r repository) CreateUser(ctx context.Context, user entity.User) error {
 	return nil
 }
 
+func (r repository) Get(ctx context.Context, id string) (entity.User, error) {
+	q := fmt.Sprintf("select * from user where id = ? and deleted_at is null")
+
+	var user entity.User
+
+	err := r.db.FetchRow(ctx, q, &user, id)
+	if err != nil {
+		return user, err
+	}
+
+	return user, nil
+}
+
 func (r repository) FindByUsername(ctx context.Context, username string) (entity.User, error) {
-	q := fmt.Sprintf("select * from user where username = ?")
+	q := fmt.Sprintf("select * from user where username = ? and deleted_at is null")
 
 	var user entity.User
 
@@ -48,3 +100,338 @@ func (r repository) FindByUsername(ctx context.Context, username string) (entity
 
 	return user, nil
 }
+
+func (r repository) FindByEmail(ctx context.Context, email string) (entity.User, error) {
+	q := fmt.Sprintf("select * from user where email = ? and deleted_at is null")
+
+	var user entity.User
+
+	err := r.db.FetchRow(ctx, q, &user, email)
+	if err != nil {
+		return user, err
+	}
+
+	return user, nil
+}
+
+func (r repository) Update(ctx context.Context, user entity.User) error {
+	q := fmt.Sprintf("update user set username = :username, " +
+		"fullname = :fullname, " +
+		"phone = :phone, " +
+		"email = :email, " +
+		"email_verified = :email_verified, " +
+		"password = :password, " +
+		"deleted_at = :deleted_at " +
+		"where id = :id")
+
+	_, err := r.db.Exec(ctx, q, user)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r repository) UpdateLoginAttempts(ctx context.Context, user entity.User) error {
+	q := fmt.Sprintf("update user set failed_logins = :failed_logins, locked_until = :locked_until where id = :id")
+
+	_, err := r.db.Exec(ctx, q, user)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r repository) AddFailedLogin(ctx context.Context, id string) (int, error) {
+	var failedLogins int
+
+	err := r.db.Transaction(ctx, func(ctx context.Context) error {
+		q := fmt.Sprintf("update user set failed_logins = failed_logins + 1 where id = ?")
+
+		res, err := r.db.Exec(ctx, q, id)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return sql.ErrNoRows
+		}
+
+		q = fmt.Sprintf("select failed_logins from user where id = ?")
+
+		return r.db.FetchRow(ctx, q, &failedLogins, id)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return failedLogins, nil
+}
+
+func (r repository) CreateToken(ctx context.Context, token entity.UserToken) error {
+	q := fmt.Sprintf("insert into user_token (token_hash, user_id, purpose, email, expires_at) " +
+		"values (:token_hash, :user_id, :purpose, :email, :expires_at)")
+
+	_, err := r.db.Exec(ctx, q, token)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r repository) ConsumeToken(ctx context.Context, hash, purpose string, now time.Time) (entity.UserToken, error) {
+	q := fmt.Sprintf("select * from user_token where token_hash = ? and purpose = ? and used_at is null and expires_at > ?")
+
+	var token entity.UserToken
+
+	err := r.db.FetchRow(ctx, q, &token, hash, purpose, now)
+	if err != nil {
+		return token, err
+	}
+
+	// the update only succeeds once, so that two concurrent requests cannot both use the token
+	q = fmt.Sprintf("update user_token set used_at = :now where token_hash = :hash and used_at is null")
+
+	res, err := r.db.Exec(ctx, q, map[string]interface{}{"hash": hash, "now": now})
+	if err != nil {
+		return token, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return token, err
+	} else if n == 0 {
+		return token, sql.ErrNoRows
+	}
+	token.UsedAt = &now
+
+	return token, nil
+}
+
+func (r repository) UpdateTOTP(ctx context.Context, user entity.User) error {
+	q := fmt.Sprintf("update user set totp_secret = :totp_secret, " +
+		"totp_enabled = :totp_enabled, " +
+		"totp_last_step = :totp_last_step " +
+		"where id = :id")
+
+	_, err := r.db.Exec(ctx, q, user)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r repository) ReplaceRecoveryCodes(ctx context.Context, userID string, hashes []string) error {
+	return r.db.Transaction(ctx, func(ctx context.Context) error {
+		q := fmt.Sprintf("delete from user_recovery_code where user_id = :user_id")
+
+		_, err := r.db.Exec(ctx, q, entity.RecoveryCode{UserID: userID})
+		if err != nil {
+			return err
+		}
+
+		q = fmt.Sprintf("insert into user_recovery_code (user_id, code_hash) values (:user_id, :code_hash)")
+
+		for _, hash := range hashes {
+			_, err = r.db.Exec(ctx, q, entity.RecoveryCode{UserID: userID, Hash: hash})
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (r repository) UseRecoveryCode(ctx context.Context, userID, hash string, now time.Time) error {
+	q := fmt.Sprintf("update user_recovery_code set used_at = :used_at " +
+		"where user_id = :user_id and code_hash = :code_hash and used_at is null")
+
+	res, err := r.db.Exec(ctx, q, entity.RecoveryCode{UserID: userID, Hash: hash, UsedAt: &now})
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+func (r repository) CreateAPIKey(ctx context.Context, key entity.APIKey) error {
+	q := fmt.Sprintf("insert into api_key (id, owner_id, name, prefix, hash, scopes, rate_limit, created_at, expires_at) " +
+		"values (:id, :owner_id, :name, :prefix, :hash, :scopes, :rate_limit, :created_at, :expires_at)")
+
+	_, err := r.db.Exec(ctx, q, key)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r repository) GetAPIKey(ctx context.Context, id string) (entity.APIKey, error) {
+	q := fmt.Sprintf("select * from api_key where id = ?")
+
+	var key entity.APIKey
+
+	err := r.db.FetchRow(ctx, q, &key, id)
+	if err != nil {
+		return key, err
+	}
+
+	return key, nil
+}
+
+func (r repository) FindAPIKeyByPrefix(ctx context.Context, prefix string) (entity.APIKey, error) {
+	q := fmt.Sprintf("select * from api_key where prefix = ?")
+
+	var key entity.APIKey
+
+	err := r.db.FetchRow(ctx, q, &key, prefix)
+	if err != nil {
+		return key, err
+	}
+
+	return key, nil
+}
+
+func (r repository) ListAPIKeys(ctx context.Context, ownerID string) ([]entity.APIKey, error) {
+	q := fmt.Sprintf("select * from api_key where owner_id = ? order by created_at desc")
+
+	var keys []entity.APIKey
+
+	err := r.db.FetchRows(ctx, q, &keys, ownerID)
+	if err != nil {
+		return keys, err
+	}
+
+	return keys, nil
+}
+
+func (r repository) RevokeAPIKey(ctx context.Context, id string, now time.Time) error {
+	q := fmt.Sprintf("update api_key set revoked_at = :revoked_at where id = :id and revoked_at is null")
+
+	_, err := r.db.Exec(ctx, q, entity.APIKey{ID: id, RevokedAt: &now})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r repository) TouchAPIKey(ctx context.Context, id string, now time.Time) error {
+	q := fmt.Sprintf("update api_key set last_used_at = :last_used_at where id = :id")
+
+	_, err := r.db.Exec(ctx, q, entity.APIKey{ID: id, LastUsedAt: &now})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r repository) CreateSession(ctx context.Context, session entity.Session) error {
+	q := fmt.Sprintf("insert into session (id, user_id, user_agent, ip, created_at, last_seen_at, expires_at) " +
+		"values (:id, :user_id, :user_agent, :ip, :created_at, :last_seen_at, :expires_at)")
+
+	_, err := r.db.Exec(ctx, q, session)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r repository) GetSession(ctx context.Context, id string) (entity.Session, error) {
+	q := fmt.Sprintf("select * from session where id = ?")
+
+	var session entity.Session
+
+	err := r.db.FetchRow(ctx, q, &session, id)
+	if err != nil {
+		return session, err
+	}
+
+	return session, nil
+}
+
+func (r repository) ListSessions(ctx context.Context, userID string, now time.Time) ([]entity.Session, error) {
+	q := fmt.Sprintf("select * from session where user_id = ? and revoked_at is null and expires_at > ? order by last_seen_at desc")
+
+	var sessions []entity.Session
+
+	err := r.db.FetchRows(ctx, q, &sessions, userID, now)
+	if err != nil {
+		return sessions, err
+	}
+
+	return sessions, nil
+}
+
+func (r repository) RevokeSession(ctx context.Context, id string, now time.Time) error {
+	q := fmt.Sprintf("update session set revoked_at = :revoked_at where id = :id and revoked_at is null")
+
+	_, err := r.db.Exec(ctx, q, entity.Session{ID: id, RevokedAt: &now})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r repository) RevokeSessions(ctx context.Context, userID, exceptID string, now time.Time) error {
+	q := fmt.Sprintf("update session set revoked_at = :now " +
+		"where user_id = :user_id and id <> :except_id and revoked_at is null and expires_at > :now")
+
+	_, err := r.db.Exec(ctx, q, map[string]interface{}{"user_id": userID, "except_id": exceptID, "now": now})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r repository) TouchSession(ctx context.Context, id string, now time.Time) error {
+	q := fmt.Sprintf("update session set last_seen_at = :last_seen_at where id = :id")
+
+	_, err := r.db.Exec(ctx, q, entity.Session{ID: id, LastSeenAt: now})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r repository) GetIdentity(ctx context.Context, provider, subject string) (entity.UserIdentity, error) {
+	q := fmt.Sprintf("select * from user_identity where provider = ? and subject = ?")
+
+	var identity entity.UserIdentity
+
+	err := r.db.FetchRow(ctx, q, &identity, provider, subject)
+	if err != nil {
+		return identity, err
+	}
+
+	return identity, nil
+}
+
+func (r repository) CreateIdentity(ctx context.Context, identity entity.UserIdentity) error {
+	q := fmt.Sprintf("insert into user_identity (provider, subject, user_id, email, created_at) " +
+		"values (:provider, :subject, :user_id, :email, :created_at)")
+
+	_, err := r.db.Exec(ctx, q, identity)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r repository) Transaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return r.db.Transaction(ctx, fn)
+}
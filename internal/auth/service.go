@@ -2,11 +2,21 @@ package auth
 
 import (
 	"context"
+	"database/sql"
+	stderrors "errors"
+	"fmt"
 	"github.com/dgrijalva/jwt-go"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/go-ozzo/ozzo-validation/v4/is"
 	"github.com/online-shop/internal/entity"
 	"github.com/online-shop/internal/errors"
+	"github.com/online-shop/pkg/jwk"
 	"github.com/online-shop/pkg/log"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/online-shop/pkg/mailer"
+	"github.com/online-shop/pkg/mysql"
+	"github.com/online-shop/pkg/password"
+	"github.com/online-shop/pkg/tracing"
+	"regexp"
 	"time"
 )
 
@@ -14,8 +24,66 @@ import (
 type Service interface {
 	// authenticate authenticates a user using username and password.
 	// It returns a JWT token if authentication succeeds. Otherwise, an error is returned.
-	Login(ctx context.Context, username, password string) (string, error)
+	// Users having enabled two-factor authentication get an MFA challenge token instead.
+	Login(ctx context.Context, username, password string) (LoginResult, error)
+	// LoginMFA completes the login of a user having enabled two-factor authentication.
+	LoginMFA(ctx context.Context, input MFALoginRequest) (LoginResult, error)
 	CreateUser(ctx context.Context, user RegisterRequest) error
+	// Unlock lifts the lockout of a user account caused by repeated failed logins.
+	Unlock(ctx context.Context, id string) error
+
+	// GetProfile returns the profile of the current user.
+	GetProfile(ctx context.Context) (Profile, error)
+	// UpdateProfile updates the profile of the current user.
+	UpdateProfile(ctx context.Context, input UpdateProfileRequest) (Profile, error)
+	// ChangePassword replaces the password of the current user after checking the old one.
+	ChangePassword(ctx context.Context, input ChangePasswordRequest) error
+	// ChangeEmail replaces the email address of the current user, which then needs to be verified again.
+	ChangeEmail(ctx context.Context, input ChangeEmailRequest) (Profile, error)
+	// DeleteAccount anonymizes the account of the current user, keeping their orders.
+	DeleteAccount(ctx context.Context, input DeleteAccountRequest) error
+
+	// ResendVerificationEmail mails a new email verification link to the current user.
+	ResendVerificationEmail(ctx context.Context) error
+	// VerifyEmail marks the email address a verification token was sent to as verified.
+	VerifyEmail(ctx context.Context, input VerifyEmailRequest) error
+	// RequestPasswordReset mails a password reset link to the user having the given email address, if any.
+	RequestPasswordReset(ctx context.Context, input ForgotPasswordRequest) error
+	// ResetPassword replaces the password of the user a password reset token was sent to.
+	ResetPassword(ctx context.Context, input ResetPasswordRequest) error
+
+	// EnrollTOTP generates a new TOTP secret for the current user, to be confirmed with ConfirmTOTP.
+	EnrollTOTP(ctx context.Context) (TOTPEnrollment, error)
+	// ConfirmTOTP enables two-factor authentication once the user proved their authenticator app works.
+	ConfirmTOTP(ctx context.Context, input TOTPCodeRequest) (RecoveryCodes, error)
+	// DisableTOTP disables two-factor authentication for the current user.
+	DisableTOTP(ctx context.Context, input DisableTOTPRequest) error
+	// RegenerateRecoveryCodes replaces the recovery codes of the current user.
+	RegenerateRecoveryCodes(ctx context.Context, input TOTPCodeRequest) (RecoveryCodes, error)
+
+	APIKeyAuthenticator
+	// CreateAPIKey creates an API key owned by the current user, or by a service account.
+	CreateAPIKey(ctx context.Context, input CreateAPIKeyRequest) (CreatedAPIKey, error)
+	// ListAPIKeys returns the API keys of the current user, or of a service account.
+	ListAPIKeys(ctx context.Context, ownerID string) ([]APIKey, error)
+	// RevokeAPIKey revokes an API key of the current user, or of a service account.
+	RevokeAPIKey(ctx context.Context, id string) error
+	// CreateServiceAccount creates an account for an integration, which can only authenticate with API keys.
+	CreateServiceAccount(ctx context.Context, input ServiceAccountRequest) (Profile, error)
+
+	SessionValidator
+	// ListSessions returns the active sessions of the current user.
+	ListSessions(ctx context.Context) ([]Session, error)
+	// RevokeSession logs the current user out of one of their sessions.
+	RevokeSession(ctx context.Context, id string) error
+
+	// StartOIDCLogin starts a login with an external identity provider, returning where to send the user.
+	StartOIDCLogin(ctx context.Context, provider string) (OIDCLogin, error)
+	// LoginOIDC completes a login with an external identity provider, linking or creating the account of the user.
+	LoginOIDC(ctx context.Context, input OIDCCallbackRequest) (LoginResult, error)
+
+	// Impersonate lets the current staff member act as another user, returning a short-lived token.
+	Impersonate(ctx context.Context, userID string) (Impersonation, error)
 }
 
 // Identity represents an authenticated user identity.
@@ -24,8 +92,36 @@ type Identity interface {
 	GetID() string
 	// GetName returns the user name.
 	GetUsername() string
+	// GetRole returns the user role.
+	GetRole() string
+	// GetActorID returns the ID of the staff member impersonating the user, if any.
+	GetActorID() string
 }
 
+const (
+	// maxFailedLogins is the number of consecutive failed logins after which an account gets locked.
+	maxFailedLogins = 5
+	// lockoutDuration is how long an account is locked after reaching maxFailedLogins.
+	// It doubles with every further failed login, up to maxLockoutDuration.
+	lockoutDuration    = time.Minute
+	maxLockoutDuration = 24 * time.Hour
+)
+
+// LoginRequest represents a login request.
+type LoginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Validate validates the LoginRequest fields.
+func (r LoginRequest) Validate() error {
+	return validation.ValidateStruct(&r,
+		validation.Field(&r.Username, validation.Required),
+		validation.Field(&r.Password, validation.Required),
+	)
+}
+
+// RegisterRequest represents a user registration request.
 type RegisterRequest struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
@@ -34,78 +130,327 @@ type RegisterRequest struct {
 	Email    string `json:"email"`
 }
 
+var (
+	usernameFormat = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+	phoneFormat    = regexp.MustCompile(`^\+?[0-9]{7,15}$`)
+	hasLetter      = regexp.MustCompile(`[a-zA-Z]`)
+	hasDigit       = regexp.MustCompile(`[0-9]`)
+)
+
+// uniqueUserFields maps the unique indexes of the user table to the request fields they apply to.
+var uniqueUserFields = map[string]string{
+	"uq_user_username": "username",
+	"uq_user_email":    "email",
+}
+
+// passwordRules are the rules every password must follow: mixing letters and digits. Their length is up to the
+// configurable password.Policy, checked when hashing, which also refuses passwords known from data breaches.
+var passwordRules = []validation.Rule{
+	validation.Required,
+	validation.Match(hasLetter).Error("must contain a letter"),
+	validation.Match(hasDigit).Error("must contain a digit"),
+}
+
+// Validate validates the RegisterRequest fields.
+func (r RegisterRequest) Validate() error {
+	return validation.ValidateStruct(&r,
+		validation.Field(&r.Username, validation.Required, validation.Length(3, 32),
+			validation.Match(usernameFormat).Error("must contain only letters, digits, dots, dashes and underscores")),
+		validation.Field(&r.Password, passwordRules...),
+		validation.Field(&r.FullName, validation.Required, validation.Length(0, 100)),
+		validation.Field(&r.Email, validation.Required, validation.Length(0, 254), is.Email),
+		validation.Field(&r.Phone, validation.Match(phoneFormat).Error("must be a valid phone number")),
+	)
+}
+
 type service struct {
-	signingKey      string
+	keys            *jwk.Set
 	tokenExpiration int
 	logger          log.Logger
 	repo            Repository
+	mailer          mailer.Mailer
+	// appURL is the base URL of the links sent by email.
+	appURL string
+	// requireVerifiedEmail refuses logins to users who did not verify their email address.
+	requireVerifiedEmail bool
+	passwords            *password.Hasher
+	policy               password.Policy
+	// providers are the external identity providers users can log in with, by name.
+	providers map[string]IdentityProvider
+	// background runs the work requests do not wait for.
+	background func(fn func())
 }
 
 // NewService creates a new authentication service.
-func NewService(repo Repository, signingKey string, tokenExpiration int, logger log.Logger) Service {
-	return service{signingKey, tokenExpiration, logger, repo}
+// Links sent by email point to appURL. If requireVerifiedEmail is set, users must verify their email address before logging in.
+// Passwords are hashed with passwords once they pass policy; hashes of other algorithms or parameters are upgraded on login.
+// Users may also log in with the given external identity providers.
+func NewService(repo Repository, keys *jwk.Set, tokenExpiration int, mailer mailer.Mailer, appURL string, requireVerifiedEmail bool,
+	passwords *password.Hasher, policy password.Policy, providers map[string]IdentityProvider, logger log.Logger) Service {
+	return service{keys, tokenExpiration, logger, repo, mailer, appURL, requireVerifiedEmail, passwords, policy, providers,
+		func(fn func()) { go fn() }}
+}
+
+// LoginResult is the outcome of a successful password check.
+type LoginResult struct {
+	// Token authenticates the requests of the user. It is empty if a second factor is required.
+	Token string `json:"token,omitempty"`
+	// MFARequired tells that the login must be completed with a second factor, sending MFAToken along with a code.
+	MFARequired bool   `json:"mfa_required,omitempty"`
+	MFAToken    string `json:"mfa_token,omitempty"`
 }
 
 // Login authenticates a user and generates a JWT token if authentication succeeds.
+// Users having enabled two-factor authentication get an MFA challenge token instead, to be passed to LoginMFA.
 // Otherwise, an error is returned.
-func (s service) Login(ctx context.Context, username, password string) (string, error) {
+func (s service) Login(ctx context.Context, username, password string) (LoginResult, error) {
+	ctx, span := tracing.StartSpan(ctx, "auth.Service.Login")
+	defer span.End()
+
 	user, err := s.repo.FindByUsername(ctx, username)
 	if err != nil {
-		return "", err
+		if stderrors.Is(err, sql.ErrNoRows) {
+			// spend as long as for an existing user, so that response times do not tell which usernames exist
+			s.passwords.VerifyNothing(password)
+			loginFailures.WithLabelValues("unknown_user").Inc()
+			s.logger.With(ctx, "user", username).Infof("authentication failed: unknown user")
+			return LoginResult{}, errors.Unauthorized("")
+		}
+		return LoginResult{}, err
+	}
+
+	now := time.Now()
+	if err := s.checkLocked(ctx, user, now); err != nil {
+		return LoginResult{}, err
+	}
+
+	identity := s.authenticate(ctx, user, password)
+	if identity == nil {
+		loginFailures.WithLabelValues("invalid_password").Inc()
+		return LoginResult{}, s.loginFailed(ctx, user, now)
+	}
+	return s.finishLogin(ctx, user, identity)
+}
+
+// finishLogin completes the login of a user who proved who they are, unless they must verify their email address first.
+// Users having enabled two-factor authentication get an MFA challenge token instead of a JWT token.
+func (s service) finishLogin(ctx context.Context, user entity.User, identity Identity) (LoginResult, error) {
+	if s.requireVerifiedEmail && !user.EmailVerified {
+		loginFailures.WithLabelValues("unverified_email").Inc()
+		return LoginResult{}, errors.Forbidden("Please verify your email address before logging in.")
+	}
+	if user.TOTPEnabled {
+		token, err := s.generateMFAToken(user)
+		if err != nil {
+			return LoginResult{}, err
+		}
+		return LoginResult{MFARequired: true, MFAToken: token}, nil
+	}
+	return s.loginSucceeded(ctx, user, identity, false)
+}
+
+// checkLocked refuses the login of a user whose account is locked.
+func (s service) checkLocked(ctx context.Context, user entity.User, now time.Time) error {
+	if user.LockedUntil != nil && user.LockedUntil.After(now) {
+		loginFailures.WithLabelValues("locked").Inc()
+		s.logger.With(ctx, "user", user.Username).Infof("authentication refused: account locked")
+		return errors.TooManyRequests("Your account is temporarily locked because of too many failed login attempts.", user.LockedUntil.Sub(now))
+	}
+	return nil
+}
+
+// loginFailed counts a failed login, locking the account if there were too many in a row.
+func (s service) loginFailed(ctx context.Context, user entity.User, now time.Time) error {
+	// the counter is incremented in database and the lockout decided while the user is locked, so that
+	// concurrent failed logins are all counted
+	err := s.repo.Transaction(ctx, func(ctx context.Context) error {
+		failedLogins, err := s.repo.AddFailedLogin(ctx, user.ID)
+		if err != nil {
+			return err
+		}
+		d := lockoutFor(failedLogins)
+		if d == 0 {
+			return nil
+		}
+		lockedUntil := now.Add(d)
+		user.FailedLogins, user.LockedUntil = failedLogins, &lockedUntil
+		s.logger.With(ctx, "user", user.Username).Infof("account locked for %s after %d failed logins", d, failedLogins)
+		return s.repo.UpdateLoginAttempts(ctx, user)
+	})
+	if err != nil {
+		return err
+	}
+	return errors.Unauthorized("")
+}
+
+// loginSucceeded resets the failed login counter of a user, starts a session and generates their JWT token.
+func (s service) loginSucceeded(ctx context.Context, user entity.User, identity Identity, mfa bool) (LoginResult, error) {
+	if user.FailedLogins > 0 || user.LockedUntil != nil {
+		user.FailedLogins, user.LockedUntil = 0, nil
+		if err := s.repo.UpdateLoginAttempts(ctx, user); err != nil {
+			return LoginResult{}, err
+		}
+	}
+	session, err := s.startSession(ctx, user.ID, time.Now())
+	if err != nil {
+		return LoginResult{}, err
+	}
+	token, err := s.generateJWT(identity, mfa, session)
+	if err != nil {
+		return LoginResult{}, err
 	}
+	return LoginResult{Token: token}, nil
+}
 
-	if identity := s.authenticate(ctx, user, password); identity != nil {
-		return s.generateJWT(identity)
+// lockoutFor returns how long an account should be locked after the given number of consecutive failed logins.
+func lockoutFor(failedLogins int) time.Duration {
+	if failedLogins < maxFailedLogins {
+		return 0
+	}
+	d := lockoutDuration
+	for i := maxFailedLogins; i < failedLogins && d < maxLockoutDuration; i++ {
+		d *= 2
+	}
+	if d > maxLockoutDuration {
+		d = maxLockoutDuration
 	}
-	return "", errors.Unauthorized("")
+	return d
+}
+
+// Unlock lifts the lockout of a user account caused by repeated failed logins.
+func (s service) Unlock(ctx context.Context, id string) error {
+	ctx, span := tracing.StartSpan(ctx, "auth.Service.Unlock")
+	defer span.End()
+
+	user, err := s.repo.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	user.FailedLogins, user.LockedUntil = 0, nil
+	if err := s.repo.UpdateLoginAttempts(ctx, user); err != nil {
+		return err
+	}
+	s.logger.With(ctx, "user", user.Username).Infof("account unlocked")
+	return nil
 }
 
 func (s service) CreateUser(ctx context.Context, user RegisterRequest) error {
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
+	ctx, span := tracing.StartSpan(ctx, "auth.Service.CreateUser")
+	defer span.End()
+
+	hashedPassword, err := s.hashPassword("password", user.Password)
 	if err != nil {
 		return err
 	}
 
-	err = s.repo.CreateUser(ctx, entity.User{
+	created := entity.User{
 		ID:       entity.GenerateID(),
 		Username: user.Username,
 		FullName: user.FullName,
 		Phone:    user.Phone,
 		Email:    user.Email,
-		Password: string(hashedPassword),
+		Password: hashedPassword,
 		Token:    "",
-	})
+		Role:     entity.RoleCustomer,
+	}
+	err = s.repo.CreateUser(ctx, created)
 
 	if err != nil {
+		if dbErr := mysql.Classify(err); dbErr != nil && dbErr.Kind == mysql.DuplicateKey {
+			return errors.Conflict("", uniqueUserFields[dbErr.Key])
+		}
 		return err
 	}
 
+	// the account exists anyway, the user can ask for another email if this one is lost
+	if err := s.sendVerificationEmail(ctx, created); err != nil {
+		s.logger.With(ctx, "user", created.Username).Errorf("failed to send verification email: %v", err)
+	}
+
 	return nil
 }
 
-func verifyPassword(password, hashedPassword string) error {
-	return bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password))
+// errPasswordMismatch reports that a password does not match the hash of the user.
+var errPasswordMismatch = stderrors.New("password does not match")
+
+// hashPassword checks a new password against the password policy and hashes it.
+// Policy violations are reported as validation errors of the given request field.
+func (s service) hashPassword(field, pw string) (string, error) {
+	if err := s.policy.Check(pw); err != nil {
+		return "", validation.Errors{field: err}
+	}
+	hash, err := s.passwords.Hash(pw)
+	if stderrors.Is(err, password.ErrTooLong) {
+		return "", validation.Errors{field: fmt.Errorf("must be at most %d bytes long", password.BcryptMaxLength)}
+	}
+	return hash, err
+}
+
+// verifyPassword checks a password against the hash of a user.
+func (s service) verifyPassword(pw, hashedPassword string) error {
+	ok, _, err := s.passwords.Verify(pw, hashedPassword)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errPasswordMismatch
+	}
+	return nil
 }
 
 // authenticate authenticates a user using username and password.
 // If username and password are correct, an identity is returned. Otherwise, nil is returned.
-func (s service) authenticate(ctx context.Context, user entity.User, password string) Identity {
+// Password hashes made with another algorithm or outdated parameters are replaced on the way.
+func (s service) authenticate(ctx context.Context, user entity.User, pw string) Identity {
 	logger := s.logger.With(ctx, "user", user.Username)
 
-	err := verifyPassword(password, user.Password)
+	if user.Password == "" {
+		// users created from an identity provider have no password until they reset it
+		s.passwords.VerifyNothing(pw)
+		logger.Infof("authentication failed: no password")
+		return nil
+	}
+	ok, rehash, err := s.passwords.Verify(pw, user.Password)
 	if err != nil {
+		logger.Errorf("failed to verify password: %v", err)
+	}
+	if !ok {
 		logger.Infof("authentication failed")
 		return nil
 	}
 	logger.Infof("authentication successful")
-	return entity.User{ID: user.ID, Username: user.Username}
+
+	if rehash {
+		// the login goes on with the old hash if the new one cannot be saved, it will be retried next time
+		if err := s.rehashPassword(ctx, user, pw); err != nil {
+			logger.Errorf("failed to rehash password: %v", err)
+		} else {
+			logger.Infof("password rehashed")
+		}
+	}
+	return entity.User{ID: user.ID, Username: user.Username, Role: user.Role}
 }
 
-// generateJWT generates a JWT that encodes an identity.
-func (s service) generateJWT(identity Identity) (string, error) {
-	return jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+// rehashPassword replaces the password hash of a user with one made with the preferred algorithm and parameters.
+func (s service) rehashPassword(ctx context.Context, user entity.User, pw string) error {
+	hash, err := s.passwords.Hash(pw)
+	if err != nil {
+		return err
+	}
+	user.Password = hash
+	return s.repo.Update(ctx, user)
+}
+
+// generateJWT generates a JWT that encodes an identity, whether it was authenticated with a second factor,
+// and the session it belongs to. The token expires along with its session.
+func (s service) generateJWT(identity Identity, mfa bool, session entity.Session) (string, error) {
+	return s.keys.Sign(jwt.MapClaims{
 		"id":   identity.GetID(),
 		"name": identity.GetUsername(),
-		"exp":  time.Now().Add(time.Duration(s.tokenExpiration) * time.Hour).Unix(),
-	}).SignedString([]byte(s.signingKey))
+		"role": identity.GetRole(),
+		"mfa":  mfa,
+		"sid":  session.ID,
+		"exp":  session.ExpiresAt.Unix(),
+	})
 }
@@ -0,0 +1,434 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	driver "github.com/go-sql-driver/mysql"
+	"github.com/online-shop/internal/entity"
+	"github.com/online-shop/internal/errors"
+	"github.com/online-shop/pkg/jwk"
+	"github.com/online-shop/pkg/log"
+	"github.com/online-shop/pkg/mailer"
+	"github.com/online-shop/pkg/password"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestService_Login(t *testing.T) {
+	logger, _ := log.NewForTest()
+	repo := newMockRepository(t, entity.User{ID: "100", Username: "demo", Role: entity.RoleCustomer}, "pass")
+	s := NewService(repo, newTestKeys(t), 100, mailer.NewMemoryMailer(""), "https://shop.test", false, newTestHasher(), password.DefaultPolicy, nil, logger)
+
+	result, err := s.Login(context.Background(), "demo", "pass")
+	assert.Nil(t, err)
+	assert.NotEmpty(t, result.Token)
+	assert.False(t, result.MFARequired)
+
+	_, err = s.Login(context.Background(), "demo", "wrong")
+	assert.Equal(t, http.StatusUnauthorized, err.(errors.ErrorResponse).Status)
+	assert.Equal(t, 1, repo.users["100"].FailedLogins)
+
+	// unknown users are refused like wrong passwords, so that usernames cannot be enumerated
+	_, err = s.Login(context.Background(), "unknown", "pass")
+	assert.Equal(t, errors.Unauthorized(""), err)
+
+	// a successful login resets the counter
+	_, err = s.Login(context.Background(), "demo", "pass")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, repo.users["100"].FailedLogins)
+}
+
+func TestService_Login_rehash(t *testing.T) {
+	logger, _ := log.NewForTest()
+	repo := newMockRepository(t, entity.User{ID: "100", Username: "demo"}, "pass")
+	s := NewService(repo, newTestKeys(t), 100, mailer.NewMemoryMailer(""), "https://shop.test", false, newTestHasher(), password.DefaultPolicy, nil, logger)
+	legacy := repo.users["100"].Password
+
+	// the bcrypt hash is replaced with an argon2id one on the first successful login
+	_, err := s.Login(context.Background(), "demo", "wrong")
+	assert.NotNil(t, err)
+	assert.Equal(t, legacy, repo.users["100"].Password)
+	_, err = s.Login(context.Background(), "demo", "pass")
+	assert.Nil(t, err)
+	upgraded := repo.users["100"].Password
+	assert.True(t, strings.HasPrefix(upgraded, "$argon2id$"), upgraded)
+
+	_, err = s.Login(context.Background(), "demo", "pass")
+	assert.Nil(t, err)
+	assert.Equal(t, upgraded, repo.users["100"].Password)
+}
+
+func TestService_CreateUser_policy(t *testing.T) {
+	logger, _ := log.NewForTest()
+	repo := newMockRepository(t, entity.User{ID: "100", Username: "demo"}, "pass")
+	policy := password.Policy{MinLength: 10, MaxLength: 64, Breached: map[string]struct{}{"password1234": {}}}
+	s := NewService(repo, newTestKeys(t), 100, mailer.NewMemoryMailer(""), "https://shop.test", false, newTestHasher(), policy, nil, logger)
+
+	err := s.CreateUser(context.Background(), RegisterRequest{Username: "new", Password: "secret123"})
+	assert.Contains(t, err.(validation.Errors), "password")
+	err = s.CreateUser(context.Background(), RegisterRequest{Username: "new", Password: "Password1234"})
+	assert.Contains(t, err.(validation.Errors), "password")
+	assert.Len(t, repo.users, 1)
+
+	assert.Nil(t, s.CreateUser(context.Background(), RegisterRequest{Username: "new", Password: "secret12345"}))
+	assert.Len(t, repo.users, 2)
+
+	// the length of passwords is only up to the policy
+	policy = password.Policy{MinLength: 6, MaxLength: 64}
+	s = NewService(repo, newTestKeys(t), 100, mailer.NewMemoryMailer(""), "https://shop.test", false, newTestHasher(), policy, nil, logger)
+	r := RegisterRequest{Username: "short", Password: "abc123", FullName: "Short", Email: "short@example.com"}
+	assert.Nil(t, r.Validate())
+	assert.Nil(t, s.CreateUser(context.Background(), r))
+	err = s.CreateUser(context.Background(), RegisterRequest{Username: "shorter", Password: "ab12"})
+	assert.Contains(t, err.(validation.Errors), "password")
+}
+
+func TestService_Login_lockout(t *testing.T) {
+	logger, _ := log.NewForTest()
+	repo := newMockRepository(t, entity.User{ID: "100", Username: "demo"}, "pass")
+	s := NewService(repo, newTestKeys(t), 100, mailer.NewMemoryMailer(""), "https://shop.test", false, newTestHasher(), password.DefaultPolicy, nil, logger)
+
+	for i := 0; i < maxFailedLogins; i++ {
+		_, err := s.Login(context.Background(), "demo", "wrong")
+		assert.Equal(t, http.StatusUnauthorized, err.(errors.ErrorResponse).Status)
+	}
+	assert.NotNil(t, repo.users["100"].LockedUntil)
+
+	// the correct password is refused while the account is locked
+	_, err := s.Login(context.Background(), "demo", "pass")
+	res := err.(errors.ErrorResponse)
+	assert.Equal(t, http.StatusTooManyRequests, res.Status)
+	assert.InDelta(t, lockoutDuration.Seconds(), res.RetryAfter.Seconds(), 1)
+
+	assert.Nil(t, s.Unlock(context.Background(), "100"))
+	assert.Nil(t, repo.users["100"].LockedUntil)
+	_, err = s.Login(context.Background(), "demo", "pass")
+	assert.Nil(t, err)
+
+	assert.Equal(t, sql.ErrNoRows, s.Unlock(context.Background(), "999"))
+}
+
+func TestService_CreateUser(t *testing.T) {
+	logger, _ := log.NewForTest()
+	repo := newMockRepository(t, entity.User{ID: "100", Username: "demo"}, "pass")
+	s := NewService(repo, newTestKeys(t), 100, mailer.NewMemoryMailer(""), "https://shop.test", false, newTestHasher(), password.DefaultPolicy, nil, logger)
+
+	err := s.CreateUser(context.Background(), RegisterRequest{Username: "new", Password: "secret123"})
+	assert.Nil(t, err)
+	assert.Len(t, repo.users, 2)
+
+	err = s.CreateUser(context.Background(), RegisterRequest{Username: "demo", Password: "secret123"})
+	if assert.NotNil(t, err) {
+		res := err.(errors.ErrorResponse)
+		assert.Equal(t, http.StatusConflict, res.Status)
+		assert.Equal(t, errors.Conflict("", "username"), res)
+	}
+}
+
+func Test_lockoutFor(t *testing.T) {
+	assert.Zero(t, lockoutFor(maxFailedLogins-1))
+	assert.Equal(t, lockoutDuration, lockoutFor(maxFailedLogins))
+	assert.Equal(t, 2*lockoutDuration, lockoutFor(maxFailedLogins+1))
+	assert.Equal(t, 4*lockoutDuration, lockoutFor(maxFailedLogins+2))
+	assert.Equal(t, maxLockoutDuration, lockoutFor(maxFailedLogins+100))
+}
+
+// newTestKeys creates a key set with a single new key.
+func newTestKeys(t *testing.T) *jwk.Set {
+	key, err := jwk.Generate(jwk.ES256, time.Now())
+	assert.Nil(t, err)
+	return jwk.NewSet(time.Hour, key)
+}
+
+// newTestHasher creates a password hasher with cheap parameters, verifying bcrypt hashes as legacy ones.
+func newTestHasher() *password.Hasher {
+	return password.NewHasher(password.Argon2id{Memory: 1024, Time: 1, Threads: 1, SaltLength: 16, KeyLength: 32}, password.Bcrypt{Cost: bcrypt.MinCost})
+}
+
+type mockRepository struct {
+	users         map[string]entity.User
+	tokens        map[string]entity.UserToken
+	recoveryCodes map[string]entity.RecoveryCode
+	apiKeys       map[string]entity.APIKey
+	sessions      map[string]entity.Session
+	identities    []entity.UserIdentity
+}
+
+func newMockRepository(t *testing.T, user entity.User, pw string) *mockRepository {
+	hash, err := bcrypt.GenerateFromPassword([]byte(pw), bcrypt.MinCost)
+	assert.Nil(t, err)
+	user.Password = string(hash)
+	return &mockRepository{users: map[string]entity.User{user.ID: user}, tokens: map[string]entity.UserToken{}, recoveryCodes: map[string]entity.RecoveryCode{}, apiKeys: map[string]entity.APIKey{}, sessions: map[string]entity.Session{}}
+}
+
+func (m *mockRepository) Get(ctx context.Context, id string) (entity.User, error) {
+	if user, ok := m.users[id]; ok {
+		return user, nil
+	}
+	return entity.User{}, sql.ErrNoRows
+}
+
+func (m *mockRepository) CreateUser(ctx context.Context, user entity.User) error {
+	for _, existing := range m.users {
+		if existing.Username == user.Username {
+			return &driver.MySQLError{Number: 1062, Message: "Duplicate entry '" + user.Username + "' for key 'user.uq_user_username'"}
+		}
+	}
+	m.users[user.ID] = user
+	return nil
+}
+
+func (m *mockRepository) FindByUsername(ctx context.Context, username string) (entity.User, error) {
+	for _, user := range m.users {
+		if user.Username == username {
+			return user, nil
+		}
+	}
+	return entity.User{}, sql.ErrNoRows
+}
+
+func (m *mockRepository) FindByEmail(ctx context.Context, email string) (entity.User, error) {
+	for _, user := range m.users {
+		if user.Email == email {
+			return user, nil
+		}
+	}
+	return entity.User{}, sql.ErrNoRows
+}
+
+func (m *mockRepository) Update(ctx context.Context, user entity.User) error {
+	for _, existing := range m.users {
+		if existing.ID != user.ID && existing.Email != "" && existing.Email == user.Email {
+			return &driver.MySQLError{Number: 1062, Message: "Duplicate entry '" + user.Email + "' for key 'user.uq_user_email'"}
+		}
+	}
+	stored := m.users[user.ID]
+	stored.Username, stored.FullName, stored.Phone, stored.Email = user.Username, user.FullName, user.Phone, user.Email
+	stored.EmailVerified, stored.Password, stored.DeletedAt = user.EmailVerified, user.Password, user.DeletedAt
+	m.users[user.ID] = stored
+	return nil
+}
+
+func (m *mockRepository) UpdateLoginAttempts(ctx context.Context, user entity.User) error {
+	stored := m.users[user.ID]
+	stored.FailedLogins, stored.LockedUntil = user.FailedLogins, user.LockedUntil
+	m.users[user.ID] = stored
+	return nil
+}
+
+func (m *mockRepository) AddFailedLogin(ctx context.Context, id string) (int, error) {
+	stored, ok := m.users[id]
+	if !ok {
+		return 0, sql.ErrNoRows
+	}
+	stored.FailedLogins++
+	m.users[id] = stored
+	return stored.FailedLogins, nil
+}
+
+func (m *mockRepository) Transaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return fn(ctx)
+}
+
+func (m *mockRepository) CreateToken(ctx context.Context, token entity.UserToken) error {
+	m.tokens[token.Hash] = token
+	return nil
+}
+
+func (m *mockRepository) ConsumeToken(ctx context.Context, hash, purpose string, now time.Time) (entity.UserToken, error) {
+	token, ok := m.tokens[hash]
+	if !ok || token.Purpose != purpose || token.UsedAt != nil || !token.ExpiresAt.After(now) {
+		return entity.UserToken{}, sql.ErrNoRows
+	}
+	token.UsedAt = &now
+	m.tokens[hash] = token
+	return token, nil
+}
+
+func (m *mockRepository) UpdateTOTP(ctx context.Context, user entity.User) error {
+	stored := m.users[user.ID]
+	stored.TOTPSecret, stored.TOTPEnabled, stored.TOTPLastStep = user.TOTPSecret, user.TOTPEnabled, user.TOTPLastStep
+	m.users[user.ID] = stored
+	return nil
+}
+
+func (m *mockRepository) ReplaceRecoveryCodes(ctx context.Context, userID string, hashes []string) error {
+	for key, code := range m.recoveryCodes {
+		if code.UserID == userID {
+			delete(m.recoveryCodes, key)
+		}
+	}
+	for _, hash := range hashes {
+		m.recoveryCodes[userID+hash] = entity.RecoveryCode{UserID: userID, Hash: hash}
+	}
+	return nil
+}
+
+func (m *mockRepository) UseRecoveryCode(ctx context.Context, userID, hash string, now time.Time) error {
+	code, ok := m.recoveryCodes[userID+hash]
+	if !ok || code.UsedAt != nil {
+		return sql.ErrNoRows
+	}
+	code.UsedAt = &now
+	m.recoveryCodes[userID+hash] = code
+	return nil
+}
+
+func (m *mockRepository) CreateAPIKey(ctx context.Context, key entity.APIKey) error {
+	m.apiKeys[key.ID] = key
+	return nil
+}
+
+func (m *mockRepository) GetAPIKey(ctx context.Context, id string) (entity.APIKey, error) {
+	if key, ok := m.apiKeys[id]; ok {
+		return key, nil
+	}
+	return entity.APIKey{}, sql.ErrNoRows
+}
+
+func (m *mockRepository) FindAPIKeyByPrefix(ctx context.Context, prefix string) (entity.APIKey, error) {
+	for _, key := range m.apiKeys {
+		if key.Prefix == prefix {
+			return key, nil
+		}
+	}
+	return entity.APIKey{}, sql.ErrNoRows
+}
+
+func (m *mockRepository) ListAPIKeys(ctx context.Context, ownerID string) ([]entity.APIKey, error) {
+	var keys []entity.APIKey
+	for _, key := range m.apiKeys {
+		if key.OwnerID == ownerID {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (m *mockRepository) RevokeAPIKey(ctx context.Context, id string, now time.Time) error {
+	key := m.apiKeys[id]
+	key.RevokedAt = &now
+	m.apiKeys[id] = key
+	return nil
+}
+
+func (m *mockRepository) TouchAPIKey(ctx context.Context, id string, now time.Time) error {
+	key := m.apiKeys[id]
+	key.LastUsedAt = &now
+	m.apiKeys[id] = key
+	return nil
+}
+
+func (m *mockRepository) CreateSession(ctx context.Context, session entity.Session) error {
+	m.sessions[session.ID] = session
+	return nil
+}
+
+func (m *mockRepository) GetSession(ctx context.Context, id string) (entity.Session, error) {
+	if session, ok := m.sessions[id]; ok {
+		return session, nil
+	}
+	return entity.Session{}, sql.ErrNoRows
+}
+
+func (m *mockRepository) ListSessions(ctx context.Context, userID string, now time.Time) ([]entity.Session, error) {
+	var sessions []entity.Session
+	for _, session := range m.sessions {
+		if session.UserID == userID && session.RevokedAt == nil && session.ExpiresAt.After(now) {
+			sessions = append(sessions, session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].LastSeenAt.After(sessions[j].LastSeenAt) })
+	return sessions, nil
+}
+
+func (m *mockRepository) RevokeSession(ctx context.Context, id string, now time.Time) error {
+	session := m.sessions[id]
+	if session.RevokedAt == nil {
+		session.RevokedAt = &now
+	}
+	m.sessions[id] = session
+	return nil
+}
+
+func (m *mockRepository) RevokeSessions(ctx context.Context, userID, exceptID string, now time.Time) error {
+	for id, session := range m.sessions {
+		if session.UserID == userID && id != exceptID && session.RevokedAt == nil {
+			session.RevokedAt = &now
+			m.sessions[id] = session
+		}
+	}
+	return nil
+}
+
+func (m *mockRepository) GetIdentity(ctx context.Context, provider, subject string) (entity.UserIdentity, error) {
+	for _, identity := range m.identities {
+		if identity.Provider == provider && identity.Subject == subject {
+			return identity, nil
+		}
+	}
+	return entity.UserIdentity{}, sql.ErrNoRows
+}
+
+func (m *mockRepository) CreateIdentity(ctx context.Context, identity entity.UserIdentity) error {
+	m.identities = append(m.identities, identity)
+	return nil
+}
+
+func (m *mockRepository) TouchSession(ctx context.Context, id string, now time.Time) error {
+	session := m.sessions[id]
+	session.LastSeenAt = now
+	m.sessions[id] = session
+	return nil
+}
+
+func TestLoginRequest_Validate(t *testing.T) {
+	assert.Nil(t, LoginRequest{Username: "demo", Password: "pass"}.Validate())
+	errs := LoginRequest{}.Validate().(validation.Errors)
+	assert.Contains(t, errs, "username")
+	assert.Contains(t, errs, "password")
+}
+
+func TestRegisterRequest_Validate(t *testing.T) {
+	valid := RegisterRequest{
+		Username: "demo_user",
+		Password: "secret123",
+		FullName: "Demo User",
+		Phone:    "+6281234567890",
+		Email:    "demo@example.com",
+	}
+	assert.Nil(t, valid.Validate())
+
+	tests := []struct {
+		name   string
+		modify func(r *RegisterRequest)
+		field  string
+	}{
+		{"empty username", func(r *RegisterRequest) { r.Username = "" }, "username"},
+		{"username with spaces", func(r *RegisterRequest) { r.Username = "demo user" }, "username"},
+		{"empty password", func(r *RegisterRequest) { r.Password = "" }, "password"},
+		{"password without digit", func(r *RegisterRequest) { r.Password = "secretpassword" }, "password"},
+		{"password without letter", func(r *RegisterRequest) { r.Password = "12345678" }, "password"},
+		{"empty full name", func(r *RegisterRequest) { r.FullName = "" }, "fullname"},
+		{"invalid email", func(r *RegisterRequest) { r.Email = "demo@" }, "email"},
+		{"invalid phone", func(r *RegisterRequest) { r.Phone = "call me" }, "phone"},
+	}
+	for _, tc := range tests {
+		r := valid
+		tc.modify(&r)
+		err := r.Validate()
+		if assert.NotNil(t, err, tc.name) {
+			assert.Contains(t, err.(validation.Errors), tc.field, tc.name)
+		}
+	}
+
+	r := valid
+	r.Phone = ""
+	assert.Nil(t, r.Validate())
+}
@@ -0,0 +1,193 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	stderrors "errors"
+	routing "github.com/go-ozzo/ozzo-routing/v2"
+	"github.com/online-shop/internal/entity"
+	"github.com/online-shop/internal/errors"
+	"github.com/online-shop/pkg/tracing"
+	"net"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// sessionTouchInterval is how often the last activity of a session is recorded, to spare the database.
+	sessionTouchInterval = time.Minute
+	// maxUserAgentLength is the length user agents are truncated to.
+	maxUserAgentLength = 255
+)
+
+// SessionValidator checks the sessions JWTs belong to.
+type SessionValidator interface {
+	// ValidateSession returns an error unless the given session of the given user is active, recording its activity.
+	ValidateSession(ctx context.Context, userID, sessionID string) error
+}
+
+// Session describes where a user is logged in.
+type Session struct {
+	ID         string    `json:"id"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	// Current tells whether the session is the one of the request.
+	Current bool `json:"current"`
+}
+
+// newSession creates the view of a session.
+func newSession(session entity.Session, current string) Session {
+	return Session{
+		ID:         session.ID,
+		UserAgent:  session.UserAgent,
+		IP:         session.IP,
+		CreatedAt:  session.CreatedAt,
+		LastSeenAt: session.LastSeenAt,
+		ExpiresAt:  session.ExpiresAt,
+		Current:    session.ID == current,
+	}
+}
+
+// client describes the device a request comes from.
+type client struct {
+	IP        string
+	UserAgent string
+}
+
+// withClient returns a context holding the device the request of the given routing context comes from,
+// which is recorded by the sessions created on login.
+func withClient(c *routing.Context) context.Context {
+	ip, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+	if err != nil {
+		ip = c.Request.RemoteAddr
+	}
+	userAgent := c.Request.UserAgent()
+	if len(userAgent) > maxUserAgentLength {
+		// the user agent is cut before a character rather than in the middle of one
+		n := maxUserAgentLength
+		for n > 0 && !utf8.RuneStart(userAgent[n]) {
+			n--
+		}
+		userAgent = userAgent[:n]
+	}
+	return context.WithValue(c.Request.Context(), clientKey, client{IP: ip, UserAgent: userAgent})
+}
+
+// currentClient returns the device the request in the given context comes from, if known.
+func currentClient(ctx context.Context) client {
+	c, _ := ctx.Value(clientKey).(client)
+	return c
+}
+
+// withSession returns a context holding the ID of the session the request was authenticated with.
+func withSession(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, sessionKey, id)
+}
+
+// currentSession returns the ID of the session the request in the given context was authenticated with.
+// It is empty for requests authenticated otherwise, such as with API keys.
+func currentSession(ctx context.Context) string {
+	id, _ := ctx.Value(sessionKey).(string)
+	return id
+}
+
+// startSession records a new session of the given user, lasting as long as their JWT.
+func (s service) startSession(ctx context.Context, userID string, now time.Time) (entity.Session, error) {
+	c := currentClient(ctx)
+	session := entity.Session{
+		ID:         entity.GenerateID(),
+		UserID:     userID,
+		UserAgent:  c.UserAgent,
+		IP:         c.IP,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(time.Duration(s.tokenExpiration) * time.Hour),
+	}
+	return session, s.repo.CreateSession(ctx, session)
+}
+
+// ValidateSession returns an error unless the given session of the given user is active, recording its activity.
+func (s service) ValidateSession(ctx context.Context, userID, sessionID string) error {
+	ctx, span := tracing.StartSpan(ctx, "auth.Service.ValidateSession")
+	defer span.End()
+
+	session, err := s.repo.GetSession(ctx, sessionID)
+	if err != nil {
+		if stderrors.Is(err, sql.ErrNoRows) {
+			return errors.Unauthorized("")
+		}
+		return err
+	}
+	now := time.Now()
+	if session.UserID != userID || session.RevokedAt != nil || !session.ExpiresAt.After(now) {
+		return errors.Unauthorized("")
+	}
+
+	if now.Sub(session.LastSeenAt) >= sessionTouchInterval {
+		if err := s.repo.TouchSession(ctx, session.ID, now); err != nil {
+			s.logger.With(ctx, "session", session.ID).Errorf("failed to record the activity of session: %v", err)
+		}
+	}
+	return nil
+}
+
+// ListSessions returns the active sessions of the current user, most recently seen first.
+func (s service) ListSessions(ctx context.Context) ([]Session, error) {
+	ctx, span := tracing.StartSpan(ctx, "auth.Service.ListSessions")
+	defer span.End()
+
+	identity := CurrentUser(ctx)
+	if identity == nil {
+		return nil, errors.Unauthorized("")
+	}
+	sessions, err := s.repo.ListSessions(ctx, identity.GetID(), time.Now())
+	if err != nil {
+		return nil, err
+	}
+	current := currentSession(ctx)
+	items := make([]Session, len(sessions))
+	for i, session := range sessions {
+		items[i] = newSession(session, current)
+	}
+	return items, nil
+}
+
+// RevokeSession logs the current user out of one of their sessions, which may be the current one.
+func (s service) RevokeSession(ctx context.Context, id string) error {
+	ctx, span := tracing.StartSpan(ctx, "auth.Service.RevokeSession")
+	defer span.End()
+
+	identity := CurrentUser(ctx)
+	if identity == nil {
+		return errors.Unauthorized("")
+	}
+	session, err := s.repo.GetSession(ctx, id)
+	if err != nil {
+		if stderrors.Is(err, sql.ErrNoRows) {
+			return errors.NotFound("")
+		}
+		return err
+	}
+	// do not reveal the sessions of other users
+	if session.UserID != identity.GetID() {
+		return errors.NotFound("")
+	}
+
+	if err := s.repo.RevokeSession(ctx, session.ID, time.Now()); err != nil {
+		return err
+	}
+	s.logger.With(ctx, "user", identity.GetUsername(), "session", session.ID).Infof("session revoked")
+	return nil
+}
+
+// revokeOtherSessions logs a user out everywhere but in the current session, if any.
+func (s service) revokeOtherSessions(ctx context.Context, user entity.User) error {
+	if err := s.repo.RevokeSessions(ctx, user.ID, currentSession(ctx), time.Now()); err != nil {
+		return err
+	}
+	s.logger.With(ctx, "user", user.Username).Infof("other sessions revoked")
+	return nil
+}
@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"context"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/online-shop/internal/entity"
+	"github.com/online-shop/internal/errors"
+	"github.com/online-shop/internal/test"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// loginFrom logs the demo user in from a device having the given user agent, returning the ID of the new session.
+func loginFrom(t *testing.T, s Service, userAgent string) string {
+	req, _ := http.NewRequest("POST", "http://example.com/v1/login", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("User-Agent", userAgent)
+	c, _ := test.MockRoutingContext(req)
+
+	result, err := s.Login(withClient(c), "demo", "pass")
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	token, err := s.(service).keys.Parse(result.Token)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	return token.Claims.(jwt.MapClaims)["sid"].(string)
+}
+
+func TestWithClient(t *testing.T) {
+	req, _ := http.NewRequest("POST", "http://example.com/v1/login", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	// the last character does not fit, and must not be split
+	req.Header.Set("User-Agent", strings.Repeat("a", maxUserAgentLength-1)+"é")
+	c, _ := test.MockRoutingContext(req)
+
+	client := currentClient(withClient(c))
+	assert.Equal(t, "192.0.2.1", client.IP)
+	assert.Equal(t, strings.Repeat("a", maxUserAgentLength-1), client.UserAgent)
+	assert.True(t, utf8.ValidString(client.UserAgent))
+}
+
+func TestService_Sessions(t *testing.T) {
+	s, repo, ctx := newProfileTestService(t)
+	phone := loginFrom(t, s, "Phone")
+	laptop := loginFrom(t, s, "Laptop")
+	session := repo.sessions[laptop]
+	assert.Equal(t, "100", session.UserID)
+	assert.Equal(t, "192.0.2.1", session.IP)
+	assert.Equal(t, "Laptop", session.UserAgent)
+	assert.Nil(t, s.ValidateSession(context.Background(), "100", laptop))
+
+	session.LastSeenAt = session.LastSeenAt.Add(-time.Hour)
+	repo.sessions[laptop] = session
+	assert.Nil(t, s.ValidateSession(context.Background(), "100", laptop))
+	assert.True(t, repo.sessions[laptop].LastSeenAt.After(session.LastSeenAt), "activity is recorded")
+
+	sessions, err := s.ListSessions(withSession(ctx, laptop))
+	assert.Nil(t, err)
+	// the laptop was seen last
+	if assert.Len(t, sessions, 2) {
+		assert.Equal(t, laptop, sessions[0].ID)
+		assert.True(t, sessions[0].Current)
+		assert.Equal(t, phone, sessions[1].ID)
+		assert.False(t, sessions[1].Current)
+	}
+
+	// the sessions of other users cannot be revoked
+	other := WithUser(context.Background(), "200", "other")
+	assert.Equal(t, errors.NotFound(""), s.RevokeSession(other, phone))
+	assert.Equal(t, errors.NotFound(""), s.RevokeSession(ctx, "unknown"))
+
+	assert.Nil(t, s.RevokeSession(ctx, phone))
+	assert.Equal(t, http.StatusUnauthorized, s.ValidateSession(context.Background(), "100", phone).(errors.ErrorResponse).Status)
+	sessions, _ = s.ListSessions(ctx)
+	assert.Len(t, sessions, 1)
+
+	// sessions are bound to their user
+	assert.NotNil(t, s.ValidateSession(context.Background(), "200", laptop))
+}
+
+func TestService_ValidateSession_expired(t *testing.T) {
+	s, repo, _ := newProfileTestService(t)
+	repo.sessions["old"] = entity.Session{ID: "old", UserID: "100", ExpiresAt: time.Now().Add(-time.Minute)}
+	assert.Equal(t, http.StatusUnauthorized, s.ValidateSession(context.Background(), "100", "old").(errors.ErrorResponse).Status)
+	assert.Equal(t, http.StatusUnauthorized, s.ValidateSession(context.Background(), "100", "missing").(errors.ErrorResponse).Status)
+}
+
+func TestService_ChangePassword_revokesOtherSessions(t *testing.T) {
+	s, repo, ctx := newProfileTestService(t)
+	phone := loginFrom(t, s, "Phone")
+	laptop := loginFrom(t, s, "Laptop")
+
+	assert.Nil(t, s.ChangePassword(withSession(ctx, laptop), ChangePasswordRequest{OldPassword: "pass", NewPassword: "secret123"}))
+	assert.NotNil(t, repo.sessions[phone].RevokedAt)
+	assert.Nil(t, repo.sessions[laptop].RevokedAt)
+}
@@ -0,0 +1,262 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	stderrors "errors"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/go-ozzo/ozzo-validation/v4/is"
+	"github.com/online-shop/internal/entity"
+	"github.com/online-shop/pkg/mailer"
+	"github.com/online-shop/pkg/tracing"
+	"net/url"
+	"time"
+)
+
+const (
+	// emailVerificationTTL is how long an email verification link stays valid.
+	emailVerificationTTL = 48 * time.Hour
+	// passwordResetTTL is how long a password reset link stays valid.
+	passwordResetTTL = time.Hour
+	// passwordResetTimeout is how long the lookup of a user and the mailing of their password reset link may take.
+	passwordResetTimeout = time.Minute
+)
+
+// VerifyEmailRequest represents the confirmation of an email address.
+type VerifyEmailRequest struct {
+	Token string `json:"token"`
+}
+
+// Validate validates the VerifyEmailRequest fields.
+func (r VerifyEmailRequest) Validate() error {
+	return validation.ValidateStruct(&r,
+		validation.Field(&r.Token, validation.Required),
+	)
+}
+
+// ForgotPasswordRequest represents a request for a password reset link.
+type ForgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+// Validate validates the ForgotPasswordRequest fields.
+func (r ForgotPasswordRequest) Validate() error {
+	return validation.ValidateStruct(&r,
+		validation.Field(&r.Email, validation.Required, validation.Length(0, 254), is.Email),
+	)
+}
+
+// ResetPasswordRequest represents the choice of a new password with a password reset token.
+type ResetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// Validate validates the ResetPasswordRequest fields.
+func (r ResetPasswordRequest) Validate() error {
+	return validation.ValidateStruct(&r,
+		validation.Field(&r.Token, validation.Required),
+		validation.Field(&r.Password, passwordRules...),
+	)
+}
+
+// errInvalidToken reports that a token is unknown, expired or already used.
+var errInvalidToken = validation.Errors{"token": stderrors.New("is invalid or expired")}
+
+// newToken generates a random token, returning it along with the hash to store.
+func newToken() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	return token, hashToken(token), nil
+}
+
+// hashToken returns the hash under which the given token is stored.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// sendToken issues a token for the given purpose and mails a link containing it to the user.
+func (s service) sendToken(ctx context.Context, user entity.User, purpose string, ttl time.Duration, path string, tmpl *mailer.Template) error {
+	token, hash, err := newToken()
+	if err != nil {
+		return err
+	}
+	err = s.repo.CreateToken(ctx, entity.UserToken{
+		Hash:      hash,
+		UserID:    user.ID,
+		Purpose:   purpose,
+		Email:     user.Email,
+		ExpiresAt: time.Now().Add(ttl),
+	})
+	if err != nil {
+		return err
+	}
+
+	name := user.FullName
+	if name == "" {
+		name = user.Username
+	}
+	msg, err := tmpl.Render(user.Email, mailData{
+		Name:    name,
+		Link:    s.appURL + path + "?token=" + url.QueryEscape(token),
+		Expires: ttl,
+	})
+	if err != nil {
+		return err
+	}
+	return s.mailer.Send(ctx, msg)
+}
+
+// sendVerificationEmail mails an email verification link to the user.
+func (s service) sendVerificationEmail(ctx context.Context, user entity.User) error {
+	return s.sendToken(ctx, user, entity.TokenEmailVerification, emailVerificationTTL, "/verify-email", verificationMail)
+}
+
+// ResendVerificationEmail mails a new email verification link to the current user.
+// Nothing is sent if their email address is already verified.
+func (s service) ResendVerificationEmail(ctx context.Context) error {
+	ctx, span := tracing.StartSpan(ctx, "auth.Service.ResendVerificationEmail")
+	defer span.End()
+
+	user, err := s.currentUser(ctx)
+	if err != nil {
+		return err
+	}
+	if user.EmailVerified {
+		return nil
+	}
+	return s.sendVerificationEmail(ctx, user)
+}
+
+// VerifyEmail marks the email address a verification token was sent to as verified.
+// The token is refused if the user changed their email address since.
+func (s service) VerifyEmail(ctx context.Context, input VerifyEmailRequest) error {
+	ctx, span := tracing.StartSpan(ctx, "auth.Service.VerifyEmail")
+	defer span.End()
+
+	token, err := s.consumeToken(ctx, input.Token, entity.TokenEmailVerification)
+	if err != nil {
+		return err
+	}
+	user, err := s.repo.Get(ctx, token.UserID)
+	if err != nil {
+		if stderrors.Is(err, sql.ErrNoRows) {
+			return errInvalidToken
+		}
+		return err
+	}
+	if user.Email != token.Email {
+		return errInvalidToken
+	}
+
+	user.EmailVerified = true
+	if err := s.repo.Update(ctx, user); err != nil {
+		return err
+	}
+	s.logger.With(ctx, "user", user.Username).Infof("email verified")
+	return nil
+}
+
+// RequestPasswordReset mails a password reset link to the user having the given email address.
+// It succeeds whether or not there is such a user, so that it cannot be used to find out who has an account:
+// the user is looked up and mailed in the background, for the response not to take longer when they exist.
+func (s service) RequestPasswordReset(ctx context.Context, input ForgotPasswordRequest) error {
+	ctx, span := tracing.StartSpan(ctx, "auth.Service.RequestPasswordReset")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(detachedContext{ctx}, passwordResetTimeout)
+	s.background(func() {
+		defer cancel()
+		if err := s.sendPasswordReset(ctx, input.Email); err != nil {
+			s.logger.With(ctx).Errorf("failed to send a password reset link: %v", err)
+		}
+	})
+	return nil
+}
+
+// sendPasswordReset mails a password reset link to the user having the given email address, if any.
+func (s service) sendPasswordReset(ctx context.Context, email string) error {
+	user, err := s.repo.FindByEmail(ctx, email)
+	if err != nil {
+		if stderrors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return err
+	}
+	return s.sendToken(ctx, user, entity.TokenPasswordReset, passwordResetTTL, "/reset-password", passwordResetMail)
+}
+
+// detachedContext carries the values of a request context, such as its request ID, without being cancelled
+// when the request completes.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// ResetPassword replaces the password of the user a password reset token was sent to.
+// As the user proved they own their email address, their account also gets unlocked and their email verified.
+func (s service) ResetPassword(ctx context.Context, input ResetPasswordRequest) error {
+	ctx, span := tracing.StartSpan(ctx, "auth.Service.ResetPassword")
+	defer span.End()
+
+	// the password is checked first, so that a refused password does not burn the token
+	hashedPassword, err := s.hashPassword("password", input.Password)
+	if err != nil {
+		return err
+	}
+	// the token is used up along with the change of the password, so that it stays valid if the change fails
+	var user entity.User
+	err = s.repo.Transaction(ctx, func(ctx context.Context) error {
+		token, err := s.consumeToken(ctx, input.Token, entity.TokenPasswordReset)
+		if err != nil {
+			return err
+		}
+		user, err = s.repo.Get(ctx, token.UserID)
+		if err != nil {
+			if stderrors.Is(err, sql.ErrNoRows) {
+				return errInvalidToken
+			}
+			return err
+		}
+		if user.Email != token.Email {
+			return errInvalidToken
+		}
+
+		user.Password = hashedPassword
+		user.EmailVerified = true
+		if err := s.repo.Update(ctx, user); err != nil {
+			return err
+		}
+		user.FailedLogins, user.LockedUntil = 0, nil
+		return s.repo.UpdateLoginAttempts(ctx, user)
+	})
+	if err != nil {
+		return err
+	}
+	s.logger.With(ctx, "user", user.Username).Infof("password reset")
+	// the request is anonymous, so that every session is revoked
+	return s.revokeOtherSessions(ctx, user)
+}
+
+// consumeToken uses up the given token, which must have been issued for the given purpose.
+func (s service) consumeToken(ctx context.Context, token, purpose string) (entity.UserToken, error) {
+	t, err := s.repo.ConsumeToken(ctx, hashToken(token), purpose, time.Now())
+	if err != nil {
+		if stderrors.Is(err, sql.ErrNoRows) {
+			return t, errInvalidToken
+		}
+		return t, err
+	}
+	return t, nil
+}
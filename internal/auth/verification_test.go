@@ -0,0 +1,138 @@
+package auth
+
+import (
+	"context"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/online-shop/internal/entity"
+	"github.com/online-shop/internal/errors"
+	"github.com/online-shop/pkg/log"
+	"github.com/online-shop/pkg/mailer"
+	"github.com/online-shop/pkg/password"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+)
+
+var mailedToken = regexp.MustCompile(`\?token=(\S+)`)
+
+// tokenFrom extracts the token from the link mailed in the given message.
+func tokenFrom(t *testing.T, msg mailer.Message) string {
+	m := mailedToken.FindStringSubmatch(msg.Text)
+	if !assert.NotNil(t, m, "no link in %q", msg.Text) {
+		return ""
+	}
+	token, err := url.QueryUnescape(m[1])
+	assert.Nil(t, err)
+	return token
+}
+
+func TestService_VerifyEmail(t *testing.T) {
+	logger, _ := log.NewForTest()
+	repo := newMockRepository(t, entity.User{ID: "100", Username: "demo"}, "pass")
+	mail := mailer.NewMemoryMailer("")
+	s := NewService(repo, newTestKeys(t), 100, mail, "https://shop.test", true, newTestHasher(), password.DefaultPolicy, nil, logger)
+
+	assert.Nil(t, s.CreateUser(context.Background(), RegisterRequest{Username: "new", Password: "secret123", FullName: "New User", Email: "new@example.com"}))
+	msg, ok := mail.Last("new@example.com")
+	if !assert.True(t, ok) {
+		return
+	}
+	assert.Contains(t, msg.Text, "New User")
+	assert.Contains(t, msg.HTML, "https://shop.test/verify-email?token=")
+
+	// logins are refused until the email address is verified
+	_, err := s.Login(context.Background(), "new", "secret123")
+	assert.Equal(t, http.StatusForbidden, err.(errors.ErrorResponse).Status)
+
+	token := tokenFrom(t, msg)
+	assert.Nil(t, s.VerifyEmail(context.Background(), VerifyEmailRequest{Token: token}))
+	_, err = s.Login(context.Background(), "new", "secret123")
+	assert.Nil(t, err)
+
+	// tokens are single-use
+	assert.Equal(t, errInvalidToken, s.VerifyEmail(context.Background(), VerifyEmailRequest{Token: token}))
+	assert.Equal(t, errInvalidToken, s.VerifyEmail(context.Background(), VerifyEmailRequest{Token: "unknown"}))
+}
+
+func TestService_VerifyEmail_changedEmail(t *testing.T) {
+	s, repo, ctx := newProfileTestService(t)
+	mail := s.(service).mailer.(*mailer.MemoryMailer)
+
+	_, err := s.ChangeEmail(ctx, ChangeEmailRequest{Email: "first@example.com", Password: "pass"})
+	assert.Nil(t, err)
+	msg, ok := mail.Last("first@example.com")
+	assert.True(t, ok)
+	_, err = s.ChangeEmail(ctx, ChangeEmailRequest{Email: "second@example.com", Password: "pass"})
+	assert.Nil(t, err)
+
+	// the link sent to the previous address no longer verifies anything
+	assert.Equal(t, errInvalidToken, s.VerifyEmail(context.Background(), VerifyEmailRequest{Token: tokenFrom(t, msg)}))
+	assert.False(t, repo.users["100"].EmailVerified)
+
+	assert.Nil(t, s.ResendVerificationEmail(ctx))
+	msg, _ = mail.Last("second@example.com")
+	assert.Nil(t, s.VerifyEmail(context.Background(), VerifyEmailRequest{Token: tokenFrom(t, msg)}))
+	assert.True(t, repo.users["100"].EmailVerified)
+}
+
+func TestService_ResetPassword(t *testing.T) {
+	logger, _ := log.NewForTest()
+	lockedUntil := time.Now().Add(time.Hour)
+	repo := newMockRepository(t, entity.User{ID: "100", Username: "demo", Email: "demo@example.com", FailedLogins: 7, LockedUntil: &lockedUntil}, "pass")
+	mail := mailer.NewMemoryMailer("")
+	s := NewService(repo, newTestKeys(t), 100, mail, "https://shop.test", false, newTestHasher(), password.DefaultPolicy, nil, logger).(service)
+	var tasks []func()
+	s.background = func(fn func()) { tasks = append(tasks, fn) }
+
+	// unknown addresses are not revealed, as users are only looked up in the background
+	assert.Nil(t, s.RequestPasswordReset(context.Background(), ForgotPasswordRequest{Email: "unknown@example.com"}))
+	assert.Nil(t, s.RequestPasswordReset(context.Background(), ForgotPasswordRequest{Email: "demo@example.com"}))
+	assert.Empty(t, mail.Messages())
+	assert.Len(t, tasks, 2)
+	for _, task := range tasks {
+		task()
+	}
+	assert.Len(t, mail.Messages(), 1)
+	msg, ok := mail.Last("demo@example.com")
+	if !assert.True(t, ok) {
+		return
+	}
+	assert.Contains(t, msg.Text, "https://shop.test/reset-password?token=")
+	token := tokenFrom(t, msg)
+
+	// a verification token cannot be used to reset the password
+	assert.Equal(t, errInvalidToken, s.VerifyEmail(context.Background(), VerifyEmailRequest{Token: token}))
+
+	assert.Nil(t, s.ResetPassword(context.Background(), ResetPasswordRequest{Token: token, Password: "secret123"}))
+	assert.Nil(t, repo.users["100"].LockedUntil)
+	_, err := s.Login(context.Background(), "demo", "secret123")
+	assert.Nil(t, err)
+
+	assert.Equal(t, errInvalidToken, s.ResetPassword(context.Background(), ResetPasswordRequest{Token: token, Password: "another123"}))
+}
+
+func TestService_ResetPassword_expired(t *testing.T) {
+	logger, _ := log.NewForTest()
+	repo := newMockRepository(t, entity.User{ID: "100", Username: "demo", Email: "demo@example.com"}, "pass")
+	s := NewService(repo, newTestKeys(t), 100, mailer.NewMemoryMailer(""), "https://shop.test", false, newTestHasher(), password.DefaultPolicy, nil, logger)
+
+	repo.tokens[hashToken("expired")] = entity.UserToken{
+		Hash:      hashToken("expired"),
+		UserID:    "100",
+		Purpose:   entity.TokenPasswordReset,
+		Email:     "demo@example.com",
+		ExpiresAt: time.Now().Add(-time.Minute),
+	}
+	assert.Equal(t, errInvalidToken, s.ResetPassword(context.Background(), ResetPasswordRequest{Token: "expired", Password: "secret123"}))
+}
+
+func TestResetPasswordRequest_Validate(t *testing.T) {
+	assert.Nil(t, ResetPasswordRequest{Token: "abc", Password: "secret123"}.Validate())
+	errs := ResetPasswordRequest{Password: "short"}.Validate().(validation.Errors)
+	assert.Contains(t, errs, "token")
+	assert.Contains(t, errs, "password")
+	assert.Contains(t, ForgotPasswordRequest{Email: "demo@"}.Validate().(validation.Errors), "email")
+}
@@ -0,0 +1,107 @@
+package category
+
+import (
+	routing "github.com/go-ozzo/ozzo-routing/v2"
+	"github.com/online-shop/internal/auth"
+	"github.com/online-shop/internal/entity"
+	"github.com/online-shop/internal/errors"
+	"github.com/online-shop/internal/response"
+	"github.com/online-shop/pkg/log"
+	"net/http"
+	"strconv"
+)
+
+// RegisterHandlers sets up the routing of the HTTP handlers. The category tree is read through the public group,
+// which anonymous requests may use, and only administrators can change it through the protected one.
+func RegisterHandlers(public, protected *routing.RouteGroup, service Service, logger log.Logger) {
+	res := resource{service, logger}
+
+	public.Get("/categories", auth.RequireScope(auth.ScopeProductsRead), res.tree)
+	public.Get("/categories/<slug>/products", auth.RequireScope(auth.ScopeProductsRead), res.products)
+
+	admin := auth.RequireRole(entity.RoleAdmin)
+	protected.Post("/categories", admin, res.create)
+	protected.Post("/categories/<slug>/move", admin, res.move)
+	protected.Put("/categories/<slug>/products/<product_id>", admin, res.assignProduct)
+	protected.Delete("/categories/<slug>/products/<product_id>", admin, res.unassignProduct)
+}
+
+type resource struct {
+	service Service
+	logger  log.Logger
+}
+
+func (r resource) tree(c *routing.Context) error {
+	categories, err := r.service.Tree(c.Request.Context())
+	if err != nil {
+		return err
+	}
+
+	return c.Write(categories)
+}
+
+func (r resource) products(c *routing.Context) error {
+	products, err := r.service.Products(c.Request.Context(), c.Param("slug"))
+	if err != nil {
+		return err
+	}
+
+	return c.Write(products)
+}
+
+func (r resource) create(c *routing.Context) error {
+	var input CreateCategoryRequest
+	if err := c.Read(&input); err != nil {
+		r.logger.With(c.Request.Context()).Info(err)
+		return errors.BadRequest("")
+	}
+	if err := input.Validate(); err != nil {
+		return err
+	}
+	category, err := r.service.Create(c.Request.Context(), input)
+	if err != nil {
+		return err
+	}
+
+	return c.WriteWithStatus(category, http.StatusCreated)
+}
+
+func (r resource) move(c *routing.Context) error {
+	var input MoveCategoryRequest
+	if err := c.Read(&input); err != nil {
+		r.logger.With(c.Request.Context()).Info(err)
+		return errors.BadRequest("")
+	}
+	if err := input.Validate(); err != nil {
+		return err
+	}
+	if err := r.service.Move(c.Request.Context(), c.Param("slug"), input); err != nil {
+		return err
+	}
+
+	return c.Write(response.SuccessResponse())
+}
+
+func (r resource) assignProduct(c *routing.Context) error {
+	productID, err := strconv.ParseInt(c.Param("product_id"), 10, 64)
+	if err != nil {
+		return errors.NotFound("")
+	}
+	if err := r.service.AssignProduct(c.Request.Context(), c.Param("slug"), productID); err != nil {
+		return err
+	}
+
+	return c.Write(response.SuccessResponse())
+}
+
+func (r resource) unassignProduct(c *routing.Context) error {
+	productID, err := strconv.ParseInt(c.Param("product_id"), 10, 64)
+	if err != nil {
+		return errors.NotFound("")
+	}
+	if err := r.service.UnassignProduct(c.Request.Context(), c.Param("slug"), productID); err != nil {
+		return err
+	}
+
+	return c.Write(response.SuccessResponse())
+}
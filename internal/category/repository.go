@@ -0,0 +1,156 @@
+package category
+
+import (
+	"context"
+	"fmt"
+	"github.com/online-shop/internal/entity"
+	"github.com/online-shop/pkg/log"
+	"github.com/online-shop/pkg/mysql"
+	"strings"
+)
+
+// Repository persists categories and the assignment of products to them.
+type Repository interface {
+	// List returns all categories, ordered by position among their siblings.
+	List(ctx context.Context) ([]entity.Category, error)
+	// ListForUpdate returns all categories like List, locking them until the end of the transaction.
+	ListForUpdate(ctx context.Context) ([]entity.Category, error)
+	Create(ctx context.Context, category entity.Category) error
+	// Update saves the parent, slug, name and position of a category.
+	Update(ctx context.Context, category entity.Category) error
+	// GetProduct returns the product having the given ID.
+	GetProduct(ctx context.Context, id int64) (entity.Product, error)
+	// ListProducts returns the products assigned to any of the given categories.
+	ListProducts(ctx context.Context, categoryIDs []string) ([]entity.Product, error)
+	// AssignProduct adds a product to a category. Assigning it again has no effect.
+	AssignProduct(ctx context.Context, productID int64, categoryID string) error
+	// UnassignProduct removes a product from a category.
+	UnassignProduct(ctx context.Context, productID int64, categoryID string) error
+	// Transaction runs fn in a transaction, which the repository calls made with the context given to fn are
+	// part of.
+	Transaction(ctx context.Context, fn func(ctx context.Context) error) error
+}
+
+// repository persists categories in database
+type repository struct {
+	db     mysql.BaseRepository
+	logger log.Logger
+}
+
+// NewRepository creates a new category repository
+func NewRepository(db mysql.BaseRepository, logger log.Logger) Repository {
+	return repository{db, logger}
+}
+
+func (r repository) List(ctx context.Context) ([]entity.Category, error) {
+	q := fmt.Sprintf("select id, parent_id, slug, name, position from category order by position, name")
+
+	var categories []entity.Category
+
+	err := r.db.FetchRows(ctx, q, &categories)
+	if err != nil {
+		return categories, err
+	}
+
+	return categories, nil
+}
+
+func (r repository) ListForUpdate(ctx context.Context) ([]entity.Category, error) {
+	q := fmt.Sprintf("select id, parent_id, slug, name, position from category order by position, name for update")
+
+	var categories []entity.Category
+
+	err := r.db.FetchRows(ctx, q, &categories)
+	if err != nil {
+		return categories, err
+	}
+
+	return categories, nil
+}
+
+func (r repository) Create(ctx context.Context, category entity.Category) error {
+	q := fmt.Sprintf("insert into category (id, parent_id, slug, name, position) " +
+		"values (:id, :parent_id, :slug, :name, :position)")
+
+	_, err := r.db.Exec(ctx, q, category)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r repository) Update(ctx context.Context, category entity.Category) error {
+	q := fmt.Sprintf("update category set parent_id = :parent_id, slug = :slug, name = :name, position = :position " +
+		"where id = :id")
+
+	_, err := r.db.Exec(ctx, q, category)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r repository) GetProduct(ctx context.Context, id int64) (entity.Product, error) {
+	q := fmt.Sprintf("select id, name, description, stock, price from product where id = ?")
+
+	var product entity.Product
+
+	err := r.db.FetchRow(ctx, q, &product, id)
+	if err != nil {
+		return product, err
+	}
+
+	return product, nil
+}
+
+func (r repository) ListProducts(ctx context.Context, categoryIDs []string) ([]entity.Product, error) {
+	var products []entity.Product
+	if len(categoryIDs) == 0 {
+		return products, nil
+	}
+
+	q := fmt.Sprintf("select distinct p.id, p.name, p.description, p.stock, p.price, p.rating, p.review_count "+
+		"from product p "+
+		"join product_category pc on pc.product_id = p.id "+
+		"where pc.category_id in (%s) "+
+		"order by p.name", strings.TrimSuffix(strings.Repeat("?,", len(categoryIDs)), ","))
+
+	args := make([]interface{}, len(categoryIDs))
+	for i, id := range categoryIDs {
+		args[i] = id
+	}
+	err := r.db.FetchRows(ctx, q, &products, args...)
+	if err != nil {
+		return products, err
+	}
+
+	return products, nil
+}
+
+func (r repository) AssignProduct(ctx context.Context, productID int64, categoryID string) error {
+	q := fmt.Sprintf("insert ignore into product_category (product_id, category_id) values (:product_id, :category_id)")
+
+	_, err := r.db.Exec(ctx, q, map[string]interface{}{"product_id": productID, "category_id": categoryID})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r repository) UnassignProduct(ctx context.Context, productID int64, categoryID string) error {
+	q := fmt.Sprintf("delete from product_category where product_id = :product_id and category_id = :category_id")
+
+	_, err := r.db.Exec(ctx, q, map[string]interface{}{"product_id": productID, "category_id": categoryID})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r repository) Transaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return r.db.Transaction(ctx, fn)
+}
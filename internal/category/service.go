@@ -0,0 +1,360 @@
+package category
+
+import (
+	"context"
+	stderrors "errors"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/online-shop/internal/entity"
+	"github.com/online-shop/internal/errors"
+	"github.com/online-shop/pkg/log"
+	"github.com/online-shop/pkg/mysql"
+	"github.com/online-shop/pkg/tracing"
+	"regexp"
+)
+
+// Service encapsulates the logic of the category tree. The whole tree is loaded for every operation,
+// catalogues having at most a few hundred categories.
+type Service interface {
+	// Tree returns the top-level categories, along with their descendants.
+	Tree(ctx context.Context) ([]Category, error)
+	// Products returns the products of the category having the given slug, and of all its descendants.
+	Products(ctx context.Context, slug string) ([]entity.Product, error)
+	// Create adds a category to the tree.
+	Create(ctx context.Context, input CreateCategoryRequest) (Category, error)
+	// Move moves a category, along with its descendants, under another parent and/or to another position.
+	Move(ctx context.Context, slug string, input MoveCategoryRequest) error
+	// AssignProduct adds a product to a category.
+	AssignProduct(ctx context.Context, slug string, productID int64) error
+	// UnassignProduct removes a product from a category.
+	UnassignProduct(ctx context.Context, slug string, productID int64) error
+}
+
+// Category is a category along with its subcategories.
+type Category struct {
+	Slug     string     `json:"slug"`
+	Name     string     `json:"name"`
+	Position int        `json:"position"`
+	Children []Category `json:"children"`
+}
+
+var slugFormat = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// CreateCategoryRequest represents a request to create a category.
+type CreateCategoryRequest struct {
+	Name string `json:"name"`
+	Slug string `json:"slug"`
+	// Parent is the slug of the parent category, empty for top-level categories.
+	Parent string `json:"parent"`
+	// Position is where to insert the category among its siblings, after the last one if unset.
+	Position *int `json:"position"`
+}
+
+// Validate validates the CreateCategoryRequest fields.
+func (r CreateCategoryRequest) Validate() error {
+	return validation.ValidateStruct(&r,
+		validation.Field(&r.Name, validation.Required, validation.Length(1, 100)),
+		validation.Field(&r.Slug, validation.Required, validation.Length(1, 64), validation.Match(slugFormat)),
+		validation.Field(&r.Position, validation.Min(0)),
+	)
+}
+
+// MoveCategoryRequest represents a request to move a category and its descendants.
+type MoveCategoryRequest struct {
+	// Parent is the slug of the new parent category, empty to make the category a top-level one.
+	Parent string `json:"parent"`
+	// Position is where to insert the category among its new siblings, after the last one if unset.
+	Position *int `json:"position"`
+}
+
+// Validate validates the MoveCategoryRequest fields.
+func (r MoveCategoryRequest) Validate() error {
+	return validation.ValidateStruct(&r,
+		validation.Field(&r.Position, validation.Min(0)),
+	)
+}
+
+// ProductIndexer updates the search index of products, which includes their categories.
+type ProductIndexer interface {
+	IndexProduct(ctx context.Context, id int64) error
+}
+
+type service struct {
+	repo    Repository
+	indexer ProductIndexer
+	logger  log.Logger
+}
+
+// NewService creates a new category service, updating the given index when products are assigned to categories.
+func NewService(repo Repository, indexer ProductIndexer, logger log.Logger) Service {
+	return service{repo, indexer, logger}
+}
+
+// tree indexes categories by slug and by parent.
+type tree struct {
+	bySlug map[string]entity.Category
+	// children maps the IDs of categories to their subcategories in order, top-level categories being under "".
+	children map[string][]entity.Category
+}
+
+// newTree indexes the given categories, which must be ordered by position.
+func newTree(categories []entity.Category) tree {
+	t := tree{bySlug: map[string]entity.Category{}, children: map[string][]entity.Category{}}
+	for _, c := range categories {
+		t.bySlug[c.Slug] = c
+		t.children[parentOf(c)] = append(t.children[parentOf(c)], c)
+	}
+	return t
+}
+
+// parentOf returns the ID of the parent of the given category, empty for top-level categories.
+func parentOf(c entity.Category) string {
+	if c.ParentID == nil {
+		return ""
+	}
+	return *c.ParentID
+}
+
+// descendants returns the IDs of the given category and of all its descendants.
+func (t tree) descendants(id string) []string {
+	ids := []string{id}
+	for i := 0; i < len(ids); i++ {
+		for _, c := range t.children[ids[i]] {
+			ids = append(ids, c.ID)
+		}
+	}
+	return ids
+}
+
+// view returns the given categories along with their descendants.
+func (t tree) view(categories []entity.Category) []Category {
+	items := make([]Category, len(categories))
+	for i, c := range categories {
+		items[i] = Category{Slug: c.Slug, Name: c.Name, Position: c.Position, Children: t.view(t.children[c.ID])}
+	}
+	return items
+}
+
+// place inserts the given category among the children of the given parent, at the given position or after the
+// last child, and renumbers the children. It returns the children whose parent or position changed.
+func (t tree) place(category entity.Category, parentID string, position *int) []entity.Category {
+	var siblings []entity.Category
+	for _, c := range t.children[parentID] {
+		if c.ID != category.ID {
+			siblings = append(siblings, c)
+		}
+	}
+	at := len(siblings)
+	if position != nil && *position < at {
+		at = *position
+	}
+	siblings = append(siblings[:at], append([]entity.Category{category}, siblings[at:]...)...)
+
+	var changed []entity.Category
+	for i, c := range siblings {
+		if c.ID == category.ID || c.Position != i {
+			c.Position = i
+			if parentID == "" {
+				c.ParentID = nil
+			} else {
+				id := parentID
+				c.ParentID = &id
+			}
+			changed = append(changed, c)
+		}
+	}
+	return changed
+}
+
+// load returns the category tree.
+func (s service) load(ctx context.Context) (tree, error) {
+	categories, err := s.repo.List(ctx)
+	if err != nil {
+		return tree{}, err
+	}
+	return newTree(categories), nil
+}
+
+// loadForUpdate returns the category tree, locking it until the end of the transaction so that concurrent changes
+// of the tree are made one after the other, each one checked against the tree left by the previous one.
+func (s service) loadForUpdate(ctx context.Context) (tree, error) {
+	categories, err := s.repo.ListForUpdate(ctx)
+	if err != nil {
+		return tree{}, err
+	}
+	return newTree(categories), nil
+}
+
+// get returns the tree along with the category having the given slug.
+func (s service) get(ctx context.Context, slug string) (tree, entity.Category, error) {
+	t, err := s.load(ctx)
+	if err != nil {
+		return tree{}, entity.Category{}, err
+	}
+	category, ok := t.bySlug[slug]
+	if !ok {
+		return tree{}, entity.Category{}, errors.NotFound("")
+	}
+	return t, category, nil
+}
+
+// parentID returns the ID of the category having the given slug, which is to become a parent.
+func (t tree) parentID(slug string) (string, error) {
+	if slug == "" {
+		return "", nil
+	}
+	parent, ok := t.bySlug[slug]
+	if !ok {
+		return "", validation.Errors{"parent": stderrors.New("must be an existing category")}
+	}
+	return parent.ID, nil
+}
+
+func (s service) Tree(ctx context.Context) ([]Category, error) {
+	ctx, span := tracing.StartSpan(ctx, "category.Service.Tree")
+	defer span.End()
+
+	t, err := s.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return t.view(t.children[""]), nil
+}
+
+func (s service) Products(ctx context.Context, slug string) ([]entity.Product, error) {
+	ctx, span := tracing.StartSpan(ctx, "category.Service.Products")
+	defer span.End()
+
+	t, category, err := s.get(ctx, slug)
+	if err != nil {
+		return nil, err
+	}
+	products, err := s.repo.ListProducts(ctx, t.descendants(category.ID))
+	if err != nil {
+		return nil, err
+	}
+	if products == nil {
+		products = []entity.Product{}
+	}
+	return products, nil
+}
+
+func (s service) Create(ctx context.Context, input CreateCategoryRequest) (Category, error) {
+	ctx, span := tracing.StartSpan(ctx, "category.Service.Create")
+	defer span.End()
+
+	category := entity.Category{ID: entity.GenerateID(), Slug: input.Slug, Name: input.Name}
+	// the siblings of the category are renumbered along with its creation, or not at all
+	err := s.repo.Transaction(ctx, func(ctx context.Context) error {
+		t, err := s.loadForUpdate(ctx)
+		if err != nil {
+			return err
+		}
+		if _, ok := t.bySlug[input.Slug]; ok {
+			return errors.Conflict("", "slug")
+		}
+		parentID, err := t.parentID(input.Parent)
+		if err != nil {
+			return err
+		}
+
+		for _, c := range t.place(category, parentID, input.Position) {
+			if c.ID == category.ID {
+				category = c
+				err = s.repo.Create(ctx, c)
+			} else {
+				err = s.repo.Update(ctx, c)
+			}
+			if err != nil {
+				if dbErr := mysql.Classify(err); dbErr != nil && dbErr.Kind == mysql.DuplicateKey {
+					return errors.Conflict("", "slug")
+				}
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return Category{}, err
+	}
+	s.logger.With(ctx, "category", category.Slug).Infof("category created")
+	return Category{Slug: category.Slug, Name: category.Name, Position: category.Position, Children: []Category{}}, nil
+}
+
+func (s service) Move(ctx context.Context, slug string, input MoveCategoryRequest) error {
+	ctx, span := tracing.StartSpan(ctx, "category.Service.Move")
+	defer span.End()
+
+	// the tree is locked while checking the move, so that concurrent moves cannot make a cycle
+	err := s.repo.Transaction(ctx, func(ctx context.Context) error {
+		t, err := s.loadForUpdate(ctx)
+		if err != nil {
+			return err
+		}
+		category, ok := t.bySlug[slug]
+		if !ok {
+			return errors.NotFound("")
+		}
+		parentID, err := t.parentID(input.Parent)
+		if err != nil {
+			return err
+		}
+		for _, id := range t.descendants(category.ID) {
+			if id == parentID {
+				return validation.Errors{"parent": stderrors.New("must not be the category itself or one of its descendants")}
+			}
+		}
+
+		for _, c := range t.place(category, parentID, input.Position) {
+			if err := s.repo.Update(ctx, c); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.logger.With(ctx, "category", slug, "parent", input.Parent).Infof("category moved")
+	return nil
+}
+
+func (s service) AssignProduct(ctx context.Context, slug string, productID int64) error {
+	ctx, span := tracing.StartSpan(ctx, "category.Service.AssignProduct")
+	defer span.End()
+
+	_, category, err := s.get(ctx, slug)
+	if err != nil {
+		return err
+	}
+	if _, err := s.repo.GetProduct(ctx, productID); err != nil {
+		return err
+	}
+	if err := s.repo.AssignProduct(ctx, productID, category.ID); err != nil {
+		return err
+	}
+	s.reindex(ctx, productID)
+	return nil
+}
+
+func (s service) UnassignProduct(ctx context.Context, slug string, productID int64) error {
+	ctx, span := tracing.StartSpan(ctx, "category.Service.UnassignProduct")
+	defer span.End()
+
+	_, category, err := s.get(ctx, slug)
+	if err != nil {
+		return err
+	}
+	if err := s.repo.UnassignProduct(ctx, productID, category.ID); err != nil {
+		return err
+	}
+	s.reindex(ctx, productID)
+	return nil
+}
+
+// reindex updates the search index after a change of the categories of a product. Failures are only logged,
+// the change being already saved.
+func (s service) reindex(ctx context.Context, productID int64) {
+	if err := s.indexer.IndexProduct(ctx, productID); err != nil {
+		s.logger.With(ctx, "product", productID).Errorf("failed to index product: %v", err)
+	}
+}
@@ -0,0 +1,281 @@
+package category
+
+import (
+	"context"
+	"database/sql"
+	stderrors "errors"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/online-shop/internal/auth"
+	"github.com/online-shop/internal/entity"
+	"github.com/online-shop/internal/errors"
+	"github.com/online-shop/internal/test"
+	"github.com/online-shop/pkg/log"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+)
+
+type mockRepository struct {
+	categories []entity.Category
+	products   map[int64]entity.Product
+	// assignments maps category IDs to the IDs of their products.
+	assignments map[string][]int64
+	// inTransaction tells whether a transaction is running, and failing is the ID of the category whose updates fail.
+	inTransaction bool
+	failing       string
+}
+
+func (m *mockRepository) List(ctx context.Context) ([]entity.Category, error) {
+	categories := append([]entity.Category{}, m.categories...)
+	sort.SliceStable(categories, func(i, j int) bool { return categories[i].Position < categories[j].Position })
+	return categories, nil
+}
+
+func (m *mockRepository) ListForUpdate(ctx context.Context) ([]entity.Category, error) {
+	if !m.inTransaction {
+		return nil, stderrors.New("categories locked outside of a transaction")
+	}
+	return m.List(ctx)
+}
+
+// Transaction rolls the categories back if fn fails.
+func (m *mockRepository) Transaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	categories := append([]entity.Category{}, m.categories...)
+	m.inTransaction = true
+	defer func() { m.inTransaction = false }()
+	if err := fn(ctx); err != nil {
+		m.categories = categories
+		return err
+	}
+	return nil
+}
+
+func (m *mockRepository) Create(ctx context.Context, category entity.Category) error {
+	m.categories = append(m.categories, category)
+	return nil
+}
+
+func (m *mockRepository) Update(ctx context.Context, category entity.Category) error {
+	if category.ID == m.failing {
+		return sql.ErrConnDone
+	}
+	for i, c := range m.categories {
+		if c.ID == category.ID {
+			m.categories[i] = category
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (m *mockRepository) GetProduct(ctx context.Context, id int64) (entity.Product, error) {
+	if product, ok := m.products[id]; ok {
+		return product, nil
+	}
+	return entity.Product{}, sql.ErrNoRows
+}
+
+func (m *mockRepository) ListProducts(ctx context.Context, categoryIDs []string) ([]entity.Product, error) {
+	var products []entity.Product
+	seen := map[int64]bool{}
+	for _, id := range categoryIDs {
+		for _, productID := range m.assignments[id] {
+			if !seen[productID] {
+				seen[productID] = true
+				products = append(products, m.products[productID])
+			}
+		}
+	}
+	return products, nil
+}
+
+func (m *mockRepository) AssignProduct(ctx context.Context, productID int64, categoryID string) error {
+	for _, id := range m.assignments[categoryID] {
+		if id == productID {
+			return nil
+		}
+	}
+	m.assignments[categoryID] = append(m.assignments[categoryID], productID)
+	return nil
+}
+
+func (m *mockRepository) UnassignProduct(ctx context.Context, productID int64, categoryID string) error {
+	ids := m.assignments[categoryID][:0]
+	for _, id := range m.assignments[categoryID] {
+		if id != productID {
+			ids = append(ids, id)
+		}
+	}
+	m.assignments[categoryID] = ids
+	return nil
+}
+
+// mockIndexer records the products indexed.
+type mockIndexer struct {
+	indexed []int64
+}
+
+func (m *mockIndexer) IndexProduct(ctx context.Context, id int64) error {
+	m.indexed = append(m.indexed, id)
+	return nil
+}
+
+// newTestService returns a service over the tree clothing > (shirts, trousers), shoes.
+func newTestService(t *testing.T) (Service, *mockRepository, *mockIndexer) {
+	logger, _ := log.NewForTest()
+	repo := &mockRepository{
+		products: map[int64]entity.Product{
+			1: {ID: 1, Name: "Oxford shirt", Stock: 3, Price: 30},
+			2: {ID: 2, Name: "Chinos", Stock: 5, Price: 40},
+			3: {ID: 3, Name: "Sneakers", Stock: 2, Price: 60},
+		},
+		assignments: map[string][]int64{},
+	}
+	indexer := &mockIndexer{}
+	s := NewService(repo, indexer, logger)
+	for _, input := range []CreateCategoryRequest{
+		{Name: "Clothing", Slug: "clothing"},
+		{Name: "Shoes", Slug: "shoes"},
+		{Name: "Trousers", Slug: "trousers", Parent: "clothing"},
+		{Name: "Shirts", Slug: "shirts", Parent: "clothing", Position: new(int)},
+	} {
+		if _, err := s.Create(context.Background(), input); !assert.Nil(t, err) {
+			t.FailNow()
+		}
+	}
+	return s, repo, indexer
+}
+
+// slugs returns the slugs of the given categories, with the slugs of their children in parentheses.
+func slugs(categories []Category) []string {
+	var items []string
+	for _, c := range categories {
+		item := c.Slug
+		if len(c.Children) > 0 {
+			item += "(" + strings.Join(slugs(c.Children), " ") + ")"
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+func TestCreateCategoryRequest_Validate(t *testing.T) {
+	assert.Nil(t, CreateCategoryRequest{Name: "T-shirts", Slug: "t-shirts-2"}.Validate())
+
+	negative := -1
+	errs := CreateCategoryRequest{Slug: "T shirts", Position: &negative}.Validate().(validation.Errors)
+	assert.Contains(t, errs, "name")
+	assert.Contains(t, errs, "slug")
+	assert.Contains(t, errs, "position")
+	assert.Contains(t, CreateCategoryRequest{Name: "T-shirts", Slug: "t--shirts"}.Validate().(validation.Errors), "slug")
+}
+
+func TestService_Create(t *testing.T) {
+	s, _, _ := newTestService(t)
+
+	tree, err := s.Tree(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"clothing(shirts trousers)", "shoes"}, slugs(tree))
+	assert.Equal(t, 1, tree[0].Children[1].Position)
+	assert.NotNil(t, tree[1].Children, "leaves have an empty list of children")
+
+	_, err = s.Create(context.Background(), CreateCategoryRequest{Name: "Other shirts", Slug: "shirts"})
+	assert.Equal(t, http.StatusConflict, err.(errors.ErrorResponse).Status)
+	_, err = s.Create(context.Background(), CreateCategoryRequest{Name: "Socks", Slug: "socks", Parent: "unknown"})
+	assert.Contains(t, err.(validation.Errors), "parent")
+}
+
+func TestService_Move(t *testing.T) {
+	s, _, _ := newTestService(t)
+	ctx := context.Background()
+	first := 0
+
+	// subtrees move along with their category
+	assert.Nil(t, s.Move(ctx, "clothing", MoveCategoryRequest{Parent: "shoes"}))
+	tree, _ := s.Tree(ctx)
+	assert.Equal(t, []string{"shoes(clothing(shirts trousers))"}, slugs(tree))
+
+	assert.Nil(t, s.Move(ctx, "trousers", MoveCategoryRequest{Position: &first}))
+	tree, _ = s.Tree(ctx)
+	assert.Equal(t, []string{"trousers", "shoes(clothing(shirts))"}, slugs(tree))
+
+	// categories cannot be moved under themselves
+	err := s.Move(ctx, "shoes", MoveCategoryRequest{Parent: "shirts"})
+	assert.Contains(t, err.(validation.Errors), "parent")
+	err = s.Move(ctx, "shoes", MoveCategoryRequest{Parent: "shoes"})
+	assert.Contains(t, err.(validation.Errors), "parent")
+	assert.Equal(t, http.StatusNotFound, s.Move(ctx, "unknown", MoveCategoryRequest{}).(errors.ErrorResponse).Status)
+}
+
+func TestService_Move_failure(t *testing.T) {
+	s, repo, _ := newTestService(t)
+	ctx := context.Background()
+	first := 0
+
+	// moving shoes first among the top-level categories renumbers clothing, whose update fails
+	repo.failing = repo.categories[0].ID
+	assert.Equal(t, sql.ErrConnDone, s.Move(ctx, "shoes", MoveCategoryRequest{Position: &first}))
+	tree, _ := s.Tree(ctx)
+	assert.Equal(t, []string{"clothing(shirts trousers)", "shoes"}, slugs(tree))
+	assert.Equal(t, 1, tree[1].Position, "positions are left as they were")
+
+	_, err := s.Create(ctx, CreateCategoryRequest{Name: "Hats", Slug: "hats", Position: &first})
+	assert.Equal(t, sql.ErrConnDone, err)
+	tree, _ = s.Tree(ctx)
+	assert.Equal(t, []string{"clothing(shirts trousers)", "shoes"}, slugs(tree))
+}
+
+func TestService_Products(t *testing.T) {
+	s, _, indexer := newTestService(t)
+	ctx := context.Background()
+	assert.Nil(t, s.AssignProduct(ctx, "shirts", 1))
+	assert.Nil(t, s.AssignProduct(ctx, "trousers", 2))
+	assert.Nil(t, s.AssignProduct(ctx, "clothing", 2))
+	assert.Nil(t, s.AssignProduct(ctx, "shoes", 3))
+	assert.Equal(t, sql.ErrNoRows, s.AssignProduct(ctx, "shoes", 4))
+	assert.Equal(t, []int64{1, 2, 2, 3}, indexer.indexed, "products are indexed along with their categories")
+
+	// products of descendants are included once
+	products, err := s.Products(ctx, "clothing")
+	assert.Nil(t, err)
+	assert.Len(t, products, 2)
+	products, _ = s.Products(ctx, "shirts")
+	assert.Equal(t, []entity.Product{{ID: 1, Name: "Oxford shirt", Stock: 3, Price: 30}}, products)
+
+	assert.Nil(t, s.UnassignProduct(ctx, "shirts", 1))
+	products, _ = s.Products(ctx, "shirts")
+	assert.Equal(t, []entity.Product{}, products)
+	_, err = s.Products(ctx, "unknown")
+	assert.Equal(t, http.StatusNotFound, err.(errors.ErrorResponse).Status)
+}
+
+func TestAPI(t *testing.T) {
+	s, _, _ := newTestService(t)
+	logger, _ := log.NewForTest()
+	router := test.MockRouter(logger)
+	public, protected := auth.MockRouteGroups(router.Group("/v1"))
+	RegisterHandlers(public, protected, s, logger)
+	header := auth.MockAuthHeader()
+	admin := auth.MockAdminAuthHeader()
+
+	tests := []test.APITestCase{
+		{Name: "tree", Method: "GET", URL: "/v1/categories", Header: header, WantStatus: http.StatusOK, WantResponse: `*"slug":"shirts","name":"Shirts","position":0,"children":[]*`},
+		{Name: "create as customer", Method: "POST", URL: "/v1/categories", Body: `{"name":"Socks","slug":"socks"}`, Header: header, WantStatus: http.StatusForbidden},
+		{Name: "create", Method: "POST", URL: "/v1/categories", Body: `{"name":"Socks","slug":"socks","parent":"clothing"}`, Header: admin, WantStatus: http.StatusCreated, WantResponse: `{"slug":"socks","name":"Socks","position":2,"children":[]}`},
+		{Name: "create invalid", Method: "POST", URL: "/v1/categories", Body: `{"name":"Socks"}`, Header: admin, WantStatus: http.StatusBadRequest},
+		{Name: "move", Method: "POST", URL: "/v1/categories/socks/move", Body: `{"parent":"shoes"}`, Header: admin, WantStatus: http.StatusOK},
+		{Name: "assign", Method: "PUT", URL: "/v1/categories/shoes/products/3", Header: admin, WantStatus: http.StatusOK},
+		{Name: "assign unknown product", Method: "PUT", URL: "/v1/categories/shoes/products/x", Header: admin, WantStatus: http.StatusNotFound},
+		{Name: "products", Method: "GET", URL: "/v1/categories/shoes/products", Header: header, WantStatus: http.StatusOK, WantResponse: `*"name":"Sneakers"*`},
+		{Name: "unassign", Method: "DELETE", URL: "/v1/categories/shoes/products/3", Header: admin, WantStatus: http.StatusOK},
+		{Name: "unknown category", Method: "GET", URL: "/v1/categories/hats/products", Header: header, WantStatus: http.StatusNotFound},
+		{Name: "anonymous", Method: "GET", URL: "/v1/categories", WantStatus: http.StatusOK, WantResponse: `*"slug":"shirts"*`},
+		{Name: "invalid credentials", Method: "GET", URL: "/v1/categories", Header: http.Header{"Authorization": {"Bearer expired"}}, WantStatus: http.StatusUnauthorized},
+		{Name: "create anonymously", Method: "POST", URL: "/v1/categories", Body: `{"name":"Hats","slug":"hats"}`, WantStatus: http.StatusUnauthorized},
+	}
+	for _, tc := range tests {
+		test.Endpoint(t, router, tc)
+	}
+}
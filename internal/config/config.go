@@ -5,11 +5,28 @@ import (
 	"github.com/online-shop/pkg/log"
 	"os"
 	"strconv"
+	"strings"
 )
 
 const (
 	defaultServerPort         = 8080
 	defaultJWTExpirationHours = 72
+	defaultJWTKeysDir         = "keys"
+	defaultJWTAlgorithm       = "RS256"
+	defaultTraceExporter      = "none"
+	defaultRateLimitStore     = "memory"
+	defaultAppURL             = "http://localhost:8080"
+	defaultMailer             = "file"
+	defaultMailDir            = "mail"
+	defaultMailFrom           = "no-reply@localhost"
+	defaultSMTPPort           = 587
+	defaultPasswordHasher     = "argon2id"
+	defaultPasswordMinLength  = 8
+	defaultBlobStore          = "file"
+	defaultBlobDir            = "media"
+	defaultProductCacheSize   = 10000
+	defaultProductCacheTTL    = 30
+	defaultReservationMinutes = 30
 )
 
 // Config represents an application configuration.
@@ -18,17 +35,96 @@ type Config struct {
 	ServerPort int `env:"PORT"`
 	// the data source name (DSN) for connecting to the database. required.
 	DSN string `env:"DSN,secret"`
-	// JWT signing key. required.
-	JWTSigningKey string `env:"JWT_SIGNING_KEY,secret"`
+	// the directory holding the private keys signing JWTs. Defaults to "keys"
+	JWTKeysDir string `env:"JWT_KEYS_DIR"`
+	// the algorithm of new JWT signing keys: "RS256" or "ES256". Defaults to "RS256"
+	JWTAlgorithm string `env:"JWT_ALGORITHM"`
 	// JWT expiration in hours. Defaults to 72 hours (3 days)
 	JWTExpiration int `env:"JWT_EXPIRATION"`
+	// where to export trace spans: "none", "stdout" or "otlp". Defaults to "none"
+	TraceExporter string `env:"TRACE_EXPORTER"`
+	// the OTLP/HTTP collector endpoint, e.g. "localhost:4318". Only used by the "otlp" trace exporter.
+	OTLPEndpoint string `env:"OTEL_EXPORTER_OTLP_ENDPOINT"`
+	// where to keep rate limit buckets: "memory" (per server instance) or "mysql" (shared). Defaults to "memory"
+	RateLimitStore string `env:"RATE_LIMIT_STORE"`
+	// the base URL of the links sent by email. Defaults to "http://localhost:8080"
+	AppURL string `env:"APP_URL"`
+	// how to send emails: "smtp" or "file" (written into MailDir, for local development). Defaults to "file"
+	Mailer string `env:"MAILER"`
+	// the directory emails are written into by the "file" mailer. Defaults to "mail"
+	MailDir string `env:"MAIL_DIR"`
+	// the sender of emails. Defaults to "no-reply@localhost"
+	MailFrom string `env:"MAIL_FROM"`
+	// the SMTP server used by the "smtp" mailer. The port defaults to 587
+	SMTPHost     string `env:"SMTP_HOST"`
+	SMTPPort     int    `env:"SMTP_PORT"`
+	SMTPUsername string `env:"SMTP_USERNAME"`
+	SMTPPassword string `env:"SMTP_PASSWORD,secret"`
+	// whether users must verify their email address before logging in. Defaults to false
+	RequireVerifiedEmail bool `env:"REQUIRE_VERIFIED_EMAIL"`
+	// the algorithm hashing new passwords: "argon2id" or "bcrypt". Hashes of the other one are upgraded on login. Defaults to "argon2id"
+	PasswordHasher string `env:"PASSWORD_HASHER"`
+	// the minimum length of new passwords, in characters. Defaults to 8
+	PasswordMinLength int `env:"PASSWORD_MIN_LENGTH"`
+	// a file listing breached passwords, one per line, refused as new passwords. Optional
+	BreachedPasswordsFile string `env:"BREACHED_PASSWORDS_FILE"`
+	// the OpenID Connect providers users can log in with, as a comma separated list of names, e.g. "google".
+	// Each provider is configured with OIDC_<NAME>_ISSUER, OIDC_<NAME>_CLIENT_ID and OIDC_<NAME>_CLIENT_SECRET
+	OIDCProviders []OIDCProvider `env:"OIDC_PROVIDERS"`
+	// where to keep product images: "file" (in BlobDir, served under /media) or "s3". Defaults to "file"
+	BlobStore string `env:"BLOB_STORE"`
+	// the directory the "file" blob store keeps images in. Defaults to "media"
+	BlobDir string `env:"BLOB_DIR"`
+	// the public base URL of stored images. Defaults to "$APP_URL/media" for the "file" blob store
+	BlobURL string `env:"BLOB_URL"`
+	// the S3-compatible service used by the "s3" blob store, e.g. "https://s3.eu-west-1.amazonaws.com"
+	S3Endpoint  string `env:"S3_ENDPOINT"`
+	S3Region    string `env:"S3_REGION"`
+	S3Bucket    string `env:"S3_BUCKET"`
+	S3AccessKey string `env:"S3_ACCESS_KEY"`
+	S3SecretKey string `env:"S3_SECRET_KEY,secret"`
+	// the number of product reads each server instance caches. Defaults to 10000
+	ProductCacheSize int `env:"PRODUCT_CACHE_SIZE"`
+	// how long product reads are cached, in seconds. Defaults to 30
+	ProductCacheTTL int `env:"PRODUCT_CACHE_TTL"`
+	// the Redis-compatible server caching product reads for all server instances,
+	// e.g. "redis://:password@localhost:6379/0". Optional, each instance only caching products in memory otherwise
+	RedisURL string `env:"REDIS_URL,secret"`
+	// how long the stock of placed orders stays reserved until they are paid, in minutes. Defaults to 30
+	StockReservationTTL int `env:"STOCK_RESERVATION_TTL"`
+}
+
+// OIDCProvider is the registration of the application at an OpenID Connect provider.
+type OIDCProvider struct {
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
 }
 
 func Load(logger log.Logger) (*Config, error) {
 	// default config
 	c := Config{
-		ServerPort:    defaultServerPort,
-		JWTExpiration: defaultJWTExpirationHours,
+		ServerPort:     defaultServerPort,
+		JWTExpiration:  defaultJWTExpirationHours,
+		JWTKeysDir:     defaultJWTKeysDir,
+		JWTAlgorithm:   defaultJWTAlgorithm,
+		TraceExporter:  defaultTraceExporter,
+		RateLimitStore: defaultRateLimitStore,
+		AppURL:         defaultAppURL,
+		Mailer:         defaultMailer,
+		MailDir:        defaultMailDir,
+		MailFrom:       defaultMailFrom,
+		SMTPPort:       defaultSMTPPort,
+
+		PasswordHasher:    defaultPasswordHasher,
+		PasswordMinLength: defaultPasswordMinLength,
+		BlobStore:         defaultBlobStore,
+		BlobDir:           defaultBlobDir,
+		ProductCacheSize:  defaultProductCacheSize,
+		ProductCacheTTL:   defaultProductCacheTTL,
+
+		StockReservationTTL: defaultReservationMinutes,
 	}
 
 	err := godotenv.Load()
@@ -38,6 +134,48 @@ func Load(logger log.Logger) (*Config, error) {
 
 	c.ServerPort = getEnvAsInt("PORT", defaultServerPort)
 	c.DSN = os.Getenv("DSN")
+	c.JWTExpiration = getEnvAsInt("JWT_EXPIRATION", defaultJWTExpirationHours)
+	c.JWTKeysDir = getEnv("JWT_KEYS_DIR", defaultJWTKeysDir)
+	c.JWTAlgorithm = getEnv("JWT_ALGORITHM", defaultJWTAlgorithm)
+	c.TraceExporter = getEnv("TRACE_EXPORTER", defaultTraceExporter)
+	c.OTLPEndpoint = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	c.RateLimitStore = getEnv("RATE_LIMIT_STORE", defaultRateLimitStore)
+	c.AppURL = getEnv("APP_URL", defaultAppURL)
+	c.Mailer = getEnv("MAILER", defaultMailer)
+	c.MailDir = getEnv("MAIL_DIR", defaultMailDir)
+	c.MailFrom = getEnv("MAIL_FROM", defaultMailFrom)
+	c.SMTPHost = os.Getenv("SMTP_HOST")
+	c.SMTPPort = getEnvAsInt("SMTP_PORT", defaultSMTPPort)
+	c.SMTPUsername = os.Getenv("SMTP_USERNAME")
+	c.SMTPPassword = os.Getenv("SMTP_PASSWORD")
+	c.RequireVerifiedEmail = getEnvAsBool("REQUIRE_VERIFIED_EMAIL", false)
+	c.PasswordHasher = getEnv("PASSWORD_HASHER", defaultPasswordHasher)
+	c.PasswordMinLength = getEnvAsInt("PASSWORD_MIN_LENGTH", defaultPasswordMinLength)
+	c.BreachedPasswordsFile = os.Getenv("BREACHED_PASSWORDS_FILE")
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		c.OIDCProviders = append(c.OIDCProviders, OIDCProvider{
+			Name:         name,
+			Issuer:       os.Getenv(prefix + "ISSUER"),
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+		})
+	}
+	c.BlobStore = getEnv("BLOB_STORE", defaultBlobStore)
+	c.BlobDir = getEnv("BLOB_DIR", defaultBlobDir)
+	c.BlobURL = getEnv("BLOB_URL", strings.TrimSuffix(c.AppURL, "/")+"/media")
+	c.S3Endpoint = os.Getenv("S3_ENDPOINT")
+	c.S3Region = os.Getenv("S3_REGION")
+	c.S3Bucket = os.Getenv("S3_BUCKET")
+	c.S3AccessKey = os.Getenv("S3_ACCESS_KEY")
+	c.S3SecretKey = os.Getenv("S3_SECRET_KEY")
+	c.ProductCacheSize = getEnvAsInt("PRODUCT_CACHE_SIZE", defaultProductCacheSize)
+	c.ProductCacheTTL = getEnvAsInt("PRODUCT_CACHE_TTL", defaultProductCacheTTL)
+	c.RedisURL = os.Getenv("REDIS_URL")
+	c.StockReservationTTL = getEnvAsInt("STOCK_RESERVATION_TTL", defaultReservationMinutes)
 	//secretKey := os.Getenv("SECRET_KEY")
 
 	return &c, err
@@ -51,3 +189,20 @@ func getEnvAsInt(name string, defaultVal int) int {
 
 	return defaultVal
 }
+
+func getEnvAsBool(name string, defaultVal bool) bool {
+	valueStr := os.Getenv(name)
+	if value, err := strconv.ParseBool(valueStr); err == nil {
+		return value
+	}
+
+	return defaultVal
+}
+
+func getEnv(name string, defaultVal string) string {
+	if value, ok := os.LookupEnv(name); ok {
+		return value
+	}
+
+	return defaultVal
+}
@@ -0,0 +1,22 @@
+package entity
+
+import "time"
+
+// APIKey represents a long-lived key authenticating the requests of an integration on behalf of its owner.
+// Only the SHA-256 hash of the whole plain key, prefix included, is stored.
+type APIKey struct {
+	ID      string `db:"id"`
+	OwnerID string `db:"owner_id"`
+	Name    string `db:"name"`
+	// Prefix is the public part of the key, which identifies it.
+	Prefix string `db:"prefix"`
+	Hash   string `db:"hash"`
+	// Scopes is the comma separated list of the scopes the key is restricted to.
+	Scopes string `db:"scopes"`
+	// RateLimit is the number of requests per minute allowed with the key.
+	RateLimit  int        `db:"rate_limit"`
+	CreatedAt  time.Time  `db:"created_at"`
+	ExpiresAt  *time.Time `db:"expires_at"`
+	LastUsedAt *time.Time `db:"last_used_at"`
+	RevokedAt  *time.Time `db:"revoked_at"`
+}
@@ -0,0 +1,15 @@
+package entity
+
+import "time"
+
+// AuditRecord records a change made by a staff member, either on their own account or while impersonating a user.
+type AuditRecord struct {
+	ID     string `db:"id"`
+	UserID string `db:"user_id"`
+	// ActorID is the ID of the staff member impersonating the user, if any.
+	ActorID string `db:"actor_id"`
+	// Action is the method and path of the request.
+	Action    string    `db:"action"`
+	Status    int       `db:"status"`
+	CreatedAt time.Time `db:"created_at"`
+}
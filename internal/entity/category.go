@@ -0,0 +1,12 @@
+package entity
+
+// Category represents a node of the category tree products are browsed by.
+type Category struct {
+	ID string `db:"id"`
+	// ParentID is the ID of the parent category, nil for top-level categories.
+	ParentID *string `db:"parent_id"`
+	Slug     string  `db:"slug"`
+	Name     string  `db:"name"`
+	// Position orders the category among its siblings.
+	Position int `db:"position"`
+}
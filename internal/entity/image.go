@@ -0,0 +1,17 @@
+package entity
+
+import "time"
+
+// ProductImage is a picture of a product, stored along with thumbnails in several sizes.
+type ProductImage struct {
+	ID        string `db:"id" json:"id"`
+	ProductID int64  `db:"product_id" json:"-"`
+	// Extension is the file extension of the original image, which tells its format.
+	Extension string    `db:"extension" json:"-"`
+	Width     int       `db:"width" json:"width"`
+	Height    int       `db:"height" json:"height"`
+	CreatedAt time.Time `db:"created_at" json:"-"`
+	// URL and Thumbnails are the public URLs of the original image and of its thumbnails by size name.
+	URL        string            `db:"-" json:"url"`
+	Thumbnails map[string]string `db:"-" json:"thumbnails"`
+}
@@ -0,0 +1,61 @@
+package entity
+
+import "time"
+
+// Kinds of stock movements. Reservations hold units of the stock of a variant for an unpaid order, and releases
+// give them back when the order is cancelled or not paid in time. Deductions take reserved units out once orders
+// are paid. Adjustments are made by staff, after counting the stock for instance, and restocks put returned units
+// back on sale.
+const (
+	MovementReservation = "reservation"
+	MovementRelease     = "release"
+	MovementDeduction   = "deduction"
+	MovementAdjustment  = "adjustment"
+	MovementRestock     = "restock"
+)
+
+// StockMovement is an entry of the inventory ledger, which records every change of the stock of variants.
+type StockMovement struct {
+	ID        string `db:"id" json:"id"`
+	VariantID string `db:"variant_id" json:"variant_id"`
+	ProductID int64  `db:"product_id" json:"product_id"`
+	Kind      string `db:"kind" json:"kind"`
+	// Quantity is the change of the stock available for sale, and Reserved the change of the units reserved by
+	// orders.
+	Quantity int32 `db:"quantity" json:"quantity"`
+	Reserved int32 `db:"reserved" json:"reserved"`
+	// ReferenceID identifies what caused the movement, such as the ID of an order.
+	ReferenceID string `db:"reference_id" json:"reference_id"`
+	Note        string `db:"note" json:"note,omitempty"`
+	// CreatedBy is the ID of the staff member who made the movement, if any.
+	CreatedBy *string   `db:"created_by" json:"created_by,omitempty"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// States of stock reservations. Active reservations are either deducted once their order is paid, or released.
+const (
+	ReservationActive   = "active"
+	ReservationDeducted = "deducted"
+	ReservationReleased = "released"
+)
+
+// StockReservation is the quantity of a variant reserved by an order, until it expires unless paid.
+type StockReservation struct {
+	OrderID   string    `db:"order_id"`
+	VariantID string    `db:"variant_id"`
+	ProductID int64     `db:"product_id"`
+	Quantity  int32     `db:"quantity"`
+	Status    string    `db:"status"`
+	ExpiresAt time.Time `db:"expires_at"`
+	CreatedAt time.Time `db:"created_at"`
+	UpdatedAt time.Time `db:"updated_at"`
+}
+
+// StockLevel is the stock of a variant: the quantity available for sale and the units reserved by orders.
+type StockLevel struct {
+	VariantID string `db:"id" json:"variant_id"`
+	ProductID int64  `db:"product_id" json:"product_id"`
+	SKU       string `db:"sku" json:"sku"`
+	Stock     int32  `db:"stock" json:"stock"`
+	Reserved  int32  `db:"reserved" json:"reserved"`
+}
@@ -13,6 +13,7 @@ type Order struct {
 	DeliveredDate *time.Time `db:"delivered_date"`
 	Status        string     `db:"status"`
 	Amount        float64    `db:"amount"`
+	UpdatedAt     time.Time  `db:"updated_at"`
 	OrderDetails  []OrderDetail
 }
 
@@ -20,6 +21,7 @@ type OrderDetail struct {
 	ID        string  `db:"id"`
 	OrderID   string  `db:"order_id"`
 	ProductID int64   `db:"product_id"`
+	VariantID string  `db:"variant_id"`
 	Price     float64 `db:"price"`
 	Quantity  int32   `db:"quantity"`
 }
@@ -33,7 +35,11 @@ type CompleteOrder struct {
 	DeliveredDate *time.Time `db:"delivered_date"`
 	Status        string     `db:"status"`
 	Amount        float64    `db:"amount"`
+	UpdatedAt     time.Time  `db:"updated_at"`
 	ProductName   string     `db:"name"`
+	VariantID     string     `db:"variant_id"`
+	SKU           string     `db:"sku"`
+	Options       string     `db:"options"`
 	Price         float64    `db:"price"`
 	Quantity      int32      `db:"quantity"`
 }
@@ -1,9 +1,23 @@
 package entity
 
+import "time"
+
 // Album represents an album record.
 type Product struct {
-	ID    int64   `json:"id"`
-	Name  string  `json:"name"`
-	Stock int32   `json:"stock"`
-	Price float64 `json:"price"`
+	ID          int64   `json:"id"`
+	Name        string  `json:"name"`
+	Description string  `json:"description"`
+	Stock       int32   `json:"stock"`
+	Price       float64 `json:"price"`
+	// Rating is the average rating of the approved reviews of the product, and ReviewCount their number.
+	Rating      float64 `db:"rating" json:"rating"`
+	ReviewCount int32   `db:"review_count" json:"review_count"`
+	// Options and Variants are only loaded along with a single product.
+	Options  []ProductOption `db:"-" json:"options,omitempty"`
+	Variants []Variant       `db:"-" json:"variants,omitempty"`
+	// Images are in the order they were added.
+	Images []ProductImage `db:"-" json:"images,omitempty"`
+	// UpdatedAt is the last time the product, or its options, variants or images, changed. It is only loaded along
+	// with a single product, and sent as the Last-Modified header.
+	UpdatedAt time.Time `db:"updated_at" json:"-"`
 }
@@ -0,0 +1,27 @@
+package entity
+
+import "time"
+
+// Moderation states of reviews. Only approved reviews are published and count in the rating of their product.
+const (
+	ReviewPending  = "pending"
+	ReviewApproved = "approved"
+	ReviewRejected = "rejected"
+)
+
+// Review is the rating and opinion of a customer about a product they received.
+type Review struct {
+	ID        string `db:"id" json:"id"`
+	ProductID int64  `db:"product_id" json:"product_id"`
+	UserID    string `db:"user_id" json:"-"`
+	// Author is the username of the customer who wrote the review.
+	Author string `db:"author" json:"author"`
+	// Rating is from 1 to 5 stars.
+	Rating int    `db:"rating" json:"rating"`
+	Text   string `db:"text" json:"text"`
+	Status string `db:"status" json:"status"`
+	// ModeratedBy is the ID of the staff member who last changed the status of the review.
+	ModeratedBy *string   `db:"moderated_by" json:"-"`
+	CreatedAt   time.Time `db:"created_at" json:"created_at"`
+	UpdatedAt   time.Time `db:"updated_at" json:"updated_at"`
+}
@@ -0,0 +1,16 @@
+package entity
+
+import "time"
+
+// Session represents a login of a user on a device. Every JWT issued at login belongs to a session,
+// and stops authenticating requests once its session is revoked.
+type Session struct {
+	ID         string     `db:"id"`
+	UserID     string     `db:"user_id"`
+	UserAgent  string     `db:"user_agent"`
+	IP         string     `db:"ip"`
+	CreatedAt  time.Time  `db:"created_at"`
+	LastSeenAt time.Time  `db:"last_seen_at"`
+	ExpiresAt  time.Time  `db:"expires_at"`
+	RevokedAt  *time.Time `db:"revoked_at"`
+}
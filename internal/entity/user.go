@@ -1,14 +1,35 @@
 package entity
 
+import "time"
+
+const (
+	// RoleCustomer is the role of users who registered themselves.
+	RoleCustomer = "customer"
+	// RoleAdmin is the role of staff members administering the shop.
+	RoleAdmin = "admin"
+	// RoleService is the role of service accounts, which only authenticate with API keys.
+	RoleService = "service"
+)
+
 // User represents a user.
 type User struct {
-	ID       string `db:"id"`
-	Username string `db:"username"`
-	FullName string `db:"fullname"`
-	Phone    string `db:"phone"`
-	Email    string `db:"email"`
-	Password string `db:"password"`
-	Token    string `db:"token"`
+	ID            string     `db:"id"`
+	Username      string     `db:"username"`
+	FullName      string     `db:"fullname"`
+	Phone         string     `db:"phone"`
+	Email         string     `db:"email"`
+	EmailVerified bool       `db:"email_verified"`
+	Password      string     `db:"password"`
+	Token         string     `db:"token"`
+	Role          string     `db:"role"`
+	FailedLogins  int        `db:"failed_logins"`
+	LockedUntil   *time.Time `db:"locked_until"`
+	DeletedAt     *time.Time `db:"deleted_at"`
+	// TOTPSecret is the secret of the user's authenticator app. It is set but not enabled while enrolling.
+	TOTPSecret  string `db:"totp_secret"`
+	TOTPEnabled bool   `db:"totp_enabled"`
+	// TOTPLastStep is the time step of the last accepted code, which cannot be used again.
+	TOTPLastStep int64 `db:"totp_last_step"`
 }
 
 // GetID returns the user ID.
@@ -20,3 +41,13 @@ func (u User) GetID() string {
 func (u User) GetUsername() string {
 	return u.Username
 }
+
+// GetRole returns the user role.
+func (u User) GetRole() string {
+	return u.Role
+}
+
+// GetActorID returns the ID of the staff member impersonating the user, which is empty as users act for themselves.
+func (u User) GetActorID() string {
+	return ""
+}
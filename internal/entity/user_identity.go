@@ -0,0 +1,14 @@
+package entity
+
+import "time"
+
+// UserIdentity links a user to their account at an external identity provider, which they can log in with.
+type UserIdentity struct {
+	Provider string `db:"provider"`
+	// Subject identifies the user at the provider.
+	Subject string `db:"subject"`
+	UserID  string `db:"user_id"`
+	// Email is the address the provider knew the user by when the identity was linked.
+	Email     string    `db:"email"`
+	CreatedAt time.Time `db:"created_at"`
+}
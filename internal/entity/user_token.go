@@ -0,0 +1,30 @@
+package entity
+
+import "time"
+
+const (
+	// TokenEmailVerification is the purpose of tokens proving the ownership of an email address.
+	TokenEmailVerification = "email_verification"
+	// TokenPasswordReset is the purpose of tokens allowing to choose a new password.
+	TokenPasswordReset = "password_reset"
+)
+
+// UserToken represents a single-use token sent to a user by email.
+// Only the SHA-256 hash of the token is stored.
+type UserToken struct {
+	Hash    string `db:"token_hash"`
+	UserID  string `db:"user_id"`
+	Purpose string `db:"purpose"`
+	// Email is the address the token was sent to.
+	Email     string     `db:"email"`
+	ExpiresAt time.Time  `db:"expires_at"`
+	UsedAt    *time.Time `db:"used_at"`
+}
+
+// RecoveryCode represents a single-use code allowing a user to log in without their second factor.
+// Only the SHA-256 hash of the code is stored.
+type RecoveryCode struct {
+	UserID string     `db:"user_id"`
+	Hash   string     `db:"code_hash"`
+	UsedAt *time.Time `db:"used_at"`
+}
@@ -0,0 +1,57 @@
+package entity
+
+// ProductOption is a dimension products vary along, such as their size or color.
+type ProductOption struct {
+	ID        string `db:"id" json:"-"`
+	ProductID int64  `db:"product_id" json:"-"`
+	Name      string `db:"name" json:"name"`
+	// Position orders the options of a product, and the values of its variants in their names.
+	Position int `db:"position" json:"-"`
+}
+
+// Variant is a version of a product which is sold on its own, such as a shirt in a given size and color.
+type Variant struct {
+	ID        string `db:"id" json:"id"`
+	ProductID int64  `db:"product_id" json:"-"`
+	SKU       string `db:"sku" json:"sku"`
+	// Price overrides the price of the product when set.
+	Price   *float64 `db:"price" json:"price,omitempty"`
+	Stock   int32    `db:"stock" json:"stock"`
+	Barcode string   `db:"barcode" json:"barcode,omitempty"`
+	// Options are the values of the product options, in the order of the options.
+	Options []VariantOption `db:"-" json:"options"`
+}
+
+// VariantOption is the value a variant has for a product option.
+type VariantOption struct {
+	VariantID string `db:"variant_id" json:"-"`
+	OptionID  string `db:"option_id" json:"-"`
+	Name      string `db:"name" json:"name"`
+	Value     string `db:"value" json:"value"`
+}
+
+// VariantDetail is a variant along with the product it belongs to, as ordered by customers.
+type VariantDetail struct {
+	ID          string `db:"id"`
+	ProductID   int64  `db:"product_id"`
+	SKU         string `db:"sku"`
+	ProductName string `db:"product_name"`
+	// Options are the values of the variant, in the order of the product options and separated by slashes.
+	Options string `db:"options"`
+	// Price is the price of the variant, or of its product if the variant does not override it.
+	Price float64 `db:"price"`
+	Stock int32   `db:"stock"`
+}
+
+// Name returns the name of the variant, made of the name of its product and of its option values.
+func (v VariantDetail) Name() string {
+	return VariantName(v.ProductName, v.Options)
+}
+
+// VariantName returns the name of a variant having the given option values, separated by slashes.
+func VariantName(productName, options string) string {
+	if options == "" {
+		return productName
+	}
+	return productName + " (" + options + ")"
+}
@@ -7,8 +7,12 @@ import (
 	routing "github.com/go-ozzo/ozzo-routing/v2"
 	validation "github.com/go-ozzo/ozzo-validation/v4"
 	"github.com/online-shop/pkg/log"
+	"github.com/online-shop/pkg/mysql"
+	"math"
 	"net/http"
 	"runtime/debug"
+	"strconv"
+	"time"
 )
 
 // Handler creates a middleware that handles panics and errors encountered during HTTP request processing.
@@ -30,6 +34,9 @@ func Handler(logger log.Logger) routing.Handler {
 				if res.StatusCode() == http.StatusInternalServerError {
 					l.Errorf("encountered internal server error: %v", err)
 				}
+				if res.RetryAfter > 0 {
+					c.Response.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(res.RetryAfter.Seconds()))))
+				}
 				c.Response.WriteHeader(res.StatusCode())
 				if err = c.Write(res); err != nil {
 					l.Errorf("failed writing error response: %v", err)
@@ -64,5 +71,23 @@ func buildErrorResponse(err error) ErrorResponse {
 	if errors.Is(err, sql.ErrNoRows) {
 		return NotFound("")
 	}
+	if dbErr := mysql.Classify(err); dbErr != nil {
+		return buildDatabaseErrorResponse(dbErr)
+	}
+	return InternalServerError("")
+}
+
+// buildDatabaseErrorResponse builds an error response from a classified database error.
+func buildDatabaseErrorResponse(err *mysql.Error) ErrorResponse {
+	switch err.Kind {
+	case mysql.DuplicateKey:
+		return Conflict("", "")
+	case mysql.ForeignKey:
+		return UnprocessableEntity("The submitted data refers to a resource which does not exist or is still in use.", CodeInvalidReference)
+	case mysql.DataTooLong:
+		return UnprocessableEntity("A submitted value is too long.", CodeValueTooLong)
+	case mysql.Deadlock, mysql.LockTimeout:
+		return ServiceUnavailable("", CodeDatabaseBusy, time.Second)
+	}
 	return InternalServerError("")
 }
@@ -5,11 +5,13 @@ import (
 	"fmt"
 	routing "github.com/go-ozzo/ozzo-routing/v2"
 	validation "github.com/go-ozzo/ozzo-validation/v4"
+	driver "github.com/go-sql-driver/mysql"
 	"github.com/online-shop/pkg/log"
 	"github.com/stretchr/testify/assert"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 func TestHandler(t *testing.T) {
@@ -40,6 +42,15 @@ func TestHandler(t *testing.T) {
 		assert.Equal(t, http.StatusNotFound, res.Code)
 	})
 
+	t.Run("rate limited", func(t *testing.T) {
+		logger, _ := log.NewForTest()
+		handler := Handler(logger)
+		ctx, res := buildContext(handler, handlerTooManyRequests)
+		assert.Nil(t, ctx.Next())
+		assert.Equal(t, http.StatusTooManyRequests, res.Code)
+		assert.Equal(t, "2", res.Header().Get("Retry-After"))
+	})
+
 	t.Run("panic processing", func(t *testing.T) {
 		logger, entries := log.NewForTest()
 		handler := Handler(logger)
@@ -68,6 +79,26 @@ func Test_buildErrorResponse(t *testing.T) {
 
 	res = buildErrorResponse(fmt.Errorf("test"))
 	assert.Equal(t, http.StatusInternalServerError, res.Status)
+
+	res = buildErrorResponse(&driver.MySQLError{Number: 1062, Message: "Duplicate entry 'a' for key 'uq_user_username'"})
+	assert.Equal(t, http.StatusConflict, res.Status)
+	assert.Equal(t, CodeDuplicateValue, res.Code)
+
+	res = buildErrorResponse(&driver.MySQLError{Number: 1452})
+	assert.Equal(t, http.StatusUnprocessableEntity, res.Status)
+	assert.Equal(t, CodeInvalidReference, res.Code)
+
+	res = buildErrorResponse(&driver.MySQLError{Number: 1406})
+	assert.Equal(t, http.StatusUnprocessableEntity, res.Status)
+	assert.Equal(t, CodeValueTooLong, res.Code)
+
+	res = buildErrorResponse(fmt.Errorf("place order: %w", &driver.MySQLError{Number: 1213}))
+	assert.Equal(t, http.StatusServiceUnavailable, res.Status)
+	assert.Equal(t, CodeDatabaseBusy, res.Code)
+	assert.Equal(t, time.Second, res.RetryAfter)
+
+	res = buildErrorResponse(&driver.MySQLError{Number: 1064})
+	assert.Equal(t, http.StatusInternalServerError, res.Status)
 }
 
 func buildContext(handlers ...routing.Handler) (*routing.Context, *httptest.ResponseRecorder) {
@@ -88,6 +119,10 @@ func handlerHTTPError(c *routing.Context) error {
 	return NotFound("")
 }
 
+func handlerTooManyRequests(c *routing.Context) error {
+	return TooManyRequests("", 1500*time.Millisecond)
+}
+
 func handlerPanic(c *routing.Context) error {
 	panic("xyz")
 }
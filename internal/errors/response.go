@@ -4,13 +4,28 @@ import (
 	validation "github.com/go-ozzo/ozzo-validation/v4"
 	"net/http"
 	"sort"
+	"time"
+)
+
+// Machine-readable error codes, stable across releases so that clients can react to them.
+const (
+	CodeDuplicateValue   = "duplicate_value"
+	CodeInvalidReference = "invalid_reference"
+	CodeValueTooLong     = "value_too_long"
+	CodeDatabaseBusy     = "database_busy"
+	CodePriceChanged     = "price_changed"
+	CodeOutOfStock       = "out_of_stock"
+	CodeInvalidStatus    = "invalid_status"
 )
 
 // ErrorResponse is the response that represents an error.
 type ErrorResponse struct {
 	Status  int         `json:"status"`
+	Code    string      `json:"code,omitempty"`
 	Message string      `json:"message"`
 	Details interface{} `json:"details,omitempty"`
+	// RetryAfter tells the client how long to wait before retrying. It is sent as the Retry-After header.
+	RetryAfter time.Duration `json:"-"`
 }
 
 // Error is required by the error interface.
@@ -78,6 +93,83 @@ func BadRequest(msg string) ErrorResponse {
 	}
 }
 
+// RequestEntityTooLarge creates a new error response representing a request body exceeding a limit (HTTP 413)
+func RequestEntityTooLarge(msg string) ErrorResponse {
+	if msg == "" {
+		msg = "Your request is too large."
+	}
+	return ErrorResponse{
+		Status:  http.StatusRequestEntityTooLarge,
+		Message: msg,
+	}
+}
+
+// TooManyRequests creates a new error response representing a rate-limited request (HTTP 429)
+func TooManyRequests(msg string, retryAfter time.Duration) ErrorResponse {
+	if msg == "" {
+		msg = "You have sent too many requests. Please try again later."
+	}
+	return ErrorResponse{
+		Status:     http.StatusTooManyRequests,
+		Message:    msg,
+		RetryAfter: retryAfter,
+	}
+}
+
+// Conflict creates a new error response representing a conflict with an existing resource (HTTP 409).
+// If field is not empty, the details tell that the value submitted for that field is already taken.
+func Conflict(msg, field string) ErrorResponse {
+	if msg == "" {
+		msg = "The submitted data conflicts with an existing resource."
+	}
+	res := ErrorResponse{
+		Status:  http.StatusConflict,
+		Code:    CodeDuplicateValue,
+		Message: msg,
+	}
+	if field != "" {
+		res.Details = []invalidField{{Field: field, Error: "is already taken"}}
+	}
+	return res
+}
+
+// PreconditionFailed creates a new error response representing a request whose preconditions do not hold, such as
+// an If-Match header not matching the current version of a resource (HTTP 412).
+func PreconditionFailed(msg string) ErrorResponse {
+	if msg == "" {
+		msg = "The resource has been changed since you last read it."
+	}
+	return ErrorResponse{
+		Status:  http.StatusPreconditionFailed,
+		Message: msg,
+	}
+}
+
+// UnprocessableEntity creates a new error response representing well-formed data which cannot be stored (HTTP 422).
+func UnprocessableEntity(msg, code string) ErrorResponse {
+	if msg == "" {
+		msg = "The submitted data cannot be processed."
+	}
+	return ErrorResponse{
+		Status:  http.StatusUnprocessableEntity,
+		Code:    code,
+		Message: msg,
+	}
+}
+
+// ServiceUnavailable creates a new error response representing a temporary failure (HTTP 503).
+func ServiceUnavailable(msg, code string, retryAfter time.Duration) ErrorResponse {
+	if msg == "" {
+		msg = "The service is temporarily unavailable. Please try again later."
+	}
+	return ErrorResponse{
+		Status:     http.StatusServiceUnavailable,
+		Code:       code,
+		Message:    msg,
+		RetryAfter: retryAfter,
+	}
+}
+
 type invalidField struct {
 	Field string `json:"field"`
 	Error string `json:"error"`
@@ -1,10 +1,15 @@
 package healthcheck
 
-import routing "github.com/go-ozzo/ozzo-routing/v2"
+import (
+	routing "github.com/go-ozzo/ozzo-routing/v2"
+	"net/http"
+)
 
 // RegisterHandlers registers the handlers that perform healthchecks.
-func RegisterHandlers(r *routing.Router, version string) {
+func RegisterHandlers(r *routing.Router, version string, checker *Checker) {
 	r.To("GET,HEAD", "/healthcheck", healthcheck(version))
+	r.To("GET,HEAD", "/healthz", liveness(version))
+	r.To("GET,HEAD", "/readyz", readiness(version, checker))
 }
 
 // healthcheck responds to a healthcheck request.
@@ -13,3 +18,22 @@ func healthcheck(version string) routing.Handler {
 		return c.Write("OK " + version)
 	}
 }
+
+// liveness responds to a liveness probe. It only tells that the process is able to serve requests.
+func liveness(version string) routing.Handler {
+	return func(c *routing.Context) error {
+		return c.Write(Report{Status: statusOK, Version: version, Checks: []Result{}})
+	}
+}
+
+// readiness responds to a readiness probe by running every registered check.
+// It responds with 503 if any check fails or the server is shutting down.
+func readiness(version string, checker *Checker) routing.Handler {
+	return func(c *routing.Context) error {
+		results, ready := checker.Run(c.Request.Context())
+		if !ready {
+			return c.WriteWithStatus(Report{Status: statusNotReady, Version: version, Checks: results}, http.StatusServiceUnavailable)
+		}
+		return c.Write(Report{Status: statusReady, Version: version, Checks: results})
+	}
+}
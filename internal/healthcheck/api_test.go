@@ -1,17 +1,49 @@
 package healthcheck
 
 import (
+	"context"
+	"errors"
 	"github.com/online-shop/internal/test"
 	"github.com/online-shop/pkg/log"
 	"net/http"
 	"testing"
+	"time"
 )
 
 func TestAPI(t *testing.T) {
 	logger, _ := log.NewForTest()
 	router := test.MockRouter(logger)
-	RegisterHandlers(router, "0.9.0")
+	checker := NewChecker(time.Second)
+	checker.Register("db", func(ctx context.Context) error { return nil })
+	RegisterHandlers(router, "0.9.0", checker)
+
+	test.Endpoint(t, router, test.APITestCase{
+		Name: "ok", Method: "GET", URL: "/healthcheck", WantStatus: http.StatusOK, WantResponse: `"OK 0.9.0"`,
+	})
+	test.Endpoint(t, router, test.APITestCase{
+		Name: "live", Method: "GET", URL: "/healthz", WantStatus: http.StatusOK,
+		WantResponse: `{"status":"ok","version":"0.9.0","checks":[]}`,
+	})
+	test.Endpoint(t, router, test.APITestCase{
+		Name: "ready", Method: "GET", URL: "/readyz", WantStatus: http.StatusOK,
+		WantResponse: `*"status":"ready"*`,
+	})
+
+	checker.Register("cache", func(ctx context.Context) error { return errors.New("connection refused") })
+	test.Endpoint(t, router, test.APITestCase{
+		Name: "dependency down", Method: "GET", URL: "/readyz", WantStatus: http.StatusServiceUnavailable,
+		WantResponse: `*"error":"connection refused"*`,
+	})
+
+	checker = NewChecker(time.Second)
+	router = test.MockRouter(logger)
+	RegisterHandlers(router, "0.9.0", checker)
+	checker.Shutdown()
+	test.Endpoint(t, router, test.APITestCase{
+		Name: "shutting down", Method: "GET", URL: "/readyz", WantStatus: http.StatusServiceUnavailable,
+		WantResponse: `{"status":"not ready","version":"0.9.0","checks":[]}`,
+	})
 	test.Endpoint(t, router, test.APITestCase{
-		"ok", "GET", "/healthcheck", "", nil, http.StatusOK, `"OK 0.9.0"`,
+		Name: "live while shutting down", Method: "GET", URL: "/healthz", WantStatus: http.StatusOK,
 	})
 }
@@ -0,0 +1,133 @@
+package healthcheck
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	statusOK       = "ok"
+	statusFailed   = "failed"
+	statusReady    = "ready"
+	statusNotReady = "not ready"
+)
+
+// Check reports whether a dependency is healthy. A nil error means healthy.
+// Implementations should return promptly once the given context is done.
+type Check func(ctx context.Context) error
+
+// Result is the outcome of running a single Check.
+type Result struct {
+	Name    string  `json:"name"`
+	Status  string  `json:"status"`
+	Latency float64 `json:"latency_ms"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// Report is the outcome of running every registered Check.
+type Report struct {
+	Status  string   `json:"status"`
+	Version string   `json:"version"`
+	Checks  []Result `json:"checks"`
+}
+
+// Checker runs the readiness checks registered by the application's subsystems.
+type Checker struct {
+	timeout      time.Duration
+	mu           sync.RWMutex
+	checks       map[string]Check
+	shuttingDown int32
+}
+
+// NewChecker creates a new Checker which gives up on each check after the given timeout.
+func NewChecker(timeout time.Duration) *Checker {
+	return &Checker{
+		timeout: timeout,
+		checks:  map[string]Check{},
+	}
+}
+
+// Register adds a named check. Registering a check under an existing name replaces it.
+func (c *Checker) Register(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks[name] = check
+}
+
+// Shutdown marks the application as shutting down so that it stops reporting itself as ready.
+func (c *Checker) Shutdown() {
+	atomic.StoreInt32(&c.shuttingDown, 1)
+}
+
+// IsShuttingDown tells whether Shutdown has been called.
+func (c *Checker) IsShuttingDown() bool {
+	return atomic.LoadInt32(&c.shuttingDown) == 1
+}
+
+// Run executes all registered checks concurrently and reports whether every one of them succeeded.
+// The application is never reported as ready once Shutdown has been called.
+func (c *Checker) Run(ctx context.Context) ([]Result, bool) {
+	c.mu.RLock()
+	names := make([]string, 0, len(c.checks))
+	for name := range c.checks {
+		names = append(names, name)
+	}
+	checks := make([]Check, len(names))
+	sort.Strings(names)
+	for i, name := range names {
+		checks[i] = c.checks[name]
+	}
+	c.mu.RUnlock()
+
+	results := make([]Result, len(names))
+	var wg sync.WaitGroup
+	for i := range names {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = c.run(ctx, names[i], checks[i])
+		}(i)
+	}
+	wg.Wait()
+
+	ready := !c.IsShuttingDown()
+	for _, result := range results {
+		if result.Status != statusOK {
+			ready = false
+		}
+	}
+	return results, ready
+}
+
+// run executes a single check, bounding it by the checker timeout.
+func (c *Checker) run(ctx context.Context, name string, check Check) Result {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- check(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	result := Result{
+		Name:    name,
+		Status:  statusOK,
+		Latency: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		result.Status = statusFailed
+		result.Error = err.Error()
+	}
+	return result
+}
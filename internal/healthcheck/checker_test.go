@@ -0,0 +1,50 @@
+package healthcheck
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestChecker_Run(t *testing.T) {
+	checker := NewChecker(50 * time.Millisecond)
+	results, ready := checker.Run(context.Background())
+	assert.True(t, ready)
+	assert.Empty(t, results)
+
+	checker.Register("b", func(ctx context.Context) error { return nil })
+	checker.Register("a", func(ctx context.Context) error { return errors.New("down") })
+	checker.Register("c", func(ctx context.Context) error {
+		time.Sleep(time.Second)
+		return nil
+	})
+
+	results, ready = checker.Run(context.Background())
+	assert.False(t, ready)
+	if assert.Len(t, results, 3) {
+		assert.Equal(t, "a", results[0].Name)
+		assert.Equal(t, statusFailed, results[0].Status)
+		assert.Equal(t, "down", results[0].Error)
+		assert.Equal(t, "b", results[1].Name)
+		assert.Equal(t, statusOK, results[1].Status)
+		assert.Equal(t, "c", results[2].Name)
+		assert.Equal(t, statusFailed, results[2].Status)
+		assert.Equal(t, context.DeadlineExceeded.Error(), results[2].Error)
+		assert.Less(t, results[2].Latency, float64(time.Second.Milliseconds()))
+	}
+}
+
+func TestChecker_Shutdown(t *testing.T) {
+	checker := NewChecker(time.Second)
+	checker.Register("a", func(ctx context.Context) error { return nil })
+	assert.False(t, checker.IsShuttingDown())
+	_, ready := checker.Run(context.Background())
+	assert.True(t, ready)
+
+	checker.Shutdown()
+	assert.True(t, checker.IsShuttingDown())
+	_, ready = checker.Run(context.Background())
+	assert.False(t, ready)
+}
@@ -0,0 +1,84 @@
+package inventory
+
+import (
+	routing "github.com/go-ozzo/ozzo-routing/v2"
+	"github.com/online-shop/internal/auth"
+	"github.com/online-shop/internal/entity"
+	"github.com/online-shop/internal/errors"
+	"github.com/online-shop/pkg/log"
+	"github.com/online-shop/pkg/pagination"
+	"net/http"
+)
+
+// RegisterHandlers sets up the routing of the HTTP handlers, through which administrators follow and adjust the
+// stock of variants. The group must authenticate the requests.
+func RegisterHandlers(r *routing.RouteGroup, service Service, logger log.Logger) {
+	res := resource{service, logger}
+
+	admin := auth.RequireRole(entity.RoleAdmin)
+	r.Get("/inventory/variants/<id>/movements", admin, res.listMovements)
+	r.Post("/inventory/adjustments", admin, res.adjust)
+	r.Post("/inventory/restocks", admin, res.restock)
+	r.Get("/inventory/reconciliation", admin, res.reconcile)
+}
+
+type resource struct {
+	service Service
+	logger  log.Logger
+}
+
+func (r resource) listMovements(c *routing.Context) error {
+	page, err := pagination.FromContext(c)
+	if err != nil {
+		return err
+	}
+	movements, err := r.service.ListMovements(c.Request.Context(), c.Param("id"), page)
+	if err != nil {
+		return err
+	}
+
+	return c.Write(movements)
+}
+
+func (r resource) adjust(c *routing.Context) error {
+	var input AdjustStockRequest
+	if err := c.Read(&input); err != nil {
+		r.logger.With(c.Request.Context()).Info(err)
+		return errors.BadRequest("")
+	}
+	if err := input.Validate(); err != nil {
+		return err
+	}
+	movement, err := r.service.Adjust(c.Request.Context(), input)
+	if err != nil {
+		return err
+	}
+
+	return c.WriteWithStatus(movement, http.StatusCreated)
+}
+
+func (r resource) restock(c *routing.Context) error {
+	var input RestockRequest
+	if err := c.Read(&input); err != nil {
+		r.logger.With(c.Request.Context()).Info(err)
+		return errors.BadRequest("")
+	}
+	if err := input.Validate(); err != nil {
+		return err
+	}
+	movement, err := r.service.Restock(c.Request.Context(), input)
+	if err != nil {
+		return err
+	}
+
+	return c.WriteWithStatus(movement, http.StatusCreated)
+}
+
+func (r resource) reconcile(c *routing.Context) error {
+	report, err := r.service.Reconcile(c.Request.Context())
+	if err != nil {
+		return err
+	}
+
+	return c.Write(report)
+}
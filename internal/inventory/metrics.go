@@ -0,0 +1,23 @@
+package inventory
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	movements = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "inventory_movements_total",
+		Help: "Number of movements recorded in the inventory ledger, labeled by kind.",
+	}, []string{"kind"})
+
+	reservationsExpired = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "stock_reservations_expired_total",
+		Help: "Number of stock reservations released because their order was not paid in time.",
+	})
+
+	driftedVariants = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "inventory_drifted_variants",
+		Help: "Number of variants whose stock drifted from the inventory ledger, as of the last reconciliation.",
+	})
+)
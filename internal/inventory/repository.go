@@ -0,0 +1,226 @@
+package inventory
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/online-shop/internal/entity"
+	"github.com/online-shop/pkg/log"
+	"github.com/online-shop/pkg/mysql"
+	"time"
+)
+
+// Repository persists the inventory ledger, along with the stock of variants and the reservations of orders.
+type Repository interface {
+	// GetLevel returns the stock of the variant having the given ID.
+	GetLevel(ctx context.Context, variantID string) (entity.StockLevel, error)
+	// Move records a movement in the ledger, applying it to the stock of its variant and to the total stock of
+	// its product. It returns sql.ErrNoRows if the stock or the reserved units of the variant would become negative.
+	Move(ctx context.Context, movement entity.StockMovement) error
+	// ListMovements returns the movements of a variant, newest first.
+	ListMovements(ctx context.Context, variantID string, offset, limit int) ([]entity.StockMovement, error)
+	// CountMovements returns the number of movements of a variant.
+	CountMovements(ctx context.Context, variantID string) (int, error)
+	// SumMovements returns the sum of the quantities of the movements of a variant having the given kind and
+	// reference.
+	SumMovements(ctx context.Context, variantID, kind, referenceID string) (int32, error)
+	CreateReservation(ctx context.Context, reservation entity.StockReservation) error
+	// ListReservations returns the reservations of an order, locking them until the end of the transaction.
+	ListReservations(ctx context.Context, orderID string) ([]entity.StockReservation, error)
+	// ListExpiredReservations returns the active reservations expired at the given time, oldest first.
+	ListExpiredReservations(ctx context.Context, now time.Time, limit int) ([]entity.StockReservation, error)
+	// UpdateReservationStatus saves the status of a reservation only if it still has the given one, and returns
+	// sql.ErrNoRows otherwise.
+	UpdateReservationStatus(ctx context.Context, reservation entity.StockReservation, status string) error
+	// EachBalance calls fn with the balance of every variant, ordered by SKU, without loading them all in memory.
+	EachBalance(ctx context.Context, fn func(balance Balance) error) error
+	// Transaction runs fn in a transaction, which the repository calls made with the context given to fn are
+	// part of.
+	Transaction(ctx context.Context, fn func(ctx context.Context) error) error
+}
+
+// reservationColumns are the columns of stock reservations.
+const reservationColumns = "order_id, variant_id, product_id, quantity, status, expires_at, created_at, updated_at"
+
+// repository persists the inventory in database
+type repository struct {
+	db     mysql.BaseRepository
+	logger log.Logger
+}
+
+// NewRepository creates a new inventory repository
+func NewRepository(db mysql.BaseRepository, logger log.Logger) Repository {
+	return repository{db, logger}
+}
+
+func (r repository) GetLevel(ctx context.Context, variantID string) (entity.StockLevel, error) {
+	q := fmt.Sprintf("select id, product_id, sku, stock, reserved from product_variant where id = ?")
+
+	var level entity.StockLevel
+
+	err := r.db.FetchRow(ctx, q, &level, variantID)
+	if err != nil {
+		return level, err
+	}
+
+	return level, nil
+}
+
+func (r repository) Move(ctx context.Context, movement entity.StockMovement) error {
+	return r.db.Transaction(ctx, func(ctx context.Context) error {
+		q := fmt.Sprintf("update product_variant set stock = stock + :quantity, reserved = reserved + :reserved " +
+			"where id = :variant_id and stock + :quantity >= 0 and reserved + :reserved >= 0")
+
+		res, err := r.db.Exec(ctx, q, movement)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return sql.ErrNoRows
+		}
+
+		q = fmt.Sprintf("insert into inventory_movement " +
+			"(id, variant_id, product_id, kind, quantity, reserved, reference_id, note, created_by, created_at) " +
+			"values (:id, :variant_id, :product_id, :kind, :quantity, :reserved, :reference_id, :note, :created_by, :created_at)")
+
+		if _, err := r.db.Exec(ctx, q, movement); err != nil {
+			return err
+		}
+
+		q = fmt.Sprintf("update product p set stock = " +
+			"(select coalesce(sum(v.stock), 0) from product_variant v where v.product_id = p.id) " +
+			"where p.id = :product_id")
+
+		_, err = r.db.Exec(ctx, q, movement)
+		return err
+	})
+}
+
+func (r repository) ListMovements(ctx context.Context, variantID string, offset, limit int) ([]entity.StockMovement, error) {
+	q := fmt.Sprintf("select id, variant_id, product_id, kind, quantity, reserved, reference_id, note, created_by, " +
+		"created_at from inventory_movement where variant_id = ? " +
+		"order by created_at desc, id limit ? offset ?")
+
+	movements := []entity.StockMovement{}
+
+	err := r.db.FetchRows(ctx, q, &movements, variantID, limit, offset)
+	if err != nil {
+		return movements, err
+	}
+
+	return movements, nil
+}
+
+func (r repository) CountMovements(ctx context.Context, variantID string) (int, error) {
+	q := fmt.Sprintf("select count(*) from inventory_movement where variant_id = ?")
+
+	var count int
+
+	err := r.db.FetchRow(ctx, q, &count, variantID)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+func (r repository) SumMovements(ctx context.Context, variantID, kind, referenceID string) (int32, error) {
+	q := fmt.Sprintf("select coalesce(sum(quantity), 0) from inventory_movement " +
+		"where variant_id = ? and kind = ? and reference_id = ?")
+
+	var sum int32
+
+	err := r.db.FetchRow(ctx, q, &sum, variantID, kind, referenceID)
+	if err != nil {
+		return 0, err
+	}
+
+	return sum, nil
+}
+
+func (r repository) CreateReservation(ctx context.Context, reservation entity.StockReservation) error {
+	q := fmt.Sprintf("insert into stock_reservation (%s) "+
+		"values (:order_id, :variant_id, :product_id, :quantity, :status, :expires_at, :created_at, :updated_at)",
+		reservationColumns)
+
+	_, err := r.db.Exec(ctx, q, reservation)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r repository) ListReservations(ctx context.Context, orderID string) ([]entity.StockReservation, error) {
+	q := fmt.Sprintf("select %s from stock_reservation where order_id = ? order by variant_id for update",
+		reservationColumns)
+
+	var reservations []entity.StockReservation
+
+	err := r.db.FetchRows(ctx, q, &reservations, orderID)
+	if err != nil {
+		return reservations, err
+	}
+
+	return reservations, nil
+}
+
+func (r repository) ListExpiredReservations(ctx context.Context, now time.Time,
+	limit int) ([]entity.StockReservation, error) {
+	q := fmt.Sprintf("select %s from stock_reservation where status = ? and expires_at <= ? "+
+		"order by expires_at limit ?", reservationColumns)
+
+	var reservations []entity.StockReservation
+
+	err := r.db.FetchRows(ctx, q, &reservations, entity.ReservationActive, now, limit)
+	if err != nil {
+		return reservations, err
+	}
+
+	return reservations, nil
+}
+
+func (r repository) UpdateReservationStatus(ctx context.Context, reservation entity.StockReservation, status string) error {
+	q := fmt.Sprintf("update stock_reservation set status = :status, updated_at = :updated_at " +
+		"where order_id = :order_id and variant_id = :variant_id and status = :previous_status")
+
+	args := struct {
+		entity.StockReservation
+		PreviousStatus string `db:"previous_status"`
+	}{reservation, status}
+	res, err := r.db.Exec(ctx, q, args)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+func (r repository) EachBalance(ctx context.Context, fn func(balance Balance) error) error {
+	q := fmt.Sprintf("select v.id, v.product_id, v.sku, v.stock, v.reserved, " +
+		"coalesce(m.quantity, 0) ledger_stock, coalesce(m.reserved, 0) ledger_reserved, " +
+		"coalesce(sr.quantity, 0) active_reservations " +
+		"from product_variant v " +
+		"left join (select variant_id, sum(quantity) quantity, sum(reserved) reserved " +
+		"from inventory_movement group by variant_id) m on m.variant_id = v.id " +
+		"left join (select variant_id, sum(quantity) quantity from stock_reservation " +
+		"where status = ? group by variant_id) sr on sr.variant_id = v.id " +
+		"order by v.sku")
+
+	var balance Balance
+
+	return r.db.Each(ctx, q, &balance, func() error {
+		return fn(balance)
+	}, entity.ReservationActive)
+}
+
+func (r repository) Transaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return r.db.Transaction(ctx, fn)
+}
@@ -0,0 +1,471 @@
+package inventory
+
+import (
+	"context"
+	"database/sql"
+	stderrors "errors"
+	"fmt"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/go-ozzo/ozzo-validation/v4/is"
+	"github.com/online-shop/internal/auth"
+	"github.com/online-shop/internal/entity"
+	"github.com/online-shop/internal/errors"
+	"github.com/online-shop/pkg/log"
+	"github.com/online-shop/pkg/mysql"
+	"github.com/online-shop/pkg/pagination"
+	"github.com/online-shop/pkg/tracing"
+	"time"
+)
+
+// Service encapsulates the inventory of variants. Every change of their stock is recorded as a movement in the
+// ledger, from which their stock can be recomputed. Placed orders reserve the stock of their items for a limited
+// time, the reservations being deducted once the orders are paid, or released when they expire or the orders are
+// cancelled.
+type Service interface {
+	// Reserve reserves the stock of the items of a new order, which must be paid before the reservations expire.
+	Reserve(ctx context.Context, orderID string, items []entity.OrderDetail) error
+	// Deduct converts the reservations of a paid order into deductions. Reservations which were released, having
+	// expired for instance, are deducted from the stock again if it allows it.
+	Deduct(ctx context.Context, orderID string) error
+	// Release gives back the stock reserved or deducted for an order which will not be shipped.
+	Release(ctx context.Context, orderID string) error
+	// ReleaseExpired releases the reservations which expired, and returns their number.
+	ReleaseExpired(ctx context.Context) (int, error)
+	// Adjust changes the stock of a variant by the given quantity.
+	Adjust(ctx context.Context, input AdjustStockRequest) (entity.StockMovement, error)
+	// Restock puts units of a variant returned from a paid order back on sale.
+	Restock(ctx context.Context, input RestockRequest) (entity.StockMovement, error)
+	// ListMovements returns a page of the movements of a variant, newest first.
+	ListMovements(ctx context.Context, variantID string, page pagination.Request) (pagination.Page, error)
+	// Reconcile recomputes the stock of every variant from the ledger, and reports the variants whose stock
+	// drifted from it.
+	Reconcile(ctx context.Context) (Reconciliation, error)
+}
+
+// expiryBatchSize is the number of expired reservations released at once.
+const expiryBatchSize = 100
+
+// AdjustStockRequest represents a manual change of the stock of a variant, after counting it for instance.
+type AdjustStockRequest struct {
+	VariantID string `json:"variant_id"`
+	// Quantity is added to the stock, which it decreases when negative.
+	Quantity int32 `json:"quantity"`
+	// ReferenceID identifies the reason of the adjustment, such as the ID of a stock count.
+	ReferenceID string `json:"reference_id"`
+	Note        string `json:"note"`
+}
+
+// Validate validates the AdjustStockRequest fields.
+func (r AdjustStockRequest) Validate() error {
+	return validation.ValidateStruct(&r,
+		validation.Field(&r.VariantID, validation.Required, is.UUID),
+		validation.Field(&r.Quantity, validation.Required),
+		validation.Field(&r.ReferenceID, validation.Required, validation.Length(1, 64)),
+		validation.Field(&r.Note, validation.Length(0, 255)),
+	)
+}
+
+// RestockRequest represents units of a variant returned by the customer who ordered them.
+type RestockRequest struct {
+	VariantID string `json:"variant_id"`
+	OrderID   string `json:"order_id"`
+	Quantity  int32  `json:"quantity"`
+	Note      string `json:"note"`
+}
+
+// Validate validates the RestockRequest fields.
+func (r RestockRequest) Validate() error {
+	return validation.ValidateStruct(&r,
+		validation.Field(&r.VariantID, validation.Required, is.UUID),
+		validation.Field(&r.OrderID, validation.Required, is.UUID),
+		validation.Field(&r.Quantity, validation.Required, validation.Min(int32(1))),
+		validation.Field(&r.Note, validation.Length(0, 255)),
+	)
+}
+
+// Balance is the stock of a variant, along with the stock and the reserved units its ledger sums to, and the
+// units of its active reservations.
+type Balance struct {
+	entity.StockLevel
+	LedgerStock        int32 `db:"ledger_stock" json:"ledger_stock"`
+	LedgerReserved     int32 `db:"ledger_reserved" json:"ledger_reserved"`
+	ActiveReservations int32 `db:"active_reservations" json:"active_reservations"`
+}
+
+// Drifted tells whether the stock of the variant differs from what its ledger and reservations sum to.
+func (b Balance) Drifted() bool {
+	return b.Stock != b.LedgerStock || b.Reserved != b.LedgerReserved || b.Reserved != b.ActiveReservations
+}
+
+// Reconciliation reports the variants whose stock drifted from their ledger.
+type Reconciliation struct {
+	// Variants is the number of variants checked.
+	Variants int       `json:"variants"`
+	Drifts   []Balance `json:"drifts"`
+	// CheckedAt is when the reconciliation started, the movements made since being possibly reported as drifts.
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// ProductCache keeps copies of products, which include the stock of their variants.
+type ProductCache interface {
+	// Invalidate drops the copies of the given products.
+	Invalidate(ctx context.Context, productIDs ...int64)
+}
+
+type service struct {
+	repo           Repository
+	products       ProductCache
+	reservationTTL time.Duration
+	logger         log.Logger
+}
+
+// NewService creates a new inventory service. The stock of orders is reserved for reservationTTL, and the cached
+// products whose stock changes are invalidated.
+func NewService(repo Repository, products ProductCache, reservationTTL time.Duration, logger log.Logger) Service {
+	return service{repo, products, reservationTTL, logger}
+}
+
+// move records a movement made now by the current user, if any.
+func (s service) move(ctx context.Context, movement entity.StockMovement) (entity.StockMovement, error) {
+	movement.ID, movement.CreatedAt = entity.GenerateID(), time.Now()
+	if user := auth.CurrentUser(ctx); user != nil {
+		id := user.GetID()
+		movement.CreatedBy = &id
+	}
+	if err := s.repo.Move(ctx, movement); err != nil {
+		return entity.StockMovement{}, err
+	}
+	movements.WithLabelValues(movement.Kind).Inc()
+	return movement, nil
+}
+
+// outOfStock returns the error telling that the stock of a variant does not allow a movement.
+func (s service) outOfStock(ctx context.Context, variantID string) error {
+	level, err := s.repo.GetLevel(ctx, variantID)
+	if err != nil {
+		return err
+	}
+	return errors.UnprocessableEntity(fmt.Sprintf("Only %d units of %s are in stock.", level.Stock, level.SKU),
+		errors.CodeOutOfStock)
+}
+
+func (s service) Reserve(ctx context.Context, orderID string, items []entity.OrderDetail) error {
+	ctx, span := tracing.StartSpan(ctx, "inventory.Service.Reserve")
+	defer span.End()
+
+	// orders may list a variant several times, which is reserved at once
+	var reservations []entity.StockReservation
+	byVariant := map[string]int{}
+	now := time.Now()
+	for _, item := range items {
+		if i, ok := byVariant[item.VariantID]; ok {
+			reservations[i].Quantity += item.Quantity
+			continue
+		}
+		byVariant[item.VariantID] = len(reservations)
+		reservations = append(reservations, entity.StockReservation{
+			OrderID:   orderID,
+			VariantID: item.VariantID,
+			ProductID: item.ProductID,
+			Quantity:  item.Quantity,
+			Status:    entity.ReservationActive,
+			ExpiresAt: now.Add(s.reservationTTL),
+			CreatedAt: now,
+			UpdatedAt: now,
+		})
+	}
+
+	err := s.repo.Transaction(ctx, func(ctx context.Context) error {
+		for _, reservation := range reservations {
+			_, err := s.move(ctx, entity.StockMovement{
+				VariantID:   reservation.VariantID,
+				ProductID:   reservation.ProductID,
+				Kind:        entity.MovementReservation,
+				Quantity:    -reservation.Quantity,
+				Reserved:    reservation.Quantity,
+				ReferenceID: orderID,
+			})
+			if stderrors.Is(err, sql.ErrNoRows) {
+				return s.outOfStock(ctx, reservation.VariantID)
+			} else if err != nil {
+				return err
+			}
+			if err := s.repo.CreateReservation(ctx, reservation); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.invalidate(ctx, reservations)
+	return nil
+}
+
+func (s service) Deduct(ctx context.Context, orderID string) error {
+	ctx, span := tracing.StartSpan(ctx, "inventory.Service.Deduct")
+	defer span.End()
+
+	var deducted []entity.StockReservation
+	err := s.repo.Transaction(ctx, func(ctx context.Context) error {
+		deducted = nil
+		reservations, err := s.repo.ListReservations(ctx, orderID)
+		if err != nil {
+			return err
+		}
+		for _, reservation := range reservations {
+			if reservation.Status == entity.ReservationDeducted {
+				continue
+			}
+			movement := entity.StockMovement{
+				VariantID:   reservation.VariantID,
+				ProductID:   reservation.ProductID,
+				Kind:        entity.MovementDeduction,
+				Reserved:    -reservation.Quantity,
+				ReferenceID: orderID,
+			}
+			if reservation.Status == entity.ReservationReleased {
+				// the units went back on sale, from which they are taken again
+				movement.Quantity, movement.Reserved = -reservation.Quantity, 0
+			}
+			if err := s.setStatus(ctx, reservation, entity.ReservationDeducted); err != nil {
+				return err
+			}
+			_, err := s.move(ctx, movement)
+			if stderrors.Is(err, sql.ErrNoRows) {
+				return s.outOfStock(ctx, reservation.VariantID)
+			} else if err != nil {
+				return err
+			}
+			deducted = append(deducted, reservation)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.invalidate(ctx, deducted)
+	return nil
+}
+
+func (s service) Release(ctx context.Context, orderID string) error {
+	ctx, span := tracing.StartSpan(ctx, "inventory.Service.Release")
+	defer span.End()
+
+	var released []entity.StockReservation
+	err := s.repo.Transaction(ctx, func(ctx context.Context) error {
+		released = nil
+		reservations, err := s.repo.ListReservations(ctx, orderID)
+		if err != nil {
+			return err
+		}
+		for _, reservation := range reservations {
+			if reservation.Status == entity.ReservationReleased {
+				continue
+			}
+			if err := s.release(ctx, reservation); err != nil {
+				return err
+			}
+			released = append(released, reservation)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.invalidate(ctx, released)
+	return nil
+}
+
+// release gives back the units of a reservation, which are still reserved if it is active, and were taken out of
+// the stock otherwise.
+func (s service) release(ctx context.Context, reservation entity.StockReservation) error {
+	movement := entity.StockMovement{
+		VariantID:   reservation.VariantID,
+		ProductID:   reservation.ProductID,
+		Kind:        entity.MovementRelease,
+		Quantity:    reservation.Quantity,
+		ReferenceID: reservation.OrderID,
+	}
+	if reservation.Status == entity.ReservationActive {
+		movement.Reserved = -reservation.Quantity
+	}
+	if err := s.setStatus(ctx, reservation, entity.ReservationReleased); err != nil {
+		return err
+	}
+	_, err := s.move(ctx, movement)
+	return err
+}
+
+// setStatus changes the status of a reservation, provided it did not change since it was read.
+func (s service) setStatus(ctx context.Context, reservation entity.StockReservation, status string) error {
+	previous := reservation.Status
+	reservation.Status, reservation.UpdatedAt = status, time.Now()
+	return s.repo.UpdateReservationStatus(ctx, reservation, previous)
+}
+
+func (s service) ReleaseExpired(ctx context.Context) (int, error) {
+	ctx, span := tracing.StartSpan(ctx, "inventory.Service.ReleaseExpired")
+	defer span.End()
+
+	count := 0
+	for {
+		reservations, err := s.repo.ListExpiredReservations(ctx, time.Now(), expiryBatchSize)
+		if err != nil {
+			return count, err
+		}
+		released := 0
+		for _, reservation := range reservations {
+			err := s.repo.Transaction(ctx, func(ctx context.Context) error {
+				return s.release(ctx, reservation)
+			})
+			if stderrors.Is(err, sql.ErrNoRows) {
+				// the order was paid or cancelled in the meantime
+				continue
+			} else if err != nil {
+				return count, err
+			}
+			s.invalidate(ctx, []entity.StockReservation{reservation})
+			s.logger.With(ctx, "order", reservation.OrderID, "variant", reservation.VariantID).
+				Infof("stock reservation expired")
+			reservationsExpired.Inc()
+			released++
+		}
+		count += released
+		// batches left as they were would be listed again
+		if len(reservations) < expiryBatchSize || released == 0 {
+			return count, nil
+		}
+	}
+}
+
+func (s service) Adjust(ctx context.Context, input AdjustStockRequest) (entity.StockMovement, error) {
+	ctx, span := tracing.StartSpan(ctx, "inventory.Service.Adjust")
+	defer span.End()
+
+	level, err := s.repo.GetLevel(ctx, input.VariantID)
+	if err != nil {
+		return entity.StockMovement{}, err
+	}
+	movement, err := s.move(ctx, entity.StockMovement{
+		VariantID:   level.VariantID,
+		ProductID:   level.ProductID,
+		Kind:        entity.MovementAdjustment,
+		Quantity:    input.Quantity,
+		ReferenceID: input.ReferenceID,
+		Note:        input.Note,
+	})
+	if stderrors.Is(err, sql.ErrNoRows) {
+		return entity.StockMovement{}, s.outOfStock(ctx, level.VariantID)
+	} else if err != nil {
+		return entity.StockMovement{}, err
+	}
+	s.products.Invalidate(ctx, level.ProductID)
+	s.logger.With(ctx, "variant", level.VariantID, "quantity", input.Quantity, "reference", input.ReferenceID).
+		Infof("stock adjusted")
+	return movement, nil
+}
+
+func (s service) Restock(ctx context.Context, input RestockRequest) (entity.StockMovement, error) {
+	ctx, span := tracing.StartSpan(ctx, "inventory.Service.Restock")
+	defer span.End()
+
+	var movement entity.StockMovement
+	err := s.repo.Transaction(ctx, func(ctx context.Context) error {
+		reservations, err := s.repo.ListReservations(ctx, input.OrderID)
+		if err != nil {
+			return err
+		}
+		// only the units paid for can be returned, once
+		var sold *entity.StockReservation
+		for i, reservation := range reservations {
+			if reservation.VariantID == input.VariantID && reservation.Status == entity.ReservationDeducted {
+				sold = &reservations[i]
+			}
+		}
+		if sold == nil {
+			return validation.Errors{"order_id": stderrors.New("must be a paid order of the variant")}
+		}
+		restocked, err := s.repo.SumMovements(ctx, input.VariantID, entity.MovementRestock, input.OrderID)
+		if err != nil {
+			return err
+		}
+		if restocked+input.Quantity > sold.Quantity {
+			return validation.Errors{
+				"quantity": fmt.Errorf("must be no greater than %d, the units not restocked yet", sold.Quantity-restocked),
+			}
+		}
+		movement, err = s.move(ctx, entity.StockMovement{
+			VariantID:   sold.VariantID,
+			ProductID:   sold.ProductID,
+			Kind:        entity.MovementRestock,
+			Quantity:    input.Quantity,
+			ReferenceID: input.OrderID,
+			Note:        input.Note,
+		})
+		return err
+	})
+	if err != nil {
+		return entity.StockMovement{}, err
+	}
+	s.products.Invalidate(ctx, movement.ProductID)
+	s.logger.With(ctx, "variant", input.VariantID, "quantity", input.Quantity, "order", input.OrderID).
+		Infof("returned stock restocked")
+	return movement, nil
+}
+
+func (s service) ListMovements(ctx context.Context, variantID string, page pagination.Request) (pagination.Page, error) {
+	ctx, span := tracing.StartSpan(ctx, "inventory.Service.ListMovements")
+	defer span.End()
+
+	if _, err := s.repo.GetLevel(ctx, variantID); err != nil {
+		return pagination.Page{}, err
+	}
+	items, err := s.repo.ListMovements(ctx, variantID, page.Offset, page.PageLimit())
+	if err != nil {
+		return pagination.Page{}, err
+	}
+	total, err := s.repo.CountMovements(ctx, variantID)
+	if err != nil {
+		return pagination.Page{}, err
+	}
+	return page.Page(items, total), nil
+}
+
+func (s service) Reconcile(ctx context.Context) (Reconciliation, error) {
+	ctx, span := tracing.StartSpan(ctx, "inventory.Service.Reconcile")
+	defer span.End()
+
+	report := Reconciliation{Drifts: []Balance{}, CheckedAt: time.Now()}
+	err := s.repo.EachBalance(ctx, func(balance Balance) error {
+		report.Variants++
+		if balance.Drifted() {
+			report.Drifts = append(report.Drifts, balance)
+		}
+		return nil
+	})
+	if err != nil {
+		return Reconciliation{}, err
+	}
+	driftedVariants.Set(float64(len(report.Drifts)))
+	if len(report.Drifts) > 0 {
+		s.logger.With(ctx, "variants", len(report.Drifts)).Infof("stock drifted from the inventory ledger")
+	}
+	return report, nil
+}
+
+// invalidate drops the cached products of the given reservations once the transaction of the context, if any, is
+// committed, as orders move the stock within their own transaction and the products would otherwise be cached
+// again with the stock they had before.
+func (s service) invalidate(ctx context.Context, reservations []entity.StockReservation) {
+	var productIDs []int64
+	for _, reservation := range reservations {
+		productIDs = append(productIDs, reservation.ProductID)
+	}
+	if len(productIDs) > 0 {
+		mysql.AfterCommit(ctx, func() {
+			s.products.Invalidate(ctx, productIDs...)
+		})
+	}
+}
@@ -0,0 +1,335 @@
+package inventory
+
+import (
+	"context"
+	"database/sql"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/online-shop/internal/auth"
+	"github.com/online-shop/internal/entity"
+	"github.com/online-shop/internal/errors"
+	"github.com/online-shop/internal/test"
+	"github.com/online-shop/pkg/log"
+	"github.com/online-shop/pkg/pagination"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"sort"
+	"testing"
+	"time"
+)
+
+const (
+	shirtM = "61dc6d71-3f60-476c-ad9b-503f8455f36b"
+	shirtL = "0b8a6d3e-95c4-4fd2-9c0b-7a1f3c3c1f2e"
+	order1 = "d9428888-122b-11e1-b85c-61cd3cbb3210"
+	order2 = "5f0c3c55-4b0e-4a8d-9f4b-2f6c4f1e8b11"
+)
+
+type mockRepository struct {
+	levels       map[string]entity.StockLevel
+	movements    []entity.StockMovement
+	reservations []entity.StockReservation
+}
+
+func (m *mockRepository) GetLevel(ctx context.Context, variantID string) (entity.StockLevel, error) {
+	if level, ok := m.levels[variantID]; ok {
+		return level, nil
+	}
+	return entity.StockLevel{}, sql.ErrNoRows
+}
+
+func (m *mockRepository) Move(ctx context.Context, movement entity.StockMovement) error {
+	level, ok := m.levels[movement.VariantID]
+	if !ok || level.Stock+movement.Quantity < 0 || level.Reserved+movement.Reserved < 0 {
+		return sql.ErrNoRows
+	}
+	level.Stock += movement.Quantity
+	level.Reserved += movement.Reserved
+	m.levels[movement.VariantID] = level
+	m.movements = append(m.movements, movement)
+	return nil
+}
+
+func (m *mockRepository) ListMovements(ctx context.Context, variantID string, offset, limit int) ([]entity.StockMovement, error) {
+	movements := []entity.StockMovement{}
+	for i := len(m.movements) - 1; i >= 0; i-- {
+		if m.movements[i].VariantID == variantID {
+			movements = append(movements, m.movements[i])
+		}
+	}
+	if offset > len(movements) {
+		offset = len(movements)
+	}
+	movements = movements[offset:]
+	if limit < len(movements) {
+		movements = movements[:limit]
+	}
+	return movements, nil
+}
+
+func (m *mockRepository) CountMovements(ctx context.Context, variantID string) (int, error) {
+	count := 0
+	for _, movement := range m.movements {
+		if movement.VariantID == variantID {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m *mockRepository) SumMovements(ctx context.Context, variantID, kind, referenceID string) (int32, error) {
+	var sum int32
+	for _, movement := range m.movements {
+		if movement.VariantID == variantID && movement.Kind == kind && movement.ReferenceID == referenceID {
+			sum += movement.Quantity
+		}
+	}
+	return sum, nil
+}
+
+func (m *mockRepository) CreateReservation(ctx context.Context, reservation entity.StockReservation) error {
+	m.reservations = append(m.reservations, reservation)
+	return nil
+}
+
+func (m *mockRepository) ListReservations(ctx context.Context, orderID string) ([]entity.StockReservation, error) {
+	var reservations []entity.StockReservation
+	for _, reservation := range m.reservations {
+		if reservation.OrderID == orderID {
+			reservations = append(reservations, reservation)
+		}
+	}
+	return reservations, nil
+}
+
+func (m *mockRepository) ListExpiredReservations(ctx context.Context, now time.Time, limit int) ([]entity.StockReservation, error) {
+	var reservations []entity.StockReservation
+	for _, reservation := range m.reservations {
+		if reservation.Status == entity.ReservationActive && !reservation.ExpiresAt.After(now) && len(reservations) < limit {
+			reservations = append(reservations, reservation)
+		}
+	}
+	return reservations, nil
+}
+
+func (m *mockRepository) UpdateReservationStatus(ctx context.Context, reservation entity.StockReservation, status string) error {
+	for i, r := range m.reservations {
+		if r.OrderID == reservation.OrderID && r.VariantID == reservation.VariantID && r.Status == status {
+			m.reservations[i] = reservation
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (m *mockRepository) EachBalance(ctx context.Context, fn func(balance Balance) error) error {
+	var balances []Balance
+	for _, level := range m.levels {
+		balance := Balance{StockLevel: level}
+		for _, movement := range m.movements {
+			if movement.VariantID == level.VariantID {
+				balance.LedgerStock += movement.Quantity
+				balance.LedgerReserved += movement.Reserved
+			}
+		}
+		for _, reservation := range m.reservations {
+			if reservation.VariantID == level.VariantID && reservation.Status == entity.ReservationActive {
+				balance.ActiveReservations += reservation.Quantity
+			}
+		}
+		balances = append(balances, balance)
+	}
+	sort.Slice(balances, func(i, j int) bool { return balances[i].SKU < balances[j].SKU })
+	for _, balance := range balances {
+		if err := fn(balance); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *mockRepository) Transaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return fn(ctx)
+}
+
+// mockProductCache records the products invalidated.
+type mockProductCache struct {
+	invalidated []int64
+}
+
+func (m *mockProductCache) Invalidate(ctx context.Context, productIDs ...int64) {
+	m.invalidated = append(m.invalidated, productIDs...)
+}
+
+// newTestService creates a service reserving stock for the given time, whose variants have a ledger opened with
+// their stock.
+func newTestService(reservationTTL time.Duration) (Service, *mockRepository, *mockProductCache) {
+	logger, _ := log.NewForTest()
+	repo := &mockRepository{levels: map[string]entity.StockLevel{
+		shirtM: {VariantID: shirtM, ProductID: 1, SKU: "SHIRT-M", Stock: 5},
+		shirtL: {VariantID: shirtL, ProductID: 1, SKU: "SHIRT-L", Stock: 1},
+	}}
+	for _, level := range repo.levels {
+		repo.movements = append(repo.movements, entity.StockMovement{VariantID: level.VariantID, ProductID: level.ProductID,
+			Kind: entity.MovementAdjustment, Quantity: level.Stock, ReferenceID: "opening-balance"})
+	}
+	products := &mockProductCache{}
+	return NewService(repo, products, reservationTTL, logger), repo, products
+}
+
+// assertLevel checks the stock and the reserved units of a variant.
+func assertLevel(t *testing.T, repo *mockRepository, variantID string, stock, reserved int32) {
+	level := repo.levels[variantID]
+	assert.Equal(t, []int32{stock, reserved}, []int32{level.Stock, level.Reserved}, level.SKU)
+}
+
+func TestService_reservations(t *testing.T) {
+	s, repo, products := newTestService(time.Hour)
+	ctx := context.Background()
+
+	// a variant listed twice is reserved at once
+	err := s.Reserve(ctx, order1, []entity.OrderDetail{
+		{ProductID: 1, VariantID: shirtM, Quantity: 2},
+		{ProductID: 1, VariantID: shirtM, Quantity: 1},
+	})
+	assert.Nil(t, err)
+	assertLevel(t, repo, shirtM, 2, 3)
+	assert.Len(t, repo.reservations, 1)
+	assert.Equal(t, []int64{1}, products.invalidated)
+
+	err = s.Reserve(ctx, order2, []entity.OrderDetail{{ProductID: 1, VariantID: shirtL, Quantity: 2}})
+	assert.Equal(t, errors.CodeOutOfStock, err.(errors.ErrorResponse).Code)
+	assert.Equal(t, "Only 1 units of SHIRT-L are in stock.", err.(errors.ErrorResponse).Message)
+
+	assert.Nil(t, s.Deduct(ctx, order1))
+	assertLevel(t, repo, shirtM, 2, 0)
+	assert.Equal(t, entity.ReservationDeducted, repo.reservations[0].Status)
+	assert.Nil(t, s.Deduct(ctx, order1))
+	assertLevel(t, repo, shirtM, 2, 0)
+
+	// the payment of the order is rejected
+	assert.Nil(t, s.Release(ctx, order1))
+	assertLevel(t, repo, shirtM, 5, 0)
+	assert.Nil(t, s.Release(ctx, order1))
+	assertLevel(t, repo, shirtM, 5, 0)
+
+	var kinds []string
+	for _, movement := range repo.movements[2:] {
+		assert.Equal(t, order1, movement.ReferenceID)
+		kinds = append(kinds, movement.Kind)
+	}
+	assert.Equal(t, []string{entity.MovementReservation, entity.MovementDeduction, entity.MovementRelease}, kinds)
+
+	report, err := s.Reconcile(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, report.Variants)
+	assert.Empty(t, report.Drifts)
+}
+
+func TestService_ReleaseExpired(t *testing.T) {
+	s, repo, _ := newTestService(-time.Minute)
+	ctx := context.Background()
+	assert.Nil(t, s.Reserve(ctx, order1, []entity.OrderDetail{{ProductID: 1, VariantID: shirtM, Quantity: 4}}))
+	assertLevel(t, repo, shirtM, 1, 4)
+
+	count, err := s.ReleaseExpired(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+	assertLevel(t, repo, shirtM, 5, 0)
+	count, _ = s.ReleaseExpired(ctx)
+	assert.Equal(t, 0, count)
+
+	// orders paid late take their units from the stock again, if it still has them
+	assert.Nil(t, s.Deduct(ctx, order1))
+	assertLevel(t, repo, shirtM, 1, 0)
+
+	assert.Nil(t, s.Reserve(ctx, order2, []entity.OrderDetail{{ProductID: 1, VariantID: shirtM, Quantity: 1}}))
+	_, _ = s.ReleaseExpired(ctx)
+	_, err = s.Adjust(ctx, AdjustStockRequest{VariantID: shirtM, Quantity: -1, ReferenceID: "count-1"})
+	assert.Nil(t, err)
+	err = s.Deduct(ctx, order2)
+	assert.Equal(t, errors.CodeOutOfStock, err.(errors.ErrorResponse).Code)
+}
+
+func TestService_Adjust(t *testing.T) {
+	s, repo, products := newTestService(time.Hour)
+	ctx := auth.WithUser(context.Background(), "1", "admin")
+
+	movement, err := s.Adjust(ctx, AdjustStockRequest{VariantID: shirtL, Quantity: 3, ReferenceID: "count-1", Note: "Found"})
+	assert.Nil(t, err)
+	assert.Equal(t, entity.MovementAdjustment, movement.Kind)
+	assert.Equal(t, "1", *movement.CreatedBy)
+	assertLevel(t, repo, shirtL, 4, 0)
+	assert.Equal(t, []int64{1}, products.invalidated)
+
+	_, err = s.Adjust(ctx, AdjustStockRequest{VariantID: shirtL, Quantity: -5, ReferenceID: "count-2"})
+	assert.Equal(t, errors.CodeOutOfStock, err.(errors.ErrorResponse).Code)
+	_, err = s.Adjust(ctx, AdjustStockRequest{VariantID: order1, Quantity: 1, ReferenceID: "count-2"})
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	page, err := s.ListMovements(ctx, shirtL, pagination.Request{Limit: 1})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, page.Total)
+	assert.Equal(t, []entity.StockMovement{movement}, page.Items)
+}
+
+func TestService_Restock(t *testing.T) {
+	s, repo, _ := newTestService(time.Hour)
+	ctx := context.Background()
+	assert.Nil(t, s.Reserve(ctx, order1, []entity.OrderDetail{{ProductID: 1, VariantID: shirtM, Quantity: 3}}))
+
+	_, err := s.Restock(ctx, RestockRequest{VariantID: shirtM, OrderID: order1, Quantity: 1})
+	assert.Contains(t, err.(validation.Errors), "order_id", "unpaid orders cannot be returned")
+
+	assert.Nil(t, s.Deduct(ctx, order1))
+	movement, err := s.Restock(ctx, RestockRequest{VariantID: shirtM, OrderID: order1, Quantity: 2, Note: "Too small"})
+	assert.Nil(t, err)
+	assert.Equal(t, int32(2), movement.Quantity)
+	assert.Equal(t, order1, movement.ReferenceID)
+	assertLevel(t, repo, shirtM, 4, 0)
+
+	_, err = s.Restock(ctx, RestockRequest{VariantID: shirtM, OrderID: order1, Quantity: 2})
+	assert.Equal(t, "must be no greater than 1, the units not restocked yet", err.(validation.Errors)["quantity"].Error())
+	_, err = s.Restock(ctx, RestockRequest{VariantID: shirtL, OrderID: order1, Quantity: 1})
+	assert.Contains(t, err.(validation.Errors), "order_id")
+}
+
+func TestService_Reconcile(t *testing.T) {
+	s, repo, _ := newTestService(time.Hour)
+	ctx := context.Background()
+	assert.Nil(t, s.Reserve(ctx, order1, []entity.OrderDetail{{ProductID: 1, VariantID: shirtM, Quantity: 1}}))
+
+	// the stock changed without being recorded
+	level := repo.levels[shirtL]
+	level.Stock = 7
+	repo.levels[shirtL] = level
+
+	report, err := s.Reconcile(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, report.Variants)
+	if assert.Len(t, report.Drifts, 1) {
+		assert.Equal(t, Balance{StockLevel: level, LedgerStock: 1}, report.Drifts[0])
+	}
+}
+
+func TestAPI(t *testing.T) {
+	s, _, _ := newTestService(time.Hour)
+	logger, _ := log.NewForTest()
+	router := test.MockRouter(logger)
+	_, protected := auth.MockRouteGroups(router.Group("/v1"))
+	RegisterHandlers(protected, s, logger)
+
+	tests := []test.APITestCase{
+		{Name: "adjust", Method: "POST", URL: "/v1/inventory/adjustments", Body: `{"variant_id":"` + shirtM + `","quantity":-2,"reference_id":"count-1"}`, Header: auth.MockAdminAuthHeader(), WantStatus: http.StatusCreated, WantResponse: `*"kind":"adjustment","quantity":-2,"reserved":0,"reference_id":"count-1","created_by":"1"*`},
+		{Name: "adjust by nothing", Method: "POST", URL: "/v1/inventory/adjustments", Body: `{"variant_id":"` + shirtM + `","quantity":0,"reference_id":"count-1"}`, Header: auth.MockAdminAuthHeader(), WantStatus: http.StatusBadRequest},
+		{Name: "adjust below zero", Method: "POST", URL: "/v1/inventory/adjustments", Body: `{"variant_id":"` + shirtM + `","quantity":-4,"reference_id":"count-1"}`, Header: auth.MockAdminAuthHeader(), WantStatus: http.StatusUnprocessableEntity},
+		{Name: "adjust as customer", Method: "POST", URL: "/v1/inventory/adjustments", Body: `{"variant_id":"` + shirtM + `","quantity":1,"reference_id":"count-1"}`, Header: auth.MockAuthHeader(), WantStatus: http.StatusForbidden},
+		{Name: "restock unpaid", Method: "POST", URL: "/v1/inventory/restocks", Body: `{"variant_id":"` + shirtM + `","order_id":"` + order1 + `","quantity":1}`, Header: auth.MockAdminAuthHeader(), WantStatus: http.StatusBadRequest},
+		{Name: "movements", Method: "GET", URL: "/v1/inventory/variants/" + shirtM + "/movements?limit=1", Header: auth.MockAdminAuthHeader(), WantStatus: http.StatusOK, WantResponse: `*"total":2,"offset":0,"limit":1}`},
+		{Name: "movements of unknown variant", Method: "GET", URL: "/v1/inventory/variants/" + order1 + "/movements", Header: auth.MockAdminAuthHeader(), WantStatus: http.StatusNotFound},
+		{Name: "reconciliation", Method: "GET", URL: "/v1/inventory/reconciliation", Header: auth.MockAdminAuthHeader(), WantStatus: http.StatusOK, WantResponse: `{"variants":2,"drifts":[],*`},
+		{Name: "reconciliation anonymously", Method: "GET", URL: "/v1/inventory/reconciliation", WantStatus: http.StatusUnauthorized},
+	}
+	for _, tc := range tests {
+		test.Endpoint(t, router, tc)
+	}
+}
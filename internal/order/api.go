@@ -2,8 +2,10 @@ package order
 
 import (
 	routing "github.com/go-ozzo/ozzo-routing/v2"
+	"github.com/online-shop/internal/auth"
 	"github.com/online-shop/internal/errors"
 	"github.com/online-shop/internal/response"
+	"github.com/online-shop/pkg/httpcache"
 	"github.com/online-shop/pkg/log"
 	"net/http"
 )
@@ -13,9 +15,11 @@ func RegisterHandlers(r *routing.RouteGroup, service Service, authHandler routin
 	res := resource{service, logger}
 	r.Use(authHandler)
 
-	r.Get("/orders/<id>", res.getOrder)
-	r.Post("/orders", res.placeOrder)
-	r.Put("/orders", res.updateOrder)
+	// orders change as they are processed, so clients must revalidate them, which conditional requests make cheap
+	r.Get("/orders/<id>", auth.RequireScope(auth.ScopeOrdersRead),
+		httpcache.CacheControl("private, no-cache"), httpcache.ETag(), res.getOrder)
+	r.Post("/orders", auth.RequireScope(auth.ScopeOrdersWrite), res.placeOrder)
+	r.Put("/orders", auth.RequireScope(auth.ScopeOrdersWrite), res.updateOrder)
 }
 
 type resource struct {
@@ -29,6 +33,9 @@ func (r resource) getOrder(c *routing.Context) error {
 		return err
 	}
 
+	// the entity tag is the one If-Match headers are compared to when updating the order
+	c.Response.Header().Set("ETag", order.ETag())
+	httpcache.SetLastModified(c.Response.Header(), order.UpdatedAt)
 	return c.Write(order)
 }
 
@@ -38,6 +45,9 @@ func (r resource) placeOrder(c *routing.Context) error {
 		r.logger.With(c.Request.Context()).Info(err)
 		return errors.BadRequest("")
 	}
+	if err := input.Validate(); err != nil {
+		return err
+	}
 	order, err := r.service.PlaceOrder(c.Request.Context(), input)
 	if err != nil {
 		return err
@@ -53,6 +63,10 @@ func (r resource) updateOrder(c *routing.Context) error {
 		r.logger.With(c.Request.Context()).Info(err)
 		return errors.BadRequest("")
 	}
+	if err := input.Validate(); err != nil {
+		return err
+	}
+	input.IfMatch = c.Request.Header.Get("If-Match")
 	_, err := r.service.UpdateOrder(c.Request.Context(), input)
 	if err != nil {
 		return err
@@ -0,0 +1,18 @@
+package order
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	ordersPlaced = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "orders_placed_total",
+		Help: "Number of orders placed successfully.",
+	})
+
+	orderStatusTransitions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "order_status_transitions_total",
+		Help: "Number of order status changes, labeled by the previous and the new status.",
+	}, []string{"from", "to"})
+)
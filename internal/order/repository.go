@@ -2,22 +2,37 @@ package order
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
 	"github.com/online-shop/internal/entity"
 	"github.com/online-shop/pkg/log"
 	"github.com/online-shop/pkg/mysql"
+	"strings"
 	"time"
 )
 
 type Repository interface {
 	Get(ctx context.Context, id string) (entity.Order, error)
 	GetCompleteOrder(ctx context.Context, id string) ([]entity.CompleteOrder, error)
+	// GetVariants returns the variants having the given IDs, along with their product. Unknown IDs are skipped.
+	GetVariants(ctx context.Context, ids []string) ([]entity.VariantDetail, error)
 	PlaceOrder(ctx context.Context, orderReq entity.Order) error
 	CreateOrder(ctx context.Context, order entity.Order) error
 	CreateOrderDetail(ctx context.Context, orderDetail entity.OrderDetail) error
 	UpdateOrder(ctx context.Context, order entity.Order) error
+	// UpdateOrderIfStatus updates an order only if its status is still the given one, and returns sql.ErrNoRows
+	// otherwise.
+	UpdateOrderIfStatus(ctx context.Context, order entity.Order, status string) error
+	// Transaction runs fn in a transaction, which the repository calls made with the context given to fn are
+	// part of.
+	Transaction(ctx context.Context, fn func(ctx context.Context) error) error
 }
 
+// variantOptions selects the option values of the variant v, in the order of the product options.
+const variantOptions = "coalesce((select group_concat(vo.value order by po.position separator ' / ') " +
+	"from variant_option_value vo join product_option po on po.id = vo.option_id " +
+	"where vo.variant_id = v.id), '')"
+
 // repository persists orders in database
 type repository struct {
 	db     mysql.BaseRepository
@@ -43,11 +58,13 @@ func (r repository) Get(ctx context.Context, id string) (entity.Order, error) {
 }
 
 func (r repository) GetCompleteOrder(ctx context.Context, id string) ([]entity.CompleteOrder, error) {
-	q := fmt.Sprintf("select o.id, user_id, address_id, order_date, payment_date, delivered_date, status, amount, p.name, quantity, od.price " +
-		"from orders o " +
-		"join order_detail od on o.id = od.order_id " +
-		"join product p on p.id = od.product_id " +
-		"where o.id = ?")
+	q := fmt.Sprintf("select o.id, user_id, address_id, order_date, payment_date, delivered_date, status, amount, o.updated_at, p.name, "+
+		"coalesce(od.variant_id, '') variant_id, coalesce(v.sku, '') sku, %s options, quantity, od.price "+
+		"from orders o "+
+		"join order_detail od on o.id = od.order_id "+
+		"join product p on p.id = od.product_id "+
+		"left join product_variant v on v.id = od.variant_id "+
+		"where o.id = ?", variantOptions)
 
 	var order []entity.CompleteOrder
 
@@ -59,43 +76,68 @@ func (r repository) GetCompleteOrder(ctx context.Context, id string) ([]entity.C
 	return order, nil
 }
 
-func (r repository) PlaceOrder(ctx context.Context, orderReq entity.Order) error {
-	// Begin Transaction
-	tx, err := r.db.BeginTx(ctx)
-	defer func() {
-		r.db.EndTx(tx, err)
-	}()
-
-	now := time.Now()
-
-	err = r.CreateOrder(ctx, entity.Order{
-		ID:        orderReq.ID,
-		UserID:    orderReq.UserID,
-		AddressID: orderReq.AddressID,
-		OrderDate: &now,
-		Status:    orderReq.Status,
-		Amount:    orderReq.Amount,
-	})
+func (r repository) GetVariants(ctx context.Context, ids []string) ([]entity.VariantDetail, error) {
+	var variants []entity.VariantDetail
+	if len(ids) == 0 {
+		return variants, nil
+	}
+
+	q := fmt.Sprintf("select v.id, v.product_id, v.sku, p.name product_name, %s options, "+
+		"coalesce(v.price, p.price) price, v.stock "+
+		"from product_variant v "+
+		"join product p on p.id = v.product_id "+
+		"where v.id in (%s)", variantOptions, strings.TrimSuffix(strings.Repeat("?,", len(ids)), ","))
 
-	for _, orderDetail := range orderReq.OrderDetails {
-		err = r.CreateOrderDetail(ctx, entity.OrderDetail{
-			ID:        entity.GenerateID(),
-			OrderID:   orderReq.ID,
-			ProductID: orderDetail.ProductID,
-			Price:     orderDetail.Price,
-			Quantity:  orderDetail.Quantity,
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	err := r.db.FetchRows(ctx, q, &variants, args...)
+	if err != nil {
+		return variants, err
+	}
+
+	return variants, nil
+}
+
+func (r repository) PlaceOrder(ctx context.Context, orderReq entity.Order) error {
+	return r.db.Transaction(ctx, func(ctx context.Context) error {
+		now := time.Now()
+
+		err := r.CreateOrder(ctx, entity.Order{
+			ID:        orderReq.ID,
+			UserID:    orderReq.UserID,
+			AddressID: orderReq.AddressID,
+			OrderDate: &now,
+			Status:    orderReq.Status,
+			Amount:    orderReq.Amount,
+			UpdatedAt: now,
 		})
 		if err != nil {
 			return err
 		}
-	}
 
-	return nil
+		for _, orderDetail := range orderReq.OrderDetails {
+			err = r.CreateOrderDetail(ctx, entity.OrderDetail{
+				ID:        entity.GenerateID(),
+				OrderID:   orderReq.ID,
+				ProductID: orderDetail.ProductID,
+				VariantID: orderDetail.VariantID,
+				Price:     orderDetail.Price,
+				Quantity:  orderDetail.Quantity,
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
 }
 
 func (r repository) CreateOrder(ctx context.Context, order entity.Order) error {
-	q := fmt.Sprintf("insert into orders (id, user_id, address_id, order_date, status, amount) " +
-		"values (:id, :user_id, :address_id, :order_date, :status, :amount)")
+	q := fmt.Sprintf("insert into orders (id, user_id, address_id, order_date, status, amount, updated_at) " +
+		"values (:id, :user_id, :address_id, :order_date, :status, :amount, :updated_at)")
 
 	_, err := r.db.Exec(ctx, q, order)
 	if err != nil {
@@ -106,7 +148,8 @@ func (r repository) CreateOrder(ctx context.Context, order entity.Order) error {
 }
 
 func (r repository) CreateOrderDetail(ctx context.Context, orderDetail entity.OrderDetail) error {
-	q := fmt.Sprintf("insert into order_detail values (:id, :order_id, :product_id, :quantity, :price)")
+	q := fmt.Sprintf("insert into order_detail (id, order_id, product_id, variant_id, quantity, price) " +
+		"values (:id, :order_id, :product_id, :variant_id, :quantity, :price)")
 
 	_, err := r.db.Exec(ctx, q, orderDetail)
 	if err != nil {
@@ -120,7 +163,8 @@ func (r repository) UpdateOrder(ctx context.Context, order entity.Order) error {
 	q := fmt.Sprintf("update orders set address_id = :address_id, " +
 		"payment_date = :payment_date, " +
 		"delivered_date = :delivered_date, " +
-		"status = :status " +
+		"status = :status, " +
+		"updated_at = :updated_at " +
 		"where id = :id")
 
 	_, err := r.db.Exec(ctx, q, order)
@@ -130,3 +174,45 @@ func (r repository) UpdateOrder(ctx context.Context, order entity.Order) error {
 
 	return nil
 }
+
+func (r repository) UpdateOrderIfStatus(ctx context.Context, order entity.Order, status string) error {
+	q := fmt.Sprintf("update orders set address_id = :address_id, " +
+		"payment_date = :payment_date, " +
+		"delivered_date = :delivered_date, " +
+		"status = :status, " +
+		"updated_at = :updated_at " +
+		"where id = :id and status = :previous_status")
+
+	args := struct {
+		entity.Order
+		PreviousStatus string `db:"previous_status"`
+	}{order, status}
+	res, err := r.db.Exec(ctx, q, args)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n > 0 {
+		return nil
+	}
+
+	// MySQL does not count the rows left unchanged, which must not be taken for orders whose status changed
+	q = fmt.Sprintf("select status from orders where id = ?")
+
+	var current string
+
+	err = r.db.FetchRow(ctx, q, &current, order.ID)
+	if err != nil {
+		return err
+	}
+	if current != status {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+func (r repository) Transaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return r.db.Transaction(ctx, fn)
+}
@@ -2,9 +2,20 @@ package order
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/go-ozzo/ozzo-validation/v4/is"
 	"github.com/online-shop/internal/auth"
 	"github.com/online-shop/internal/entity"
+	"github.com/online-shop/internal/errors"
+	"github.com/online-shop/pkg/httpcache"
 	"github.com/online-shop/pkg/log"
+	"github.com/online-shop/pkg/tracing"
+	"math"
+	"strconv"
 	"time"
 )
 
@@ -24,26 +35,64 @@ type Service interface {
 	UpdateOrder(ctx context.Context, input UpdateOrderRequest) (entity.Order, error)
 }
 
+// maxOrderItems and maxItemQuantity bound the size of a single order.
+const (
+	maxOrderItems   = 100
+	maxItemQuantity = 1000
+)
+
 type PlaceOrderRequest struct {
 	ShippingAddress string        `json:"shipping_address"`
 	Items           []ItemRequest `json:"items"`
 }
 
+// Validate validates the PlaceOrderRequest fields, including every item.
+func (r PlaceOrderRequest) Validate() error {
+	return validation.ValidateStruct(&r,
+		validation.Field(&r.ShippingAddress, validation.Required, validation.Length(0, 64)),
+		validation.Field(&r.Items, validation.Required, validation.Length(1, maxOrderItems)),
+	)
+}
+
 type ItemRequest struct {
-	ProductID int64   `json:"product_id"`
-	Quantity  int32   `json:"quantity"`
-	Price     float64 `json:"price"`
+	VariantID string `json:"variant_id"`
+	Quantity  int32  `json:"quantity"`
+	// Price is the price the customer was shown, if any. The order is refused if the price changed since.
+	Price float64 `json:"price"`
+}
+
+// Validate validates the ItemRequest fields.
+func (r ItemRequest) Validate() error {
+	return validation.ValidateStruct(&r,
+		validation.Field(&r.VariantID, validation.Required, is.UUID),
+		validation.Field(&r.Quantity, validation.Required, validation.Min(int32(1)), validation.Max(int32(maxItemQuantity))),
+		validation.Field(&r.Price, validation.Min(float64(0))),
+	)
 }
 
 type UpdateOrderRequest struct {
 	OrderID string `json:"order_id"`
 	Status  string `json:"status"`
+	// IfMatch is the If-Match header of the request, if any. The order is only updated if it matches the entity
+	// tag of its current version, so that concurrent updates are not lost.
+	IfMatch string `json:"-"`
+}
+
+// Validate validates the UpdateOrderRequest fields.
+func (r UpdateOrderRequest) Validate() error {
+	return validation.ValidateStruct(&r,
+		validation.Field(&r.OrderID, validation.Required, is.UUID),
+		validation.Field(&r.Status, validation.Required,
+			validation.In(CREATED, PAYMENT, VERIFIED, SHIPPED, RECEIVED, CANCELLED, REJECTED)),
+	)
 }
 
 type ItemResponse struct {
-	Name     string  `json:"name"`
-	Price    float64 `json:"price"`
-	Quantity int32   `json:"quantity"`
+	VariantID string  `json:"variant_id"`
+	SKU       string  `json:"sku"`
+	Name      string  `json:"name"`
+	Price     float64 `json:"price"`
+	Quantity  int32   `json:"quantity"`
 }
 
 type OrderResponse struct {
@@ -52,93 +101,277 @@ type OrderResponse struct {
 	Status string         `json:"status"`
 	Amount float64        `json:"amount"`
 	Items  []ItemResponse `json:"items"`
+	// UpdatedAt is sent as the Last-Modified header rather than in the body.
+	UpdatedAt time.Time `json:"-"`
+}
+
+// ETag returns the strong entity tag of the order, which changes whenever its representation does.
+func (o OrderResponse) ETag() string {
+	data, _ := json.Marshal(o)
+	return httpcache.StrongETag(data)
+}
+
+// Inventory keeps the stock of the ordered variants.
+type Inventory interface {
+	// Reserve reserves the stock of the items of a new order until it is paid, for a limited time.
+	Reserve(ctx context.Context, orderID string, items []entity.OrderDetail) error
+	// Deduct converts the reservations of an order into deductions once it is paid.
+	Deduct(ctx context.Context, orderID string) error
+	// Release gives back the stock of an order which will not be shipped.
+	Release(ctx context.Context, orderID string) error
 }
 
 type service struct {
-	repo   Repository
-	logger log.Logger
+	repo      Repository
+	inventory Inventory
+	logger    log.Logger
 }
 
-// NewService creates a new album service.
-func NewService(repo Repository, logger log.Logger) Service {
-	return service{repo, logger}
+// NewService creates a new album service, reserving the stock of the orders in the given inventory.
+func NewService(repo Repository, inventory Inventory, logger log.Logger) Service {
+	return service{repo, inventory, logger}
 }
 
 func (s service) Get(ctx context.Context, id string) (OrderResponse, error) {
+	ctx, span := tracing.StartSpan(ctx, "order.Service.Get")
+	defer span.End()
+
 	order, err := s.repo.GetCompleteOrder(ctx, id)
 	if err != nil {
 		return OrderResponse{}, err
 	}
+	if len(order) == 0 {
+		return OrderResponse{}, errors.NotFound("")
+	}
 
 	var items []ItemResponse
 	for _, item := range order {
 		items = append(items, ItemResponse{
-			Name:     item.ProductName,
-			Price:    item.Price,
-			Quantity: item.Quantity,
+			VariantID: item.VariantID,
+			SKU:       item.SKU,
+			Name:      entity.VariantName(item.ProductName, item.Options),
+			Price:     item.Price,
+			Quantity:  item.Quantity,
 		})
 	}
 
 	return OrderResponse{
-		ID:     order[0].ID,
-		UserID: order[0].UserID,
-		Status: order[0].Status,
-		Amount: order[0].Amount,
-		Items:  items,
+		ID:        order[0].ID,
+		UserID:    order[0].UserID,
+		Status:    order[0].Status,
+		Amount:    order[0].Amount,
+		Items:     items,
+		UpdatedAt: order[0].UpdatedAt,
 	}, nil
 }
 
 func (s service) PlaceOrder(ctx context.Context, input PlaceOrderRequest) (OrderResponse, error) {
+	ctx, span := tracing.StartSpan(ctx, "order.Service.PlaceOrder")
+	defer span.End()
+
 	var orderDetails []entity.OrderDetail
 	var total float64
 
 	orderId := entity.GenerateID()
 	user := auth.CurrentUser(ctx)
 
-	for _, item := range input.Items {
+	variants, err := s.resolveVariants(ctx, input.Items)
+	if err != nil {
+		return OrderResponse{}, err
+	}
+	for i, item := range input.Items {
+		variant := variants[i]
 		orderDetails = append(orderDetails, entity.OrderDetail{
-			ProductID: item.ProductID,
-			Price:     item.Price,
+			ProductID: variant.ProductID,
+			VariantID: variant.ID,
+			Price:     variant.Price,
 			Quantity:  item.Quantity,
 		})
-		total = total + (item.Price * float64(item.Quantity))
+		total = total + (variant.Price * float64(item.Quantity))
 	}
 
-	err := s.repo.PlaceOrder(ctx, entity.Order{
-		ID:           orderId,
-		UserID:       user.GetID(),
-		AddressID:    input.ShippingAddress,
-		Status:       CREATED,
-		Amount:       total,
-		OrderDetails: orderDetails,
+	err = s.repo.Transaction(ctx, func(ctx context.Context) error {
+		err := s.repo.PlaceOrder(ctx, entity.Order{
+			ID:           orderId,
+			UserID:       user.GetID(),
+			AddressID:    input.ShippingAddress,
+			Status:       CREATED,
+			Amount:       total,
+			OrderDetails: orderDetails,
+		})
+		if err != nil {
+			return err
+		}
+		return s.inventory.Reserve(ctx, orderId, orderDetails)
 	})
 
 	if err != nil {
 		return OrderResponse{}, err
 	}
+	ordersPlaced.Inc()
 
 	return s.Get(ctx, orderId)
 }
 
-func (s service) UpdateOrder(ctx context.Context, input UpdateOrderRequest) (entity.Order, error) {
-	order, err := s.repo.Get(ctx, input.OrderID)
+// resolveVariants returns the variants of the given items, in the same order. Items must refer to existing
+// variants, at the price the customer was shown if any.
+func (s service) resolveVariants(ctx context.Context, items []ItemRequest) ([]entity.VariantDetail, error) {
+	ids := make([]string, len(items))
+	for i, item := range items {
+		ids[i] = item.VariantID
+	}
+	found, err := s.repo.GetVariants(ctx, ids)
 	if err != nil {
-		return entity.Order{}, err
+		return nil, err
+	}
+	byID := make(map[string]entity.VariantDetail, len(found))
+	for _, variant := range found {
+		byID[variant.ID] = variant
 	}
 
-	now := time.Now()
-	switch status := input.Status; status {
-	case PAYMENT:
-		order.PaymentDate = &now
-	case SHIPPED:
-		order.DeliveredDate = &now
+	variants := make([]entity.VariantDetail, len(items))
+	for i, item := range items {
+		variant, ok := byID[item.VariantID]
+		if !ok {
+			return nil, validation.Errors{"items": validation.Errors{
+				strconv.Itoa(i): validation.Errors{"variant_id": stderrors.New("must be an existing variant")},
+			}}
+		}
+		if item.Price != 0 && math.Abs(item.Price-variant.Price) >= 0.005 {
+			return nil, errors.UnprocessableEntity(fmt.Sprintf("The price of %s is now %.2f.", variant.Name(), variant.Price), errors.CodePriceChanged)
+		}
+		variants[i] = variant
 	}
-	order.Status = input.Status
+	return variants, nil
+}
+
+// transitions maps the statuses of orders to the ones they may change to. Orders are paid, their payment verified,
+// and then shipped and received, unless they are cancelled or rejected before being shipped.
+var transitions = map[string][]string{
+	CREATED:  {PAYMENT, CANCELLED, REJECTED},
+	PAYMENT:  {VERIFIED, REJECTED},
+	VERIFIED: {SHIPPED, REJECTED},
+	SHIPPED:  {RECEIVED},
+}
+
+// customerTransitions are the transitions customers may make to their own orders, the others being made by staff
+// members and service accounts.
+var customerTransitions = map[string][]string{
+	CREATED: {PAYMENT, CANCELLED},
+}
+
+// allows tells whether the given transitions include the change of an order from one status to another.
+func allows(transitions map[string][]string, from, to string) bool {
+	for _, status := range transitions[from] {
+		if status == to {
+			return true
+		}
+	}
+	return false
+}
+
+func (s service) UpdateOrder(ctx context.Context, input UpdateOrderRequest) (entity.Order, error) {
+	ctx, span := tracing.StartSpan(ctx, "order.Service.UpdateOrder")
+	defer span.End()
+
+	// payments are made by customers themselves, never by staff members on their behalf
+	if input.Status == PAYMENT {
+		if err := auth.ForbidImpersonation(ctx); err != nil {
+			return entity.Order{}, err
+		}
+	}
+
+	var order entity.Order
+	var previousStatus string
+	err := s.repo.Transaction(ctx, func(ctx context.Context) error {
+		var err error
+		order, err = s.repo.Get(ctx, input.OrderID)
+		if err != nil {
+			return err
+		}
+		if err := s.checkTransition(ctx, order, input.Status); err != nil {
+			return err
+		}
+		if input.IfMatch != "" {
+			current, err := s.Get(ctx, input.OrderID)
+			if err != nil {
+				return err
+			}
+			// the statuses differ if the order changed between both reads
+			if current.Status != order.Status || !httpcache.Match(input.IfMatch, current.ETag()) {
+				return errors.PreconditionFailed("")
+			}
+		}
 
-	err = s.repo.UpdateOrder(ctx, order)
+		previousStatus = order.Status
+		now := time.Now()
+		switch status := input.Status; status {
+		case PAYMENT:
+			order.PaymentDate = &now
+		case SHIPPED:
+			order.DeliveredDate = &now
+		}
+		order.Status = input.Status
+		order.UpdatedAt = now
+
+		// only the status of orders changes, so the order still has the version read above if its status did not
+		// change in the meantime, which also keeps concurrent updates from both moving the stock
+		err = s.repo.UpdateOrderIfStatus(ctx, order, previousStatus)
+		if stderrors.Is(err, sql.ErrNoRows) {
+			if input.IfMatch != "" {
+				return errors.PreconditionFailed("")
+			}
+			return errors.UnprocessableEntity("The order was changed meanwhile, please retry.", errors.CodeInvalidStatus)
+		} else if err != nil {
+			return err
+		}
+		return s.updateStock(ctx, order.ID, order.Status)
+	})
 	if err != nil {
 		return entity.Order{}, err
 	}
+	orderStatusTransitions.WithLabelValues(previousStatus, order.Status).Inc()
 
 	return order, nil
 }
+
+// checkTransition returns an error unless the current user may change the status of the given order to the given
+// one. Customers may only pay or cancel their own orders once placed, staff members and service accounts making
+// the other transitions of any order.
+func (s service) checkTransition(ctx context.Context, order entity.Order, status string) error {
+	user := auth.CurrentUser(ctx)
+	if user == nil {
+		return errors.Unauthorized("")
+	}
+	staff := user.GetRole() == entity.RoleAdmin || user.GetRole() == entity.RoleService
+	if staff {
+		if err := auth.CheckRole(ctx, entity.RoleAdmin, entity.RoleService); err != nil {
+			return err
+		}
+	} else if order.UserID != user.GetID() {
+		// the orders of other customers are not revealed
+		return errors.NotFound("")
+	}
+
+	if !allows(transitions, order.Status, status) {
+		return errors.UnprocessableEntity(fmt.Sprintf("The status of %s orders cannot be changed to %s.", order.Status, status),
+			errors.CodeInvalidStatus)
+	}
+	if !staff && !allows(customerTransitions, order.Status, status) {
+		return errors.Forbidden("Customers can only pay or cancel their orders once placed.")
+	}
+	return nil
+}
+
+// updateStock deducts the stock reserved by an order once it is paid, and releases it when the order is cancelled
+// or rejected, which happens before it is shipped. The units of shipped orders come back through restocks, once
+// returned.
+func (s service) updateStock(ctx context.Context, orderID, to string) error {
+	switch to {
+	case PAYMENT:
+		return s.inventory.Deduct(ctx, orderID)
+	case CANCELLED, REJECTED:
+		return s.inventory.Release(ctx, orderID)
+	}
+	return nil
+}
@@ -0,0 +1,385 @@
+package order
+
+import (
+	"context"
+	"database/sql"
+	routing "github.com/go-ozzo/ozzo-routing/v2"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/online-shop/internal/auth"
+	"github.com/online-shop/internal/entity"
+	"github.com/online-shop/internal/errors"
+	"github.com/online-shop/internal/test"
+	"github.com/online-shop/pkg/log"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const (
+	shirtM = "61dc6d71-3f60-476c-ad9b-503f8455f36b"
+	shirtL = "0b8a6d3e-95c4-4fd2-9c0b-7a1f3c3c1f2e"
+)
+
+type mockRepository struct {
+	variants map[string]entity.VariantDetail
+	orders   map[string]entity.Order
+	// beforeUpdate, if set, is called before conditionally updating an order, to change it concurrently.
+	beforeUpdate func()
+}
+
+func newMockRepository() *mockRepository {
+	return &mockRepository{
+		variants: map[string]entity.VariantDetail{
+			shirtM: {ID: shirtM, ProductID: 1, SKU: "SHIRT-M", ProductName: "Shirt", Options: "M / Blue", Price: 25, Stock: 3},
+			shirtL: {ID: shirtL, ProductID: 1, SKU: "SHIRT-L", ProductName: "Shirt", Options: "L / Blue", Price: 27.5, Stock: 1},
+		},
+		orders: map[string]entity.Order{},
+	}
+}
+
+func (m *mockRepository) Get(ctx context.Context, id string) (entity.Order, error) {
+	if order, ok := m.orders[id]; ok {
+		return order, nil
+	}
+	return entity.Order{}, sql.ErrNoRows
+}
+
+func (m *mockRepository) GetCompleteOrder(ctx context.Context, id string) ([]entity.CompleteOrder, error) {
+	order := m.orders[id]
+	var rows []entity.CompleteOrder
+	for _, detail := range order.OrderDetails {
+		variant := m.variants[detail.VariantID]
+		rows = append(rows, entity.CompleteOrder{
+			ID: order.ID, UserID: order.UserID, Status: order.Status, Amount: order.Amount, UpdatedAt: order.UpdatedAt, ProductName: variant.ProductName,
+			VariantID: variant.ID, SKU: variant.SKU, Options: variant.Options, Price: detail.Price, Quantity: detail.Quantity,
+		})
+	}
+	return rows, nil
+}
+
+func (m *mockRepository) GetVariants(ctx context.Context, ids []string) ([]entity.VariantDetail, error) {
+	var variants []entity.VariantDetail
+	for _, id := range ids {
+		if variant, ok := m.variants[id]; ok {
+			variants = append(variants, variant)
+		}
+	}
+	return variants, nil
+}
+
+func (m *mockRepository) PlaceOrder(ctx context.Context, order entity.Order) error {
+	// orders were placed some time ago, so that updating them changes their last modification time
+	order.UpdatedAt = time.Now().Add(-time.Hour)
+	m.orders[order.ID] = order
+	return nil
+}
+
+func (m *mockRepository) CreateOrder(ctx context.Context, order entity.Order) error {
+	m.orders[order.ID] = order
+	return nil
+}
+
+func (m *mockRepository) CreateOrderDetail(ctx context.Context, detail entity.OrderDetail) error {
+	order := m.orders[detail.OrderID]
+	order.OrderDetails = append(order.OrderDetails, detail)
+	m.orders[detail.OrderID] = order
+	return nil
+}
+
+func (m *mockRepository) UpdateOrder(ctx context.Context, order entity.Order) error {
+	m.orders[order.ID] = order
+	return nil
+}
+
+func (m *mockRepository) UpdateOrderIfStatus(ctx context.Context, order entity.Order, status string) error {
+	if m.beforeUpdate != nil {
+		m.beforeUpdate()
+	}
+	if m.orders[order.ID].Status != status {
+		return sql.ErrNoRows
+	}
+	m.orders[order.ID] = order
+	return nil
+}
+
+func (m *mockRepository) Transaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return fn(ctx)
+}
+
+// mockInventory keeps the stock of the mock variants, recording the movements made for every order.
+type mockInventory struct {
+	stock     map[string]int32
+	movements []string
+}
+
+func newMockInventory() *mockInventory {
+	return &mockInventory{stock: map[string]int32{shirtM: 3, shirtL: 1}}
+}
+
+func (m *mockInventory) Reserve(ctx context.Context, orderID string, items []entity.OrderDetail) error {
+	for _, item := range items {
+		if item.Quantity > m.stock[item.VariantID] {
+			return errors.UnprocessableEntity("", errors.CodeOutOfStock)
+		}
+	}
+	for _, item := range items {
+		m.stock[item.VariantID] -= item.Quantity
+	}
+	m.movements = append(m.movements, "reserve "+orderID)
+	return nil
+}
+
+func (m *mockInventory) Deduct(ctx context.Context, orderID string) error {
+	m.movements = append(m.movements, "deduct "+orderID)
+	return nil
+}
+
+func (m *mockInventory) Release(ctx context.Context, orderID string) error {
+	m.movements = append(m.movements, "release "+orderID)
+	return nil
+}
+
+// contextFor returns the context of a request authenticated by auth.MockAuthHandler with the given header.
+func contextFor(t *testing.T, header http.Header) context.Context {
+	req := httptest.NewRequest("PUT", "/v1/orders", nil)
+	req.Header = header
+	c := routing.NewContext(httptest.NewRecorder(), req)
+	if !assert.Nil(t, auth.MockAuthHandler(c)) {
+		t.FailNow()
+	}
+	return c.Request.Context()
+}
+
+func TestService_PlaceOrder(t *testing.T) {
+	logger, _ := log.NewForTest()
+	repo := newMockRepository()
+	s := NewService(repo, newMockInventory(), logger)
+	ctx := auth.WithUser(context.Background(), "100", "demo")
+
+	// prices are the ones of the variants, whatever the customer sends
+	order, err := s.PlaceOrder(ctx, PlaceOrderRequest{ShippingAddress: "addr-1", Items: []ItemRequest{
+		{VariantID: shirtM, Quantity: 2},
+		{VariantID: shirtL, Quantity: 1, Price: 27.5},
+	}})
+	assert.Nil(t, err)
+	assert.Equal(t, "100", order.UserID)
+	assert.Equal(t, 77.5, order.Amount)
+	assert.Equal(t, []ItemResponse{
+		{VariantID: shirtM, SKU: "SHIRT-M", Name: "Shirt (M / Blue)", Price: 25, Quantity: 2},
+		{VariantID: shirtL, SKU: "SHIRT-L", Name: "Shirt (L / Blue)", Price: 27.5, Quantity: 1},
+	}, order.Items)
+	assert.Equal(t, int64(1), repo.orders[order.ID].OrderDetails[0].ProductID)
+
+	_, err = s.PlaceOrder(ctx, PlaceOrderRequest{ShippingAddress: "addr-1", Items: []ItemRequest{
+		{VariantID: shirtM, Quantity: 1, Price: 20},
+	}})
+	assert.Equal(t, errors.CodePriceChanged, err.(errors.ErrorResponse).Code)
+
+	_, err = s.PlaceOrder(ctx, PlaceOrderRequest{ShippingAddress: "addr-1", Items: []ItemRequest{
+		{VariantID: shirtM, Quantity: 1},
+		{VariantID: "d9428888-122b-11e1-b85c-61cd3cbb3210", Quantity: 1},
+	}})
+	assert.Contains(t, err.(validation.Errors)["items"].(validation.Errors), "1")
+	assert.Len(t, repo.orders, 1)
+}
+
+func TestService_stock(t *testing.T) {
+	logger, _ := log.NewForTest()
+	inventory := newMockInventory()
+	s := NewService(newMockRepository(), inventory, logger)
+	ctx := contextFor(t, auth.MockAuthHeader())
+	staff := contextFor(t, auth.MockAdminAuthHeader())
+
+	_, err := s.PlaceOrder(ctx, PlaceOrderRequest{ShippingAddress: "addr-1", Items: []ItemRequest{{VariantID: shirtL, Quantity: 2}}})
+	assert.Equal(t, errors.CodeOutOfStock, err.(errors.ErrorResponse).Code)
+
+	paid, _ := s.PlaceOrder(ctx, PlaceOrderRequest{ShippingAddress: "addr-1", Items: []ItemRequest{{VariantID: shirtM, Quantity: 1}}})
+	cancelled, _ := s.PlaceOrder(ctx, PlaceOrderRequest{ShippingAddress: "addr-1", Items: []ItemRequest{{VariantID: shirtM, Quantity: 1}}})
+	assert.Equal(t, int32(1), inventory.stock[shirtM])
+	for _, status := range []string{PAYMENT, VERIFIED, SHIPPED, RECEIVED} {
+		_, err := s.UpdateOrder(staff, UpdateOrderRequest{OrderID: paid.ID, Status: status})
+		assert.Nil(t, err, status)
+	}
+	_, err = s.UpdateOrder(ctx, UpdateOrderRequest{OrderID: cancelled.ID, Status: CANCELLED})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		"reserve " + paid.ID, "reserve " + cancelled.ID, "deduct " + paid.ID, "release " + cancelled.ID,
+	}, inventory.movements)
+}
+
+func TestService_UpdateOrder_transitions(t *testing.T) {
+	logger, _ := log.NewForTest()
+	repo := newMockRepository()
+	inventory := newMockInventory()
+	s := NewService(repo, inventory, logger)
+	ctx := contextFor(t, auth.MockAuthHeader())
+	staff := contextFor(t, auth.MockAdminAuthHeader())
+	place := func() string {
+		order, err := s.PlaceOrder(ctx, PlaceOrderRequest{ShippingAddress: "addr-1", Items: []ItemRequest{{VariantID: shirtM, Quantity: 1}}})
+		if !assert.Nil(t, err) {
+			t.FailNow()
+		}
+		return order.ID
+	}
+	status := func(err error) int {
+		if err == nil {
+			return http.StatusOK
+		}
+		return err.(errors.ErrorResponse).Status
+	}
+
+	// customers can only pay or cancel their own orders, once placed
+	paid := place()
+	_, err := s.UpdateOrder(ctx, UpdateOrderRequest{OrderID: paid, Status: PAYMENT})
+	assert.Nil(t, err)
+	_, err = s.UpdateOrder(ctx, UpdateOrderRequest{OrderID: paid, Status: VERIFIED})
+	assert.Equal(t, http.StatusForbidden, status(err))
+	id := place()
+	_, err = s.UpdateOrder(ctx, UpdateOrderRequest{OrderID: id, Status: REJECTED})
+	assert.Equal(t, http.StatusForbidden, status(err))
+	_, err = s.UpdateOrder(ctx, UpdateOrderRequest{OrderID: id, Status: RECEIVED})
+	assert.Equal(t, http.StatusUnprocessableEntity, status(err))
+	_, err = s.UpdateOrder(auth.WithUser(context.Background(), "200", "other"), UpdateOrderRequest{OrderID: id, Status: CANCELLED})
+	assert.Equal(t, http.StatusNotFound, status(err))
+	_, err = s.UpdateOrder(ctx, UpdateOrderRequest{OrderID: id, Status: CANCELLED})
+	assert.Nil(t, err)
+
+	// cancelled, rejected and received orders stay so
+	for _, update := range []struct{ from, to string }{{CANCELLED, PAYMENT}, {REJECTED, PAYMENT}, {RECEIVED, CREATED}, {CREATED, CREATED}} {
+		order := repo.orders[id]
+		order.Status = update.from
+		repo.orders[id] = order
+		_, err = s.UpdateOrder(staff, UpdateOrderRequest{OrderID: id, Status: update.to})
+		assert.Equal(t, errors.CodeInvalidStatus, err.(errors.ErrorResponse).Code, "%s to %s", update.from, update.to)
+	}
+
+	// of concurrent updates, only the first one applies and moves the stock
+	id = place()
+	repo.beforeUpdate = func() {
+		order := repo.orders[id]
+		order.Status = CANCELLED
+		repo.orders[id] = order
+	}
+	_, err = s.UpdateOrder(staff, UpdateOrderRequest{OrderID: id, Status: PAYMENT})
+	assert.Equal(t, errors.CodeInvalidStatus, err.(errors.ErrorResponse).Code)
+	assert.NotContains(t, inventory.movements, "deduct "+id)
+}
+
+func TestPlaceOrderRequest_Validate(t *testing.T) {
+	valid := PlaceOrderRequest{
+		ShippingAddress: "addr-1",
+		Items:           []ItemRequest{{VariantID: shirtM, Quantity: 2, Price: 50000}},
+	}
+	assert.Nil(t, valid.Validate())
+	valid.Items[0].Price = 0
+	assert.Nil(t, valid.Validate(), "the expected price is optional")
+
+	errs := PlaceOrderRequest{}.Validate().(validation.Errors)
+	assert.Contains(t, errs, "shipping_address")
+	assert.Contains(t, errs, "items")
+
+	for _, item := range []ItemRequest{
+		{VariantID: shirtM, Quantity: 0, Price: 1},
+		{VariantID: shirtM, Quantity: -1, Price: 1},
+		{VariantID: shirtM, Quantity: maxItemQuantity + 1, Price: 1},
+		{VariantID: "", Quantity: 1, Price: 1},
+		{VariantID: "P1", Quantity: 1, Price: 1},
+		{VariantID: shirtM, Quantity: 1, Price: -1},
+	} {
+		r := valid
+		r.Items = []ItemRequest{item}
+		err := r.Validate()
+		if assert.NotNil(t, err, "%+v", item) {
+			assert.Contains(t, err.(validation.Errors), "items")
+		}
+	}
+}
+
+func TestUpdateOrderRequest_Validate(t *testing.T) {
+	assert.Nil(t, UpdateOrderRequest{OrderID: "61dc6d71-3f60-476c-ad9b-503f8455f36b", Status: PAYMENT}.Validate())
+
+	errs := UpdateOrderRequest{OrderID: "abc", Status: "LOST"}.Validate().(validation.Errors)
+	assert.Contains(t, errs, "order_id")
+	assert.Contains(t, errs, "status")
+}
+
+func TestService_UpdateOrder_impersonation(t *testing.T) {
+	logger, _ := log.NewForTest()
+	s := NewService(newMockRepository(), newMockInventory(), logger)
+	order, err := s.PlaceOrder(contextFor(t, auth.MockAuthHeader()),
+		PlaceOrderRequest{ShippingAddress: "addr-1", Items: []ItemRequest{{VariantID: shirtM, Quantity: 1}}})
+	assert.Nil(t, err)
+
+	// staff members impersonating customers cannot pay on their behalf
+	impersonation := contextFor(t, auth.MockImpersonationAuthHeader())
+	_, err = s.UpdateOrder(impersonation, UpdateOrderRequest{OrderID: order.ID, Status: PAYMENT})
+	assert.NotNil(t, err)
+	assert.Equal(t, auth.ForbidImpersonation(impersonation), err)
+	_, err = s.UpdateOrder(contextFor(t, auth.MockAuthHeader()), UpdateOrderRequest{OrderID: order.ID, Status: PAYMENT})
+	assert.Nil(t, err)
+}
+
+func TestService_UpdateOrder_ifMatch(t *testing.T) {
+	logger, _ := log.NewForTest()
+	repo := newMockRepository()
+	s := NewService(repo, newMockInventory(), logger)
+	ctx := contextFor(t, auth.MockAdminAuthHeader())
+	placed, err := s.PlaceOrder(contextFor(t, auth.MockAuthHeader()),
+		PlaceOrderRequest{ShippingAddress: "addr-1", Items: []ItemRequest{{VariantID: shirtM, Quantity: 1}}})
+	assert.Nil(t, err)
+
+	_, err = s.UpdateOrder(ctx, UpdateOrderRequest{OrderID: placed.ID, Status: PAYMENT, IfMatch: `"stale"`})
+	assert.Equal(t, http.StatusPreconditionFailed, err.(errors.ErrorResponse).Status)
+	assert.Equal(t, CREATED, repo.orders[placed.ID].Status)
+
+	order, err := s.UpdateOrder(ctx, UpdateOrderRequest{OrderID: placed.ID, Status: PAYMENT, IfMatch: placed.ETag()})
+	assert.Nil(t, err)
+	assert.Equal(t, PAYMENT, order.Status)
+	assert.NotNil(t, order.PaymentDate)
+
+	// the entity tag changed along with the status
+	_, err = s.UpdateOrder(ctx, UpdateOrderRequest{OrderID: placed.ID, Status: REJECTED, IfMatch: placed.ETag()})
+	assert.Equal(t, http.StatusPreconditionFailed, err.(errors.ErrorResponse).Status)
+	current, _ := s.Get(ctx, placed.ID)
+	assert.NotEqual(t, placed.ETag(), current.ETag())
+	_, err = s.UpdateOrder(ctx, UpdateOrderRequest{OrderID: placed.ID, Status: REJECTED, IfMatch: "*"})
+	assert.Nil(t, err)
+
+	_, err = s.Get(ctx, "d9428888-122b-11e1-b85c-61cd3cbb3210")
+	assert.Equal(t, http.StatusNotFound, err.(errors.ErrorResponse).Status)
+}
+
+func TestAPI_conditionalRequests(t *testing.T) {
+	logger, _ := log.NewForTest()
+	repo := newMockRepository()
+	s := NewService(repo, newMockInventory(), logger)
+	order, err := s.PlaceOrder(auth.WithUser(context.Background(), "100", "demo"),
+		PlaceOrderRequest{ShippingAddress: "addr-1", Items: []ItemRequest{{VariantID: shirtM, Quantity: 1}}})
+	assert.Nil(t, err)
+	placedAt := repo.orders[order.ID].UpdatedAt.UTC().Format(http.TimeFormat)
+	router := test.MockRouter(logger)
+	RegisterHandlers(router.Group("/v1"), s, auth.MockAuthHandler, logger)
+	header := func(name, value string) http.Header {
+		h := auth.MockAuthHeader()
+		h.Set(name, value)
+		return h
+	}
+	update := `{"order_id":"` + order.ID + `","status":"CANCELLED"}`
+
+	tests := []test.APITestCase{
+		{Name: "get", Method: "GET", URL: "/v1/orders/" + order.ID, Header: auth.MockAuthHeader(), WantStatus: http.StatusOK, WantResponse: `*"status":"CREATED"*`},
+		{Name: "not modified", Method: "GET", URL: "/v1/orders/" + order.ID, Header: header("If-None-Match", order.ETag()), WantStatus: http.StatusNotModified},
+		{Name: "not modified since", Method: "GET", URL: "/v1/orders/" + order.ID, Header: header("If-Modified-Since", placedAt), WantStatus: http.StatusNotModified},
+		{Name: "rejection", Method: "PUT", URL: "/v1/orders", Body: `{"order_id":"` + order.ID + `","status":"REJECTED"}`, Header: auth.MockAuthHeader(), WantStatus: http.StatusForbidden},
+		{Name: "stale update", Method: "PUT", URL: "/v1/orders", Body: update, Header: header("If-Match", `"stale"`), WantStatus: http.StatusPreconditionFailed},
+		{Name: "update", Method: "PUT", URL: "/v1/orders", Body: update, Header: header("If-Match", order.ETag()), WantStatus: http.StatusOK},
+		{Name: "modified", Method: "GET", URL: "/v1/orders/" + order.ID, Header: header("If-None-Match", order.ETag()), WantStatus: http.StatusOK, WantResponse: `*"status":"CANCELLED"*`},
+		{Name: "modified since", Method: "GET", URL: "/v1/orders/" + order.ID, Header: header("If-Modified-Since", placedAt), WantStatus: http.StatusOK, WantResponse: `*"status":"CANCELLED"*`},
+		{Name: "unknown order", Method: "GET", URL: "/v1/orders/d9428888-122b-11e1-b85c-61cd3cbb3210", Header: header("If-None-Match", "*"), WantStatus: http.StatusNotFound},
+	}
+	for _, tc := range tests {
+		test.Endpoint(t, router, tc)
+	}
+}
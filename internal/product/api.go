@@ -1,17 +1,72 @@
 package product
 
 import (
+	stderrors "errors"
+	"fmt"
 	routing "github.com/go-ozzo/ozzo-routing/v2"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/online-shop/internal/auth"
+	"github.com/online-shop/internal/entity"
+	"github.com/online-shop/internal/errors"
+	"github.com/online-shop/internal/response"
+	"github.com/online-shop/pkg/httpcache"
 	"github.com/online-shop/pkg/log"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
 )
 
-// RegisterHandlers sets up the routing of the HTTP handlers.
-func RegisterHandlers(r *routing.RouteGroup, service Service, authHandler routing.Handler, logger log.Logger) {
+// RegisterHandlers sets up the routing of the HTTP handlers. The catalogue is read through the public group,
+// which anonymous requests may use, and changed through the protected one.
+func RegisterHandlers(public, protected *routing.RouteGroup, service Service, logger log.Logger) {
 	res := resource{service, logger}
-	r.Use(authHandler)
 
-	r.Get("/products", res.list)
-	r.Get("/products/<id>", res.get)
+	public.Get("/products", auth.RequireScope(auth.ScopeProductsRead), res.list)
+	protected.Get("/products/export", auth.RequireRole(entity.RoleAdmin), res.export)
+	protected.Post("/products/import", auth.RequireRole(entity.RoleAdmin), res.importCatalogue)
+	public.Get("/products/<id>", auth.RequireScope(auth.ScopeProductsRead), res.get)
+
+	protected.Post("/products/<id>/variants", auth.RequireRole(entity.RoleAdmin), res.createVariant)
+	protected.Put("/products/<id>/variants/<variant_id>", auth.RequireRole(entity.RoleAdmin), res.updateVariant)
+	protected.Post("/products/<id>/images", auth.RequireRole(entity.RoleAdmin), res.addImage)
+	protected.Delete("/products/<id>/images/<image_id>", auth.RequireRole(entity.RoleAdmin), res.deleteImage)
+}
+
+// maxMultipartOverhead is the size allowed for the parts of image uploads besides the image itself.
+const maxMultipartOverhead = 64 << 10
+
+// errBodyTooLarge is returned by limitedBody once the request body exceeds its limit.
+var errBodyTooLarge = stderrors.New("request body too large")
+
+// limitedBody reads a request body, failing with errBodyTooLarge after reading more than the given number of bytes.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, errBodyTooLarge
+	}
+	// one byte more than allowed is read, to tell bodies of exactly the limit from larger ones
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n + int(b.remaining), errBodyTooLarge
+	}
+	return n, err
+}
+
+// catalogueContentTypes maps the catalogue formats to their content type.
+var catalogueContentTypes = map[string]string{
+	FormatCSV:   "text/csv; charset=utf-8",
+	FormatJSONL: "application/x-ndjson",
 }
 
 type resource struct {
@@ -25,10 +80,22 @@ func (r resource) get(c *routing.Context) error {
 		return err
 	}
 
+	httpcache.SetLastModified(c.Response.Header(), product.UpdatedAt)
 	return c.Write(product)
 }
 
+// searchParameters are the query parameters of a product search.
+var searchParameters = []string{"q", "category", "price", "limit", "offset"}
+
+// list returns all the products, or the result of a search when any search parameter is given.
 func (r resource) list(c *routing.Context) error {
+	query := c.Request.URL.Query()
+	for _, name := range searchParameters {
+		if _, ok := query[name]; ok {
+			return r.search(c)
+		}
+	}
+
 	product, err := r.service.List(c.Request.Context())
 	if err != nil {
 		return err
@@ -36,3 +103,162 @@ func (r resource) list(c *routing.Context) error {
 
 	return c.Write(product)
 }
+
+func (r resource) search(c *routing.Context) error {
+	query := c.Request.URL.Query()
+	input := SearchRequest{Q: query.Get("q"), Category: query["category"], Price: query["price"]}
+	errs := validation.Errors{}
+	for name, value := range map[string]*int{"limit": &input.Limit, "offset": &input.Offset} {
+		if query.Get(name) == "" {
+			continue
+		}
+		n, err := strconv.Atoi(query.Get(name))
+		if err != nil {
+			errs[name] = stderrors.New("must be an integer")
+		}
+		*value = n
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	if err := input.Validate(); err != nil {
+		return err
+	}
+	result, err := r.service.Search(c.Request.Context(), input)
+	if err != nil {
+		return err
+	}
+
+	return c.Write(result)
+}
+
+func (r resource) createVariant(c *routing.Context) error {
+	var input CreateVariantRequest
+	if err := c.Read(&input); err != nil {
+		r.logger.With(c.Request.Context()).Info(err)
+		return errors.BadRequest("")
+	}
+	if err := input.Validate(); err != nil {
+		return err
+	}
+	variant, err := r.service.CreateVariant(c.Request.Context(), c.Param("id"), input)
+	if err != nil {
+		return err
+	}
+
+	return c.WriteWithStatus(variant, http.StatusCreated)
+}
+
+func (r resource) updateVariant(c *routing.Context) error {
+	var input UpdateVariantRequest
+	if err := c.Read(&input); err != nil {
+		r.logger.With(c.Request.Context()).Info(err)
+		return errors.BadRequest("")
+	}
+	if err := input.Validate(); err != nil {
+		return err
+	}
+	variant, err := r.service.UpdateVariant(c.Request.Context(), c.Param("id"), c.Param("variant_id"), input)
+	if err != nil {
+		return err
+	}
+
+	return c.Write(variant)
+}
+
+// addImage adds the image uploaded as the "image" field of a multipart form.
+func (r resource) addImage(c *routing.Context) error {
+	if c.Request.ContentLength > MaxImageSize+maxMultipartOverhead {
+		return errImageTooLarge
+	}
+	c.Request.Body = &limitedBody{c.Request.Body, MaxImageSize + maxMultipartOverhead}
+	file, _, err := c.Request.FormFile("image")
+	if err != nil {
+		r.logger.With(c.Request.Context()).Info(err)
+		if stderrors.Is(err, errBodyTooLarge) {
+			return errImageTooLarge
+		}
+		return errors.BadRequest("The image must be sent as the \"image\" field of a multipart form.")
+	}
+	defer file.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(file, MaxImageSize+1))
+	if err != nil {
+		r.logger.With(c.Request.Context()).Info(err)
+		return errors.BadRequest("")
+	}
+	image, err := r.service.AddImage(c.Request.Context(), c.Param("id"), data)
+	if err != nil {
+		return err
+	}
+
+	return c.WriteWithStatus(image, http.StatusCreated)
+}
+
+func (r resource) deleteImage(c *routing.Context) error {
+	if err := r.service.DeleteImage(c.Request.Context(), c.Param("id"), c.Param("image_id")); err != nil {
+		return err
+	}
+
+	return c.Write(response.SuccessResponse())
+}
+
+// catalogueFormat returns the format given as the "format" query parameter, or else the one of the given content
+// type, defaulting to CSV.
+func catalogueFormat(c *routing.Context, contentType string) string {
+	if format := c.Query("format"); format != "" {
+		return format
+	}
+	for format, formatType := range catalogueContentTypes {
+		if strings.HasPrefix(formatType, contentType) && contentType != "" {
+			return format
+		}
+	}
+	return FormatCSV
+}
+
+// importCatalogue imports the CSV or JSON Lines file sent as the request body. Only the changes are reported
+// when the "dry_run" query parameter is true.
+func (r resource) importCatalogue(c *routing.Context) error {
+	dryRun, err := strconv.ParseBool(c.Query("dry_run", "false"))
+	if err != nil {
+		return validation.Errors{"dry_run": stderrors.New("must be a boolean")}
+	}
+	contentType, _, _ := mime.ParseMediaType(c.Request.Header.Get("Content-Type"))
+	report, err := r.service.Import(c.Request.Context(), c.Request.Body, catalogueFormat(c, contentType), dryRun)
+	if err != nil {
+		return err
+	}
+
+	return c.Write(report)
+}
+
+// writeTracker tells whether anything was written to a writer.
+type writeTracker struct {
+	w       io.Writer
+	written bool
+}
+
+func (t *writeTracker) Write(p []byte) (int, error) {
+	t.written = true
+	return t.w.Write(p)
+}
+
+// export streams the catalogue as a CSV or JSON Lines file.
+func (r resource) export(c *routing.Context) error {
+	format := catalogueFormat(c, "")
+	contentType, ok := catalogueContentTypes[format]
+	if !ok {
+		return validation.Errors{"format": stderrors.New("must be csv or jsonl")}
+	}
+	c.Response.Header().Set("Content-Type", contentType)
+	c.Response.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"catalogue.%s\"", format))
+	w := &writeTracker{w: c.Response}
+	if err := r.service.Export(c.Request.Context(), w, format); err != nil {
+		if !w.written {
+			return err
+		}
+		// the response has started, so the error can only be logged and the file is truncated
+		r.logger.With(c.Request.Context()).Errorf("failed to export the catalogue: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package product
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"github.com/online-shop/internal/entity"
+	"github.com/online-shop/pkg/cache"
+	"strconv"
+)
+
+// CachedRepository is a repository caching the reads made to serve single products: the product itself, along with
+// its options, variants and images. The cached reads of a product are invalidated whenever the repository changes
+// it, once the transaction the change is part of ends. Products changed by other means, such as their rating
+// being updated by reviews, must be invalidated explicitly.
+//
+// Reads made within transactions are never cached, so that they see the changes made by the transaction.
+type CachedRepository struct {
+	Repository
+	cache *cache.Cache
+}
+
+// changedKey is the context key of the IDs of the products changed by the current transaction.
+type changedKey struct{}
+
+// NewCachedRepository creates a repository caching the reads of repo in c.
+func NewCachedRepository(repo Repository, c *cache.Cache) *CachedRepository {
+	return &CachedRepository{repo, c}
+}
+
+// cachedParts are the parts of a product which are cached: the product itself, its options, its variants, their
+// option values and its images.
+var cachedParts = []string{"", "options", "variants", "variant-options", "images"}
+
+// productCacheKey returns the key of a cached part of a product.
+func productCacheKey(productID int64, part string) string {
+	key := "product:" + strconv.FormatInt(productID, 10)
+	if part != "" {
+		key += ":" + part
+	}
+	return key
+}
+
+// inTransaction tells whether ctx is the one of a transaction.
+func inTransaction(ctx context.Context) bool {
+	return ctx.Value(changedKey{}) != nil
+}
+
+// fetch decodes the cached value of key into dest, calling load on misses. Values are encoded with gob rather than
+// JSON, since entities leave some fields out of JSON.
+func (r *CachedRepository) fetch(ctx context.Context, key string, dest interface{},
+	load func(ctx context.Context) (interface{}, error)) error {
+	data, err := r.cache.Fetch(ctx, key, func(ctx context.Context) ([]byte, error) {
+		value, err := load(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(value); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	})
+	if err != nil {
+		return err
+	}
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(dest)
+}
+
+func (r *CachedRepository) Get(ctx context.Context, id string) (entity.Product, error) {
+	productID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil || inTransaction(ctx) {
+		return r.Repository.Get(ctx, id)
+	}
+	var product entity.Product
+	err = r.fetch(ctx, productCacheKey(productID, ""), &product, func(ctx context.Context) (interface{}, error) {
+		return r.Repository.Get(ctx, id)
+	})
+	return product, err
+}
+
+func (r *CachedRepository) ListOptions(ctx context.Context, productID int64) ([]entity.ProductOption, error) {
+	if inTransaction(ctx) {
+		return r.Repository.ListOptions(ctx, productID)
+	}
+	var options []entity.ProductOption
+	err := r.fetch(ctx, productCacheKey(productID, "options"), &options, func(ctx context.Context) (interface{}, error) {
+		return r.Repository.ListOptions(ctx, productID)
+	})
+	return options, err
+}
+
+func (r *CachedRepository) ListVariants(ctx context.Context, productID int64) ([]entity.Variant, error) {
+	if inTransaction(ctx) {
+		return r.Repository.ListVariants(ctx, productID)
+	}
+	var variants []entity.Variant
+	err := r.fetch(ctx, productCacheKey(productID, "variants"), &variants, func(ctx context.Context) (interface{}, error) {
+		return r.Repository.ListVariants(ctx, productID)
+	})
+	return variants, err
+}
+
+func (r *CachedRepository) ListVariantOptions(ctx context.Context, productID int64) ([]entity.VariantOption, error) {
+	if inTransaction(ctx) {
+		return r.Repository.ListVariantOptions(ctx, productID)
+	}
+	var values []entity.VariantOption
+	key := productCacheKey(productID, "variant-options")
+	err := r.fetch(ctx, key, &values, func(ctx context.Context) (interface{}, error) {
+		return r.Repository.ListVariantOptions(ctx, productID)
+	})
+	return values, err
+}
+
+// ListImages only caches the images of single products, those of several products being listed along with the
+// search results.
+func (r *CachedRepository) ListImages(ctx context.Context, productIDs ...int64) ([]entity.ProductImage, error) {
+	if len(productIDs) != 1 || inTransaction(ctx) {
+		return r.Repository.ListImages(ctx, productIDs...)
+	}
+	var images []entity.ProductImage
+	key := productCacheKey(productIDs[0], "images")
+	err := r.fetch(ctx, key, &images, func(ctx context.Context) (interface{}, error) {
+		return r.Repository.ListImages(ctx, productIDs...)
+	})
+	return images, err
+}
+
+func (r *CachedRepository) CreateOption(ctx context.Context, option entity.ProductOption) error {
+	err := r.Repository.CreateOption(ctx, option)
+	r.Invalidate(ctx, option.ProductID)
+	return err
+}
+
+func (r *CachedRepository) CreateVariant(ctx context.Context, variant entity.Variant) error {
+	err := r.Repository.CreateVariant(ctx, variant)
+	r.Invalidate(ctx, variant.ProductID)
+	return err
+}
+
+func (r *CachedRepository) UpdateVariant(ctx context.Context, variant entity.Variant) error {
+	err := r.Repository.UpdateVariant(ctx, variant)
+	r.Invalidate(ctx, variant.ProductID)
+	return err
+}
+
+func (r *CachedRepository) UpdateProduct(ctx context.Context, product entity.Product) error {
+	err := r.Repository.UpdateProduct(ctx, product)
+	r.Invalidate(ctx, product.ID)
+	return err
+}
+
+func (r *CachedRepository) CreateImage(ctx context.Context, image entity.ProductImage) error {
+	err := r.Repository.CreateImage(ctx, image)
+	r.Invalidate(ctx, image.ProductID)
+	return err
+}
+
+func (r *CachedRepository) DeleteImage(ctx context.Context, image entity.ProductImage) error {
+	err := r.Repository.DeleteImage(ctx, image)
+	r.Invalidate(ctx, image.ProductID)
+	return err
+}
+
+// Transaction runs fn in a transaction, invalidating the products it changed once it ends.
+func (r *CachedRepository) Transaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	if inTransaction(ctx) {
+		return r.Repository.Transaction(ctx, fn)
+	}
+	var changed []int64
+	err := r.Repository.Transaction(context.WithValue(ctx, changedKey{}, &changed), fn)
+	r.Invalidate(ctx, changed...)
+	return err
+}
+
+// Invalidate drops the cached reads of the given products. Within a transaction, they are dropped once it ends, so
+// that the products are not cached again in the meantime as they were before the transaction.
+func (r *CachedRepository) Invalidate(ctx context.Context, productIDs ...int64) {
+	if changed, ok := ctx.Value(changedKey{}).(*[]int64); ok {
+		*changed = append(*changed, productIDs...)
+		return
+	}
+	var keys []string
+	for _, productID := range productIDs {
+		for _, part := range cachedParts {
+			keys = append(keys, productCacheKey(productID, part))
+		}
+	}
+	r.cache.Delete(ctx, keys...)
+}
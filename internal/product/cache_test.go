@@ -0,0 +1,139 @@
+package product
+
+import (
+	"context"
+	"database/sql"
+	"github.com/online-shop/internal/entity"
+	"github.com/online-shop/pkg/cache"
+	"github.com/online-shop/pkg/cache/cachetest"
+	"github.com/online-shop/pkg/log"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// countingRepository counts the products read from the repository it decorates.
+type countingRepository struct {
+	Repository
+	gets int
+}
+
+func (r *countingRepository) Get(ctx context.Context, id string) (entity.Product, error) {
+	r.gets++
+	return r.Repository.Get(ctx, id)
+}
+
+func newCachedRepository(repo Repository, shared cache.Shared) (*CachedRepository, *countingRepository) {
+	logger, _ := log.NewForTest()
+	counting := &countingRepository{Repository: repo}
+	c := cache.New("products", cache.NewLRU(100, time.Minute), shared, time.Minute, logger)
+	return NewCachedRepository(counting, c), counting
+}
+
+func TestCachedRepository(t *testing.T) {
+	_, repo := newCatalogueService()
+	repo.images = []entity.ProductImage{{ID: "i1", ProductID: 1, Extension: "jpg"}}
+	cached, counting := newCachedRepository(repo, nil)
+	ctx := context.Background()
+
+	product, err := cached.Get(ctx, "1")
+	assert.Nil(t, err)
+	assert.Equal(t, repo.products["1"], product)
+	_, _ = cached.Get(ctx, "1")
+	assert.Equal(t, 1, counting.gets, "products are cached")
+	_, err = cached.Get(ctx, "9")
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	variants, _ := cached.ListVariants(ctx, 1)
+	assert.Len(t, variants, 2)
+	values, _ := cached.ListVariantOptions(ctx, 1)
+	assert.Len(t, values, 2)
+	images, _ := cached.ListImages(ctx, 1)
+	assert.Equal(t, repo.images, images, "the fields left out of JSON are cached too")
+
+	product.Stock = 7
+	assert.Nil(t, cached.UpdateProduct(ctx, product))
+	product, _ = cached.Get(ctx, "1")
+	assert.Equal(t, int32(7), product.Stock, "changed products are invalidated")
+	assert.Equal(t, 3, counting.gets, "missing products are not cached")
+
+	variants[0].Stock = 1
+	assert.Nil(t, cached.UpdateVariant(ctx, variants[0]))
+	variants, _ = cached.ListVariants(ctx, 1)
+	assert.Equal(t, int32(1), variants[0].Stock, "stock changes invalidate their product")
+
+	assert.Nil(t, cached.DeleteImage(ctx, repo.images[0]))
+	images, _ = cached.ListImages(ctx, 1)
+	assert.Empty(t, images)
+
+	// products changed by other means are invalidated explicitly
+	repo.products["1"] = entity.Product{ID: 1, Name: "Shirt", Rating: 4.5, ReviewCount: 2}
+	cached.Invalidate(ctx, 1)
+	product, _ = cached.Get(ctx, "1")
+	assert.Equal(t, 4.5, product.Rating)
+}
+
+func TestCachedRepository_Transaction(t *testing.T) {
+	_, repo := newCatalogueService()
+	cached, counting := newCachedRepository(repo, nil)
+	ctx := context.Background()
+	_, _ = cached.Get(ctx, "2")
+
+	err := cached.Transaction(ctx, func(ctx context.Context) error {
+		product := repo.products["2"]
+		product.Name = "Large mug"
+		if err := cached.UpdateProduct(ctx, product); err != nil {
+			return err
+		}
+		// reads within the transaction see its changes, and are not cached
+		read, err := cached.Get(ctx, "2")
+		assert.Equal(t, "Large mug", read.Name)
+		assert.Equal(t, 2, counting.gets)
+		// the product is only invalidated once the transaction ends
+		read, _ = cached.Get(context.Background(), "2")
+		assert.Equal(t, "Mug", read.Name)
+		return err
+	})
+	assert.Nil(t, err)
+	product, _ := cached.Get(ctx, "2")
+	assert.Equal(t, "Large mug", product.Name)
+}
+
+func TestCachedRepository_shared(t *testing.T) {
+	server, err := cachetest.NewRedisServer("")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer server.Close()
+	shared, _ := cache.NewRedisCache(server.URL(), time.Second)
+	defer shared.Close()
+	_, repo := newCatalogueService()
+	// two server instances, each having its own local cache
+	first, firstCounting := newCachedRepository(repo, shared)
+	second, secondCounting := newCachedRepository(repo, shared)
+	ctx := context.Background()
+
+	_, _ = first.Get(ctx, "1")
+	product, err := second.Get(ctx, "1")
+	assert.Nil(t, err)
+	assert.Equal(t, "Shirt", product.Name)
+	assert.Equal(t, 1, firstCounting.gets+secondCounting.gets, "the product is found in the shared cache")
+
+	product.Name = "Linen shirt"
+	assert.Nil(t, first.UpdateProduct(ctx, product))
+	_, ok := server.Value("product:1")
+	assert.False(t, ok, "changes invalidate the shared cache")
+}
+
+func TestService_GetCached(t *testing.T) {
+	s, repo := newCatalogueService()
+	logger, _ := log.NewForTest()
+	cached, _ := newCachedRepository(repo, nil)
+	ctx := context.Background()
+
+	want, err := s.Get(ctx, "1")
+	assert.Nil(t, err)
+	got, err := NewService(cached, NewSearchIndex(), mockBlobStore{}, logger).Get(ctx, "1")
+	assert.Nil(t, err)
+	assert.Equal(t, want, got)
+}
@@ -0,0 +1,564 @@
+package product
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/online-shop/internal/entity"
+	"github.com/online-shop/pkg/tracing"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Formats of catalogue imports and exports.
+const (
+	FormatCSV   = "csv"
+	FormatJSONL = "jsonl"
+)
+
+const (
+	// importChunkSize is the number of rows committed together by an import.
+	importChunkSize = 500
+	// maxReportedRows bounds the number of rows detailed by an import report.
+	maxReportedRows = 1000
+)
+
+// catalogueColumns are the columns of catalogue files, in order.
+var catalogueColumns = []string{"sku", "product_id", "name", "description", "price", "stock", "barcode"}
+
+// CatalogueRow is a variant along with its product, as found in catalogue files.
+type CatalogueRow struct {
+	SKU         string `db:"sku" json:"sku"`
+	ProductID   int64  `db:"product_id" json:"product_id"`
+	Name        string `db:"name" json:"name"`
+	Description string `db:"description" json:"description"`
+	// Price is the price of the variant, or of its product if the variant does not override it.
+	Price   float64 `db:"price" json:"price"`
+	Stock   int32   `db:"stock" json:"stock"`
+	Barcode string  `db:"barcode" json:"barcode"`
+}
+
+// importRow is a row of an imported file. Missing fields are left unchanged.
+type importRow struct {
+	// row is the number of the row in the file, the header of CSV files being the first one.
+	row         int
+	SKU         string   `json:"sku"`
+	ProductID   *int64   `json:"product_id"`
+	Name        *string  `json:"name"`
+	Description *string  `json:"description"`
+	Price       *float64 `json:"price"`
+	Stock       *int32   `json:"stock"`
+	Barcode     *string  `json:"barcode"`
+}
+
+// Validate validates the importRow fields.
+func (r importRow) Validate() error {
+	return validation.ValidateStruct(&r,
+		validation.Field(&r.SKU, validation.Required, validation.Length(1, 64), validation.Match(skuFormat)),
+		validation.Field(&r.Name, validation.NilOrNotEmpty, validation.Length(1, 255)),
+		validation.Field(&r.Description, validation.Length(0, 4000)),
+		validation.Field(&r.Price, validation.Min(float64(0))),
+		validation.Field(&r.Stock, validation.Min(int32(0))),
+		validation.Field(&r.Barcode, validation.Match(barcodeFormat)),
+	)
+}
+
+// ImportChange is the change of a field by an import.
+type ImportChange struct {
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+// Actions of the rows of an import report.
+const (
+	ImportCreate    = "create"
+	ImportUpdate    = "update"
+	ImportUnchanged = "unchanged"
+	ImportError     = "error"
+)
+
+// ImportRowReport tells what an import does with a row.
+type ImportRowReport struct {
+	Row     int                     `json:"row"`
+	SKU     string                  `json:"sku"`
+	Action  string                  `json:"action"`
+	Changes map[string]ImportChange `json:"changes,omitempty"`
+	Errors  validation.Errors       `json:"errors,omitempty"`
+}
+
+// ImportReport tells what an import does, or would do for dry runs.
+type ImportReport struct {
+	DryRun    bool `json:"dry_run"`
+	Created   int  `json:"created"`
+	Updated   int  `json:"updated"`
+	Unchanged int  `json:"unchanged"`
+	Failed    int  `json:"failed"`
+	// Rows details the rows which are created, updated or invalid, up to maxReportedRows.
+	Rows []ImportRowReport `json:"rows"`
+	// Truncated tells whether some rows are not detailed.
+	Truncated bool `json:"truncated"`
+}
+
+// add counts a row in the report.
+func (r *ImportReport) add(row ImportRowReport) {
+	switch row.Action {
+	case ImportCreate:
+		r.Created++
+	case ImportUpdate:
+		r.Updated++
+	case ImportUnchanged:
+		r.Unchanged++
+		return
+	case ImportError:
+		r.Failed++
+	}
+	if len(r.Rows) < maxReportedRows {
+		r.Rows = append(r.Rows, row)
+	} else {
+		r.Truncated = true
+	}
+}
+
+// rowReader reads the rows of an imported file one at a time. It returns io.EOF after the last row, and the
+// errors of rows which cannot be parsed along with their number.
+type rowReader interface {
+	next() (importRow, validation.Errors, error)
+}
+
+// csvReader reads CSV files, whose first row names the columns.
+type csvReader struct {
+	r       *csv.Reader
+	columns []string
+	row     int
+}
+
+func newCSVReader(r io.Reader) (*csvReader, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, validation.Errors{"file": stderrors.New("must have a header row")}
+	} else if err != nil {
+		return nil, validation.Errors{"file": err}
+	}
+	known := map[string]bool{}
+	for _, column := range catalogueColumns {
+		known[column] = true
+	}
+	columns := make([]string, len(header))
+	for i, column := range header {
+		// spreadsheets may start files with a byte order mark
+		column = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(column, "\ufeff")))
+		if !known[column] {
+			return nil, validation.Errors{"file": fmt.Errorf("has an unknown column %q", column)}
+		}
+		columns[i] = column
+	}
+	return &csvReader{r: reader, columns: columns, row: 1}, nil
+}
+
+func (r *csvReader) next() (importRow, validation.Errors, error) {
+	record, err := r.r.Read()
+	if err == io.EOF {
+		return importRow{}, nil, err
+	}
+	r.row++
+	row := importRow{row: r.row}
+	if err != nil {
+		var parseErr *csv.ParseError
+		if stderrors.As(err, &parseErr) && parseErr.Err == csv.ErrFieldCount {
+			return row, validation.Errors{"row": stderrors.New("must have a value for every column")}, nil
+		}
+		return row, nil, validation.Errors{"file": err}
+	}
+
+	errs := validation.Errors{}
+	for i, value := range record {
+		value := strings.TrimSpace(value)
+		if value == "" && r.columns[i] != "sku" {
+			continue
+		}
+		switch r.columns[i] {
+		case "sku":
+			row.SKU = value
+		case "product_id":
+			id, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				errs["product_id"] = stderrors.New("must be an integer")
+			}
+			row.ProductID = &id
+		case "name":
+			row.Name = &value
+		case "description":
+			row.Description = &value
+		case "price":
+			price, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				errs["price"] = stderrors.New("must be a number")
+			}
+			row.Price = &price
+		case "stock":
+			stock, err := strconv.ParseInt(value, 10, 32)
+			if err != nil {
+				errs["stock"] = stderrors.New("must be an integer")
+			}
+			stock32 := int32(stock)
+			row.Stock = &stock32
+		case "barcode":
+			row.Barcode = &value
+		}
+	}
+	if len(errs) > 0 {
+		return row, errs, nil
+	}
+	return row, nil, nil
+}
+
+// jsonlReader reads JSON Lines files, having a JSON object per line.
+type jsonlReader struct {
+	r   *bufio.Reader
+	row int
+}
+
+func (r *jsonlReader) next() (importRow, validation.Errors, error) {
+	for {
+		line, err := r.r.ReadString('\n')
+		if err == io.EOF && line != "" {
+			// the last line may lack a line feed
+			err = nil
+		}
+		if err != nil {
+			return importRow{}, nil, err
+		}
+		r.row++
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		row := importRow{row: r.row}
+		decoder := json.NewDecoder(strings.NewReader(line))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&row); err != nil {
+			return row, validation.Errors{"row": fmt.Errorf("must be a valid JSON object: %v", err)}, nil
+		}
+		return row, nil, nil
+	}
+}
+
+// newRowReader returns a reader of files in the given format.
+func newRowReader(r io.Reader, format string) (rowReader, error) {
+	switch format {
+	case FormatCSV:
+		reader, err := newCSVReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return reader, nil
+	case FormatJSONL:
+		return &jsonlReader{r: bufio.NewReader(r)}, nil
+	}
+	return nil, validation.Errors{"format": stderrors.New("must be csv or jsonl")}
+}
+
+func (s service) Import(ctx context.Context, r io.Reader, format string, dryRun bool) (ImportReport, error) {
+	ctx, span := tracing.StartSpan(ctx, "product.Service.Import")
+	defer span.End()
+
+	reader, err := newRowReader(r, format)
+	if err != nil {
+		return ImportReport{}, err
+	}
+	report := ImportReport{DryRun: dryRun, Rows: []ImportRowReport{}}
+	// seen are the SKUs of the previous rows, which must not appear twice
+	seen := map[string]bool{}
+	var chunk []importRow
+	for {
+		row, errs, err := reader.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return report, err
+		}
+		if err := row.Validate(); err != nil {
+			// values which cannot be parsed are reported rather than their zero value
+			for field, fieldErr := range err.(validation.Errors) {
+				if _, ok := errs[field]; !ok {
+					if errs == nil {
+						errs = validation.Errors{}
+					}
+					errs[field] = fieldErr
+				}
+			}
+		} else if errs == nil && seen[row.SKU] {
+			errs = validation.Errors{"sku": stderrors.New("must not appear in several rows")}
+		}
+		if errs != nil {
+			report.add(ImportRowReport{Row: row.row, SKU: row.SKU, Action: ImportError, Errors: errs})
+			continue
+		}
+		seen[row.SKU] = true
+		if chunk = append(chunk, row); len(chunk) == importChunkSize {
+			if err := s.importChunk(ctx, chunk, &report); err != nil {
+				return report, err
+			}
+			chunk = nil
+		}
+	}
+	if err := s.importChunk(ctx, chunk, &report); err != nil {
+		return report, err
+	}
+	// invalid rows are reported before the chunk they belong to is planned
+	sort.SliceStable(report.Rows, func(i, j int) bool { return report.Rows[i].Row < report.Rows[j].Row })
+	s.logger.With(ctx, "dry_run", dryRun, "created", report.Created, "updated", report.Updated, "failed", report.Failed).
+		Infof("catalogue imported")
+	return report, nil
+}
+
+// catalogueChanges are the changes an import makes to the database.
+type catalogueChanges struct {
+	// products are the changed products by ID.
+	products map[int64]entity.Product
+	variants []entity.Variant
+	// newVariants are the variants added to existing products.
+	newVariants []entity.Variant
+	// newProducts are the products created along with a variant, in the same order as newProductVariants.
+	newProducts        []entity.Product
+	newProductVariants []entity.Variant
+}
+
+// importChunk plans the changes of the given valid rows and, unless the import is a dry run, commits them in
+// a transaction.
+func (s service) importChunk(ctx context.Context, rows []importRow, report *ImportReport) error {
+	if len(rows) == 0 {
+		return nil
+	}
+
+	skus := make([]string, len(rows))
+	for i, row := range rows {
+		skus[i] = row.SKU
+	}
+	variants, err := s.repo.ListVariantsBySKU(ctx, skus)
+	if err != nil {
+		return err
+	}
+	bySKU := map[string]entity.Variant{}
+	var productIDs []int64
+	for _, variant := range variants {
+		bySKU[variant.SKU] = variant
+		productIDs = append(productIDs, variant.ProductID)
+	}
+	for _, row := range rows {
+		if row.ProductID != nil {
+			productIDs = append(productIDs, *row.ProductID)
+		}
+	}
+	products, err := s.repo.ListByIDs(ctx, productIDs)
+	if err != nil {
+		return err
+	}
+	byID := map[int64]entity.Product{}
+	for _, product := range products {
+		byID[product.ID] = product
+	}
+
+	changes := catalogueChanges{products: map[int64]entity.Product{}}
+	for _, row := range rows {
+		entry, err := s.planRow(ctx, row, bySKU, byID, &changes)
+		if err != nil {
+			return err
+		}
+		report.add(entry)
+	}
+	if report.DryRun {
+		return nil
+	}
+
+	var created []int64
+	err = s.repo.Transaction(ctx, func(ctx context.Context) error {
+		created = nil
+		for _, product := range changes.products {
+			if err := s.repo.UpdateProduct(ctx, product); err != nil {
+				return err
+			}
+		}
+		for _, variant := range changes.variants {
+			if err := s.repo.UpdateVariant(ctx, variant); err != nil {
+				return err
+			}
+		}
+		for _, variant := range changes.newVariants {
+			if err := s.repo.CreateVariant(ctx, variant); err != nil {
+				return err
+			}
+		}
+		for i, product := range changes.newProducts {
+			id, err := s.repo.CreateProduct(ctx, product)
+			if err != nil {
+				return err
+			}
+			variant := changes.newProductVariants[i]
+			variant.ProductID = id
+			if err := s.repo.CreateVariant(ctx, variant); err != nil {
+				return err
+			}
+			created = append(created, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for id := range changes.products {
+		s.reindex(ctx, id)
+	}
+	for _, variant := range changes.newVariants {
+		s.reindex(ctx, variant.ProductID)
+	}
+	for _, id := range created {
+		s.reindex(ctx, id)
+	}
+	return nil
+}
+
+// planRow plans the changes of a valid row, updating the given variants and products as if the changes were made.
+func (s service) planRow(ctx context.Context, row importRow, bySKU map[string]entity.Variant, byID map[int64]entity.Product,
+	changes *catalogueChanges) (ImportRowReport, error) {
+	entry := ImportRowReport{Row: row.row, SKU: row.SKU, Changes: map[string]ImportChange{}}
+	fail := func(field, message string) (ImportRowReport, error) {
+		entry.Action, entry.Changes, entry.Errors = ImportError, nil, validation.Errors{field: stderrors.New(message)}
+		return entry, nil
+	}
+
+	variant, exists := bySKU[row.SKU]
+	switch {
+	case exists:
+		if row.ProductID != nil && *row.ProductID != variant.ProductID {
+			return fail("product_id", "must be the product of the existing variant")
+		}
+		entry.Action = ImportUpdate
+	case row.ProductID != nil:
+		if _, ok := byID[*row.ProductID]; !ok {
+			return fail("product_id", "must be an existing product")
+		}
+		options, err := s.repo.ListOptions(ctx, *row.ProductID)
+		if err != nil {
+			return entry, err
+		}
+		if len(options) > 0 {
+			return fail("product_id", "must not have options, variants of products having options being created with the API")
+		}
+		variant = entity.Variant{ID: entity.GenerateID(), ProductID: *row.ProductID, SKU: row.SKU, Options: []entity.VariantOption{}}
+		entry.Action = ImportCreate
+	default:
+		if row.Name == nil {
+			return fail("name", "cannot be blank for new products")
+		}
+		if row.Price == nil {
+			return fail("price", "cannot be blank for new products")
+		}
+		variant = entity.Variant{ID: entity.GenerateID(), SKU: row.SKU, Options: []entity.VariantOption{}}
+		entry.Action = ImportCreate
+	}
+
+	product := byID[variant.ProductID]
+	productChanged := false
+	if row.Name != nil && *row.Name != product.Name {
+		entry.Changes["name"] = ImportChange{From: product.Name, To: *row.Name}
+		product.Name, productChanged = *row.Name, true
+	}
+	if row.Description != nil && *row.Description != product.Description {
+		entry.Changes["description"] = ImportChange{From: product.Description, To: *row.Description}
+		product.Description, productChanged = *row.Description, true
+	}
+	if price := effectivePrice(variant, product); row.Price != nil && *row.Price != price {
+		entry.Changes["price"] = ImportChange{From: price, To: *row.Price}
+		if variant.ProductID == 0 {
+			// new products get the price, their single variant not overriding it
+			product.Price = *row.Price
+		} else {
+			value := *row.Price
+			variant.Price = &value
+		}
+	}
+	if row.Stock != nil && *row.Stock != variant.Stock {
+		entry.Changes["stock"] = ImportChange{From: variant.Stock, To: *row.Stock}
+		variant.Stock = *row.Stock
+	}
+	if row.Barcode != nil && *row.Barcode != variant.Barcode {
+		entry.Changes["barcode"] = ImportChange{From: variant.Barcode, To: *row.Barcode}
+		variant.Barcode = *row.Barcode
+	}
+	if entry.Action == ImportCreate {
+		for field, change := range entry.Changes {
+			entry.Changes[field] = ImportChange{To: change.To}
+		}
+	}
+
+	switch {
+	case variant.ProductID == 0:
+		product.Stock = variant.Stock
+		changes.newProducts = append(changes.newProducts, product)
+		changes.newProductVariants = append(changes.newProductVariants, variant)
+	case entry.Action == ImportCreate:
+		changes.newVariants = append(changes.newVariants, variant)
+	case len(entry.Changes) == 0:
+		entry.Action, entry.Changes = ImportUnchanged, nil
+	default:
+		changes.variants = append(changes.variants, variant)
+	}
+	if productChanged && variant.ProductID != 0 {
+		byID[product.ID] = product
+		changes.products[product.ID] = product
+	}
+	bySKU[variant.SKU] = variant
+	return entry, nil
+}
+
+// effectivePrice returns the price of a variant, which is the price of its product unless it overrides it.
+func effectivePrice(variant entity.Variant, product entity.Product) float64 {
+	if variant.Price != nil {
+		return *variant.Price
+	}
+	return product.Price
+}
+
+func (s service) Export(ctx context.Context, w io.Writer, format string) error {
+	ctx, span := tracing.StartSpan(ctx, "product.Service.Export")
+	defer span.End()
+
+	switch format {
+	case FormatCSV:
+		writer := csv.NewWriter(w)
+		if err := writer.Write(catalogueColumns); err != nil {
+			return err
+		}
+		err := s.repo.EachCatalogueRow(ctx, func(row CatalogueRow) error {
+			return writer.Write([]string{
+				row.SKU,
+				strconv.FormatInt(row.ProductID, 10),
+				row.Name,
+				row.Description,
+				strconv.FormatFloat(row.Price, 'f', -1, 64),
+				strconv.FormatInt(int64(row.Stock), 10),
+				row.Barcode,
+			})
+		})
+		if err != nil {
+			return err
+		}
+		writer.Flush()
+		return writer.Error()
+	case FormatJSONL:
+		encoder := json.NewEncoder(w)
+		return s.repo.EachCatalogueRow(ctx, func(row CatalogueRow) error {
+			return encoder.Encode(row)
+		})
+	}
+	return validation.Errors{"format": stderrors.New("must be csv or jsonl")}
+}
@@ -0,0 +1,194 @@
+package product
+
+import (
+	"bytes"
+	"context"
+	"github.com/online-shop/internal/auth"
+	"github.com/online-shop/internal/entity"
+	"github.com/online-shop/internal/test"
+	"github.com/online-shop/pkg/log"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func newCatalogueService() (Service, *mockRepository) {
+	logger, _ := log.NewForTest()
+	price := 30.0
+	repo := &mockRepository{
+		products: map[string]entity.Product{
+			"1": {ID: 1, Name: "Shirt", Description: "Cotton shirt", Stock: 10, Price: 25},
+			"2": {ID: 2, Name: "Mug", Stock: 5, Price: 8},
+		},
+		options: []entity.ProductOption{{ID: "size", ProductID: 1, Name: "Size"}},
+		variants: []entity.Variant{
+			{ID: "v1", ProductID: 1, SKU: "SHIRT-M", Stock: 4, Options: []entity.VariantOption{{VariantID: "v1", OptionID: "size", Name: "Size", Value: "M"}}},
+			{ID: "v2", ProductID: 1, SKU: "SHIRT-L", Price: &price, Stock: 6, Barcode: "4006381333931", Options: []entity.VariantOption{{VariantID: "v2", OptionID: "size", Name: "Size", Value: "L"}}},
+			{ID: "v3", ProductID: 2, SKU: "MUG", Stock: 5, Options: []entity.VariantOption{}},
+		},
+	}
+	return NewService(repo, NewSearchIndex(), mockBlobStore{}, logger), repo
+}
+
+// variantBySKU returns the variant of the mock repository having the given SKU.
+func variantBySKU(repo *mockRepository, sku string) (entity.Variant, bool) {
+	for _, variant := range repo.variants {
+		if variant.SKU == sku {
+			return variant, true
+		}
+	}
+	return entity.Variant{}, false
+}
+
+const catalogueCSV = `sku,product_id,name,price,stock,barcode
+SHIRT-M,,Linen shirt,,8,
+SHIRT-L,1,,30,6,4006381333931
+MUG-XL,2,,12,3,
+LAMP,,Desk lamp,45.5,2,
+SHIRT-M,,,,1,
+CAP,,Cap,,1,
+MUG,1,,,,
+BAD SKU,,,,,
+MUG,,,-1,x,
+`
+
+func TestService_Import(t *testing.T) {
+	s, repo := newCatalogueService()
+	ctx := context.Background()
+
+	report, err := s.Import(ctx, strings.NewReader(catalogueCSV), FormatCSV, true)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, report.Created)
+	assert.Equal(t, 1, report.Updated)
+	assert.Equal(t, 1, report.Unchanged)
+	assert.Equal(t, 5, report.Failed)
+	if assert.Len(t, report.Rows, 8) {
+		assert.Equal(t, ImportRowReport{Row: 2, SKU: "SHIRT-M", Action: ImportUpdate, Changes: map[string]ImportChange{
+			"name":  {From: "Shirt", To: "Linen shirt"},
+			"stock": {From: int32(4), To: int32(8)},
+		}}, report.Rows[0])
+		assert.Equal(t, ImportRowReport{Row: 4, SKU: "MUG-XL", Action: ImportCreate, Changes: map[string]ImportChange{
+			"price": {To: 12.0},
+			"stock": {To: int32(3)},
+		}}, report.Rows[1])
+		assert.Equal(t, ImportCreate, report.Rows[2].Action)
+		for i, field := range []string{"sku", "price", "product_id", "sku"} {
+			assert.Equal(t, ImportError, report.Rows[3+i].Action)
+			assert.Contains(t, report.Rows[3+i].Errors, field, report.Rows[3+i].SKU)
+		}
+		assert.Equal(t, 10, report.Rows[7].Row)
+		assert.Contains(t, report.Rows[7].Errors, "stock")
+	}
+	variant, _ := variantBySKU(repo, "SHIRT-M")
+	assert.Equal(t, int32(4), variant.Stock, "dry runs change nothing")
+	assert.Len(t, repo.products, 2)
+
+	report, err = s.Import(ctx, strings.NewReader(catalogueCSV), FormatCSV, false)
+	assert.Nil(t, err)
+	assert.False(t, report.DryRun)
+	assert.Equal(t, 2, report.Created)
+	variant, _ = variantBySKU(repo, "SHIRT-M")
+	assert.Equal(t, int32(8), variant.Stock)
+	assert.Equal(t, "Linen shirt", repo.products["1"].Name)
+	assert.Equal(t, "Cotton shirt", repo.products["1"].Description, "missing values are left unchanged")
+	variant, _ = variantBySKU(repo, "MUG-XL")
+	assert.Equal(t, int64(2), variant.ProductID)
+	assert.Equal(t, 12.0, *variant.Price)
+	variant, _ = variantBySKU(repo, "LAMP")
+	if assert.Len(t, repo.products, 3) {
+		lamp := repo.products["3"]
+		assert.Equal(t, entity.Product{ID: 3, Name: "Desk lamp", Stock: 2, Price: 45.5}, lamp)
+		assert.Equal(t, lamp.ID, variant.ProductID)
+		assert.Nil(t, variant.Price)
+	}
+
+	// importing the same file again changes nothing
+	report, _ = s.Import(ctx, strings.NewReader(catalogueCSV), FormatCSV, false)
+	assert.Equal(t, 0, report.Created+report.Updated)
+
+	_, err = s.Import(ctx, strings.NewReader("sku,color\nMUG,red\n"), FormatCSV, false)
+	assert.NotNil(t, err)
+	_, err = s.Import(ctx, strings.NewReader(""), "xml", false)
+	assert.NotNil(t, err)
+}
+
+func TestService_ImportJSONL(t *testing.T) {
+	s, repo := newCatalogueService()
+
+	report, err := s.Import(context.Background(), strings.NewReader(`{"sku":"MUG","stock":7,"description":"Stoneware mug"}
+
+{"sku":"MUG","stock":9}
+{"sku":"CAP","colour":"red"}
+{"sku":"PEN","name":"Pen","price":1.5}`), FormatJSONL, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, report.Created)
+	assert.Equal(t, 1, report.Updated)
+	if assert.Equal(t, 2, report.Failed) {
+		assert.Equal(t, 3, report.Rows[1].Row)
+		assert.Contains(t, report.Rows[1].Errors, "sku")
+		assert.Equal(t, 4, report.Rows[2].Row)
+		assert.Contains(t, report.Rows[2].Errors, "row")
+	}
+	variant, _ := variantBySKU(repo, "MUG")
+	assert.Equal(t, int32(7), variant.Stock)
+	assert.Equal(t, "Stoneware mug", repo.products["2"].Description)
+	_, ok := variantBySKU(repo, "PEN")
+	assert.True(t, ok)
+}
+
+func TestService_Export(t *testing.T) {
+	s, _ := newCatalogueService()
+	ctx := context.Background()
+
+	var buf bytes.Buffer
+	assert.Nil(t, s.Export(ctx, &buf, FormatCSV))
+	assert.Equal(t, `sku,product_id,name,description,price,stock,barcode
+SHIRT-L,1,Shirt,Cotton shirt,30,6,4006381333931
+SHIRT-M,1,Shirt,Cotton shirt,25,4,
+MUG,2,Mug,,8,5,
+`, buf.String())
+
+	buf.Reset()
+	assert.Nil(t, s.Export(ctx, &buf, FormatJSONL))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if assert.Len(t, lines, 3) {
+		assert.JSONEq(t, `{"sku":"MUG","product_id":2,"name":"Mug","description":"","price":8,"stock":5,"barcode":""}`, lines[2])
+	}
+
+	// exports can be imported back without any change
+	report, err := s.Import(ctx, &buf, FormatJSONL, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, report.Unchanged)
+
+	assert.NotNil(t, s.Export(ctx, &buf, "xml"))
+}
+
+func TestAPI_Catalogue(t *testing.T) {
+	s, _ := newCatalogueService()
+	logger, _ := log.NewForTest()
+	router := test.MockRouter(logger)
+	public, protected := auth.MockRouteGroups(router.Group("/v1"))
+	RegisterHandlers(public, protected, s, logger)
+	header := func(contentType string) http.Header {
+		h := auth.MockAdminAuthHeader()
+		h.Set("Content-Type", contentType)
+		return h
+	}
+
+	tests := []test.APITestCase{
+		{Name: "export", Method: "GET", URL: "/v1/products/export", Header: auth.MockAdminAuthHeader(), WantStatus: http.StatusOK, WantResponse: "sku,product_id,name,description,price,stock,barcode*"},
+		{Name: "export jsonl", Method: "GET", URL: "/v1/products/export?format=jsonl", Header: auth.MockAdminAuthHeader(), WantStatus: http.StatusOK, WantResponse: `{"sku":"SHIRT-L"*`},
+		{Name: "export unknown format", Method: "GET", URL: "/v1/products/export?format=xml", Header: auth.MockAdminAuthHeader(), WantStatus: http.StatusBadRequest},
+		{Name: "export as customer", Method: "GET", URL: "/v1/products/export", Header: auth.MockAuthHeader(), WantStatus: http.StatusForbidden},
+		{Name: "dry run", Method: "POST", URL: "/v1/products/import?dry_run=true", Body: "sku,stock\nMUG,1\n", Header: header("text/csv"), WantStatus: http.StatusOK, WantResponse: `*"dry_run":true,"created":0,"updated":1,*`},
+		{Name: "import jsonl", Method: "POST", URL: "/v1/products/import", Body: `{"sku":"MUG","stock":2}`, Header: header("application/x-ndjson"), WantStatus: http.StatusOK, WantResponse: `*"dry_run":false,"created":0,"updated":1,*`},
+		{Name: "import unknown column", Method: "POST", URL: "/v1/products/import", Body: "sku,color\nMUG,red\n", Header: header("text/csv"), WantStatus: http.StatusBadRequest},
+		{Name: "import invalid dry run", Method: "POST", URL: "/v1/products/import?dry_run=maybe", Body: "sku\n", Header: header("text/csv"), WantStatus: http.StatusBadRequest},
+		{Name: "import as customer", Method: "POST", URL: "/v1/products/import", Body: "sku\n", Header: auth.MockAuthHeader(), WantStatus: http.StatusForbidden},
+		{Name: "product", Method: "GET", URL: "/v1/products/2", Header: auth.MockAuthHeader(), WantStatus: http.StatusOK, WantResponse: `*"name":"Mug"*`},
+	}
+	for _, tc := range tests {
+		test.Endpoint(t, router, tc)
+	}
+}
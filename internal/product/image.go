@@ -0,0 +1,182 @@
+package product
+
+import (
+	"context"
+	stderrors "errors"
+	"fmt"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/online-shop/internal/entity"
+	"github.com/online-shop/internal/errors"
+	"github.com/online-shop/pkg/imaging"
+	"github.com/online-shop/pkg/tracing"
+	goimage "image"
+	"time"
+)
+
+// BlobStore stores the images of products.
+type BlobStore interface {
+	// Put stores a blob, replacing the one having the same key if any.
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+	// Delete removes a blob. Removing a missing blob is not an error.
+	Delete(ctx context.Context, key string) error
+	// URL returns the public URL of a blob.
+	URL(key string) string
+}
+
+const (
+	// MaxImageSize is the maximum size of uploaded images, in bytes.
+	MaxImageSize = 10 << 20
+	// maxImagePixels bounds the dimensions of uploaded images, whose decoding takes 4 bytes per pixel.
+	maxImagePixels = 25000000
+	// thumbnailQuality is the JPEG quality of thumbnails.
+	thumbnailQuality = 85
+)
+
+var errImageTooLarge = errors.RequestEntityTooLarge(fmt.Sprintf("Images must not exceed %d MB.", MaxImageSize>>20))
+
+// thumbnailSizes are the sizes of the thumbnails made of every image, by decreasing size. Thumbnails fit in a
+// square of the given size.
+var thumbnailSizes = []struct {
+	name string
+	size int
+}{
+	{"large", 1024},
+	{"medium", 480},
+	{"small", 160},
+}
+
+// imageKey returns the key of an image file in the blob store.
+func imageKey(image entity.ProductImage, name string) string {
+	return fmt.Sprintf("products/%d/%s/%s", image.ProductID, image.ID, name)
+}
+
+// imageKeys returns the keys of the original image and of its thumbnails.
+func imageKeys(image entity.ProductImage) []string {
+	keys := []string{imageKey(image, "original"+image.Extension)}
+	for _, thumbnail := range thumbnailSizes {
+		keys = append(keys, imageKey(image, thumbnail.name+".jpg"))
+	}
+	return keys
+}
+
+// withURLs fills in the URLs of an image.
+func (s service) withURLs(image entity.ProductImage) entity.ProductImage {
+	image.URL = s.blobs.URL(imageKey(image, "original"+image.Extension))
+	image.Thumbnails = map[string]string{}
+	for _, thumbnail := range thumbnailSizes {
+		image.Thumbnails[thumbnail.name] = s.blobs.URL(imageKey(image, thumbnail.name+".jpg"))
+	}
+	return image
+}
+
+// attachImages loads the images of the given products.
+func (s service) attachImages(ctx context.Context, products []entity.Product) error {
+	ids := make([]int64, len(products))
+	for i, product := range products {
+		ids[i] = product.ID
+	}
+	images, err := s.repo.ListImages(ctx, ids...)
+	if err != nil {
+		return err
+	}
+	byProduct := map[int64][]entity.ProductImage{}
+	for _, image := range images {
+		byProduct[image.ProductID] = append(byProduct[image.ProductID], s.withURLs(image))
+	}
+	for i := range products {
+		products[i].Images = byProduct[products[i].ID]
+	}
+	return nil
+}
+
+func (s service) AddImage(ctx context.Context, productID string, data []byte) (entity.ProductImage, error) {
+	ctx, span := tracing.StartSpan(ctx, "product.Service.AddImage")
+	defer span.End()
+
+	product, err := s.repo.Get(ctx, productID)
+	if err != nil {
+		return entity.ProductImage{}, err
+	}
+	if len(data) > MaxImageSize {
+		return entity.ProductImage{}, errImageTooLarge
+	}
+	img, contentType, err := imaging.Decode(data, maxImagePixels)
+	if err == imaging.ErrTooLarge {
+		return entity.ProductImage{}, validation.Errors{"image": stderrors.New("must not exceed 25 megapixels")}
+	} else if err != nil {
+		return entity.ProductImage{}, validation.Errors{"image": stderrors.New("must be a JPEG, PNG or GIF image")}
+	}
+
+	image := entity.ProductImage{
+		ID:        entity.GenerateID(),
+		ProductID: product.ID,
+		Extension: imaging.Extensions[contentType],
+		Width:     img.Bounds().Dx(),
+		Height:    img.Bounds().Dy(),
+		CreatedAt: time.Now(),
+	}
+	if err := s.putBlobs(ctx, image, data, contentType, img); err != nil {
+		s.deleteBlobs(ctx, image)
+		return entity.ProductImage{}, err
+	}
+	if err := s.repo.CreateImage(ctx, image); err != nil {
+		s.deleteBlobs(ctx, image)
+		return entity.ProductImage{}, err
+	}
+	s.logger.With(ctx, "product", product.ID, "image", image.ID).Infof("image added")
+	return s.withURLs(image), nil
+}
+
+// putBlobs stores an original image, then makes and stores its thumbnails.
+func (s service) putBlobs(ctx context.Context, image entity.ProductImage, data []byte, contentType string, img goimage.Image) error {
+	if err := s.blobs.Put(ctx, imageKey(image, "original"+image.Extension), data, contentType); err != nil {
+		return err
+	}
+	// every thumbnail is made from the previous one, which is much faster than from the original
+	for _, thumbnail := range thumbnailSizes {
+		img = imaging.Fit(img, thumbnail.size)
+		jpeg, err := imaging.JPEG(img, thumbnailQuality)
+		if err != nil {
+			return err
+		}
+		if err := s.blobs.Put(ctx, imageKey(image, thumbnail.name+".jpg"), jpeg, "image/jpeg"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s service) DeleteImage(ctx context.Context, productID, imageID string) error {
+	ctx, span := tracing.StartSpan(ctx, "product.Service.DeleteImage")
+	defer span.End()
+
+	product, err := s.repo.Get(ctx, productID)
+	if err != nil {
+		return err
+	}
+	images, err := s.repo.ListImages(ctx, product.ID)
+	if err != nil {
+		return err
+	}
+	for _, image := range images {
+		if image.ID != imageID {
+			continue
+		}
+		if err := s.repo.DeleteImage(ctx, image); err != nil {
+			return err
+		}
+		s.deleteBlobs(ctx, image)
+		s.logger.With(ctx, "product", product.ID, "image", image.ID).Infof("image deleted")
+		return nil
+	}
+	return errors.NotFound("")
+}
+
+// deleteBlobs removes the files of an image. Failures are only logged, leaving unused files behind.
+func (s service) deleteBlobs(ctx context.Context, image entity.ProductImage) {
+	for _, key := range imageKeys(image) {
+		if err := s.blobs.Delete(ctx, key); err != nil {
+			s.logger.With(ctx, "image", image.ID).Errorf("failed to delete image file %s: %v", key, err)
+		}
+	}
+}
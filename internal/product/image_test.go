@@ -0,0 +1,153 @@
+package product
+
+import (
+	"bytes"
+	"context"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/online-shop/internal/auth"
+	"github.com/online-shop/internal/entity"
+	"github.com/online-shop/internal/errors"
+	"github.com/online-shop/internal/test"
+	"github.com/online-shop/pkg/imaging"
+	"github.com/online-shop/pkg/log"
+	"github.com/stretchr/testify/assert"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newPNG returns a PNG image of the given size.
+func newPNG(w, h int) []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.NRGBA{R: uint8(x), G: uint8(y), B: 128, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	return buf.Bytes()
+}
+
+func newImageService() (Service, *mockRepository, mockBlobStore) {
+	logger, _ := log.NewForTest()
+	repo := &mockRepository{products: map[string]entity.Product{
+		"1": {ID: 1, Name: "Shirt", Stock: 10, Price: 25},
+	}}
+	blobs := mockBlobStore{}
+	return NewService(repo, NewSearchIndex(), blobs, logger), repo, blobs
+}
+
+func TestService_AddImage(t *testing.T) {
+	s, _, blobs := newImageService()
+	ctx := context.Background()
+
+	added, err := s.AddImage(ctx, "1", newPNG(2000, 1000))
+	assert.Nil(t, err)
+	assert.Equal(t, 2000, added.Width)
+	prefix := "https://cdn.example.com/products/1/" + added.ID
+	assert.Equal(t, prefix+"/original.png", added.URL)
+	assert.Equal(t, map[string]string{"small": prefix + "/small.jpg", "medium": prefix + "/medium.jpg", "large": prefix + "/large.jpg"}, added.Thumbnails)
+	assert.Len(t, blobs, 4)
+	for name, size := range map[string]image.Rectangle{"large": image.Rect(0, 0, 1024, 512), "small": image.Rect(0, 0, 160, 80)} {
+		thumbnail, contentType, err := imaging.Decode(blobs["products/1/"+added.ID+"/"+name+".jpg"], maxImagePixels)
+		if assert.Nil(t, err) {
+			assert.Equal(t, "image/jpeg", contentType)
+			assert.Equal(t, size, thumbnail.Bounds())
+		}
+	}
+
+	// small images are not enlarged
+	small, _ := s.AddImage(ctx, "1", newPNG(100, 50))
+	thumbnail, _, _ := imaging.Decode(blobs["products/1/"+small.ID+"/large.jpg"], maxImagePixels)
+	assert.Equal(t, image.Rect(0, 0, 100, 50), thumbnail.Bounds())
+
+	product, _ := s.Get(ctx, "1")
+	if assert.Len(t, product.Images, 2) {
+		assert.Equal(t, added.ID, product.Images[0].ID)
+		assert.Equal(t, added.URL, product.Images[0].URL)
+	}
+	products, _ := s.List(ctx)
+	assert.Len(t, products[0].Images, 2)
+
+	_, err = s.AddImage(ctx, "1", []byte("<svg/>"))
+	assert.Contains(t, err.(validation.Errors), "image")
+	_, err = s.AddImage(ctx, "1", make([]byte, MaxImageSize+1))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, err.(errors.ErrorResponse).Status)
+	_, err = s.AddImage(ctx, "2", newPNG(10, 10))
+	assert.NotNil(t, err)
+	assert.Len(t, blobs, 8, "nothing is stored for refused images")
+}
+
+func TestService_DeleteImage(t *testing.T) {
+	s, repo, blobs := newImageService()
+	ctx := context.Background()
+	added, _ := s.AddImage(ctx, "1", newPNG(20, 20))
+
+	assert.Equal(t, http.StatusNotFound, s.DeleteImage(ctx, "1", "unknown").(errors.ErrorResponse).Status)
+	assert.Nil(t, s.DeleteImage(ctx, "1", added.ID))
+	assert.Empty(t, repo.images)
+	assert.Empty(t, blobs)
+}
+
+// multipartBody returns a multipart form having the given file as the given field, along with its content type.
+func multipartBody(field string, data []byte) (string, string) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	part, _ := w.CreateFormFile(field, "image.png")
+	part.Write(data)
+	w.Close()
+	return buf.String(), w.FormDataContentType()
+}
+
+func TestAPI_Images(t *testing.T) {
+	s, repo, _ := newImageService()
+	logger, _ := log.NewForTest()
+	router := test.MockRouter(logger)
+	public, protected := auth.MockRouteGroups(router.Group("/v1"))
+	RegisterHandlers(public, protected, s, logger)
+	header := func(h http.Header, contentType string) http.Header {
+		h.Set("Content-Type", contentType)
+		return h
+	}
+	body, contentType := multipartBody("image", newPNG(30, 20))
+	invalid, invalidType := multipartBody("image", []byte("GIF89a"))
+	misnamed, misnamedType := multipartBody("file", newPNG(30, 20))
+
+	tests := []test.APITestCase{
+		{Name: "upload", Method: "POST", URL: "/v1/products/1/images", Body: body, Header: header(auth.MockAdminAuthHeader(), contentType), WantStatus: http.StatusCreated, WantResponse: `*"width":30,"height":20,"url":"https://cdn.example.com/products/1/*`},
+		{Name: "upload as customer", Method: "POST", URL: "/v1/products/1/images", Body: body, Header: header(auth.MockAuthHeader(), contentType), WantStatus: http.StatusForbidden},
+		{Name: "upload invalid image", Method: "POST", URL: "/v1/products/1/images", Body: invalid, Header: header(auth.MockAdminAuthHeader(), invalidType), WantStatus: http.StatusBadRequest},
+		{Name: "upload without image", Method: "POST", URL: "/v1/products/1/images", Body: misnamed, Header: header(auth.MockAdminAuthHeader(), misnamedType), WantStatus: http.StatusBadRequest},
+		{Name: "upload to unknown product", Method: "POST", URL: "/v1/products/2/images", Body: body, Header: header(auth.MockAdminAuthHeader(), contentType), WantStatus: http.StatusNotFound},
+		{Name: "product", Method: "GET", URL: "/v1/products/1", Header: auth.MockAuthHeader(), WantStatus: http.StatusOK, WantResponse: `*"images":[{"id":*`},
+		{Name: "delete unknown image", Method: "DELETE", URL: "/v1/products/1/images/unknown", Header: auth.MockAdminAuthHeader(), WantStatus: http.StatusNotFound},
+	}
+	for _, tc := range tests {
+		test.Endpoint(t, router, tc)
+	}
+
+	// bodies of unknown length are cut once too large, even if the image itself is small
+	var large bytes.Buffer
+	w := multipart.NewWriter(&large)
+	w.WriteField("padding", strings.Repeat("x", MaxImageSize+maxMultipartOverhead))
+	part, _ := w.CreateFormFile("image", "image.png")
+	part.Write(newPNG(30, 20))
+	w.Close()
+	req, _ := http.NewRequest("POST", "/v1/products/1/images", ioutil.NopCloser(&large))
+	req.Header = header(auth.MockAdminAuthHeader(), w.FormDataContentType())
+	req.ContentLength = -1
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, res.Code)
+
+	if assert.Len(t, repo.images, 1) {
+		test.Endpoint(t, router, test.APITestCase{Name: "delete", Method: "DELETE", URL: "/v1/products/1/images/" + repo.images[0].ID, Header: auth.MockAdminAuthHeader(), WantStatus: http.StatusOK})
+	}
+}
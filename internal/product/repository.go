@@ -6,11 +6,58 @@ import (
 	"github.com/online-shop/internal/entity"
 	"github.com/online-shop/pkg/log"
 	"github.com/online-shop/pkg/mysql"
+	"strings"
+	"time"
 )
 
 type Repository interface {
 	Get(ctx context.Context, id string) (entity.Product, error)
 	List(ctx context.Context) ([]entity.Product, error)
+	// ListByIDs returns the products having the given IDs, in no particular order.
+	ListByIDs(ctx context.Context, ids []int64) ([]entity.Product, error)
+	// ListCategories returns the slugs of the categories of the given products, or of all products if none is given.
+	ListCategories(ctx context.Context, productIDs ...int64) ([]ProductValue, error)
+	// ListAttributes returns the option values of the variants of the given products, or of all products if none
+	// is given.
+	ListAttributes(ctx context.Context, productIDs ...int64) ([]ProductValue, error)
+
+	// ListOptions returns the options of a product, in order.
+	ListOptions(ctx context.Context, productID int64) ([]entity.ProductOption, error)
+	CreateOption(ctx context.Context, option entity.ProductOption) error
+	// ListVariants returns the variants of a product, without their option values.
+	ListVariants(ctx context.Context, productID int64) ([]entity.Variant, error)
+	// ListVariantOptions returns the option values of all the variants of a product, in the order of the options.
+	ListVariantOptions(ctx context.Context, productID int64) ([]entity.VariantOption, error)
+	// CreateVariant saves a new variant along with its option values. Its stock is recorded in the inventory ledger.
+	CreateVariant(ctx context.Context, variant entity.Variant) error
+	// UpdateVariant saves the SKU, price, stock and barcode of a variant. The change of its stock is recorded in the
+	// inventory ledger as an adjustment.
+	UpdateVariant(ctx context.Context, variant entity.Variant) error
+
+	// CreateProduct saves a new product, returning its ID.
+	CreateProduct(ctx context.Context, product entity.Product) (int64, error)
+	// UpdateProduct saves the name, description and price of a product, whose stock is the total stock of its
+	// variants.
+	UpdateProduct(ctx context.Context, product entity.Product) error
+	// ListVariantsBySKU returns the variants having the given SKUs, without their option values.
+	ListVariantsBySKU(ctx context.Context, skus []string) ([]entity.Variant, error)
+	// EachCatalogueRow calls fn with every variant of every product, ordered by product and SKU, without loading
+	// the whole catalogue in memory.
+	EachCatalogueRow(ctx context.Context, fn func(row CatalogueRow) error) error
+	// Transaction runs fn in a transaction, which the repository calls made with the context given to fn are
+	// part of.
+	Transaction(ctx context.Context, fn func(ctx context.Context) error) error
+
+	// ListImages returns the images of the given products, in the order they were added.
+	ListImages(ctx context.Context, productIDs ...int64) ([]entity.ProductImage, error)
+	CreateImage(ctx context.Context, image entity.ProductImage) error
+	DeleteImage(ctx context.Context, image entity.ProductImage) error
+}
+
+// ProductValue is a value related to a product, such as the slug of one of its categories.
+type ProductValue struct {
+	ProductID int64  `db:"product_id"`
+	Value     string `db:"value"`
 }
 
 // repository persists albums in database
@@ -25,7 +72,7 @@ func NewRepository(db mysql.BaseRepository, logger log.Logger) Repository {
 }
 
 func (r repository) List(ctx context.Context) ([]entity.Product, error) {
-	q := fmt.Sprintf("select id, name, stock, price from product")
+	q := fmt.Sprintf("select id, name, description, stock, price, rating, review_count from product")
 
 	var products []entity.Product
 
@@ -38,7 +85,7 @@ func (r repository) List(ctx context.Context) ([]entity.Product, error) {
 }
 
 func (r repository) Get(ctx context.Context, id string) (entity.Product, error) {
-	q := fmt.Sprintf("select id, name, stock, price from product where id = ?")
+	q := fmt.Sprintf("select id, name, description, stock, price, rating, review_count, updated_at from product where id = ?")
 
 	var product entity.Product
 
@@ -49,3 +96,331 @@ func (r repository) Get(ctx context.Context, id string) (entity.Product, error)
 
 	return product, nil
 }
+
+func (r repository) ListByIDs(ctx context.Context, ids []int64) ([]entity.Product, error) {
+	var products []entity.Product
+	if len(ids) == 0 {
+		return products, nil
+	}
+
+	q := fmt.Sprintf("select id, name, description, stock, price, rating, review_count from product where id in (%s)",
+		placeholders(len(ids)))
+
+	err := r.db.FetchRows(ctx, q, &products, int64Args(ids)...)
+	if err != nil {
+		return products, err
+	}
+
+	return products, nil
+}
+
+func (r repository) ListCategories(ctx context.Context, productIDs ...int64) ([]ProductValue, error) {
+	q := fmt.Sprintf("select pc.product_id, c.slug as value from product_category pc " +
+		"join category c on c.id = pc.category_id")
+	if len(productIDs) > 0 {
+		q += fmt.Sprintf(" where pc.product_id in (%s)", placeholders(len(productIDs)))
+	}
+
+	var values []ProductValue
+
+	err := r.db.FetchRows(ctx, q, &values, int64Args(productIDs)...)
+	if err != nil {
+		return values, err
+	}
+
+	return values, nil
+}
+
+func (r repository) ListAttributes(ctx context.Context, productIDs ...int64) ([]ProductValue, error) {
+	q := fmt.Sprintf("select distinct po.product_id, vo.value from variant_option_value vo " +
+		"join product_option po on po.id = vo.option_id")
+	if len(productIDs) > 0 {
+		q += fmt.Sprintf(" where po.product_id in (%s)", placeholders(len(productIDs)))
+	}
+
+	var values []ProductValue
+
+	err := r.db.FetchRows(ctx, q, &values, int64Args(productIDs)...)
+	if err != nil {
+		return values, err
+	}
+
+	return values, nil
+}
+
+// placeholders returns the placeholders of a list of n arguments.
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
+
+// int64Args converts IDs to query arguments.
+func int64Args(ids []int64) []interface{} {
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	return args
+}
+
+func (r repository) ListOptions(ctx context.Context, productID int64) ([]entity.ProductOption, error) {
+	q := fmt.Sprintf("select id, product_id, name, position from product_option where product_id = ? order by position")
+
+	var options []entity.ProductOption
+
+	err := r.db.FetchRows(ctx, q, &options, productID)
+	if err != nil {
+		return options, err
+	}
+
+	return options, nil
+}
+
+func (r repository) CreateOption(ctx context.Context, option entity.ProductOption) error {
+	q := fmt.Sprintf("insert into product_option (id, product_id, name, position) values (:id, :product_id, :name, :position)")
+
+	_, err := r.db.Exec(ctx, q, option)
+	if err != nil {
+		return err
+	}
+
+	return r.touch(ctx, option.ProductID)
+}
+
+func (r repository) ListVariants(ctx context.Context, productID int64) ([]entity.Variant, error) {
+	q := fmt.Sprintf("select id, product_id, sku, price, stock, barcode from product_variant where product_id = ? order by sku")
+
+	var variants []entity.Variant
+
+	err := r.db.FetchRows(ctx, q, &variants, productID)
+	if err != nil {
+		return variants, err
+	}
+
+	return variants, nil
+}
+
+func (r repository) ListVariantOptions(ctx context.Context, productID int64) ([]entity.VariantOption, error) {
+	q := fmt.Sprintf("select vo.variant_id, vo.option_id, po.name, vo.value " +
+		"from variant_option_value vo " +
+		"join product_option po on po.id = vo.option_id " +
+		"where po.product_id = ? " +
+		"order by po.position")
+
+	var options []entity.VariantOption
+
+	err := r.db.FetchRows(ctx, q, &options, productID)
+	if err != nil {
+		return options, err
+	}
+
+	return options, nil
+}
+
+func (r repository) CreateVariant(ctx context.Context, variant entity.Variant) error {
+	return r.db.Transaction(ctx, func(ctx context.Context) error {
+		q := fmt.Sprintf("insert into product_variant (id, product_id, sku, price, stock, barcode) " +
+			"values (:id, :product_id, :sku, :price, :stock, :barcode)")
+
+		_, err := r.db.Exec(ctx, q, variant)
+		if err != nil {
+			return err
+		}
+
+		for _, option := range variant.Options {
+			q := fmt.Sprintf("insert into variant_option_value (variant_id, option_id, value) values (:variant_id, :option_id, :value)")
+
+			_, err := r.db.Exec(ctx, q, option)
+			if err != nil {
+				return err
+			}
+		}
+
+		if err := r.adjustStock(ctx, variant, variant.Stock); err != nil {
+			return err
+		}
+
+		return r.touch(ctx, variant.ProductID)
+	})
+}
+
+func (r repository) UpdateVariant(ctx context.Context, variant entity.Variant) error {
+	return r.db.Transaction(ctx, func(ctx context.Context) error {
+		q := fmt.Sprintf("select stock from product_variant where id = ? for update")
+
+		var stock int32
+
+		err := r.db.FetchRow(ctx, q, &stock, variant.ID)
+		if err != nil {
+			return err
+		}
+
+		q = fmt.Sprintf("update product_variant set sku = :sku, price = :price, stock = :stock, barcode = :barcode " +
+			"where id = :id")
+
+		_, err = r.db.Exec(ctx, q, variant)
+		if err != nil {
+			return err
+		}
+
+		if err := r.adjustStock(ctx, variant, variant.Stock-stock); err != nil {
+			return err
+		}
+
+		return r.touch(ctx, variant.ProductID)
+	})
+}
+
+// catalogueReference is the reference of the stock adjustments made by changing variants through the catalogue.
+const catalogueReference = "catalogue"
+
+// adjustStock records a change of the stock of a variant made through the catalogue in the inventory ledger, and
+// updates the total stock of its product.
+func (r repository) adjustStock(ctx context.Context, variant entity.Variant, quantity int32) error {
+	if quantity == 0 {
+		return nil
+	}
+
+	q := fmt.Sprintf("insert into inventory_movement " +
+		"(id, variant_id, product_id, kind, quantity, reserved, reference_id, note, created_by, created_at) " +
+		"values (:id, :variant_id, :product_id, :kind, :quantity, :reserved, :reference_id, :note, :created_by, :created_at)")
+
+	movement := entity.StockMovement{
+		ID:          entity.GenerateID(),
+		VariantID:   variant.ID,
+		ProductID:   variant.ProductID,
+		Kind:        entity.MovementAdjustment,
+		Quantity:    quantity,
+		ReferenceID: catalogueReference,
+		Note:        "Stock set through the catalogue",
+		CreatedAt:   time.Now(),
+	}
+	_, err := r.db.Exec(ctx, q, movement)
+	if err != nil {
+		return err
+	}
+
+	q = fmt.Sprintf("update product p set stock = " +
+		"(select coalesce(sum(v.stock), 0) from product_variant v where v.product_id = p.id) " +
+		"where p.id = :product_id")
+
+	_, err = r.db.Exec(ctx, q, movement)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r repository) ListImages(ctx context.Context, productIDs ...int64) ([]entity.ProductImage, error) {
+	var images []entity.ProductImage
+	if len(productIDs) == 0 {
+		return images, nil
+	}
+
+	q := fmt.Sprintf("select id, product_id, extension, width, height, created_at from product_image "+
+		"where product_id in (%s) order by created_at, id", placeholders(len(productIDs)))
+
+	err := r.db.FetchRows(ctx, q, &images, int64Args(productIDs)...)
+	if err != nil {
+		return images, err
+	}
+
+	return images, nil
+}
+
+func (r repository) CreateImage(ctx context.Context, image entity.ProductImage) error {
+	q := fmt.Sprintf("insert into product_image (id, product_id, extension, width, height, created_at) " +
+		"values (:id, :product_id, :extension, :width, :height, :created_at)")
+
+	_, err := r.db.Exec(ctx, q, image)
+	if err != nil {
+		return err
+	}
+
+	return r.touch(ctx, image.ProductID)
+}
+
+func (r repository) DeleteImage(ctx context.Context, image entity.ProductImage) error {
+	q := fmt.Sprintf("delete from product_image where id = :id")
+
+	_, err := r.db.Exec(ctx, q, image)
+	if err != nil {
+		return err
+	}
+
+	return r.touch(ctx, image.ProductID)
+}
+
+// touch records that a product changed through its options, variants or images, which are kept in other tables;
+// changes of the product row itself update its updated_at column on their own.
+func (r repository) touch(ctx context.Context, productID int64) error {
+	q := fmt.Sprintf("update product set updated_at = current_timestamp where id = :id")
+
+	_, err := r.db.Exec(ctx, q, map[string]interface{}{"id": productID})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r repository) CreateProduct(ctx context.Context, product entity.Product) (int64, error) {
+	q := fmt.Sprintf("insert into product (name, description, stock, price) values (:name, :description, :stock, :price)")
+
+	res, err := r.db.Exec(ctx, q, product)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.LastInsertId()
+}
+
+func (r repository) UpdateProduct(ctx context.Context, product entity.Product) error {
+	q := fmt.Sprintf("update product set name = :name, description = :description, price = :price where id = :id")
+
+	_, err := r.db.Exec(ctx, q, product)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r repository) ListVariantsBySKU(ctx context.Context, skus []string) ([]entity.Variant, error) {
+	var variants []entity.Variant
+	if len(skus) == 0 {
+		return variants, nil
+	}
+
+	q := fmt.Sprintf("select id, product_id, sku, price, stock, barcode from product_variant where sku in (%s)",
+		placeholders(len(skus)))
+
+	args := make([]interface{}, len(skus))
+	for i, sku := range skus {
+		args[i] = sku
+	}
+	err := r.db.FetchRows(ctx, q, &variants, args...)
+	if err != nil {
+		return variants, err
+	}
+
+	return variants, nil
+}
+
+func (r repository) EachCatalogueRow(ctx context.Context, fn func(row CatalogueRow) error) error {
+	q := fmt.Sprintf("select v.sku, p.id as product_id, p.name, p.description, coalesce(v.price, p.price) as price, " +
+		"v.stock, v.barcode " +
+		"from product p " +
+		"join product_variant v on v.product_id = p.id " +
+		"order by p.id, v.sku")
+
+	var row CatalogueRow
+
+	return r.db.Each(ctx, q, &row, func() error {
+		return fn(row)
+	})
+}
+
+func (r repository) Transaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return r.db.Transaction(ctx, fn)
+}
@@ -0,0 +1,235 @@
+package product
+
+import (
+	"context"
+	"database/sql"
+	stderrors "errors"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/online-shop/internal/entity"
+	"github.com/online-shop/pkg/search"
+	"github.com/online-shop/pkg/tracing"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// SearchIndex indexes products for full-text search.
+type SearchIndex interface {
+	// Put adds a document to the index, replacing the one having the same ID if any.
+	Put(doc search.Document)
+	// Delete removes a document from the index.
+	Delete(id string)
+	// Search returns the documents matching the given query.
+	Search(q search.Query) search.Result
+}
+
+// NewSearchIndex creates an empty in-process search index, matches in product names weighing more than matches
+// in attributes, which weigh more than matches in descriptions.
+func NewSearchIndex() SearchIndex {
+	return search.NewIndex(map[string]float64{"name": 3, "attributes": 1.5, "description": 1})
+}
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+
+	facetCategory = "category"
+	facetPrice    = "price"
+)
+
+// priceBuckets are the price ranges products are counted in, each one including its lower bound.
+var priceBuckets = []struct {
+	label string
+	max   float64
+}{
+	{"0-25", 25},
+	{"25-50", 50},
+	{"50-100", 100},
+	{"100-250", 250},
+	{"250+", math.Inf(1)},
+}
+
+// priceBucket returns the label of the price range of the given price.
+func priceBucket(price float64) string {
+	for _, bucket := range priceBuckets {
+		if price < bucket.max {
+			return bucket.label
+		}
+	}
+	return priceBuckets[len(priceBuckets)-1].label
+}
+
+// SearchRequest represents a product search.
+type SearchRequest struct {
+	// Q is the text to search for in the names, descriptions and attributes of products. Every word must match.
+	Q string `json:"q"`
+	// Category restricts the results to the products of one of the categories having the given slugs.
+	Category []string `json:"category"`
+	// Price restricts the results to the products in one of the given price ranges, such as "25-50".
+	Price  []string `json:"price"`
+	Limit  int      `json:"limit"`
+	Offset int      `json:"offset"`
+}
+
+// Validate validates the SearchRequest fields.
+func (r SearchRequest) Validate() error {
+	labels := make([]interface{}, len(priceBuckets))
+	for i, bucket := range priceBuckets {
+		labels[i] = bucket.label
+	}
+	return validation.ValidateStruct(&r,
+		validation.Field(&r.Q, validation.Length(0, 200)),
+		validation.Field(&r.Price, validation.Each(validation.In(labels...))),
+		validation.Field(&r.Limit, validation.Min(0), validation.Max(maxSearchLimit)),
+		validation.Field(&r.Offset, validation.Min(0)),
+	)
+}
+
+// SearchResult is a page of the products matching a search.
+type SearchResult struct {
+	// Items are the matching products, by decreasing relevance.
+	Items []entity.Product `json:"items"`
+	// Total is the number of matching products.
+	Total int `json:"total"`
+	// Facets counts the matching products per category and price range. The counts of a facet ignore its own
+	// filter, telling how many products selecting other categories or price ranges would give.
+	Facets map[string]map[string]int `json:"facets"`
+}
+
+// document returns the search document of a product.
+func document(product entity.Product, categories, attributes []string) search.Document {
+	return search.Document{
+		ID: strconv.FormatInt(product.ID, 10),
+		Fields: map[string]string{
+			"name":        product.Name,
+			"description": product.Description,
+			"attributes":  strings.Join(attributes, " "),
+		},
+		Facets: map[string][]string{
+			facetCategory: categories,
+			facetPrice:    {priceBucket(product.Price)},
+		},
+	}
+}
+
+// byProduct groups values by product.
+func byProduct(values []ProductValue) map[int64][]string {
+	grouped := map[int64][]string{}
+	for _, value := range values {
+		grouped[value.ProductID] = append(grouped[value.ProductID], value.Value)
+	}
+	return grouped
+}
+
+func (s service) BuildIndex(ctx context.Context) error {
+	ctx, span := tracing.StartSpan(ctx, "product.Service.BuildIndex")
+	defer span.End()
+
+	products, err := s.repo.List(ctx)
+	if err != nil {
+		return err
+	}
+	categories, err := s.repo.ListCategories(ctx)
+	if err != nil {
+		return err
+	}
+	attributes, err := s.repo.ListAttributes(ctx)
+	if err != nil {
+		return err
+	}
+
+	productCategories, productAttributes := byProduct(categories), byProduct(attributes)
+	indexed := map[string]bool{}
+	for _, product := range products {
+		doc := document(product, productCategories[product.ID], productAttributes[product.ID])
+		s.index.Put(doc)
+		indexed[doc.ID] = true
+	}
+	// products deleted since the last build
+	for _, hit := range s.index.Search(search.Query{}).Hits {
+		if !indexed[hit.ID] {
+			s.index.Delete(hit.ID)
+		}
+	}
+	s.logger.With(ctx, "products", len(products)).Infof("search index built")
+	return nil
+}
+
+func (s service) IndexProduct(ctx context.Context, id int64) error {
+	ctx, span := tracing.StartSpan(ctx, "product.Service.IndexProduct")
+	defer span.End()
+
+	product, err := s.repo.Get(ctx, strconv.FormatInt(id, 10))
+	if stderrors.Is(err, sql.ErrNoRows) {
+		s.index.Delete(strconv.FormatInt(id, 10))
+		return nil
+	} else if err != nil {
+		return err
+	}
+	categories, err := s.repo.ListCategories(ctx, id)
+	if err != nil {
+		return err
+	}
+	attributes, err := s.repo.ListAttributes(ctx, id)
+	if err != nil {
+		return err
+	}
+	s.index.Put(document(product, byProduct(categories)[id], byProduct(attributes)[id]))
+	return nil
+}
+
+// reindex updates the search index after a change of the given product. Failures are only logged, the change
+// being already saved; the product is indexed again by the next build of the index.
+func (s service) reindex(ctx context.Context, id int64) {
+	if err := s.IndexProduct(ctx, id); err != nil {
+		s.logger.With(ctx, "product", id).Errorf("failed to index product: %v", err)
+	}
+}
+
+func (s service) Search(ctx context.Context, input SearchRequest) (SearchResult, error) {
+	ctx, span := tracing.StartSpan(ctx, "product.Service.Search")
+	defer span.End()
+
+	q := search.Query{Text: input.Q, Filters: map[string][]string{}, Offset: input.Offset, Limit: input.Limit}
+	if q.Limit == 0 {
+		q.Limit = defaultSearchLimit
+	}
+	if len(input.Category) > 0 {
+		q.Filters[facetCategory] = input.Category
+	}
+	if len(input.Price) > 0 {
+		q.Filters[facetPrice] = input.Price
+	}
+	found := s.index.Search(q)
+
+	ids := make([]int64, 0, len(found.Hits))
+	for _, hit := range found.Hits {
+		id, _ := strconv.ParseInt(hit.ID, 10, 64)
+		ids = append(ids, id)
+	}
+	products, err := s.repo.ListByIDs(ctx, ids)
+	if err != nil {
+		return SearchResult{}, err
+	}
+	byID := map[int64]entity.Product{}
+	for _, product := range products {
+		byID[product.ID] = product
+	}
+
+	result := SearchResult{Items: []entity.Product{}, Total: found.Total, Facets: found.Facets}
+	for _, id := range ids {
+		// products deleted since they were indexed are skipped
+		if product, ok := byID[id]; ok {
+			result.Items = append(result.Items, product)
+		}
+	}
+	if err := s.attachImages(ctx, result.Items); err != nil {
+		return SearchResult{}, err
+	}
+	for _, name := range []string{facetCategory, facetPrice} {
+		if result.Facets[name] == nil {
+			result.Facets[name] = map[string]int{}
+		}
+	}
+	return result, nil
+}
@@ -4,35 +4,78 @@ import (
 	"context"
 	"github.com/online-shop/internal/entity"
 	"github.com/online-shop/pkg/log"
+	"github.com/online-shop/pkg/tracing"
+	"io"
 )
 
 type Service interface {
+	// Get returns a product along with its options, variants and images.
 	Get(ctx context.Context, id string) (entity.Product, error)
 	List(ctx context.Context) ([]entity.Product, error)
+	// Search returns the products matching a search, by decreasing relevance, along with their counts per
+	// category and price range.
+	Search(ctx context.Context, input SearchRequest) (SearchResult, error)
+	// BuildIndex indexes all the products for search, removing the products which no longer exist from the index.
+	BuildIndex(ctx context.Context) error
+	// IndexProduct updates the search index after a change of a product or of its categories.
+	IndexProduct(ctx context.Context, id int64) error
+	// CreateVariant adds a variant to a product.
+	CreateVariant(ctx context.Context, productID string, input CreateVariantRequest) (entity.Variant, error)
+	// UpdateVariant changes the SKU, price, stock and barcode of a variant of a product.
+	UpdateVariant(ctx context.Context, productID, variantID string, input UpdateVariantRequest) (entity.Variant, error)
+	// AddImage adds an image to a product, storing it along with its thumbnails.
+	AddImage(ctx context.Context, productID string, data []byte) (entity.ProductImage, error)
+	// DeleteImage removes an image of a product, along with its thumbnails.
+	DeleteImage(ctx context.Context, productID, imageID string) error
+	// Import creates and updates products and variants from a CSV or JSON Lines file, matching variants by SKU.
+	// Dry runs only report the changes.
+	Import(ctx context.Context, r io.Reader, format string, dryRun bool) (ImportReport, error)
+	// Export writes every variant along with its product as a CSV or JSON Lines file.
+	Export(ctx context.Context, w io.Writer, format string) error
 }
 
 type service struct {
 	repo   Repository
+	index  SearchIndex
+	blobs  BlobStore
 	logger log.Logger
 }
 
-// NewService creates a new album service.
-func NewService(repo Repository, logger log.Logger) Service {
-	return service{repo, logger}
+// NewService creates a new album service. Products are searched in the given index, which must be built with
+// BuildIndex, and their images are kept in the given store.
+func NewService(repo Repository, index SearchIndex, blobs BlobStore, logger log.Logger) Service {
+	return service{repo, index, blobs, logger}
 }
 
 func (s service) Get(ctx context.Context, id string) (entity.Product, error) {
+	ctx, span := tracing.StartSpan(ctx, "product.Service.Get")
+	defer span.End()
+
 	product, err := s.repo.Get(ctx, id)
 	if err != nil {
 		return entity.Product{}, err
 	}
-	return product, nil
+	product.Options, product.Variants, err = s.loadVariants(ctx, product)
+	if err != nil {
+		return entity.Product{}, err
+	}
+	products := []entity.Product{product}
+	if err := s.attachImages(ctx, products); err != nil {
+		return entity.Product{}, err
+	}
+	return products[0], nil
 }
 
 func (s service) List(ctx context.Context) ([]entity.Product, error) {
+	ctx, span := tracing.StartSpan(ctx, "product.Service.List")
+	defer span.End()
+
 	products, err := s.repo.List(ctx)
 	if err != nil {
 		return []entity.Product{}, err
 	}
+	if err := s.attachImages(ctx, products); err != nil {
+		return []entity.Product{}, err
+	}
 	return products, nil
 }
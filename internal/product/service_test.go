@@ -0,0 +1,453 @@
+package product
+
+import (
+	"context"
+	"database/sql"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/online-shop/internal/auth"
+	"github.com/online-shop/internal/entity"
+	"github.com/online-shop/internal/errors"
+	"github.com/online-shop/internal/test"
+	"github.com/online-shop/pkg/httpcache"
+	"github.com/online-shop/pkg/log"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type mockRepository struct {
+	products map[string]entity.Product
+	options  []entity.ProductOption
+	variants []entity.Variant
+	// categories maps product IDs to the slugs of their categories.
+	categories map[int64][]string
+	images     []entity.ProductImage
+}
+
+func (m *mockRepository) Get(ctx context.Context, id string) (entity.Product, error) {
+	if product, ok := m.products[id]; ok {
+		return product, nil
+	}
+	return entity.Product{}, sql.ErrNoRows
+}
+
+func (m *mockRepository) List(ctx context.Context) ([]entity.Product, error) {
+	var products []entity.Product
+	for _, product := range m.products {
+		products = append(products, product)
+	}
+	return products, nil
+}
+
+func (m *mockRepository) ListByIDs(ctx context.Context, ids []int64) ([]entity.Product, error) {
+	var products []entity.Product
+	for _, id := range ids {
+		if product, ok := m.products[strconv.FormatInt(id, 10)]; ok {
+			products = append(products, product)
+		}
+	}
+	return products, nil
+}
+
+// selected tells whether a product is among the given ones, all products being selected if none is given.
+func selected(productID int64, productIDs []int64) bool {
+	for _, id := range productIDs {
+		if id == productID {
+			return true
+		}
+	}
+	return len(productIDs) == 0
+}
+
+func (m *mockRepository) ListCategories(ctx context.Context, productIDs ...int64) ([]ProductValue, error) {
+	var values []ProductValue
+	for productID, slugs := range m.categories {
+		for _, slug := range slugs {
+			if selected(productID, productIDs) {
+				values = append(values, ProductValue{ProductID: productID, Value: slug})
+			}
+		}
+	}
+	return values, nil
+}
+
+func (m *mockRepository) ListAttributes(ctx context.Context, productIDs ...int64) ([]ProductValue, error) {
+	var values []ProductValue
+	for _, variant := range m.variants {
+		for _, option := range variant.Options {
+			if selected(variant.ProductID, productIDs) {
+				values = append(values, ProductValue{ProductID: variant.ProductID, Value: option.Value})
+			}
+		}
+	}
+	return values, nil
+}
+
+func (m *mockRepository) ListOptions(ctx context.Context, productID int64) ([]entity.ProductOption, error) {
+	var options []entity.ProductOption
+	for _, option := range m.options {
+		if option.ProductID == productID {
+			options = append(options, option)
+		}
+	}
+	return options, nil
+}
+
+func (m *mockRepository) CreateOption(ctx context.Context, option entity.ProductOption) error {
+	m.options = append(m.options, option)
+	return nil
+}
+
+func (m *mockRepository) ListVariants(ctx context.Context, productID int64) ([]entity.Variant, error) {
+	var variants []entity.Variant
+	for _, variant := range m.variants {
+		if variant.ProductID == productID {
+			variant.Options = nil
+			variants = append(variants, variant)
+		}
+	}
+	sort.Slice(variants, func(i, j int) bool { return variants[i].SKU < variants[j].SKU })
+	return variants, nil
+}
+
+func (m *mockRepository) ListVariantOptions(ctx context.Context, productID int64) ([]entity.VariantOption, error) {
+	var values []entity.VariantOption
+	for _, variant := range m.variants {
+		if variant.ProductID == productID {
+			values = append(values, variant.Options...)
+		}
+	}
+	return values, nil
+}
+
+func (m *mockRepository) CreateVariant(ctx context.Context, variant entity.Variant) error {
+	for _, other := range m.variants {
+		if other.SKU == variant.SKU {
+			return errors.Conflict("", "sku")
+		}
+	}
+	m.variants = append(m.variants, variant)
+	return nil
+}
+
+func (m *mockRepository) UpdateVariant(ctx context.Context, variant entity.Variant) error {
+	for i, other := range m.variants {
+		if other.ID == variant.ID {
+			m.variants[i] = variant
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (m *mockRepository) CreateProduct(ctx context.Context, product entity.Product) (int64, error) {
+	product.ID = int64(len(m.products) + 1)
+	for m.products[strconv.FormatInt(product.ID, 10)].ID != 0 {
+		product.ID++
+	}
+	m.products[strconv.FormatInt(product.ID, 10)] = product
+	return product.ID, nil
+}
+
+func (m *mockRepository) UpdateProduct(ctx context.Context, product entity.Product) error {
+	id := strconv.FormatInt(product.ID, 10)
+	if _, ok := m.products[id]; !ok {
+		return sql.ErrNoRows
+	}
+	m.products[id] = product
+	return nil
+}
+
+func (m *mockRepository) ListVariantsBySKU(ctx context.Context, skus []string) ([]entity.Variant, error) {
+	var variants []entity.Variant
+	for _, variant := range m.variants {
+		for _, sku := range skus {
+			if variant.SKU == sku {
+				variant.Options = nil
+				variants = append(variants, variant)
+			}
+		}
+	}
+	return variants, nil
+}
+
+func (m *mockRepository) EachCatalogueRow(ctx context.Context, fn func(row CatalogueRow) error) error {
+	var rows []CatalogueRow
+	for _, variant := range m.variants {
+		product := m.products[strconv.FormatInt(variant.ProductID, 10)]
+		rows = append(rows, CatalogueRow{SKU: variant.SKU, ProductID: product.ID, Name: product.Name,
+			Description: product.Description, Price: effectivePrice(variant, product), Stock: variant.Stock, Barcode: variant.Barcode})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		return rows[i].ProductID < rows[j].ProductID || rows[i].ProductID == rows[j].ProductID && rows[i].SKU < rows[j].SKU
+	})
+	for _, row := range rows {
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *mockRepository) Transaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return fn(ctx)
+}
+
+func (m *mockRepository) ListImages(ctx context.Context, productIDs ...int64) ([]entity.ProductImage, error) {
+	var images []entity.ProductImage
+	for _, image := range m.images {
+		if selected(image.ProductID, productIDs) {
+			images = append(images, image)
+		}
+	}
+	return images, nil
+}
+
+func (m *mockRepository) CreateImage(ctx context.Context, image entity.ProductImage) error {
+	m.images = append(m.images, image)
+	return nil
+}
+
+func (m *mockRepository) DeleteImage(ctx context.Context, image entity.ProductImage) error {
+	for i, other := range m.images {
+		if other.ID == image.ID {
+			m.images = append(m.images[:i], m.images[i+1:]...)
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+// mockBlobStore keeps blobs in memory.
+type mockBlobStore map[string][]byte
+
+func (m mockBlobStore) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	m[key] = data
+	return nil
+}
+
+func (m mockBlobStore) Delete(ctx context.Context, key string) error {
+	delete(m, key)
+	return nil
+}
+
+func (m mockBlobStore) URL(key string) string {
+	return "https://cdn.example.com/" + key
+}
+
+func newTestService() (Service, *mockRepository) {
+	logger, _ := log.NewForTest()
+	repo := &mockRepository{products: map[string]entity.Product{
+		"1": {ID: 1, Name: "Shirt", Stock: 10, Price: 25},
+	}}
+	return NewService(repo, NewSearchIndex(), mockBlobStore{}, logger), repo
+}
+
+func TestCreateVariantRequest_Validate(t *testing.T) {
+	price := 30.0
+	valid := CreateVariantRequest{
+		UpdateVariantRequest: UpdateVariantRequest{SKU: "SHIRT-M-BLUE", Price: &price, Stock: 3, Barcode: "4006381333931"},
+		Options:              []OptionValue{{Name: "Size", Value: "M"}, {Name: "Color", Value: "Blue"}},
+	}
+	assert.Nil(t, valid.Validate())
+
+	negative := -1.0
+	errs := CreateVariantRequest{UpdateVariantRequest: UpdateVariantRequest{SKU: "shirt m", Price: &negative, Stock: -1, Barcode: "12"}}.Validate().(validation.Errors)
+	assert.Contains(t, errs, "sku")
+	assert.Contains(t, errs, "price")
+	assert.Contains(t, errs, "stock")
+	assert.Contains(t, errs, "barcode")
+
+	duplicate := valid
+	duplicate.Options = []OptionValue{{Name: "Size", Value: "M"}, {Name: "size", Value: "L"}}
+	assert.Contains(t, duplicate.Validate().(validation.Errors), "options")
+}
+
+func TestService_CreateVariant(t *testing.T) {
+	s, repo := newTestService()
+	ctx := context.Background()
+	request := func(sku string, values ...string) CreateVariantRequest {
+		r := CreateVariantRequest{UpdateVariantRequest: UpdateVariantRequest{SKU: sku, Stock: 1}}
+		for i := 0; i < len(values); i += 2 {
+			r.Options = append(r.Options, OptionValue{Name: values[i], Value: values[i+1]})
+		}
+		return r
+	}
+
+	// the first variant defines the options of the product
+	variant, err := s.CreateVariant(ctx, "1", request("SHIRT-M-BLUE", "Size", "M", "Color", "Blue"))
+	assert.Nil(t, err)
+	assert.Len(t, repo.options, 2)
+	assert.Equal(t, "Size", variant.Options[0].Name)
+
+	_, err = s.CreateVariant(ctx, "1", request("SHIRT-L-BLUE", "color", "Blue", "size", "L"))
+	assert.Nil(t, err)
+	_, err = s.CreateVariant(ctx, "1", request("SHIRT-L", "Size", "L"))
+	assert.Contains(t, err.(validation.Errors), "options")
+	_, err = s.CreateVariant(ctx, "1", request("SHIRT-L-BLUE-2", "Size", "l", "Color", "blue"))
+	assert.Equal(t, http.StatusConflict, err.(errors.ErrorResponse).Status)
+	_, err = s.CreateVariant(ctx, "2", request("HAT"))
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	product, err := s.Get(ctx, "1")
+	assert.Nil(t, err)
+	assert.Len(t, product.Options, 2)
+	if assert.Len(t, product.Variants, 2) {
+		assert.Equal(t, "SHIRT-L-BLUE", product.Variants[0].SKU)
+		assert.Equal(t, "L", product.Variants[0].Options[0].Value, "values follow the order of the options")
+	}
+}
+
+func TestService_UpdateVariant(t *testing.T) {
+	s, _ := newTestService()
+	ctx := context.Background()
+	variant, _ := s.CreateVariant(ctx, "1", CreateVariantRequest{UpdateVariantRequest: UpdateVariantRequest{SKU: "SHIRT"}})
+
+	price := 19.99
+	updated, err := s.UpdateVariant(ctx, "1", variant.ID, UpdateVariantRequest{SKU: "SHIRT-1", Price: &price, Stock: 4})
+	assert.Nil(t, err)
+	assert.Equal(t, "SHIRT-1", updated.SKU)
+	product, _ := s.Get(ctx, "1")
+	assert.Equal(t, &price, product.Variants[0].Price)
+	assert.Equal(t, int32(4), product.Variants[0].Stock)
+
+	_, err = s.UpdateVariant(ctx, "1", "unknown", UpdateVariantRequest{SKU: "SHIRT-2"})
+	assert.Equal(t, http.StatusNotFound, err.(errors.ErrorResponse).Status)
+}
+
+// newSearchService returns a service over a small catalogue, with its search index built.
+func newSearchService(t *testing.T) (Service, *mockRepository) {
+	logger, _ := log.NewForTest()
+	repo := &mockRepository{
+		products: map[string]entity.Product{
+			"1": {ID: 1, Name: "Oxford shirt", Description: "A cotton shirt with a button-down collar.", Price: 30},
+			"2": {ID: 2, Name: "Linen shirt", Description: "Light and breathable.", Price: 45},
+			"3": {ID: 3, Name: "Chinos", Description: "Cotton trousers to wear with a shirt.", Price: 60},
+			"4": {ID: 4, Name: "Sneakers", Description: "Leather sneakers.", Price: 120},
+		},
+		categories: map[int64][]string{1: {"shirts"}, 2: {"shirts"}, 3: {"trousers"}, 4: {"shoes"}},
+	}
+	s := NewService(repo, NewSearchIndex(), mockBlobStore{}, logger)
+	if !assert.Nil(t, s.BuildIndex(context.Background())) {
+		t.FailNow()
+	}
+	return s, repo
+}
+
+// names returns the names of the given products.
+func names(products []entity.Product) []string {
+	items := []string{}
+	for _, product := range products {
+		items = append(items, product.Name)
+	}
+	return items
+}
+
+func TestSearchRequest_Validate(t *testing.T) {
+	assert.Nil(t, SearchRequest{Q: "shirt", Price: []string{"0-25", "250+"}, Limit: 100}.Validate())
+
+	errs := SearchRequest{Price: []string{"10-20"}, Limit: 101, Offset: -1}.Validate().(validation.Errors)
+	assert.Contains(t, errs, "price")
+	assert.Contains(t, errs, "limit")
+	assert.Contains(t, errs, "offset")
+}
+
+func TestPriceBucket(t *testing.T) {
+	assert.Equal(t, "0-25", priceBucket(0))
+	assert.Equal(t, "25-50", priceBucket(25))
+	assert.Equal(t, "100-250", priceBucket(249.99))
+	assert.Equal(t, "250+", priceBucket(1000))
+}
+
+func TestService_Search(t *testing.T) {
+	s, repo := newSearchService(t)
+	ctx := context.Background()
+
+	// matches in names rank first, then products mentioning the words more often
+	result, err := s.Search(ctx, SearchRequest{Q: "shirt"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"Oxford shirt", "Linen shirt", "Chinos"}, names(result.Items))
+	assert.Equal(t, 3, result.Total)
+	assert.Equal(t, map[string]int{"shirts": 2, "trousers": 1}, result.Facets["category"])
+	assert.Equal(t, map[string]int{"25-50": 2, "50-100": 1}, result.Facets["price"])
+
+	// prefixes and typos
+	result, _ = s.Search(ctx, SearchRequest{Q: "cott shrit"})
+	assert.Equal(t, []string{"Oxford shirt", "Chinos"}, names(result.Items))
+
+	// filtered facets keep counting the other values
+	result, _ = s.Search(ctx, SearchRequest{Category: []string{"shirts"}, Limit: 1, Offset: 1})
+	assert.Equal(t, 2, result.Total)
+	assert.Len(t, result.Items, 1)
+	assert.Equal(t, map[string]int{"shirts": 2, "trousers": 1, "shoes": 1}, result.Facets["category"])
+	assert.Equal(t, map[string]int{"25-50": 2}, result.Facets["price"])
+
+	result, _ = s.Search(ctx, SearchRequest{Q: "hat"})
+	assert.Equal(t, []entity.Product{}, result.Items)
+	assert.Equal(t, map[string]int{}, result.Facets["category"])
+
+	// writes update the index
+	_, err = s.CreateVariant(ctx, "4", CreateVariantRequest{
+		UpdateVariantRequest: UpdateVariantRequest{SKU: "SNEAKERS-WHITE"},
+		Options:              []OptionValue{{Name: "Color", Value: "White"}},
+	})
+	assert.Nil(t, err)
+	result, _ = s.Search(ctx, SearchRequest{Q: "white"})
+	assert.Equal(t, []string{"Sneakers"}, names(result.Items))
+
+	delete(repo.products, "4")
+	assert.Nil(t, s.IndexProduct(ctx, 4))
+	result, _ = s.Search(ctx, SearchRequest{Q: "sneakers"})
+	assert.Equal(t, 0, result.Total)
+}
+
+func TestAPI(t *testing.T) {
+	s, _ := newSearchService(t)
+	logger, _ := log.NewForTest()
+	router := test.MockRouter(logger)
+	public, protected := auth.MockRouteGroups(router.Group("/v1"))
+	RegisterHandlers(public, protected, s, logger)
+	header := auth.MockAuthHeader()
+
+	tests := []test.APITestCase{
+		{Name: "list", Method: "GET", URL: "/v1/products", Header: header, WantStatus: http.StatusOK, WantResponse: `*"name":"Chinos"*`},
+		{Name: "search", Method: "GET", URL: "/v1/products?q=sneaker&limit=5", Header: header, WantStatus: http.StatusOK, WantResponse: `*"total":1,"facets":{"category":{"shoes":1},"price":{"100-250":1}}}`},
+		{Name: "filter", Method: "GET", URL: "/v1/products?category=shirts&category=shoes&price=25-50", Header: header, WantStatus: http.StatusOK, WantResponse: `*"total":2,*`},
+		{Name: "invalid limit", Method: "GET", URL: "/v1/products?q=shirt&limit=x", Header: header, WantStatus: http.StatusBadRequest},
+		{Name: "invalid price", Method: "GET", URL: "/v1/products?price=1-2", Header: header, WantStatus: http.StatusBadRequest},
+		{Name: "list anonymously", Method: "GET", URL: "/v1/products", WantStatus: http.StatusOK, WantResponse: `*"name":"Chinos"*`},
+		{Name: "search anonymously", Method: "GET", URL: "/v1/products?q=sneaker", WantStatus: http.StatusOK, WantResponse: `*"total":1,*`},
+		{Name: "get anonymously", Method: "GET", URL: "/v1/products/1", WantStatus: http.StatusOK},
+		{Name: "change anonymously", Method: "POST", URL: "/v1/products/1/variants", Body: `{"sku":"X"}`, WantStatus: http.StatusUnauthorized},
+	}
+	for _, tc := range tests {
+		test.Endpoint(t, router, tc)
+	}
+}
+
+func TestAPI_lastModified(t *testing.T) {
+	s, repo := newSearchService(t)
+	updatedAt := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	product := repo.products["1"]
+	product.UpdatedAt = updatedAt
+	repo.products["1"] = product
+	logger, _ := log.NewForTest()
+	router := test.MockRouter(logger)
+	public, protected := auth.MockRouteGroups(router.Group("/v1"))
+	public.Use(httpcache.ETag())
+	RegisterHandlers(public, protected, s, logger)
+	since := func(t time.Time) http.Header {
+		return http.Header{"If-Modified-Since": {t.Format(http.TimeFormat)}}
+	}
+
+	tests := []test.APITestCase{
+		{Name: "not modified", Method: "GET", URL: "/v1/products/1", Header: since(updatedAt), WantStatus: http.StatusNotModified},
+		{Name: "modified", Method: "GET", URL: "/v1/products/1", Header: since(updatedAt.Add(-time.Second)), WantStatus: http.StatusOK, WantResponse: `*"name":"Oxford shirt"*`},
+	}
+	for _, tc := range tests {
+		test.Endpoint(t, router, tc)
+	}
+}
@@ -0,0 +1,216 @@
+package product
+
+import (
+	"context"
+	stderrors "errors"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/online-shop/internal/entity"
+	"github.com/online-shop/internal/errors"
+	"github.com/online-shop/pkg/mysql"
+	"github.com/online-shop/pkg/tracing"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	skuFormat     = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+	barcodeFormat = regexp.MustCompile(`^[0-9]{8,14}$`)
+)
+
+// OptionValue is the value of a variant for a product option.
+type OptionValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// Validate validates the OptionValue fields.
+func (v OptionValue) Validate() error {
+	return validation.ValidateStruct(&v,
+		validation.Field(&v.Name, validation.Required, validation.Length(1, 50)),
+		validation.Field(&v.Value, validation.Required, validation.Length(1, 100)),
+	)
+}
+
+// UpdateVariantRequest represents the fields of a variant which can be changed.
+type UpdateVariantRequest struct {
+	SKU string `json:"sku"`
+	// Price overrides the price of the product when set.
+	Price   *float64 `json:"price"`
+	Stock   int32    `json:"stock"`
+	Barcode string   `json:"barcode"`
+}
+
+// Validate validates the UpdateVariantRequest fields.
+func (r UpdateVariantRequest) Validate() error {
+	return validation.ValidateStruct(&r,
+		validation.Field(&r.SKU, validation.Required, validation.Length(1, 64), validation.Match(skuFormat)),
+		validation.Field(&r.Price, validation.Min(float64(0))),
+		validation.Field(&r.Stock, validation.Min(int32(0))),
+		validation.Field(&r.Barcode, validation.Match(barcodeFormat)),
+	)
+}
+
+// CreateVariantRequest represents a request to create a variant.
+type CreateVariantRequest struct {
+	UpdateVariantRequest
+	// Options are the values of the variant for every option of the product. The first variant having options
+	// defines the options of its product.
+	Options []OptionValue `json:"options"`
+}
+
+// Validate validates the CreateVariantRequest fields.
+func (r CreateVariantRequest) Validate() error {
+	if err := r.UpdateVariantRequest.Validate(); err != nil {
+		return err
+	}
+	return validation.ValidateStruct(&r,
+		validation.Field(&r.Options, validation.Length(0, 3), validation.By(uniqueOptionNames)),
+	)
+}
+
+// uniqueOptionNames checks that a list of option values has at most one value per option.
+func uniqueOptionNames(value interface{}) error {
+	seen := map[string]bool{}
+	for _, option := range value.([]OptionValue) {
+		name := strings.ToLower(option.Name)
+		if seen[name] {
+			return stderrors.New("must have one value per option")
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// loadVariants returns the options and variants of the given product.
+func (s service) loadVariants(ctx context.Context, product entity.Product) ([]entity.ProductOption, []entity.Variant, error) {
+	options, err := s.repo.ListOptions(ctx, product.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	variants, err := s.repo.ListVariants(ctx, product.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	values, err := s.repo.ListVariantOptions(ctx, product.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	byVariant := map[string][]entity.VariantOption{}
+	for _, value := range values {
+		byVariant[value.VariantID] = append(byVariant[value.VariantID], value)
+	}
+	for i := range variants {
+		variants[i].Options = byVariant[variants[i].ID]
+		if variants[i].Options == nil {
+			variants[i].Options = []entity.VariantOption{}
+		}
+	}
+	return options, variants, nil
+}
+
+// optionKey identifies the combination of option values of a variant.
+func optionKey(values []entity.VariantOption) string {
+	keys := make([]string, len(values))
+	for i, value := range values {
+		keys[i] = value.OptionID + "=" + strings.ToLower(value.Value)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, "&")
+}
+
+// CreateVariant adds a variant to the given product.
+func (s service) CreateVariant(ctx context.Context, productID string, input CreateVariantRequest) (entity.Variant, error) {
+	ctx, span := tracing.StartSpan(ctx, "product.Service.CreateVariant")
+	defer span.End()
+
+	product, err := s.repo.Get(ctx, productID)
+	if err != nil {
+		return entity.Variant{}, err
+	}
+	options, variants, err := s.loadVariants(ctx, product)
+	if err != nil {
+		return entity.Variant{}, err
+	}
+
+	variant := entity.Variant{
+		ID:        entity.GenerateID(),
+		ProductID: product.ID,
+		SKU:       input.SKU,
+		Price:     input.Price,
+		Stock:     input.Stock,
+		Barcode:   input.Barcode,
+		Options:   []entity.VariantOption{},
+	}
+	// the first variant having options defines them
+	var newOptions []entity.ProductOption
+	if len(options) == 0 {
+		for i, value := range input.Options {
+			newOptions = append(newOptions, entity.ProductOption{ID: entity.GenerateID(), ProductID: product.ID, Name: value.Name, Position: i})
+		}
+		options = newOptions
+	}
+	byName := map[string]OptionValue{}
+	for _, value := range input.Options {
+		byName[strings.ToLower(value.Name)] = value
+	}
+	if len(byName) != len(options) {
+		return entity.Variant{}, validation.Errors{"options": stderrors.New("must have a value for every option of the product")}
+	}
+	for _, option := range options {
+		value, ok := byName[strings.ToLower(option.Name)]
+		if !ok {
+			return entity.Variant{}, validation.Errors{"options": stderrors.New("must have a value for every option of the product")}
+		}
+		variant.Options = append(variant.Options, entity.VariantOption{VariantID: variant.ID, OptionID: option.ID, Name: option.Name, Value: value.Value})
+	}
+	for _, other := range variants {
+		if len(other.Options) > 0 && optionKey(other.Options) == optionKey(variant.Options) {
+			return entity.Variant{}, errors.Conflict("Another variant has the same options.", "options")
+		}
+	}
+
+	for _, option := range newOptions {
+		if err := s.repo.CreateOption(ctx, option); err != nil {
+			return entity.Variant{}, err
+		}
+	}
+	if err := s.repo.CreateVariant(ctx, variant); err != nil {
+		if dbErr := mysql.Classify(err); dbErr != nil && dbErr.Kind == mysql.DuplicateKey {
+			return entity.Variant{}, errors.Conflict("", "sku")
+		}
+		return entity.Variant{}, err
+	}
+	s.logger.With(ctx, "product", product.ID, "sku", variant.SKU).Infof("variant created")
+	s.reindex(ctx, product.ID)
+	return variant, nil
+}
+
+// UpdateVariant changes the SKU, price, stock and barcode of a variant of the given product.
+func (s service) UpdateVariant(ctx context.Context, productID, variantID string, input UpdateVariantRequest) (entity.Variant, error) {
+	ctx, span := tracing.StartSpan(ctx, "product.Service.UpdateVariant")
+	defer span.End()
+
+	product, err := s.repo.Get(ctx, productID)
+	if err != nil {
+		return entity.Variant{}, err
+	}
+	_, variants, err := s.loadVariants(ctx, product)
+	if err != nil {
+		return entity.Variant{}, err
+	}
+	for _, variant := range variants {
+		if variant.ID != variantID {
+			continue
+		}
+		variant.SKU, variant.Price, variant.Stock, variant.Barcode = input.SKU, input.Price, input.Stock, input.Barcode
+		if err := s.repo.UpdateVariant(ctx, variant); err != nil {
+			if dbErr := mysql.Classify(err); dbErr != nil && dbErr.Kind == mysql.DuplicateKey {
+				return entity.Variant{}, errors.Conflict("", "sku")
+			}
+			return entity.Variant{}, err
+		}
+		return variant, nil
+	}
+	return entity.Variant{}, errors.NotFound("")
+}
@@ -0,0 +1,104 @@
+package review
+
+import (
+	routing "github.com/go-ozzo/ozzo-routing/v2"
+	"github.com/online-shop/internal/auth"
+	"github.com/online-shop/internal/entity"
+	"github.com/online-shop/internal/errors"
+	"github.com/online-shop/pkg/log"
+	"github.com/online-shop/pkg/pagination"
+	"net/http"
+	"strconv"
+)
+
+// RegisterHandlers sets up the routing of the HTTP handlers. Published reviews are read through the public group,
+// which anonymous requests may use, while customers review products and administrators moderate the reviews
+// through the protected one.
+func RegisterHandlers(public, protected *routing.RouteGroup, service Service, logger log.Logger) {
+	res := resource{service, logger}
+
+	public.Get("/products/<id>/reviews", auth.RequireScope(auth.ScopeProductsRead), res.list)
+	protected.Post("/products/<id>/reviews", auth.RejectAPIKeys, auth.RequireRole(entity.RoleCustomer), res.create)
+
+	admin := auth.RequireRole(entity.RoleAdmin)
+	protected.Get("/reviews", admin, res.listByStatus)
+	protected.Put("/reviews/<id>/status", admin, res.moderate)
+}
+
+type resource struct {
+	service Service
+	logger  log.Logger
+}
+
+func (r resource) list(c *routing.Context) error {
+	productID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return errors.NotFound("")
+	}
+	page, err := pagination.FromContext(c)
+	if err != nil {
+		return err
+	}
+	reviews, err := r.service.List(c.Request.Context(), productID, page)
+	if err != nil {
+		return err
+	}
+
+	return c.Write(reviews)
+}
+
+// listByStatus returns the reviews having the status given as the "status" query parameter, pending by default.
+func (r resource) listByStatus(c *routing.Context) error {
+	status := c.Query("status", entity.ReviewPending)
+	if err := (ModerateReviewRequest{Status: status}).Validate(); err != nil {
+		return err
+	}
+	page, err := pagination.FromContext(c)
+	if err != nil {
+		return err
+	}
+	reviews, err := r.service.ListByStatus(c.Request.Context(), status, page)
+	if err != nil {
+		return err
+	}
+
+	return c.Write(reviews)
+}
+
+func (r resource) create(c *routing.Context) error {
+	productID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return errors.NotFound("")
+	}
+	var input CreateReviewRequest
+	if err := c.Read(&input); err != nil {
+		r.logger.With(c.Request.Context()).Info(err)
+		return errors.BadRequest("")
+	}
+	if err := input.Validate(); err != nil {
+		return err
+	}
+	review, err := r.service.Create(c.Request.Context(), productID, input)
+	if err != nil {
+		return err
+	}
+
+	return c.WriteWithStatus(review, http.StatusCreated)
+}
+
+func (r resource) moderate(c *routing.Context) error {
+	var input ModerateReviewRequest
+	if err := c.Read(&input); err != nil {
+		r.logger.With(c.Request.Context()).Info(err)
+		return errors.BadRequest("")
+	}
+	if err := input.Validate(); err != nil {
+		return err
+	}
+	review, err := r.service.Moderate(c.Request.Context(), c.Param("id"), input)
+	if err != nil {
+		return err
+	}
+
+	return c.Write(review)
+}
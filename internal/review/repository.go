@@ -0,0 +1,192 @@
+package review
+
+import (
+	"context"
+	"fmt"
+	"github.com/online-shop/internal/entity"
+	"github.com/online-shop/internal/order"
+	"github.com/online-shop/pkg/log"
+	"github.com/online-shop/pkg/mysql"
+)
+
+// Repository persists reviews, along with the rating they give to products.
+type Repository interface {
+	// Get returns the review having the given ID.
+	Get(ctx context.Context, id string) (entity.Review, error)
+	// List returns the reviews of a product having the given status, newest first.
+	List(ctx context.Context, productID int64, status string, offset, limit int) ([]entity.Review, error)
+	// Count returns the number of reviews of a product having the given status.
+	Count(ctx context.Context, productID int64, status string) (int, error)
+	// ListByStatus returns the reviews of all products having the given status, oldest first.
+	ListByStatus(ctx context.Context, status string, offset, limit int) ([]entity.Review, error)
+	// CountByStatus returns the number of reviews of all products having the given status.
+	CountByStatus(ctx context.Context, status string) (int, error)
+	Create(ctx context.Context, review entity.Review) error
+	// UpdateStatus saves the status of a review, along with who changed it and when.
+	UpdateStatus(ctx context.Context, review entity.Review) error
+	// UpdateRating recomputes the rating and review count of a product from its approved reviews.
+	UpdateRating(ctx context.Context, productID int64) error
+	// ProductExists tells whether the product having the given ID exists.
+	ProductExists(ctx context.Context, productID int64) (bool, error)
+	// HasReceived tells whether a user has received an order containing the given product, which staff members
+	// shipped and then marked as received.
+	HasReceived(ctx context.Context, userID string, productID int64) (bool, error)
+	// Transaction runs fn in a transaction, which the repository calls made with the context given to fn are
+	// part of.
+	Transaction(ctx context.Context, fn func(ctx context.Context) error) error
+}
+
+// reviewColumns selects the columns of a review r, along with the username of its author from the user u.
+const reviewColumns = "r.id, r.product_id, r.user_id, coalesce(u.username, '') author, r.rating, r.text, r.status, " +
+	"r.moderated_by, r.created_at, r.updated_at"
+
+// repository persists reviews in database
+type repository struct {
+	db     mysql.BaseRepository
+	logger log.Logger
+}
+
+// NewRepository creates a new review repository
+func NewRepository(db mysql.BaseRepository, logger log.Logger) Repository {
+	return repository{db, logger}
+}
+
+func (r repository) Get(ctx context.Context, id string) (entity.Review, error) {
+	q := fmt.Sprintf("select %s from product_review r left join user u on u.id = r.user_id where r.id = ?", reviewColumns)
+
+	var review entity.Review
+
+	err := r.db.FetchRow(ctx, q, &review, id)
+	if err != nil {
+		return review, err
+	}
+
+	return review, nil
+}
+
+func (r repository) List(ctx context.Context, productID int64, status string, offset, limit int) ([]entity.Review, error) {
+	q := fmt.Sprintf("select %s from product_review r left join user u on u.id = r.user_id "+
+		"where r.product_id = ? and r.status = ? "+
+		"order by r.created_at desc, r.id limit ? offset ?", reviewColumns)
+
+	reviews := []entity.Review{}
+
+	err := r.db.FetchRows(ctx, q, &reviews, productID, status, limit, offset)
+	if err != nil {
+		return reviews, err
+	}
+
+	return reviews, nil
+}
+
+func (r repository) Count(ctx context.Context, productID int64, status string) (int, error) {
+	q := fmt.Sprintf("select count(*) from product_review where product_id = ? and status = ?")
+
+	var count int
+
+	err := r.db.FetchRow(ctx, q, &count, productID, status)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+func (r repository) ListByStatus(ctx context.Context, status string, offset, limit int) ([]entity.Review, error) {
+	q := fmt.Sprintf("select %s from product_review r left join user u on u.id = r.user_id "+
+		"where r.status = ? "+
+		"order by r.created_at, r.id limit ? offset ?", reviewColumns)
+
+	reviews := []entity.Review{}
+
+	err := r.db.FetchRows(ctx, q, &reviews, status, limit, offset)
+	if err != nil {
+		return reviews, err
+	}
+
+	return reviews, nil
+}
+
+func (r repository) CountByStatus(ctx context.Context, status string) (int, error) {
+	q := fmt.Sprintf("select count(*) from product_review where status = ?")
+
+	var count int
+
+	err := r.db.FetchRow(ctx, q, &count, status)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+func (r repository) Create(ctx context.Context, review entity.Review) error {
+	q := fmt.Sprintf("insert into product_review (id, product_id, user_id, rating, text, status, created_at, updated_at) " +
+		"values (:id, :product_id, :user_id, :rating, :text, :status, :created_at, :updated_at)")
+
+	_, err := r.db.Exec(ctx, q, review)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r repository) UpdateStatus(ctx context.Context, review entity.Review) error {
+	q := fmt.Sprintf("update product_review set status = :status, moderated_by = :moderated_by, updated_at = :updated_at " +
+		"where id = :id")
+
+	_, err := r.db.Exec(ctx, q, review)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r repository) UpdateRating(ctx context.Context, productID int64) error {
+	q := fmt.Sprintf("update product p set " +
+		"rating = coalesce((select avg(rating) from product_review where product_id = p.id and status = :status), 0), " +
+		"review_count = (select count(*) from product_review where product_id = p.id and status = :status) " +
+		"where p.id = :id")
+
+	_, err := r.db.Exec(ctx, q, map[string]interface{}{"id": productID, "status": entity.ReviewApproved})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r repository) ProductExists(ctx context.Context, productID int64) (bool, error) {
+	q := fmt.Sprintf("select exists (select 1 from product where id = ?)")
+
+	var exists bool
+
+	err := r.db.FetchRow(ctx, q, &exists, productID)
+	if err != nil {
+		return false, err
+	}
+
+	return exists, nil
+}
+
+func (r repository) HasReceived(ctx context.Context, userID string, productID int64) (bool, error) {
+	// orders get a delivery date when staff members ship them, which customers cannot set
+	q := fmt.Sprintf("select exists (select 1 from orders o " +
+		"join order_detail od on od.order_id = o.id " +
+		"where o.user_id = ? and o.status = ? and o.delivered_date is not null and od.product_id = ?)")
+
+	var received bool
+
+	err := r.db.FetchRow(ctx, q, &received, userID, order.RECEIVED, productID)
+	if err != nil {
+		return false, err
+	}
+
+	return received, nil
+}
+
+func (r repository) Transaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return r.db.Transaction(ctx, fn)
+}
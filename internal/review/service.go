@@ -0,0 +1,181 @@
+package review
+
+import (
+	"context"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/online-shop/internal/auth"
+	"github.com/online-shop/internal/entity"
+	"github.com/online-shop/internal/errors"
+	"github.com/online-shop/pkg/log"
+	"github.com/online-shop/pkg/mysql"
+	"github.com/online-shop/pkg/pagination"
+	"github.com/online-shop/pkg/tracing"
+	"time"
+)
+
+// Service encapsulates the logic of product reviews. Reviews are published once approved by staff, and the
+// rating of products is updated whenever the status of one of their reviews changes.
+type Service interface {
+	// List returns a page of the approved reviews of a product, newest first.
+	List(ctx context.Context, productID int64, page pagination.Request) (pagination.Page, error)
+	// ListByStatus returns a page of the reviews having the given status, oldest first, for staff to moderate.
+	ListByStatus(ctx context.Context, status string, page pagination.Request) (pagination.Page, error)
+	// Create adds a review by the current user, which is pending until moderated.
+	Create(ctx context.Context, productID int64, input CreateReviewRequest) (entity.Review, error)
+	// Moderate changes the status of a review.
+	Moderate(ctx context.Context, id string, input ModerateReviewRequest) (entity.Review, error)
+}
+
+// CreateReviewRequest represents a review posted by a customer.
+type CreateReviewRequest struct {
+	Rating int    `json:"rating"`
+	Text   string `json:"text"`
+}
+
+// Validate validates the CreateReviewRequest fields.
+func (r CreateReviewRequest) Validate() error {
+	return validation.ValidateStruct(&r,
+		validation.Field(&r.Rating, validation.Required, validation.Min(1), validation.Max(5)),
+		validation.Field(&r.Text, validation.Required, validation.Length(1, 4000)),
+	)
+}
+
+// ModerateReviewRequest represents the decision of a staff member about a review.
+type ModerateReviewRequest struct {
+	Status string `json:"status"`
+}
+
+// Validate validates the ModerateReviewRequest fields.
+func (r ModerateReviewRequest) Validate() error {
+	return validation.ValidateStruct(&r,
+		validation.Field(&r.Status, validation.Required,
+			validation.In(entity.ReviewPending, entity.ReviewApproved, entity.ReviewRejected)),
+	)
+}
+
+// ProductCache keeps copies of products, which include their rating.
+type ProductCache interface {
+	// Invalidate drops the copies of the given products.
+	Invalidate(ctx context.Context, productIDs ...int64)
+}
+
+type service struct {
+	repo     Repository
+	products ProductCache
+	logger   log.Logger
+}
+
+// NewService creates a new review service, invalidating the cached products whose rating changes.
+func NewService(repo Repository, products ProductCache, logger log.Logger) Service {
+	return service{repo, products, logger}
+}
+
+func (s service) List(ctx context.Context, productID int64, page pagination.Request) (pagination.Page, error) {
+	ctx, span := tracing.StartSpan(ctx, "review.Service.List")
+	defer span.End()
+
+	exists, err := s.repo.ProductExists(ctx, productID)
+	if err != nil {
+		return pagination.Page{}, err
+	}
+	if !exists {
+		return pagination.Page{}, errors.NotFound("")
+	}
+	reviews, err := s.repo.List(ctx, productID, entity.ReviewApproved, page.Offset, page.PageLimit())
+	if err != nil {
+		return pagination.Page{}, err
+	}
+	total, err := s.repo.Count(ctx, productID, entity.ReviewApproved)
+	if err != nil {
+		return pagination.Page{}, err
+	}
+	return page.Page(reviews, total), nil
+}
+
+func (s service) ListByStatus(ctx context.Context, status string, page pagination.Request) (pagination.Page, error) {
+	ctx, span := tracing.StartSpan(ctx, "review.Service.ListByStatus")
+	defer span.End()
+
+	reviews, err := s.repo.ListByStatus(ctx, status, page.Offset, page.PageLimit())
+	if err != nil {
+		return pagination.Page{}, err
+	}
+	total, err := s.repo.CountByStatus(ctx, status)
+	if err != nil {
+		return pagination.Page{}, err
+	}
+	return page.Page(reviews, total), nil
+}
+
+func (s service) Create(ctx context.Context, productID int64, input CreateReviewRequest) (entity.Review, error) {
+	ctx, span := tracing.StartSpan(ctx, "review.Service.Create")
+	defer span.End()
+
+	// staff members must not give their opinion in the name of customers
+	if err := auth.ForbidImpersonation(ctx); err != nil {
+		return entity.Review{}, err
+	}
+	user := auth.CurrentUser(ctx)
+	exists, err := s.repo.ProductExists(ctx, productID)
+	if err != nil {
+		return entity.Review{}, err
+	}
+	if !exists {
+		return entity.Review{}, errors.NotFound("")
+	}
+	received, err := s.repo.HasReceived(ctx, user.GetID(), productID)
+	if err != nil {
+		return entity.Review{}, err
+	}
+	if !received {
+		return entity.Review{}, errors.Forbidden("Only customers who received the product can review it.")
+	}
+
+	now := time.Now()
+	review := entity.Review{
+		ID:        entity.GenerateID(),
+		ProductID: productID,
+		UserID:    user.GetID(),
+		Author:    user.GetUsername(),
+		Rating:    input.Rating,
+		Text:      input.Text,
+		Status:    entity.ReviewPending,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := s.repo.Create(ctx, review); err != nil {
+		if dbErr := mysql.Classify(err); dbErr != nil && dbErr.Kind == mysql.DuplicateKey {
+			return entity.Review{}, errors.Conflict("The product has already been reviewed.", "product_id")
+		}
+		return entity.Review{}, err
+	}
+	s.logger.With(ctx, "product", productID, "review", review.ID).Infof("review posted")
+	return review, nil
+}
+
+func (s service) Moderate(ctx context.Context, id string, input ModerateReviewRequest) (entity.Review, error) {
+	ctx, span := tracing.StartSpan(ctx, "review.Service.Moderate")
+	defer span.End()
+
+	review, err := s.repo.Get(ctx, id)
+	if err != nil {
+		return entity.Review{}, err
+	}
+	if review.Status == input.Status {
+		return review, nil
+	}
+	moderator := auth.CurrentUser(ctx).GetID()
+	review.Status, review.ModeratedBy, review.UpdatedAt = input.Status, &moderator, time.Now()
+	err = s.repo.Transaction(ctx, func(ctx context.Context) error {
+		if err := s.repo.UpdateStatus(ctx, review); err != nil {
+			return err
+		}
+		return s.repo.UpdateRating(ctx, review.ProductID)
+	})
+	if err != nil {
+		return entity.Review{}, err
+	}
+	s.products.Invalidate(ctx, review.ProductID)
+	s.logger.With(ctx, "product", review.ProductID, "review", review.ID, "status", review.Status).Infof("review moderated")
+	return review, nil
+}
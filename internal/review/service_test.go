@@ -0,0 +1,291 @@
+package review
+
+import (
+	"context"
+	"database/sql"
+	"github.com/online-shop/internal/auth"
+	"github.com/online-shop/internal/entity"
+	"github.com/online-shop/internal/errors"
+	"github.com/online-shop/internal/order"
+	"github.com/online-shop/internal/test"
+	"github.com/online-shop/pkg/log"
+	"github.com/online-shop/pkg/mysql"
+	"github.com/online-shop/pkg/pagination"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"sort"
+	"testing"
+	"time"
+)
+
+type mockRepository struct {
+	reviews []entity.Review
+	// products maps the IDs of the existing products to their rating and review count.
+	products map[int64]entity.Product
+	// orders are the orders of the customers, along with the IDs of their products.
+	orders []entity.Order
+}
+
+func (m *mockRepository) Get(ctx context.Context, id string) (entity.Review, error) {
+	for _, review := range m.reviews {
+		if review.ID == id {
+			return review, nil
+		}
+	}
+	return entity.Review{}, sql.ErrNoRows
+}
+
+// page returns the reviews matching the given filter, in the given order, from offset up to limit reviews.
+func (m *mockRepository) page(match func(entity.Review) bool, newest bool, offset, limit int) []entity.Review {
+	reviews := []entity.Review{}
+	for _, review := range m.reviews {
+		if match(review) {
+			reviews = append(reviews, review)
+		}
+	}
+	sort.SliceStable(reviews, func(i, j int) bool {
+		return reviews[i].CreatedAt.Before(reviews[j].CreatedAt) != newest
+	})
+	if offset > len(reviews) {
+		offset = len(reviews)
+	}
+	reviews = reviews[offset:]
+	if limit < len(reviews) {
+		reviews = reviews[:limit]
+	}
+	return reviews
+}
+
+func (m *mockRepository) List(ctx context.Context, productID int64, status string, offset, limit int) ([]entity.Review, error) {
+	return m.page(func(r entity.Review) bool { return r.ProductID == productID && r.Status == status }, true, offset, limit), nil
+}
+
+func (m *mockRepository) Count(ctx context.Context, productID int64, status string) (int, error) {
+	return len(m.page(func(r entity.Review) bool { return r.ProductID == productID && r.Status == status }, true, 0, len(m.reviews))), nil
+}
+
+func (m *mockRepository) ListByStatus(ctx context.Context, status string, offset, limit int) ([]entity.Review, error) {
+	return m.page(func(r entity.Review) bool { return r.Status == status }, false, offset, limit), nil
+}
+
+func (m *mockRepository) CountByStatus(ctx context.Context, status string) (int, error) {
+	return len(m.page(func(r entity.Review) bool { return r.Status == status }, false, 0, len(m.reviews))), nil
+}
+
+func (m *mockRepository) Create(ctx context.Context, review entity.Review) error {
+	for _, other := range m.reviews {
+		if other.ProductID == review.ProductID && other.UserID == review.UserID {
+			return &mysql.Error{Kind: mysql.DuplicateKey}
+		}
+	}
+	m.reviews = append(m.reviews, review)
+	return nil
+}
+
+func (m *mockRepository) UpdateStatus(ctx context.Context, review entity.Review) error {
+	for i, other := range m.reviews {
+		if other.ID == review.ID {
+			m.reviews[i] = review
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (m *mockRepository) UpdateRating(ctx context.Context, productID int64) error {
+	product := m.products[productID]
+	total := 0
+	product.ReviewCount = 0
+	for _, review := range m.reviews {
+		if review.ProductID == productID && review.Status == entity.ReviewApproved {
+			total += review.Rating
+			product.ReviewCount++
+		}
+	}
+	product.Rating = 0
+	if product.ReviewCount > 0 {
+		product.Rating = float64(total) / float64(product.ReviewCount)
+	}
+	m.products[productID] = product
+	return nil
+}
+
+func (m *mockRepository) ProductExists(ctx context.Context, productID int64) (bool, error) {
+	_, ok := m.products[productID]
+	return ok, nil
+}
+
+func (m *mockRepository) HasReceived(ctx context.Context, userID string, productID int64) (bool, error) {
+	for _, o := range m.orders {
+		if o.UserID != userID || o.Status != order.RECEIVED || o.DeliveredDate == nil {
+			continue
+		}
+		for _, detail := range o.OrderDetails {
+			if detail.ProductID == productID {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func (m *mockRepository) Transaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return fn(ctx)
+}
+
+// mockProductCache records the products invalidated.
+type mockProductCache struct {
+	invalidated []int64
+}
+
+func (m *mockProductCache) Invalidate(ctx context.Context, productIDs ...int64) {
+	m.invalidated = append(m.invalidated, productIDs...)
+}
+
+func newTestService() (Service, *mockRepository, *mockProductCache) {
+	logger, _ := log.NewForTest()
+	delivered := time.Now()
+	repo := &mockRepository{
+		products: map[int64]entity.Product{1: {ID: 1}, 2: {ID: 2}},
+		orders: []entity.Order{
+			{UserID: "100", Status: order.RECEIVED, DeliveredDate: &delivered, OrderDetails: []entity.OrderDetail{{ProductID: 1}}},
+		},
+	}
+	products := &mockProductCache{}
+	return NewService(repo, products, logger), repo, products
+}
+
+// customer returns a context authenticated as the customer "Tester", whose ID is "100".
+func customer() context.Context {
+	return auth.WithUser(context.Background(), "100", "Tester")
+}
+
+func TestCreateReviewRequest_Validate(t *testing.T) {
+	assert.Nil(t, CreateReviewRequest{Rating: 5, Text: "Great"}.Validate())
+	assert.NotNil(t, CreateReviewRequest{Rating: 0, Text: "Great"}.Validate())
+	assert.NotNil(t, CreateReviewRequest{Rating: 6, Text: "Great"}.Validate())
+	assert.NotNil(t, CreateReviewRequest{Rating: 3}.Validate())
+}
+
+func TestService_Create(t *testing.T) {
+	s, repo, _ := newTestService()
+
+	review, err := s.Create(customer(), 1, CreateReviewRequest{Rating: 4, Text: "Fits well"})
+	assert.Nil(t, err)
+	assert.Equal(t, entity.ReviewPending, review.Status)
+	assert.Equal(t, "Tester", review.Author)
+	assert.Len(t, repo.reviews, 1)
+	assert.Equal(t, int32(0), repo.products[1].ReviewCount, "pending reviews do not count")
+
+	_, err = s.Create(customer(), 1, CreateReviewRequest{Rating: 5, Text: "Again"})
+	assert.Equal(t, http.StatusConflict, err.(errors.ErrorResponse).Status)
+	_, err = s.Create(customer(), 2, CreateReviewRequest{Rating: 5, Text: "Not received"})
+	assert.Equal(t, http.StatusForbidden, err.(errors.ErrorResponse).Status)
+	_, err = s.Create(customer(), 3, CreateReviewRequest{Rating: 5, Text: "Unknown"})
+	assert.Equal(t, http.StatusNotFound, err.(errors.ErrorResponse).Status)
+}
+
+func TestService_Create_received(t *testing.T) {
+	s, repo, _ := newTestService()
+	delivered := time.Now()
+
+	// orders are only received once staff members shipped them, giving them a delivery date
+	repo.orders = append(repo.orders,
+		entity.Order{UserID: "100", Status: order.RECEIVED, OrderDetails: []entity.OrderDetail{{ProductID: 2}}},
+		entity.Order{UserID: "100", Status: order.SHIPPED, DeliveredDate: &delivered, OrderDetails: []entity.OrderDetail{{ProductID: 2}}},
+		entity.Order{UserID: "101", Status: order.RECEIVED, DeliveredDate: &delivered, OrderDetails: []entity.OrderDetail{{ProductID: 2}}},
+	)
+	_, err := s.Create(customer(), 2, CreateReviewRequest{Rating: 5, Text: "Not delivered"})
+	assert.Equal(t, http.StatusForbidden, err.(errors.ErrorResponse).Status)
+	assert.Empty(t, repo.reviews)
+
+	repo.orders[1].DeliveredDate = &delivered
+	_, err = s.Create(customer(), 2, CreateReviewRequest{Rating: 5, Text: "Delivered"})
+	assert.Nil(t, err)
+}
+
+func TestService_Moderate(t *testing.T) {
+	s, repo, products := newTestService()
+	now := time.Now()
+	repo.reviews = []entity.Review{
+		{ID: "a", ProductID: 1, UserID: "100", Rating: 4, Status: entity.ReviewPending, CreatedAt: now},
+		{ID: "b", ProductID: 1, UserID: "101", Rating: 1, Status: entity.ReviewPending, CreatedAt: now.Add(time.Minute)},
+	}
+	ctx := auth.WithUser(context.Background(), "1", "Admin")
+
+	review, err := s.Moderate(ctx, "a", ModerateReviewRequest{Status: entity.ReviewApproved})
+	assert.Nil(t, err)
+	assert.Equal(t, "1", *review.ModeratedBy)
+	_, err = s.Moderate(ctx, "b", ModerateReviewRequest{Status: entity.ReviewApproved})
+	assert.Nil(t, err)
+	assert.Equal(t, entity.Product{ID: 1, Rating: 2.5, ReviewCount: 2}, repo.products[1])
+	assert.Equal(t, []int64{1, 1}, products.invalidated, "the rating of cached products is updated")
+
+	_, err = s.Moderate(ctx, "b", ModerateReviewRequest{Status: entity.ReviewRejected})
+	assert.Nil(t, err)
+	assert.Equal(t, entity.Product{ID: 1, Rating: 4, ReviewCount: 1}, repo.products[1])
+
+	_, err = s.Moderate(ctx, "c", ModerateReviewRequest{Status: entity.ReviewRejected})
+	assert.Equal(t, sql.ErrNoRows, err)
+}
+
+func TestService_List(t *testing.T) {
+	s, repo, _ := newTestService()
+	now := time.Now()
+	for i, status := range []string{entity.ReviewApproved, entity.ReviewPending, entity.ReviewApproved, entity.ReviewApproved} {
+		repo.reviews = append(repo.reviews, entity.Review{ID: string(rune('a' + i)), ProductID: 1, Status: status, CreatedAt: now.Add(time.Duration(i) * time.Minute)})
+	}
+	ctx := context.Background()
+
+	page, err := s.List(ctx, 1, pagination.Request{Limit: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, page.Total)
+	if reviews := page.Items.([]entity.Review); assert.Len(t, reviews, 2) {
+		assert.Equal(t, "d", reviews[0].ID, "newest first")
+		assert.Equal(t, "c", reviews[1].ID)
+	}
+	page, _ = s.List(ctx, 1, pagination.Request{Limit: 2, Offset: 2})
+	if reviews := page.Items.([]entity.Review); assert.Len(t, reviews, 1) {
+		assert.Equal(t, "a", reviews[0].ID)
+	}
+	page, _ = s.List(ctx, 1, pagination.Request{})
+	assert.Equal(t, pagination.DefaultLimit, page.Limit)
+
+	page, _ = s.ListByStatus(ctx, entity.ReviewPending, pagination.Request{})
+	assert.Equal(t, 1, page.Total)
+
+	_, err = s.List(ctx, 3, pagination.Request{})
+	assert.Equal(t, http.StatusNotFound, err.(errors.ErrorResponse).Status)
+}
+
+func TestAPI(t *testing.T) {
+	s, repo, _ := newTestService()
+	repo.reviews = []entity.Review{{ID: "a", ProductID: 1, UserID: "101", Author: "Other", Rating: 5, Text: "Perfect", Status: entity.ReviewPending}}
+	logger, _ := log.NewForTest()
+	router := test.MockRouter(logger)
+	public, protected := auth.MockRouteGroups(router.Group("/v1"))
+	RegisterHandlers(public, protected, s, logger)
+
+	tests := []test.APITestCase{
+		{Name: "review", Method: "POST", URL: "/v1/products/1/reviews", Body: `{"rating":4,"text":"Fits well"}`, Header: auth.MockAuthHeader(), WantStatus: http.StatusCreated, WantResponse: `*"author":"Tester","rating":4,"text":"Fits well","status":"pending"*`},
+		{Name: "review twice", Method: "POST", URL: "/v1/products/1/reviews", Body: `{"rating":4,"text":"Fits well"}`, Header: auth.MockAuthHeader(), WantStatus: http.StatusConflict},
+		{Name: "invalid rating", Method: "POST", URL: "/v1/products/2/reviews", Body: `{"rating":9,"text":"Wow"}`, Header: auth.MockAuthHeader(), WantStatus: http.StatusBadRequest},
+		{Name: "review while impersonating", Method: "POST", URL: "/v1/products/1/reviews", Body: `{"rating":1,"text":"Bad"}`, Header: auth.MockImpersonationAuthHeader(), WantStatus: http.StatusForbidden},
+		{Name: "review with an API key", Method: "POST", URL: "/v1/products/1/reviews", Body: `{"rating":1,"text":"Bad"}`, Header: auth.MockAPIKeyAuthHeader(), WantStatus: http.StatusForbidden},
+		{Name: "review as admin", Method: "POST", URL: "/v1/products/1/reviews", Body: `{"rating":1,"text":"Bad"}`, Header: auth.MockAdminAuthHeader(), WantStatus: http.StatusForbidden},
+		{Name: "moderation queue", Method: "GET", URL: "/v1/reviews?limit=1", Header: auth.MockAdminAuthHeader(), WantStatus: http.StatusOK, WantResponse: `*"total":2,"offset":0,"limit":1}`},
+		{Name: "moderation queue as customer", Method: "GET", URL: "/v1/reviews", Header: auth.MockAuthHeader(), WantStatus: http.StatusForbidden},
+		{Name: "invalid status", Method: "GET", URL: "/v1/reviews?status=spam", Header: auth.MockAdminAuthHeader(), WantStatus: http.StatusBadRequest},
+		{Name: "approve", Method: "PUT", URL: "/v1/reviews/a/status", Body: `{"status":"approved"}`, Header: auth.MockAdminAuthHeader(), WantStatus: http.StatusOK, WantResponse: `*"status":"approved"*`},
+		{Name: "approve unknown", Method: "PUT", URL: "/v1/reviews/x/status", Body: `{"status":"approved"}`, Header: auth.MockAdminAuthHeader(), WantStatus: http.StatusNotFound},
+		{Name: "list", Method: "GET", URL: "/v1/products/1/reviews", Header: auth.MockAuthHeader(), WantStatus: http.StatusOK, WantResponse: `{"items":[{"id":"a","product_id":1,"author":"Other","rating":5,"text":"Perfect","status":"approved","created_at":"0001-01-01T00:00:00Z","updated_at":"*`},
+		{Name: "list anonymously", Method: "GET", URL: "/v1/products/1/reviews", WantStatus: http.StatusOK, WantResponse: `*"total":1,*`},
+		{Name: "review anonymously", Method: "POST", URL: "/v1/products/1/reviews", Body: `{"rating":4,"text":"Nice"}`, WantStatus: http.StatusUnauthorized},
+		{Name: "list invalid limit", Method: "GET", URL: "/v1/products/1/reviews?limit=x", Header: auth.MockAuthHeader(), WantStatus: http.StatusBadRequest},
+		{Name: "list unknown product", Method: "GET", URL: "/v1/products/x/reviews", Header: auth.MockAuthHeader(), WantStatus: http.StatusNotFound},
+	}
+	for _, tc := range tests {
+		test.Endpoint(t, router, tc)
+	}
+	assert.Equal(t, int32(1), repo.products[1].ReviewCount)
+}
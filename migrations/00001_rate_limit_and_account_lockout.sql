@@ -0,0 +1,20 @@
+-- +goose Up
+alter table user
+    add column role          varchar(32) not null default 'customer',
+    add column failed_logins int         not null default 0,
+    add column locked_until  datetime    null;
+
+create table rate_limit
+(
+    bucket     varchar(191) not null primary key,
+    tokens     double       not null,
+    updated_at datetime(6)  not null
+);
+
+-- +goose Down
+drop table rate_limit;
+
+alter table user
+    drop column locked_until,
+    drop column failed_logins,
+    drop column role;
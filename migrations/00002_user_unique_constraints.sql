@@ -0,0 +1,7 @@
+-- +goose Up
+create unique index uq_user_username on user (username);
+create unique index uq_user_email on user (email);
+
+-- +goose Down
+drop index uq_user_email on user;
+drop index uq_user_username on user;
@@ -0,0 +1,9 @@
+-- +goose Up
+alter table user
+    add column email_verified boolean  not null default false,
+    add column deleted_at     datetime null;
+
+-- +goose Down
+alter table user
+    drop column deleted_at,
+    drop column email_verified;
@@ -0,0 +1,14 @@
+-- +goose Up
+create table user_token
+(
+    token_hash char(64)     not null primary key,
+    user_id    varchar(64)  not null,
+    purpose    varchar(32)  not null,
+    email      varchar(254) not null,
+    expires_at datetime     not null,
+    used_at    datetime     null,
+    index ix_user_token_user (user_id, purpose)
+);
+
+-- +goose Down
+drop table user_token;
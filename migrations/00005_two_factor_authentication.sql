@@ -0,0 +1,21 @@
+-- +goose Up
+alter table user
+    add column totp_secret    varchar(64) not null default '',
+    add column totp_enabled   boolean     not null default false,
+    add column totp_last_step bigint      not null default 0;
+
+create table user_recovery_code
+(
+    user_id   varchar(64) not null,
+    code_hash char(64)    not null,
+    used_at   datetime    null,
+    primary key (user_id, code_hash)
+);
+
+-- +goose Down
+drop table user_recovery_code;
+
+alter table user
+    drop column totp_last_step,
+    drop column totp_enabled,
+    drop column totp_secret;
@@ -0,0 +1,20 @@
+-- +goose Up
+create table api_key
+(
+    id           varchar(64)  not null primary key,
+    owner_id     varchar(64)  not null,
+    name         varchar(100) not null,
+    prefix       varchar(16)  not null,
+    hash         char(64)     not null,
+    scopes       varchar(255) not null,
+    rate_limit   int          not null,
+    created_at   datetime     not null,
+    expires_at   datetime     null,
+    last_used_at datetime     null,
+    revoked_at   datetime     null,
+    unique index uq_api_key_prefix (prefix),
+    index ix_api_key_owner (owner_id)
+);
+
+-- +goose Down
+drop table api_key;
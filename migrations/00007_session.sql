@@ -0,0 +1,16 @@
+-- +goose Up
+create table session
+(
+    id           varchar(64)  not null primary key,
+    user_id      varchar(64)  not null,
+    user_agent   varchar(255) not null,
+    ip           varchar(45)  not null,
+    created_at   datetime     not null,
+    last_seen_at datetime     not null,
+    expires_at   datetime     not null,
+    revoked_at   datetime     null,
+    index ix_session_user (user_id, expires_at)
+);
+
+-- +goose Down
+drop table session;
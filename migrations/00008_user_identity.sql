@@ -0,0 +1,14 @@
+-- +goose Up
+create table user_identity
+(
+    provider   varchar(32)  not null,
+    subject    varchar(255) not null,
+    user_id    varchar(64)  not null,
+    email      varchar(254) not null,
+    created_at datetime     not null,
+    primary key (provider, subject),
+    index ix_user_identity_user (user_id)
+);
+
+-- +goose Down
+drop table user_identity;
@@ -0,0 +1,15 @@
+-- +goose Up
+create table audit_record
+(
+    id         varchar(64)  not null primary key,
+    user_id    varchar(64)  not null,
+    actor_id   varchar(64)  not null default '',
+    action     varchar(255) not null,
+    status     int          not null,
+    created_at datetime     not null,
+    index ix_audit_record_user (user_id, created_at),
+    index ix_audit_record_actor (actor_id, created_at)
+);
+
+-- +goose Down
+drop table audit_record;
@@ -0,0 +1,25 @@
+-- +goose Up
+create table category
+(
+    id        varchar(64)  not null primary key,
+    parent_id varchar(64)  null,
+    slug      varchar(64)  not null,
+    name      varchar(100) not null,
+    position  int          not null default 0,
+    constraint uq_category_slug unique (slug),
+    constraint fk_category_parent foreign key (parent_id) references category (id),
+    index ix_category_parent (parent_id, position)
+);
+
+create table product_category
+(
+    product_id  bigint      not null,
+    category_id varchar(64) not null,
+    primary key (product_id, category_id),
+    constraint fk_product_category_category foreign key (category_id) references category (id) on delete cascade,
+    index ix_product_category_category (category_id)
+);
+
+-- +goose Down
+drop table product_category;
+drop table category;
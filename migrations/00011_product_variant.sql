@@ -0,0 +1,49 @@
+-- +goose Up
+create table product_option
+(
+    id         varchar(64) not null primary key,
+    product_id bigint      not null,
+    name       varchar(50) not null,
+    position   int         not null default 0,
+    constraint uq_product_option_name unique (product_id, name)
+);
+
+create table product_variant
+(
+    id         varchar(64)    not null primary key,
+    product_id bigint         not null,
+    sku        varchar(64)    not null,
+    price      decimal(15, 2) null,
+    stock      int            not null default 0,
+    barcode    varchar(32)    not null default '',
+    constraint uq_product_variant_sku unique (sku),
+    index ix_product_variant_product (product_id)
+);
+
+create table variant_option_value
+(
+    variant_id varchar(64)  not null,
+    option_id  varchar(64)  not null,
+    value      varchar(100) not null,
+    primary key (variant_id, option_id),
+    constraint fk_variant_option_value_variant foreign key (variant_id) references product_variant (id) on delete cascade,
+    constraint fk_variant_option_value_option foreign key (option_id) references product_option (id) on delete cascade
+);
+
+-- every existing product is sold as a single variant, which its past orders refer to
+insert into product_variant (id, product_id, sku, stock)
+select uuid(), id, concat('P', id), stock
+from product;
+
+alter table order_detail
+    add column variant_id varchar(64) null after product_id;
+
+update order_detail od join product_variant v on v.product_id = od.product_id
+set od.variant_id = v.id;
+
+-- +goose Down
+alter table order_detail
+    drop column variant_id;
+drop table variant_option_value;
+drop table product_variant;
+drop table product_option;
@@ -0,0 +1,7 @@
+-- +goose Up
+alter table product
+    add column description varchar(4000) not null default '' after name;
+
+-- +goose Down
+alter table product
+    drop column description;
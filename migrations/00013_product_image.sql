@@ -0,0 +1,14 @@
+-- +goose Up
+create table product_image
+(
+    id         varchar(64) not null primary key,
+    product_id bigint      not null,
+    extension  varchar(8)  not null,
+    width      int         not null,
+    height     int         not null,
+    created_at datetime    not null,
+    index ix_product_image_product (product_id, created_at)
+);
+
+-- +goose Down
+drop table product_image;
@@ -0,0 +1,27 @@
+-- +goose Up
+create table product_review
+(
+    id           varchar(64)   not null primary key,
+    product_id   bigint        not null,
+    user_id      varchar(64)   not null,
+    rating       tinyint       not null,
+    text         varchar(4000) not null,
+    status       varchar(16)   not null,
+    moderated_by varchar(64)   null,
+    created_at   datetime      not null,
+    updated_at   datetime      not null,
+    constraint uq_product_review_user unique (product_id, user_id),
+    index ix_product_review_product (product_id, status, created_at),
+    index ix_product_review_status (status, created_at)
+);
+
+-- the approved reviews are summarized on products, so that listing products does not aggregate reviews
+alter table product
+    add column rating       decimal(3, 2) not null default 0,
+    add column review_count int           not null default 0;
+
+-- +goose Down
+alter table product
+    drop column review_count,
+    drop column rating;
+drop table product_review;
@@ -0,0 +1,46 @@
+-- +goose Up
+-- the stock of variants is the quantity available for sale, the units reserved by unpaid orders being kept apart
+alter table product_variant
+    add column reserved int not null default 0 after stock;
+
+create table inventory_movement
+(
+    id           varchar(64)  not null primary key,
+    variant_id   varchar(64)  not null,
+    product_id   bigint       not null,
+    kind         varchar(16)  not null,
+    quantity     int          not null,
+    reserved     int          not null,
+    reference_id varchar(64)  not null,
+    note         varchar(255) not null default '',
+    created_by   varchar(64)  null,
+    created_at   datetime     not null,
+    index ix_inventory_movement_variant (variant_id, created_at),
+    index ix_inventory_movement_reference (reference_id)
+);
+
+create table stock_reservation
+(
+    order_id   varchar(64) not null,
+    variant_id varchar(64) not null,
+    product_id bigint      not null,
+    quantity   int         not null,
+    status     varchar(16) not null,
+    expires_at datetime    not null,
+    created_at datetime    not null,
+    updated_at datetime    not null,
+    primary key (order_id, variant_id),
+    index ix_stock_reservation_status (status, expires_at)
+);
+
+-- the stock of existing variants opens their ledger
+insert into inventory_movement (id, variant_id, product_id, kind, quantity, reserved, reference_id, note, created_at)
+select uuid(), id, product_id, 'adjustment', stock, 0, 'opening-balance', 'Stock before the inventory ledger', now()
+from product_variant
+where stock <> 0;
+
+-- +goose Down
+drop table stock_reservation;
+drop table inventory_movement;
+alter table product_variant
+    drop column reserved;
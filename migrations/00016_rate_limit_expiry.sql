@@ -0,0 +1,10 @@
+-- +goose Up
+-- buckets are purged once they would have been refilled completely, as they are then equivalent to missing ones
+alter table rate_limit
+    add column full_at datetime(6) not null default current_timestamp(6) after updated_at,
+    add index ix_rate_limit_full_at (full_at);
+
+-- +goose Down
+alter table rate_limit
+    drop index ix_rate_limit_full_at,
+    drop column full_at;
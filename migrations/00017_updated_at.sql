@@ -0,0 +1,17 @@
+-- +goose Up
+-- products are touched whenever they, or their options, variants or images, change
+alter table product
+    add column updated_at datetime not null default current_timestamp on update current_timestamp;
+
+alter table orders
+    add column updated_at datetime null;
+update orders
+set updated_at = coalesce(delivered_date, payment_date, order_date, current_timestamp);
+alter table orders
+    modify updated_at datetime not null;
+
+-- +goose Down
+alter table orders
+    drop column updated_at;
+alter table product
+    drop column updated_at;
@@ -0,0 +1,108 @@
+// Package blobtest provides a minimal S3-compatible service for tests, keeping objects in memory on a local
+// HTTP server.
+package blobtest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+// Object is an object stored by the fake service.
+type Object struct {
+	Data        []byte
+	ContentType string
+}
+
+// S3Server serves the PUT, GET and DELETE object operations of a single bucket, addressed path-style.
+// Requests must be signed with the access key of the server and have the hash of their body in
+// X-Amz-Content-Sha256; signatures themselves are not verified.
+type S3Server struct {
+	Bucket    string
+	AccessKey string
+
+	server *httptest.Server
+
+	mu      sync.Mutex
+	objects map[string]Object
+}
+
+// NewS3Server starts a fake service, which must be closed once done.
+func NewS3Server(bucket, accessKey string) *S3Server {
+	s := &S3Server{Bucket: bucket, AccessKey: accessKey, objects: map[string]Object{}}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// URL returns the endpoint of the service.
+func (s *S3Server) URL() string {
+	return s.server.URL
+}
+
+// Close shuts the service down.
+func (s *S3Server) Close() {
+	s.server.Close()
+}
+
+// Object returns the object having the given key.
+func (s *S3Server) Object(key string) (Object, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	object, ok := s.objects[key]
+	return object, ok
+}
+
+// Len returns the number of objects in the bucket.
+func (s *S3Server) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.objects)
+}
+
+func (s *S3Server) serve(w http.ResponseWriter, r *http.Request) {
+	prefix := "/" + s.Bucket + "/"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		http.Error(w, "NoSuchBucket", http.StatusNotFound)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, prefix)
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sum := sha256.Sum256(body)
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential="+s.AccessKey+"/") {
+		http.Error(w, "InvalidAccessKeyId", http.StatusForbidden)
+		return
+	}
+	if r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(sum[:]) {
+		http.Error(w, "XAmzContentSHA256Mismatch", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		s.objects[key] = Object{Data: body, ContentType: r.Header.Get("Content-Type")}
+	case http.MethodGet:
+		object, ok := s.objects[key]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", object.ContentType)
+		w.Write(object.Data)
+	case http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "MethodNotAllowed", http.StatusMethodNotAllowed)
+	}
+}
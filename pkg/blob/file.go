@@ -0,0 +1,99 @@
+// Package blob stores binary objects, such as images, and tells the public URLs they are served at.
+package blob
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// checkKey checks that a key is a relative slash-separated path which stays inside the store.
+func checkKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return fmt.Errorf("invalid blob key %q", key)
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return fmt.Errorf("invalid blob key %q", key)
+		}
+	}
+	return nil
+}
+
+// joinURL returns the URL of a key under a base URL.
+func joinURL(baseURL, key string) string {
+	return strings.TrimSuffix(baseURL, "/") + "/" + key
+}
+
+// FileStore keeps blobs as files in a directory, for local development or servers sharing a volume.
+// The directory must be served at the base URL, e.g. by the HTTP server or a reverse proxy.
+type FileStore struct {
+	dir     string
+	baseURL string
+}
+
+// NewFileStore creates a store keeping blobs in the given directory, which is created if needed.
+func NewFileStore(dir, baseURL string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir, baseURL: baseURL}, nil
+}
+
+// Put writes a blob, replacing the one having the same key if any. The content type is implied by the extension
+// of the key when the blob is served.
+func (s *FileStore) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	path := filepath.Join(s.dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	// written to a temporary file first, so that readers never see a partial blob
+	file, err := ioutil.TempFile(filepath.Dir(path), ".blob-*")
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	if err := os.Chmod(file.Name(), 0644); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// Get reads a blob.
+func (s *FileStore) Get(ctx context.Context, key string) ([]byte, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(filepath.Join(s.dir, filepath.FromSlash(key)))
+}
+
+// Delete removes a blob. Removing a missing blob is not an error.
+func (s *FileStore) Delete(ctx context.Context, key string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(s.dir, filepath.FromSlash(key))); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// URL returns the public URL of a blob.
+func (s *FileStore) URL(key string) string {
+	return joinURL(s.baseURL, key)
+}
@@ -0,0 +1,108 @@
+package blob
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// S3Store keeps blobs in a bucket of an S3-compatible service, such as Amazon S3 or MinIO, addressed path-style.
+// The bucket must be publicly readable at the base URL, directly or through a CDN.
+type S3Store struct {
+	client      *http.Client
+	endpoint    string
+	region      string
+	bucket      string
+	credentials Credentials
+	baseURL     string
+	now         func() time.Time
+}
+
+// NewS3Store creates a store keeping blobs in the given bucket. The endpoint is the base URL of the service,
+// e.g. "https://s3.eu-west-1.amazonaws.com".
+func NewS3Store(client *http.Client, endpoint, region, bucket string, credentials Credentials, baseURL string) *S3Store {
+	return &S3Store{
+		client:      client,
+		endpoint:    strings.TrimSuffix(endpoint, "/"),
+		region:      region,
+		bucket:      bucket,
+		credentials: credentials,
+		baseURL:     baseURL,
+		now:         time.Now,
+	}
+}
+
+// do sends a signed request about the object having the given key.
+func (s *S3Store) do(ctx context.Context, method, key string, body []byte, contentType string) (*http.Response, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, s.endpoint+"/"+s.bucket+"/"+uriEncode(key, false), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	signV4(req, hashHex(body), s.credentials, s.region, "s3", s.now())
+	return s.client.Do(req)
+}
+
+// check returns an error if the service did not answer with a success.
+func check(res *http.Response, operation, key string) error {
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return nil
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+	return fmt.Errorf("s3 %s %s: %s: %s", operation, key, res.Status, bytes.TrimSpace(body))
+}
+
+// Put uploads a blob, replacing the one having the same key if any.
+func (s *S3Store) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	res, err := s.do(ctx, http.MethodPut, key, data, contentType)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return check(res, "put", key)
+}
+
+// Get downloads a blob. It returns an error satisfying os.IsNotExist if there is no such blob.
+func (s *S3Store) Get(ctx context.Context, key string) ([]byte, error) {
+	res, err := s.do(ctx, http.MethodGet, key, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, &os.PathError{Op: "get", Path: key, Err: os.ErrNotExist}
+	}
+	if err := check(res, "get", key); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(res.Body)
+}
+
+// Delete removes a blob. Removing a missing blob is not an error.
+func (s *S3Store) Delete(ctx context.Context, key string) error {
+	res, err := s.do(ctx, http.MethodDelete, key, nil, "")
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	return check(res, "delete", key)
+}
+
+// URL returns the public URL of a blob.
+func (s *S3Store) URL(key string) string {
+	return joinURL(s.baseURL, uriEncode(key, false))
+}
@@ -0,0 +1,118 @@
+// Package cache provides caches of serialized values: an in-process LRU cache whose values expire, a cache shared by
+// server instances through a Redis-compatible server, and Cache combining both in front of slower loads.
+package cache
+
+import (
+	"context"
+	"github.com/online-shop/pkg/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"sync/atomic"
+	"time"
+)
+
+var lookups = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "cache_lookups_total",
+	Help: "Number of cache lookups, labeled by cache and by where the value was found: local, shared or miss.",
+}, []string{"cache", "result"})
+
+// Shared is a cache shared by server instances, such as a Redis server.
+type Shared interface {
+	// Get returns the value of key, or nil if there is none.
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Set sets the value of key, which expires after ttl.
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// Delete removes the values of the given keys.
+	Delete(ctx context.Context, keys ...string) error
+}
+
+// Cache looks values up in an in-process cache, then in a shared cache, and loads them on misses, storing them in
+// both caches. Concurrent misses of the same key share a single load. Either cache may be missing.
+//
+// The shared cache is a best effort: its failures are logged and taken as misses, so that the values are loaded
+// instead.
+type Cache struct {
+	// generation changes whenever values are deleted, so that values loaded before are not stored afterwards. It
+	// comes first for 64-bit atomic operations to be aligned on 32-bit platforms.
+	generation uint64
+
+	name   string
+	local  *LRU
+	shared Shared
+	ttl    time.Duration
+	logger log.Logger
+
+	calls group
+}
+
+// New creates a cache named after what it keeps. The values stored in the shared cache expire after ttl.
+func New(name string, local *LRU, shared Shared, ttl time.Duration, logger log.Logger) *Cache {
+	return &Cache{name: name, local: local, shared: shared, ttl: ttl, logger: logger}
+}
+
+// Fetch returns the value of key, calling load to get it on misses. The errors of load are returned as is, and
+// nothing is cached then. Concurrent callers share the outcome of the load made with the context of the first one.
+func (c *Cache) Fetch(ctx context.Context, key string, load func(ctx context.Context) ([]byte, error)) ([]byte, error) {
+	if c.local != nil {
+		if value, ok := c.local.Get(key); ok {
+			lookups.WithLabelValues(c.name, "local").Inc()
+			return value, nil
+		}
+	}
+	return c.calls.do(key, func() ([]byte, error) {
+		generation := atomic.LoadUint64(&c.generation)
+		if c.shared != nil {
+			value, err := c.shared.Get(ctx, key)
+			if err != nil {
+				c.logger.With(ctx, "cache", c.name).Errorf("failed to get %s from the shared cache: %v", key, err)
+			} else if value != nil {
+				lookups.WithLabelValues(c.name, "shared").Inc()
+				c.store(ctx, key, value, generation, false)
+				return value, nil
+			}
+		}
+		lookups.WithLabelValues(c.name, "miss").Inc()
+		value, err := load(ctx)
+		if err != nil {
+			return nil, err
+		}
+		c.store(ctx, key, value, generation, true)
+		return value, nil
+	})
+}
+
+// store keeps a value fetched while the cache was at the given generation, unless values were deleted since, as
+// the value may be one of them.
+func (c *Cache) store(ctx context.Context, key string, value []byte, generation uint64, shared bool) {
+	if atomic.LoadUint64(&c.generation) != generation {
+		return
+	}
+	if c.local != nil {
+		c.local.Set(key, value)
+	}
+	if shared && c.shared != nil {
+		if err := c.shared.Set(ctx, key, value, c.ttl); err != nil {
+			c.logger.With(ctx, "cache", c.name).Errorf("failed to set %s in the shared cache: %v", key, err)
+		}
+	}
+}
+
+// Delete removes the values of the given keys from both caches, which must be called whenever they change. The
+// values loaded concurrently are not cached, since they may predate the change.
+func (c *Cache) Delete(ctx context.Context, keys ...string) {
+	if len(keys) == 0 {
+		return
+	}
+	atomic.AddUint64(&c.generation, 1)
+	for _, key := range keys {
+		c.calls.forget(key)
+	}
+	if c.local != nil {
+		c.local.Delete(keys...)
+	}
+	if c.shared != nil {
+		if err := c.shared.Delete(ctx, keys...); err != nil {
+			c.logger.With(ctx, "cache", c.name).Errorf("failed to delete %v from the shared cache: %v", keys, err)
+		}
+	}
+}
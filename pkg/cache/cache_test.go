@@ -0,0 +1,171 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"github.com/online-shop/pkg/log"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLRU(t *testing.T) {
+	now := time.Now()
+	c := NewLRU(2, time.Minute)
+	c.now = func() time.Time { return now }
+
+	c.Set("a", []byte("1"))
+	c.Set("b", []byte("2"))
+	value, ok := c.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, "1", string(value))
+
+	// b is the least recently used
+	c.Set("c", []byte("3"))
+	_, ok = c.Get("b")
+	assert.False(t, ok)
+	assert.Equal(t, 2, c.Len())
+
+	c.Set("a", []byte("4"))
+	value, _ = c.Get("a")
+	assert.Equal(t, "4", string(value))
+
+	c.Delete("a", "unknown")
+	_, ok = c.Get("a")
+	assert.False(t, ok)
+
+	now = now.Add(time.Minute)
+	_, ok = c.Get("c")
+	assert.False(t, ok, "values expire")
+	assert.Equal(t, 0, c.Len())
+
+	c = NewLRU(0, time.Minute)
+	c.Set("a", []byte("1"))
+	assert.Equal(t, 0, c.Len())
+}
+
+// memoryShared is a shared cache kept in memory, which may be made to fail.
+type memoryShared struct {
+	mu     sync.Mutex
+	values map[string][]byte
+	err    error
+}
+
+func (m *memoryShared) Get(ctx context.Context, key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.values[key], m.err
+}
+
+func (m *memoryShared) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err == nil {
+		m.values[key] = value
+	}
+	return m.err
+}
+
+func (m *memoryShared) Delete(ctx context.Context, keys ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, key := range keys {
+		delete(m.values, key)
+	}
+	return m.err
+}
+
+func TestCache_Fetch(t *testing.T) {
+	logger, entries := log.NewForTest()
+	shared := &memoryShared{values: map[string][]byte{}}
+	c := New("test", NewLRU(10, time.Minute), shared, time.Minute, logger)
+	ctx := context.Background()
+	loads := 0
+	load := func(ctx context.Context) ([]byte, error) {
+		loads++
+		return []byte("value"), nil
+	}
+
+	value, err := c.Fetch(ctx, "key", load)
+	assert.Nil(t, err)
+	assert.Equal(t, "value", string(value))
+	assert.Equal(t, "value", string(shared.values["key"]))
+	_, _ = c.Fetch(ctx, "key", load)
+	assert.Equal(t, 1, loads, "the value is cached locally")
+
+	// another server instance finds the value in the shared cache
+	other := New("test", NewLRU(10, time.Minute), shared, time.Minute, logger)
+	value, _ = other.Fetch(ctx, "key", load)
+	assert.Equal(t, "value", string(value))
+	assert.Equal(t, 1, loads)
+
+	c.Delete(ctx, "key")
+	assert.Empty(t, shared.values)
+	_, _ = c.Fetch(ctx, "key", load)
+	assert.Equal(t, 2, loads)
+
+	_, err = c.Fetch(ctx, "failing", func(ctx context.Context) ([]byte, error) {
+		return nil, errors.New("failed")
+	})
+	assert.NotNil(t, err)
+	_, ok := shared.values["failing"]
+	assert.False(t, ok, "errors are not cached")
+
+	// failures of the shared cache are logged, and the values loaded
+	shared.err = errors.New("unavailable")
+	value, err = New("test", nil, shared, time.Minute, logger).Fetch(ctx, "key", load)
+	assert.Nil(t, err)
+	assert.Equal(t, "value", string(value))
+	assert.Equal(t, 3, loads)
+	assert.Equal(t, 2, entries.Len())
+}
+
+func TestCache_FetchConcurrently(t *testing.T) {
+	logger, _ := log.NewForTest()
+	c := New("test", NewLRU(10, time.Minute), nil, time.Minute, logger)
+	ctx := context.Background()
+	release := make(chan struct{})
+	var mu sync.Mutex
+	loads := 0
+	load := func(ctx context.Context) ([]byte, error) {
+		mu.Lock()
+		loads++
+		mu.Unlock()
+		<-release
+		return []byte("value"), nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, err := c.Fetch(ctx, "key", load)
+			assert.Nil(t, err)
+			assert.Equal(t, "value", string(value))
+		}()
+	}
+	// lets the goroutines reach the load before releasing it
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(t, 1, loads, "concurrent misses share a single load")
+}
+
+func TestCache_DeleteWhileLoading(t *testing.T) {
+	logger, _ := log.NewForTest()
+	c := New("test", NewLRU(10, time.Minute), nil, time.Minute, logger)
+	ctx := context.Background()
+
+	value, _ := c.Fetch(ctx, "key", func(ctx context.Context) ([]byte, error) {
+		// the value changes while the previous one is being loaded
+		c.Delete(ctx, "key")
+		return []byte("stale"), nil
+	})
+	assert.Equal(t, "stale", string(value))
+	value, _ = c.Fetch(ctx, "key", func(ctx context.Context) ([]byte, error) {
+		return []byte("fresh"), nil
+	})
+	assert.Equal(t, "fresh", string(value), "values loaded before a deletion are not cached")
+}
@@ -0,0 +1,212 @@
+// Package cachetest provides a minimal Redis-compatible server for tests, keeping values in memory.
+package cachetest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RedisServer serves the AUTH, SELECT, PING, GET, SET (with the EX and PX options) and DEL commands on a local
+// TCP port. Databases are not told apart.
+type RedisServer struct {
+	// Password is the password clients must authenticate with, if any.
+	Password string
+
+	listener net.Listener
+
+	mu       sync.Mutex
+	values   map[string]entry
+	commands []string
+	now      func() time.Time
+}
+
+// entry is a value kept by the server.
+type entry struct {
+	value   []byte
+	expires time.Time
+}
+
+// NewRedisServer starts a fake server requiring the given password, if any, which must be closed once done.
+func NewRedisServer(password string) (*RedisServer, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &RedisServer{Password: password, listener: listener, values: map[string]entry{}, now: time.Now}
+	go s.serve()
+	return s, nil
+}
+
+// URL returns the URL clients connect to the server with.
+func (s *RedisServer) URL() string {
+	if s.Password != "" {
+		return "redis://:" + s.Password + "@" + s.listener.Addr().String()
+	}
+	return "redis://" + s.listener.Addr().String()
+}
+
+// Close stops the server.
+func (s *RedisServer) Close() error {
+	return s.listener.Close()
+}
+
+// Value returns the value of key, and whether there is one.
+func (s *RedisServer) Value(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.values[key]
+	if !ok || !e.expires.IsZero() && !s.now().Before(e.expires) {
+		return nil, false
+	}
+	return e.value, true
+}
+
+// Commands returns the names of the commands received so far, in order.
+func (s *RedisServer) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.commands...)
+}
+
+// Advance moves the clock of the server forward, for values to expire.
+func (s *RedisServer) Advance(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	s.now = func() time.Time { return now.Add(d) }
+}
+
+func (s *RedisServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+// handle answers the commands sent on a connection until it is closed.
+func (s *RedisServer) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	authenticated := s.Password == ""
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		if len(args) == 0 {
+			fmt.Fprint(conn, "-ERR invalid command\r\n")
+			continue
+		}
+		command := strings.ToUpper(args[0])
+		switch {
+		case command == "AUTH":
+			if authenticated = args[len(args)-1] == s.Password; !authenticated {
+				fmt.Fprint(conn, "-WRONGPASS invalid password\r\n")
+				continue
+			}
+			fmt.Fprint(conn, "+OK\r\n")
+		case !authenticated:
+			fmt.Fprint(conn, "-NOAUTH Authentication required.\r\n")
+		default:
+			fmt.Fprint(conn, s.execute(command, args[1:]))
+		}
+	}
+}
+
+// readCommand reads a command sent as an array of bulk strings.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	n, err := readLength(r, '*')
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		size, err := readLength(r, '$')
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		args[i] = string(data[:size])
+	}
+	return args, nil
+}
+
+// readLength reads a line made of the given prefix and of a length.
+func readLength(r *bufio.Reader, prefix byte) (int, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return 0, err
+	}
+	if len(line) < 3 || line[0] != prefix {
+		return 0, fmt.Errorf("unexpected line %q", line)
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(line[1:], "\r\n"))
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("unexpected line %q", line)
+	}
+	return n, nil
+}
+
+// execute runs a command and returns its encoded reply.
+func (s *RedisServer) execute(command string, args []string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.commands = append(s.commands, command)
+	now := s.now()
+	switch {
+	case command == "PING":
+		return "+PONG\r\n"
+	case command == "SELECT" && len(args) == 1:
+		return "+OK\r\n"
+	case command == "GET" && len(args) == 1:
+		e, ok := s.values[args[0]]
+		if !ok || !e.expires.IsZero() && !now.Before(e.expires) {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(e.value), e.value)
+	case command == "SET" && (len(args) == 2 || len(args) == 4):
+		e := entry{value: []byte(args[1])}
+		if len(args) == 4 {
+			n, err := strconv.Atoi(args[3])
+			if err != nil || n <= 0 {
+				return "-ERR invalid expire time in 'set' command\r\n"
+			}
+			switch strings.ToUpper(args[2]) {
+			case "EX":
+				e.expires = now.Add(time.Duration(n) * time.Second)
+			case "PX":
+				e.expires = now.Add(time.Duration(n) * time.Millisecond)
+			default:
+				return "-ERR syntax error\r\n"
+			}
+		}
+		s.values[args[0]] = e
+		return "+OK\r\n"
+	case command == "DEL" && len(args) > 0:
+		deleted := 0
+		for _, key := range args {
+			if _, ok := s.values[key]; ok {
+				delete(s.values, key)
+				deleted++
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", deleted)
+	}
+	return fmt.Sprintf("-ERR unknown command or wrong number of arguments for '%s'\r\n", command)
+}
@@ -0,0 +1,59 @@
+package cache
+
+import (
+	"errors"
+	"sync"
+)
+
+// errPanicked is returned to the callers waiting for a call which panicked.
+var errPanicked = errors.New("cache: load panicked")
+
+// call is a load in progress or completed.
+type call struct {
+	wg    sync.WaitGroup
+	value []byte
+	err   error
+}
+
+// group de-duplicates concurrent loads of the same key: while a load is in progress, the callers asking for the
+// same key wait for its result instead of loading the value again.
+type group struct {
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+// do calls fn, unless a call for the same key is in progress, in which case it waits for the result of that call.
+func (g *group) do(key string, fn func() ([]byte, error)) ([]byte, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = map[string]*call{}
+	}
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		c.wg.Wait()
+		return c.value, c.err
+	}
+	c := &call{err: errPanicked}
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		if g.calls[key] == c {
+			delete(g.calls, key)
+		}
+		g.mu.Unlock()
+		c.wg.Done()
+	}()
+	c.value, c.err = fn()
+	return c.value, c.err
+}
+
+// forget makes the next callers asking for key start a new call, rather than waiting for the one in progress,
+// which may return a value loaded before it changed.
+func (g *group) forget(key string) {
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+}
@@ -0,0 +1,216 @@
+// Package httpcache provides middlewares setting the HTTP caching headers of responses.
+package httpcache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	routing "github.com/go-ozzo/ozzo-routing/v2"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// headerWriter calls a function right before the response headers are written.
+type headerWriter struct {
+	http.ResponseWriter
+	before  func(status int)
+	written bool
+}
+
+func (w *headerWriter) WriteHeader(status int) {
+	if !w.written {
+		w.written = true
+		w.before(status)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *headerWriter) Write(p []byte) (int, error) {
+	if !w.written {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// beforeHeaders makes the context call before right before the response headers are written, once the status
+// of the response is known.
+func beforeHeaders(c *routing.Context, before func(status int)) {
+	c.Response = &headerWriter{ResponseWriter: c.Response, before: before}
+}
+
+// cacheable tells whether the caching headers apply to responses having the given status. Not modified responses
+// carry the same caching headers as the full responses they stand for.
+func cacheable(status int) bool {
+	return status == http.StatusOK || status == http.StatusNotModified
+}
+
+// Public returns a middleware letting caches keep successful responses for maxAge. The responses to anonymous
+// requests may be kept by shared caches, such as CDNs, while those to requests having any of the given
+// credential headers are only kept by the client. Responses vary by the credential headers, so that shared
+// caches never serve anonymous responses to authenticated requests, which may be refused.
+func Public(maxAge time.Duration, credentialHeaders ...string) routing.Handler {
+	vary := strings.Join(credentialHeaders, ", ")
+	return func(c *routing.Context) error {
+		if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead {
+			return nil
+		}
+		scope := "public"
+		for _, header := range credentialHeaders {
+			if c.Request.Header.Get(header) != "" {
+				scope = "private"
+			}
+		}
+		beforeHeaders(c, func(status int) {
+			if !cacheable(status) || c.Response.Header().Get("Cache-Control") != "" {
+				return
+			}
+			c.Response.Header().Set("Cache-Control", fmt.Sprintf("%s, max-age=%d", scope, int(maxAge.Seconds())))
+			if vary != "" {
+				c.Response.Header().Add("Vary", vary)
+			}
+		})
+		return nil
+	}
+}
+
+// CacheControl returns a middleware setting the Cache-Control header of successful responses to value, unless the
+// handler set it already. It is meant for single routes, to override the policy of their group.
+func CacheControl(value string) routing.Handler {
+	return func(c *routing.Context) error {
+		beforeHeaders(c, func(status int) {
+			if cacheable(status) && c.Response.Header().Get("Cache-Control") == "" {
+				c.Response.Header().Set("Cache-Control", value)
+			}
+		})
+		return nil
+	}
+}
+
+// SetLastModified sets the Last-Modified header to the given time, unless it is unknown.
+func SetLastModified(header http.Header, t time.Time) {
+	if !t.IsZero() {
+		header.Set("Last-Modified", t.UTC().Format(http.TimeFormat))
+	}
+}
+
+// StrongETag returns a strong entity tag identifying the given representation of a resource.
+func StrongETag(data []byte) string {
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// Match tells whether header, the value of an If-Match header, matches the entity tag. Strong comparison is used,
+// so weak entity tags never match.
+func Match(header, etag string) bool {
+	return matches(header, etag, false)
+}
+
+// matches tells whether etag is one of the comma-separated entity tags of header, or whether header is "*". The
+// weak comparison ignores the W/ prefix of weak entity tags, while the strong one never matches them.
+func matches(header, etag string, weak bool) bool {
+	if strings.TrimSpace(header) == "*" {
+		return etag != ""
+	}
+	if strings.HasPrefix(etag, "W/") {
+		if !weak {
+			return false
+		}
+		etag = etag[2:]
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if strings.HasPrefix(tag, "W/") {
+			if !weak {
+				continue
+			}
+			tag = tag[2:]
+		}
+		if tag != "" && tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// bufferedWriter keeps the response in memory, so that it can be replaced by a not modified response.
+type bufferedWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *bufferedWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferedWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *bufferedWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(p)
+}
+
+// ETag returns a middleware tagging the successful responses to GET and HEAD requests with a strong entity tag
+// computed from their body, unless the handler set the ETag header already. Conditional requests whose
+// If-None-Match header matches the entity tag, or whose If-Modified-Since header is not older than the
+// Last-Modified header set by the handler, get a not modified response without body. Since the responses are
+// buffered, the middleware must not be used for streamed responses.
+func ETag() routing.Handler {
+	return func(c *routing.Context) error {
+		if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead {
+			return nil
+		}
+		w := c.Response
+		buf := &bufferedWriter{header: w.Header()}
+		c.Response = buf
+		// errors are written by an outer middleware, which must not write them in the buffer, even on panics
+		defer func() { c.Response = w }()
+		if err := c.Next(); err != nil {
+			return err
+		}
+
+		status := buf.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		if status == http.StatusOK {
+			if w.Header().Get("ETag") == "" {
+				w.Header().Set("ETag", StrongETag(buf.body.Bytes()))
+			}
+			if notModified(c.Request, w.Header()) {
+				w.Header().Del("Content-Type")
+				w.Header().Del("Content-Length")
+				w.WriteHeader(http.StatusNotModified)
+				return nil
+			}
+		}
+		w.WriteHeader(status)
+		_, err := w.Write(buf.body.Bytes())
+		return err
+	}
+}
+
+// notModified tells whether the conditional headers of a request show that the client has the representation
+// described by the given response headers already. If-Modified-Since is ignored when If-None-Match is sent.
+func notModified(req *http.Request, header http.Header) bool {
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		return matches(inm, header.Get("ETag"), true)
+	}
+	ims, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(header.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+	return !lastModified.After(ims)
+}
@@ -0,0 +1,125 @@
+package httpcache
+
+import (
+	routing "github.com/go-ozzo/ozzo-routing/v2"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPublic(t *testing.T) {
+	router := routing.New()
+	router.Use(Public(time.Minute, "Authorization", "X-API-Key"))
+	router.Get("/products", func(c *routing.Context) error {
+		return c.Write("products")
+	})
+	router.Get("/missing", func(c *routing.Context) error {
+		return routing.NewHTTPError(http.StatusNotFound)
+	})
+	router.Get("/private", func(c *routing.Context) error {
+		c.Response.Header().Set("Cache-Control", "no-store")
+		return c.Write("private")
+	})
+	serve := func(path string, header http.Header) http.Header {
+		res := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		if header != nil {
+			req.Header = header
+		}
+		router.ServeHTTP(res, req)
+		return res.Header()
+	}
+
+	header := serve("/products", nil)
+	assert.Equal(t, "public, max-age=60", header.Get("Cache-Control"))
+	assert.Equal(t, "Authorization, X-API-Key", header.Get("Vary"))
+	header = serve("/products", http.Header{"X-Api-Key": {"key"}})
+	assert.Equal(t, "private, max-age=60", header.Get("Cache-Control"))
+	assert.Empty(t, serve("/missing", nil).Get("Cache-Control"), "errors are not cached")
+	assert.Equal(t, "no-store", serve("/private", nil).Get("Cache-Control"), "handlers choose otherwise")
+}
+
+func TestETag(t *testing.T) {
+	lastModified := time.Date(2020, 5, 1, 10, 0, 0, 0, time.UTC)
+	router := routing.New()
+	router.Use(func(c *routing.Context) error {
+		if err := c.Next(); err != nil {
+			c.Response.WriteHeader(http.StatusNotFound)
+			_, _ = c.Response.Write([]byte("error"))
+		}
+		return nil
+	})
+	router.Use(Public(time.Minute), ETag())
+	router.Get("/products", func(c *routing.Context) error {
+		return c.Write("products")
+	})
+	router.Get("/products/1", func(c *routing.Context) error {
+		c.Response.Header().Set("ETag", `"v1"`)
+		c.Response.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+		return c.Write("product")
+	})
+	router.Get("/missing", func(c *routing.Context) error {
+		return routing.NewHTTPError(http.StatusNotFound)
+	})
+	router.Get("/orders/1", CacheControl("private, no-cache"), func(c *routing.Context) error {
+		return c.Write("order")
+	})
+	serve := func(path string, header http.Header) *httptest.ResponseRecorder {
+		res := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		if header != nil {
+			req.Header = header
+		}
+		router.ServeHTTP(res, req)
+		return res
+	}
+
+	res := serve("/products", nil)
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "products", res.Body.String())
+	etag := res.Header().Get("ETag")
+	assert.Equal(t, StrongETag([]byte("products")), etag)
+
+	res = serve("/products", http.Header{"If-None-Match": {`"other", ` + etag}})
+	assert.Equal(t, http.StatusNotModified, res.Code)
+	assert.Empty(t, res.Body.String())
+	assert.Empty(t, res.Header().Get("Content-Type"))
+	assert.Equal(t, etag, res.Header().Get("ETag"))
+	assert.Equal(t, "public, max-age=60", res.Header().Get("Cache-Control"))
+	assert.Equal(t, http.StatusNotModified, serve("/products", http.Header{"If-None-Match": {"W/" + etag}}).Code)
+	assert.Equal(t, http.StatusNotModified, serve("/products", http.Header{"If-None-Match": {"*"}}).Code)
+	assert.Equal(t, http.StatusOK, serve("/products", http.Header{"If-None-Match": {`"other"`}}).Code)
+
+	res = serve("/products/1", http.Header{"If-Modified-Since": {lastModified.Format(http.TimeFormat)}})
+	assert.Equal(t, http.StatusNotModified, res.Code)
+	assert.Equal(t, `"v1"`, res.Header().Get("ETag"), "handlers may choose the entity tag")
+	res = serve("/products/1", http.Header{"If-Modified-Since": {lastModified.Add(-time.Hour).Format(http.TimeFormat)}})
+	assert.Equal(t, http.StatusOK, res.Code)
+	res = serve("/products/1", http.Header{"If-None-Match": {`"v0"`}, "If-Modified-Since": {lastModified.Format(http.TimeFormat)}})
+	assert.Equal(t, http.StatusOK, res.Code, "If-None-Match takes precedence")
+	assert.Equal(t, http.StatusOK, serve("/products", http.Header{"If-Modified-Since": {time.Now().Format(http.TimeFormat)}}).Code)
+
+	res = serve("/missing", http.Header{"If-None-Match": {"*"}})
+	assert.Equal(t, http.StatusNotFound, res.Code)
+	assert.Equal(t, "error", res.Body.String())
+	assert.Empty(t, res.Header().Get("ETag"))
+
+	res = serve("/orders/1", nil)
+	assert.Equal(t, "private, no-cache", res.Header().Get("Cache-Control"))
+	res = serve("/orders/1", http.Header{"If-None-Match": {res.Header().Get("ETag")}})
+	assert.Equal(t, http.StatusNotModified, res.Code)
+	assert.Equal(t, "private, no-cache", res.Header().Get("Cache-Control"))
+}
+
+func TestMatch(t *testing.T) {
+	assert.True(t, Match(`"a"`, `"a"`))
+	assert.True(t, Match(`"b", "a"`, `"a"`))
+	assert.True(t, Match("*", `"a"`))
+	assert.False(t, Match(`"b"`, `"a"`))
+	assert.False(t, Match(`W/"a"`, `"a"`), "weak entity tags never match strongly")
+	assert.False(t, Match(`"a"`, `W/"a"`))
+	assert.False(t, Match("*", ""))
+	assert.False(t, Match("", ""))
+}
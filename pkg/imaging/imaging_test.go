@@ -0,0 +1,63 @@
+package imaging
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+// newImage returns an image of the given size, red on its left half and transparent on its right half.
+func newImage(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w/2; x++ {
+			img.Set(x, y, color.NRGBA{R: 255, A: 255})
+		}
+	}
+	return img
+}
+
+func encodePNG(img image.Image) []byte {
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	return buf.Bytes()
+}
+
+func TestDecode(t *testing.T) {
+	img, contentType, err := Decode(encodePNG(newImage(40, 20)), 1000)
+	assert.Nil(t, err)
+	assert.Equal(t, "image/png", contentType)
+	assert.Equal(t, image.Rect(0, 0, 40, 20), img.Bounds())
+
+	_, _, err = Decode(encodePNG(newImage(40, 30)), 1000)
+	assert.Equal(t, ErrTooLarge, err)
+	_, _, err = Decode([]byte("<svg xmlns=\"http://www.w3.org/2000/svg\"/>"), 1000)
+	assert.Equal(t, ErrUnsupportedFormat, err)
+	_, _, err = Decode(encodePNG(newImage(40, 20))[:100], 1000)
+	assert.Equal(t, ErrUnsupportedFormat, err, "truncated images are refused")
+}
+
+func TestFit(t *testing.T) {
+	img := newImage(400, 200)
+	assert.Equal(t, image.Rect(0, 0, 100, 50), Fit(img, 100).Bounds())
+	assert.Equal(t, image.Rect(0, 0, 50, 100), Fit(newImage(200, 400), 100).Bounds())
+	assert.Equal(t, image.Rect(0, 0, 100, 1), Fit(newImage(1000, 2), 100).Bounds())
+	assert.Equal(t, img, Fit(img, 400), "images already fitting are unchanged")
+
+	thumbnail := Fit(img, 100)
+	assert.Equal(t, color.NRGBA{R: 255, A: 255}, color.NRGBAModel.Convert(thumbnail.At(10, 10)))
+	assert.Equal(t, uint8(0), color.NRGBAModel.Convert(thumbnail.At(90, 10)).(color.NRGBA).A)
+}
+
+func TestJPEG(t *testing.T) {
+	data, err := JPEG(Fit(newImage(400, 200), 100), 85)
+	assert.Nil(t, err)
+	img, contentType, err := Decode(data, 1000000)
+	assert.Nil(t, err)
+	assert.Equal(t, "image/jpeg", contentType)
+	r, g, b, _ := img.At(90, 10).RGBA()
+	assert.True(t, r > 0xf000 && g > 0xf000 && b > 0xf000, "transparent areas become white")
+}
@@ -0,0 +1,83 @@
+package jwk
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// keyFileExt is the extension of the files keys are stored in, which are named after the key ID.
+const keyFileExt = ".pem"
+
+// LoadDir loads the keys stored in the given directory.
+func LoadDir(dir string) ([]Key, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*"+keyFileExt))
+	if err != nil {
+		return nil, err
+	}
+	var keys []Key
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		key, err := ParsePEM(strings.TrimSuffix(filepath.Base(file), keyFileExt), data)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// Save stores the given key into the given directory, which is created if needed.
+func Save(dir string, key Key) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	data, err := key.MarshalPEM()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, key.ID+keyFileExt), data, 0600)
+}
+
+// Rotate introduces a new key for the given algorithm into the given directory. It then removes the keys
+// which stopped signing tokens more than the given retention ago, as all the tokens they signed have expired.
+// The retention must be at least the lifetime of tokens. It returns the new key and the IDs of the removed ones.
+func Rotate(dir, algorithm string, activationDelay, retention time.Duration, now time.Time) (Key, []string, error) {
+	key, err := Generate(algorithm, now)
+	if err != nil {
+		return Key{}, nil, err
+	}
+	if err := Save(dir, key); err != nil {
+		return Key{}, nil, err
+	}
+
+	keys, err := LoadDir(dir)
+	if err != nil {
+		return key, nil, err
+	}
+	set := NewSet(activationDelay, keys...)
+	keys = set.Keys()
+	current, _ := set.Signing(now)
+
+	var removed []string
+	for i, old := range keys[:len(keys)-1] {
+		if old.ID >= current.ID {
+			break
+		}
+		// a key stops signing when its successor becomes active
+		retired := keys[i+1].Created().Add(activationDelay)
+		if retired.Add(retention).After(now) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, old.ID+keyFileExt)); err != nil {
+			return key, removed, err
+		}
+		removed = append(removed, old.ID)
+	}
+	return key, removed, nil
+}
@@ -0,0 +1,180 @@
+package jwk
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func generate(t *testing.T, algorithm string, created time.Time) Key {
+	key, err := Generate(algorithm, created)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	return key
+}
+
+func TestSet_SignParse(t *testing.T) {
+	now := time.Now()
+	for _, algorithm := range []string{RS256, ES256} {
+		key := generate(t, algorithm, now)
+		assert.Equal(t, now.UTC().Truncate(time.Second), key.Created(), algorithm)
+		set := NewSet(time.Hour, key)
+
+		signed, err := set.Sign(jwt.MapClaims{"id": "100"})
+		assert.Nil(t, err, algorithm)
+		token, err := set.Parse(signed)
+		if assert.Nil(t, err, algorithm) {
+			assert.Equal(t, key.ID, token.Header["kid"])
+			assert.Equal(t, algorithm, token.Method.Alg())
+			assert.Equal(t, "100", token.Claims.(jwt.MapClaims)["id"])
+		}
+
+		// tokens signed by unknown keys are refused
+		_, err = NewSet(time.Hour, generate(t, algorithm, now)).Parse(signed)
+		assert.NotNil(t, err, algorithm)
+	}
+}
+
+func TestSet_Parse_algorithmMismatch(t *testing.T) {
+	key := generate(t, ES256, time.Now())
+	set := NewSet(time.Hour, key)
+
+	// an HMAC token using the key ID must not be verified with the public key
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"id": "100"})
+	token.Header["kid"] = key.ID
+	signed, _ := token.SignedString([]byte("secret"))
+	_, err := set.Parse(signed)
+	assert.NotNil(t, err)
+
+	token = jwt.NewWithClaims(jwt.SigningMethodNone, jwt.MapClaims{"id": "100"})
+	token.Header["kid"] = key.ID
+	signed, _ = token.SignedString(jwt.UnsafeAllowNoneSignatureType)
+	_, err = set.Parse(signed)
+	assert.NotNil(t, err)
+}
+
+func TestSet_Signing(t *testing.T) {
+	now := time.Now()
+	old := generate(t, ES256, now.Add(-48*time.Hour))
+	current := generate(t, ES256, now.Add(-2*time.Hour))
+	next := generate(t, ES256, now.Add(-time.Minute))
+
+	_, ok := NewSet(time.Hour).Signing(now)
+	assert.False(t, ok)
+
+	set := NewSet(time.Hour, next, old, current)
+	key, _ := set.Signing(now)
+	assert.Equal(t, current.ID, key.ID)
+	key, _ = set.Signing(now.Add(time.Hour))
+	assert.Equal(t, next.ID, key.ID)
+
+	// the only key signs right away
+	key, _ = NewSet(time.Hour, next).Signing(now)
+	assert.Equal(t, next.ID, key.ID)
+
+	// tokens signed by the previous key stay valid
+	signed, _ := NewSet(time.Hour, old).Sign(jwt.MapClaims{})
+	_, err := set.Parse(signed)
+	assert.Nil(t, err)
+}
+
+func TestSet_JWKS(t *testing.T) {
+	rsaKey := generate(t, RS256, time.Now().Add(-time.Hour))
+	ecKey := generate(t, ES256, time.Now())
+	jwks := NewSet(time.Hour, rsaKey, ecKey).JWKS()
+
+	if assert.Len(t, jwks.Keys, 2) {
+		assert.Equal(t, JSONWebKey{
+			KeyType:   "RSA",
+			Use:       "sig",
+			KeyID:     rsaKey.ID,
+			Algorithm: RS256,
+			N:         jwks.Keys[0].N,
+			E:         "AQAB",
+		}, jwks.Keys[0])
+
+		jwk := jwks.Keys[1]
+		assert.Equal(t, "EC", jwk.KeyType)
+		assert.Equal(t, "P-256", jwk.Curve)
+		x, _ := base64.RawURLEncoding.DecodeString(jwk.X)
+		y, _ := base64.RawURLEncoding.DecodeString(jwk.Y)
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		assert.True(t, pub.Equal(ecKey.PublicKey()))
+	}
+}
+
+func TestJSONWebKey_PublicKey(t *testing.T) {
+	rsaKey := generate(t, RS256, time.Now().Add(-time.Hour))
+	ecKey := generate(t, ES256, time.Now())
+	jwks := NewSet(time.Hour, rsaKey, ecKey).JWKS()
+
+	pub, err := jwks.Keys[0].PublicKey()
+	assert.Nil(t, err)
+	assert.True(t, pub.(*rsa.PublicKey).Equal(rsaKey.PublicKey()))
+	pub, err = jwks.Keys[1].PublicKey()
+	assert.Nil(t, err)
+	assert.True(t, pub.(*ecdsa.PublicKey).Equal(ecKey.PublicKey()))
+
+	invalid := jwks.Keys[1]
+	invalid.Y = invalid.X
+	_, err = invalid.PublicKey()
+	assert.NotNil(t, err)
+	_, err = JSONWebKey{KeyType: "oct"}.PublicKey()
+	assert.NotNil(t, err)
+}
+
+func TestRotate(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "keys")
+	now := time.Now()
+	delay, retention := time.Hour, 72*time.Hour
+
+	first, removed, err := Rotate(dir, RS256, delay, retention, now.Add(-30*24*time.Hour))
+	assert.Nil(t, err)
+	assert.Empty(t, removed)
+	second, _, err := Rotate(dir, ES256, delay, retention, now.Add(-4*24*time.Hour))
+	assert.Nil(t, err)
+	third, _, err := Rotate(dir, ES256, delay, retention, now.Add(-24*time.Hour))
+	assert.Nil(t, err)
+
+	// the first key stopped signing four days ago, the second one only a day ago
+	fourth, removed, err := Rotate(dir, ES256, delay, retention, now)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{first.ID}, removed)
+
+	keys, err := LoadDir(dir)
+	assert.Nil(t, err)
+	var ids []string
+	for _, key := range keys {
+		ids = append(ids, key.ID)
+	}
+	sort.Strings(ids)
+	assert.Equal(t, []string{second.ID, third.ID, fourth.ID}, ids)
+
+	info, err := os.Stat(filepath.Join(dir, fourth.ID+keyFileExt))
+	if assert.Nil(t, err) {
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+}
+
+func TestParsePEM(t *testing.T) {
+	key := generate(t, ES256, time.Now())
+	data, err := key.MarshalPEM()
+	assert.Nil(t, err)
+	parsed, err := ParsePEM(key.ID, data)
+	assert.Nil(t, err)
+	assert.Equal(t, ES256, parsed.Algorithm)
+	assert.True(t, parsed.PublicKey().(*ecdsa.PublicKey).Equal(key.PublicKey()))
+
+	_, err = ParsePEM("bad", []byte("not a key"))
+	assert.NotNil(t, err)
+}
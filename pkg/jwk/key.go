@@ -0,0 +1,114 @@
+// Package jwk manages the asymmetric keys signing JWTs, and publishes their public part as a JSON Web Key Set.
+package jwk
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"time"
+)
+
+const (
+	// RS256 signs with RSASSA-PKCS1-v1_5 using SHA-256 and a 2048 bit key.
+	RS256 = "RS256"
+	// ES256 signs with ECDSA using the P-256 curve and SHA-256.
+	ES256 = "ES256"
+)
+
+// idTimeFormat is the layout of the creation time starting key IDs, which makes them sort chronologically.
+const idTimeFormat = "20060102T150405Z"
+
+// Key is a private key signing JWTs, identified by its key ID.
+type Key struct {
+	ID        string
+	Algorithm string
+	signer    crypto.Signer
+}
+
+// Generate generates a new key for the given algorithm, created at the given time.
+func Generate(algorithm string, now time.Time) (Key, error) {
+	var (
+		signer crypto.Signer
+		err    error
+	)
+	switch algorithm {
+	case RS256:
+		signer, err = rsa.GenerateKey(rand.Reader, 2048)
+	case ES256:
+		signer, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	default:
+		return Key{}, fmt.Errorf("unsupported signing algorithm %q", algorithm)
+	}
+	if err != nil {
+		return Key{}, err
+	}
+
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return Key{}, err
+	}
+	return Key{
+		ID:        now.UTC().Format(idTimeFormat) + "-" + hex.EncodeToString(suffix),
+		Algorithm: algorithm,
+		signer:    signer,
+	}, nil
+}
+
+// Created returns when the key was generated, as recorded in its ID.
+func (k Key) Created() time.Time {
+	if len(k.ID) < len(idTimeFormat) {
+		return time.Time{}
+	}
+	t, _ := time.Parse(idTimeFormat, k.ID[:len(idTimeFormat)])
+	return t
+}
+
+// SigningMethod returns the JWT signing method of the key.
+func (k Key) SigningMethod() jwt.SigningMethod {
+	return jwt.GetSigningMethod(k.Algorithm)
+}
+
+// PublicKey returns the public part of the key, which verifies signatures.
+func (k Key) PublicKey() crypto.PublicKey {
+	return k.signer.Public()
+}
+
+// MarshalPEM encodes the private key in the PKCS #8 PEM format.
+func (k Key) MarshalPEM() ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(k.signer)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// ParsePEM decodes the private key having the given ID from the PKCS #8 PEM format.
+// The algorithm is derived from the type of the key.
+func ParsePEM(id string, data []byte) (Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return Key{}, fmt.Errorf("key %s: no PKCS #8 private key found", id)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return Key{}, fmt.Errorf("key %s: %w", id, err)
+	}
+
+	switch key := parsed.(type) {
+	case *rsa.PrivateKey:
+		return Key{ID: id, Algorithm: RS256, signer: key}, nil
+	case *ecdsa.PrivateKey:
+		if key.Curve != elliptic.P256() {
+			return Key{}, fmt.Errorf("key %s: unsupported curve %s", id, key.Curve.Params().Name)
+		}
+		return Key{ID: id, Algorithm: ES256, signer: key}, nil
+	}
+	return Key{}, fmt.Errorf("key %s: unsupported key type %T", id, parsed)
+}
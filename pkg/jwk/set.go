@@ -0,0 +1,105 @@
+package jwk
+
+import (
+	"errors"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Set is the set of keys signing and verifying JWTs. It is safe for concurrent use.
+//
+// A new key only starts signing tokens after the activation delay, so that every party verifying tokens
+// gets the chance to learn about it first. Older keys keep verifying the tokens they signed until they
+// are removed from the set.
+type Set struct {
+	mu              sync.RWMutex
+	keys            []Key
+	activationDelay time.Duration
+}
+
+// NewSet creates a key set with the given keys.
+func NewSet(activationDelay time.Duration, keys ...Key) *Set {
+	s := &Set{activationDelay: activationDelay}
+	s.Update(keys)
+	return s
+}
+
+// Update replaces the keys of the set.
+func (s *Set) Update(keys []Key) {
+	sorted := append([]Key(nil), keys...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ID < sorted[j].ID })
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = sorted
+}
+
+// Keys returns the keys of the set, oldest first.
+func (s *Set) Keys() []Key {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]Key(nil), s.keys...)
+}
+
+// Signing returns the key signing tokens at the given time: the newest key past its activation delay,
+// or the oldest key if none is. It returns false if the set is empty.
+func (s *Set) Signing(now time.Time) (Key, bool) {
+	return signing(s.Keys(), s.activationDelay, now)
+}
+
+func signing(keys []Key, activationDelay time.Duration, now time.Time) (Key, bool) {
+	if len(keys) == 0 {
+		return Key{}, false
+	}
+	for i := len(keys) - 1; i > 0; i-- {
+		if !keys[i].Created().Add(activationDelay).After(now) {
+			return keys[i], true
+		}
+	}
+	return keys[0], true
+}
+
+// Lookup returns the key having the given ID.
+func (s *Set) Lookup(id string) (Key, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, key := range s.keys {
+		if key.ID == id {
+			return key, true
+		}
+	}
+	return Key{}, false
+}
+
+// Sign signs a token with the given claims, using the current signing key.
+func (s *Set) Sign(claims jwt.Claims) (string, error) {
+	key, ok := s.Signing(time.Now())
+	if !ok {
+		return "", errors.New("no key to sign tokens with")
+	}
+	token := jwt.NewWithClaims(key.SigningMethod(), claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.signer)
+}
+
+// Parse parses and verifies a token signed by a key of the set.
+func (s *Set) Parse(token string) (*jwt.Token, error) {
+	return jwt.Parse(token, s.Keyfunc)
+}
+
+// Keyfunc returns the public key verifying the given token, as identified by its kid header.
+// Tokens whose algorithm does not match the one of the key are refused.
+func (s *Set) Keyfunc(token *jwt.Token) (interface{}, error) {
+	id, _ := token.Header["kid"].(string)
+	key, ok := s.Lookup(id)
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", id)
+	}
+	if token.Method.Alg() != key.Algorithm {
+		return nil, fmt.Errorf("unexpected signing method %s for key %s", token.Method.Alg(), id)
+	}
+	return key.PublicKey(), nil
+}
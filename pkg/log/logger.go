@@ -4,6 +4,7 @@ package log
 import (
 	"context"
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"go.uber.org/zap/zaptest/observer"
@@ -39,8 +40,17 @@ type contextKey int
 const (
 	requestIDKey contextKey = iota
 	correlationIDKey
+	identityKey
 )
 
+// Identity is the authenticated identity a request is made with.
+type Identity interface {
+	// GetID returns the ID of the user.
+	GetID() string
+	// GetActorID returns the ID of the staff member impersonating the user, if any.
+	GetActorID() string
+}
+
 // New creates a new logger using the default configuration.
 func New() Logger {
 	l, _ := zap.NewProduction()
@@ -62,6 +72,8 @@ func NewForTest() (Logger, *observer.ObservedLogs) {
 //
 // If the context contains request ID and/or correlation ID information (recorded via WithRequestID()
 // and WithCorrelationID()), they will be added to every log message generated by the new logger.
+// So will the user ID and actor ID of the identity recorded via WithIdentity().
+// So will the trace ID and span ID of the span found in the context, if any.
 //
 // The arguments should be specified as a sequence of name, value pairs with names being strings.
 // The arguments will also be added to every log message generated by the logger.
@@ -73,6 +85,15 @@ func (l *logger) With(ctx context.Context, args ...interface{}) Logger {
 		if id, ok := ctx.Value(correlationIDKey).(string); ok {
 			args = append(args, zap.String("correlation_id", id))
 		}
+		if identity, ok := ctx.Value(identityKey).(Identity); ok {
+			args = append(args, zap.String("user_id", identity.GetID()))
+			if actor := identity.GetActorID(); actor != "" {
+				args = append(args, zap.String("actor_id", actor))
+			}
+		}
+		if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+			args = append(args, zap.String("trace_id", sc.TraceID().String()), zap.String("span_id", sc.SpanID().String()))
+		}
 	}
 	if len(args) > 0 {
 		return &logger{l.SugaredLogger.With(args...)}
@@ -93,6 +114,11 @@ func WithRequest(ctx context.Context, req *http.Request) context.Context {
 	return ctx
 }
 
+// WithIdentity returns a context whose loggers record the given identity.
+func WithIdentity(ctx context.Context, identity Identity) context.Context {
+	return context.WithValue(ctx, identityKey, identity)
+}
+
 // getCorrelationID extracts the correlation ID from the HTTP request
 func getCorrelationID(req *http.Request) string {
 	return req.Header.Get("X-Correlation-ID")
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"net/http"
 	"reflect"
@@ -57,6 +58,44 @@ func Test_logger_With(t *testing.T) {
 	assert.False(t, reflect.DeepEqual(l3, l2))
 }
 
+func Test_logger_WithTrace(t *testing.T) {
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	ctx := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID: traceID,
+		SpanID:  spanID,
+	}))
+
+	l, entries := NewForTest()
+	l.With(ctx).Info("traced")
+	l.With(context.Background()).Info("untraced")
+	if assert.Equal(t, 2, entries.Len()) {
+		fields := entries.All()[0].ContextMap()
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", fields["trace_id"])
+		assert.Equal(t, "00f067aa0ba902b7", fields["span_id"])
+		assert.NotContains(t, entries.All()[1].ContextMap(), "trace_id")
+	}
+}
+
+type testIdentity struct{ id, actor string }
+
+func (i testIdentity) GetID() string      { return i.id }
+func (i testIdentity) GetActorID() string { return i.actor }
+
+func Test_logger_WithIdentity(t *testing.T) {
+	l, entries := NewForTest()
+	l.With(WithIdentity(context.Background(), testIdentity{"100", ""})).Info("self")
+	l.With(WithIdentity(context.Background(), testIdentity{"100", "1"})).Info("impersonated")
+	if assert.Equal(t, 2, entries.Len()) {
+		fields := entries.All()[0].ContextMap()
+		assert.Equal(t, "100", fields["user_id"])
+		assert.NotContains(t, fields, "actor_id")
+		fields = entries.All()[1].ContextMap()
+		assert.Equal(t, "100", fields["user_id"])
+		assert.Equal(t, "1", fields["actor_id"])
+	}
+}
+
 func buildRequest(requestID, correlationID string) *http.Request {
 	req, _ := http.NewRequest("GET", "http://example.com", bytes.NewBufferString(""))
 	if requestID != "" {
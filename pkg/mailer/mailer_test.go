@@ -0,0 +1,104 @@
+package mailer
+
+import (
+	"context"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testTemplate = MustTemplate("welcome",
+	"Welcome, {{.Name}}",
+	"Hello {{.Name}}, visit {{.Link}}",
+	`<p>Hello {{.Name}}, <a href="{{.Link}}">visit</a></p>`,
+)
+
+func TestTemplate_Render(t *testing.T) {
+	msg, err := testTemplate.Render("demo@example.com", map[string]string{"Name": "<Demo>", "Link": "https://shop.test/?a=1&b=2"})
+	assert.Nil(t, err)
+	assert.Equal(t, "demo@example.com", msg.To)
+	assert.Equal(t, "Welcome, <Demo>", msg.Subject)
+	assert.Equal(t, "Hello <Demo>, visit https://shop.test/?a=1&b=2", msg.Text)
+	assert.Contains(t, msg.HTML, "Hello &lt;Demo&gt;")
+	assert.Contains(t, msg.HTML, `href="https://shop.test/?a=1&amp;b=2"`)
+
+	text := MustTemplate("text", "Hi", "Hello", "")
+	msg, err = text.Render("demo@example.com", nil)
+	assert.Nil(t, err)
+	assert.Empty(t, msg.HTML)
+}
+
+func Test_compose(t *testing.T) {
+	data, err := compose(Message{
+		From:    "shop@example.com",
+		To:      "demo@example.com",
+		Subject: "Grüße",
+		Text:    "plain body",
+		HTML:    "<p>html body</p>",
+	}, time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC))
+	assert.Nil(t, err)
+
+	parsed, err := mail.ReadMessage(strings.NewReader(string(data)))
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, "demo@example.com", parsed.Header.Get("To"))
+	subject, _ := new(mime.WordDecoder).DecodeHeader(parsed.Header.Get("Subject"))
+	assert.Equal(t, "Grüße", subject)
+
+	mediaType, params, err := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+	assert.Nil(t, err)
+	assert.Equal(t, "multipart/alternative", mediaType)
+
+	reader := multipart.NewReader(parsed.Body, params["boundary"])
+	var bodies []string
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			break
+		}
+		body, _ := ioutil.ReadAll(part)
+		bodies = append(bodies, part.Header.Get("Content-Type")+": "+string(body))
+	}
+	assert.Equal(t, []string{
+		"text/plain; charset=utf-8: plain body",
+		"text/html; charset=utf-8: <p>html body</p>",
+	}, bodies)
+}
+
+func TestFileMailer(t *testing.T) {
+	dir := t.TempDir()
+	m, err := NewFileMailer(filepath.Join(dir, "mail"), "shop@example.com")
+	assert.Nil(t, err)
+	assert.Nil(t, m.Send(context.Background(), Message{To: "demo@example.com", Subject: "Hi", Text: "Hello"}))
+
+	files, _ := filepath.Glob(filepath.Join(dir, "mail", "*.eml"))
+	if assert.Len(t, files, 1) {
+		assert.Contains(t, files[0], "demo@example.com")
+		data, _ := ioutil.ReadFile(files[0])
+		assert.Contains(t, string(data), "From: shop@example.com")
+		assert.Contains(t, string(data), "Hello")
+	}
+}
+
+func TestMemoryMailer(t *testing.T) {
+	m := NewMemoryMailer("shop@example.com")
+	assert.Nil(t, m.Send(context.Background(), Message{To: "a@example.com", Subject: "1"}))
+	assert.Nil(t, m.Send(context.Background(), Message{To: "b@example.com", Subject: "2"}))
+	assert.Nil(t, m.Send(context.Background(), Message{To: "a@example.com", Subject: "3"}))
+
+	assert.Len(t, m.Messages(), 3)
+	msg, ok := m.Last("a@example.com")
+	assert.True(t, ok)
+	assert.Equal(t, "3", msg.Subject)
+	assert.Equal(t, "shop@example.com", msg.From)
+	_, ok = m.Last("c@example.com")
+	assert.False(t, ok)
+}
@@ -0,0 +1,53 @@
+package mailer
+
+import (
+	"bytes"
+	htmltemplate "html/template"
+	texttemplate "text/template"
+)
+
+// Template renders messages of one kind from a subject, a plain text body and an HTML body,
+// which are all Go templates executed with the same data. Values are escaped in the HTML body.
+type Template struct {
+	subject *texttemplate.Template
+	text    *texttemplate.Template
+	html    *htmltemplate.Template
+}
+
+// MustTemplate parses the given templates. It panics if any of them is invalid, and is meant
+// to initialize package level variables. The HTML template may be empty.
+func MustTemplate(name, subject, text, html string) *Template {
+	t := &Template{
+		subject: texttemplate.Must(texttemplate.New(name + ".subject").Parse(subject)),
+		text:    texttemplate.Must(texttemplate.New(name + ".text").Parse(text)),
+	}
+	if html != "" {
+		t.html = htmltemplate.Must(htmltemplate.New(name + ".html").Parse(html))
+	}
+	return t
+}
+
+// Render renders a message to the given recipient.
+func (t *Template) Render(to string, data interface{}) (Message, error) {
+	msg := Message{To: to}
+	var buf bytes.Buffer
+	if err := t.subject.Execute(&buf, data); err != nil {
+		return msg, err
+	}
+	msg.Subject = buf.String()
+
+	buf.Reset()
+	if err := t.text.Execute(&buf, data); err != nil {
+		return msg, err
+	}
+	msg.Text = buf.String()
+
+	if t.html != nil {
+		buf.Reset()
+		if err := t.html.Execute(&buf, data); err != nil {
+			return msg, err
+		}
+		msg.HTML = buf.String()
+	}
+	return msg, nil
+}
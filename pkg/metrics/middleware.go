@@ -0,0 +1,61 @@
+// Package metrics provides a middleware that records Prometheus metrics for every RESTful API call.
+package metrics
+
+import (
+	routing "github.com/go-ozzo/ozzo-routing/v2"
+	"github.com/go-ozzo/ozzo-routing/v2/access"
+	"github.com/online-shop/pkg/routepattern"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "Number of HTTP requests processed, labeled by method, route pattern and status code.",
+	}, []string{"method", "route", "status"})
+
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "Latency of HTTP requests, labeled by method, route pattern and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+)
+
+// Handler returns a middleware that records the count and latency of every HTTP request being processed.
+// Requests are labeled by the route pattern they matched (e.g. "/v1/orders/<id>") to keep label cardinality bounded.
+func Handler() routing.Handler {
+	matcher := &routepattern.Matcher{}
+	return func(c *routing.Context) error {
+		start := time.Now()
+
+		rw := &access.LogResponseWriter{ResponseWriter: c.Response, Status: http.StatusOK}
+		c.Response = rw
+
+		err := c.Next()
+
+		// errors not yet turned into a response are written by the router after this middleware returns
+		code := rw.Status
+		if httpErr, ok := err.(routing.HTTPError); ok {
+			code = httpErr.StatusCode()
+		} else if err != nil {
+			code = http.StatusInternalServerError
+		}
+
+		route := matcher.Match(c.Router(), c.Request.Method, c.Request.URL.Path)
+		status := strconv.Itoa(code)
+		requestsTotal.WithLabelValues(c.Request.Method, route, status).Inc()
+		requestDuration.WithLabelValues(c.Request.Method, route, status).Observe(time.Since(start).Seconds())
+
+		return err
+	}
+}
+
+// Endpoint returns a handler that exposes the metrics registered with the default Prometheus registry.
+func Endpoint() routing.Handler {
+	return routing.HTTPHandler(promhttp.Handler())
+}
@@ -0,0 +1,35 @@
+package metrics
+
+import (
+	routing "github.com/go-ozzo/ozzo-routing/v2"
+	"github.com/online-shop/pkg/routepattern"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	router := routing.New()
+	router.Use(Handler())
+	router.Get("/v1/orders/<id>", func(c *routing.Context) error { return c.Write("order") })
+	router.Get("/v1/orders/latest", func(c *routing.Context) error { return c.Write("latest") })
+	router.Get("/metrics", Endpoint())
+
+	for _, path := range []string{"/v1/orders/1", "/v1/orders/2", "/v1/orders/latest", "/unknown"} {
+		req, _ := http.NewRequest("GET", path, nil)
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	assert.Equal(t, float64(2), testutil.ToFloat64(requestsTotal.WithLabelValues("GET", "/v1/orders/<id>", "200")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(requestsTotal.WithLabelValues("GET", "/v1/orders/latest", "200")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(requestsTotal.WithLabelValues("GET", routepattern.Unmatched, "404")))
+
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.True(t, strings.Contains(res.Body.String(), `http_request_duration_seconds_count{method="GET",route="/v1/orders/<id>",status="200"} 2`))
+}
@@ -0,0 +1,107 @@
+package mysql
+
+import (
+	"errors"
+	"fmt"
+	driver "github.com/go-sql-driver/mysql"
+	"regexp"
+	"strings"
+)
+
+// ErrorKind classifies the database errors callers may want to react to.
+type ErrorKind string
+
+const (
+	// DuplicateKey means a unique index rejected the written value.
+	DuplicateKey ErrorKind = "duplicate_key"
+	// ForeignKey means a foreign key constraint rejected the written or deleted row.
+	ForeignKey ErrorKind = "foreign_key"
+	// Deadlock means the transaction was rolled back to resolve a deadlock. Retrying it may succeed.
+	Deadlock ErrorKind = "deadlock"
+	// LockTimeout means a row lock could not be acquired in time. Retrying may succeed.
+	LockTimeout ErrorKind = "lock_timeout"
+	// DataTooLong means a value does not fit in its column.
+	DataTooLong ErrorKind = "data_too_long"
+)
+
+// errorKinds maps MySQL server error numbers to error kinds.
+var errorKinds = map[uint16]ErrorKind{
+	1062: DuplicateKey, // ER_DUP_ENTRY
+	1586: DuplicateKey, // ER_DUP_ENTRY_WITH_KEY_NAME
+	1216: ForeignKey,   // ER_NO_REFERENCED_ROW
+	1217: ForeignKey,   // ER_ROW_IS_REFERENCED
+	1451: ForeignKey,   // ER_ROW_IS_REFERENCED_2
+	1452: ForeignKey,   // ER_NO_REFERENCED_ROW_2
+	1213: Deadlock,     // ER_LOCK_DEADLOCK
+	1205: LockTimeout,  // ER_LOCK_WAIT_TIMEOUT
+	1406: DataTooLong,  // ER_DATA_TOO_LONG
+}
+
+var (
+	duplicateKeyPattern = regexp.MustCompile(`for key '([^']+)'`)
+	dataTooLongPattern  = regexp.MustCompile(`for column '([^']+)'`)
+)
+
+// Error is a database error classified by kind.
+type Error struct {
+	Kind ErrorKind
+	// Key is the unique index that rejected a duplicate value, or the column a value was too long for.
+	// It may be empty if the server did not report it.
+	Key string
+	Err error
+}
+
+// Error is required by the error interface.
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %v", e.Kind, e.Err)
+}
+
+// Unwrap returns the underlying driver error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Retryable tells whether retrying the failed transaction may succeed.
+func (e *Error) Retryable() bool {
+	return e.Kind == Deadlock || e.Kind == LockTimeout
+}
+
+// Classify returns the classified form of the given error, or nil if it is not a database error of a known kind.
+// Errors already classified are returned as they are.
+func Classify(err error) *Error {
+	var classified *Error
+	if errors.As(err, &classified) {
+		return classified
+	}
+
+	var driverErr *driver.MySQLError
+	if !errors.As(err, &driverErr) {
+		return nil
+	}
+	kind, ok := errorKinds[driverErr.Number]
+	if !ok {
+		return nil
+	}
+
+	classified = &Error{Kind: kind, Err: err}
+	switch kind {
+	case DuplicateKey:
+		if m := duplicateKeyPattern.FindStringSubmatch(driverErr.Message); m != nil {
+			// MySQL 8 qualifies the index name with the table name
+			classified.Key = m[1][strings.LastIndex(m[1], ".")+1:]
+		}
+	case DataTooLong:
+		if m := dataTooLongPattern.FindStringSubmatch(driverErr.Message); m != nil {
+			classified.Key = m[1]
+		}
+	}
+	return classified
+}
+
+// classify wraps database errors of a known kind into an Error, leaving other errors untouched.
+func classify(err error) error {
+	if classified := Classify(err); classified != nil {
+		return classified
+	}
+	return err
+}
@@ -0,0 +1,43 @@
+package mysql
+
+import (
+	"database/sql"
+	"fmt"
+	driver "github.com/go-sql-driver/mysql"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		kind ErrorKind
+		key  string
+	}{
+		{"duplicate on MySQL 8", &driver.MySQLError{Number: 1062, Message: "Duplicate entry 'demo' for key 'user.uq_user_username'"}, DuplicateKey, "uq_user_username"},
+		{"duplicate on MySQL 5.7", &driver.MySQLError{Number: 1062, Message: "Duplicate entry 'demo' for key 'uq_user_username'"}, DuplicateKey, "uq_user_username"},
+		{"missing parent", &driver.MySQLError{Number: 1452, Message: "Cannot add or update a child row"}, ForeignKey, ""},
+		{"referenced row", &driver.MySQLError{Number: 1451, Message: "Cannot delete or update a parent row"}, ForeignKey, ""},
+		{"deadlock", &driver.MySQLError{Number: 1213, Message: "Deadlock found when trying to get lock"}, Deadlock, ""},
+		{"lock timeout", &driver.MySQLError{Number: 1205, Message: "Lock wait timeout exceeded"}, LockTimeout, ""},
+		{"too long", &driver.MySQLError{Number: 1406, Message: "Data too long for column 'fullname' at row 1"}, DataTooLong, "fullname"},
+		{"wrapped", fmt.Errorf("insert: %w", &driver.MySQLError{Number: 1213}), Deadlock, ""},
+	}
+	for _, tc := range tests {
+		err := Classify(tc.err)
+		if assert.NotNil(t, err, tc.name) {
+			assert.Equal(t, tc.kind, err.Kind, tc.name)
+			assert.Equal(t, tc.key, err.Key, tc.name)
+			assert.Equal(t, tc.kind == Deadlock || tc.kind == LockTimeout, err.Retryable(), tc.name)
+			assert.Same(t, err, Classify(err), tc.name)
+		}
+	}
+
+	assert.Nil(t, Classify(nil))
+	assert.Nil(t, Classify(sql.ErrNoRows))
+	assert.Nil(t, Classify(&driver.MySQLError{Number: 1064, Message: "You have an error in your SQL syntax"}))
+
+	assert.Equal(t, sql.ErrNoRows, classify(sql.ErrNoRows))
+	assert.IsType(t, &Error{}, classify(&driver.MySQLError{Number: 1062}))
+}
@@ -5,15 +5,106 @@ import (
 	"database/sql"
 	"errors"
 	"github.com/jmoiron/sqlx"
+	"github.com/online-shop/pkg/tracing"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/multierr"
+	"time"
 )
 
+var queryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "db_query_duration_seconds",
+	Help:    "Latency of database queries, labeled by target database, operation and outcome.",
+	Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+}, []string{"db", "operation", "status"})
+
+// startQuery starts a client span for a query about to be sent to the given database.
+func startQuery(ctx context.Context, db, operation, query string) (context.Context, trace.Span) {
+	return tracing.StartSpan(ctx, "mysql."+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.DBSystemMySQL, semconv.DBStatementKey.String(query), attribute.String("db.instance", db)),
+	)
+}
+
+// endQuery ends the span of a query which started at the given time, and records its duration.
+func endQuery(span trace.Span, db, operation string, start time.Time, err error) {
+	status := "ok"
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		status = "error"
+		tracing.RecordError(span, err)
+	}
+	queryDuration.WithLabelValues(db, operation, status).Observe(time.Since(start).Seconds())
+	span.End()
+}
+
 // BaseRepository type
 type BaseRepository struct {
 	MasterDB *sqlx.DB
 	SlaveDB  *sqlx.DB
 }
 
+// txKey is the context key of the transaction started by Transaction.
+type txKey struct{}
+
+// transaction is a transaction started by Transaction, along with the functions to run once it is committed.
+type transaction struct {
+	tx          *sqlx.Tx
+	afterCommit []func()
+}
+
+// Transaction runs fn in a transaction on the master DB. The queries run with the context given to fn are part of
+// the transaction, reads included. The transaction is committed if fn returns nil, and rolled back otherwise.
+func (r *BaseRepository) Transaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	if r.MasterDB == nil {
+		return errors.New("the master DB connection is nil")
+	}
+	if _, ok := ctx.Value(txKey{}).(*transaction); ok {
+		// nested transactions are part of the outer one
+		return fn(ctx)
+	}
+
+	tx, err := r.MasterDB.BeginTxx(ctx, nil)
+	if err != nil {
+		return classify(err)
+	}
+	t := &transaction{tx: tx}
+	if err := fn(context.WithValue(ctx, txKey{}, t)); err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return multierr.Combine(err, rollbackErr)
+		}
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return classify(err)
+	}
+	for _, fn := range t.afterCommit {
+		fn()
+	}
+	return nil
+}
+
+// AfterCommit runs fn once the transaction of the given context is committed, or right away if the context has
+// none. The functions registered within nested transactions wait for the outermost one, and are dropped if it is
+// rolled back.
+func AfterCommit(ctx context.Context, fn func()) {
+	if t, ok := ctx.Value(txKey{}).(*transaction); ok {
+		t.afterCommit = append(t.afterCommit, fn)
+		return
+	}
+	fn()
+}
+
+// queryer returns the transaction of the given context if any, or the given database.
+func queryer(ctx context.Context, db *sqlx.DB) sqlx.ExtContext {
+	if t, ok := ctx.Value(txKey{}).(*transaction); ok {
+		return t.tx
+	}
+	return db
+}
+
 func (r *BaseRepository) Exec(ctx context.Context, query string, args interface{}) (sql.Result, error) {
 	var (
 		res sql.Result
@@ -24,10 +115,13 @@ func (r *BaseRepository) Exec(ctx context.Context, query string, args interface{
 		return res, errors.New("the master DB connection is nil")
 	}
 
-	res, err = r.MasterDB.NamedExecContext(ctx, query, args)
+	ctx, span := startQuery(ctx, "master", "exec", query)
+	start := time.Now()
+	res, err = sqlx.NamedExecContext(ctx, queryer(ctx, r.MasterDB), query, args)
+	endQuery(span, "master", "exec", start, err)
 
 	if err != nil {
-		return nil, err
+		return nil, classify(err)
 	}
 
 	return res, nil
@@ -39,9 +133,12 @@ func (r *BaseRepository) FetchRows(ctx context.Context, query string, resp inter
 		return errors.New("the slave DB connection is nil")
 	}
 
-	err := r.SlaveDB.SelectContext(ctx, resp, query, args...)
+	ctx, span := startQuery(ctx, "slave", "fetch_rows", query)
+	start := time.Now()
+	err := sqlx.SelectContext(ctx, queryer(ctx, r.SlaveDB), resp, query, args...)
+	endQuery(span, "slave", "fetch_rows", start, err)
 	if err != nil {
-		return err
+		return classify(err)
 	}
 
 	return nil
@@ -53,14 +150,52 @@ func (r *BaseRepository) FetchRow(ctx context.Context, query string, resp interf
 		return errors.New("the slave DB connection is nil")
 	}
 
-	err := r.SlaveDB.GetContext(ctx, resp, query, args...)
+	ctx, span := startQuery(ctx, "slave", "fetch_row", query)
+	start := time.Now()
+	err := sqlx.GetContext(ctx, queryer(ctx, r.SlaveDB), resp, query, args...)
+	endQuery(span, "slave", "fetch_row", start, err)
 	if err != nil {
-		return err
+		return classify(err)
+	}
+
+	return nil
+}
+
+// Each fetches rows on the slave DB one at a time, scanning every row into dest before calling fn, so that large
+// results are never held in memory. It stops at the first error returned by fn.
+func (r *BaseRepository) Each(ctx context.Context, query string, dest interface{}, fn func() error, args ...interface{}) error {
+	if r.SlaveDB == nil {
+		return errors.New("the slave DB connection is nil")
+	}
+
+	ctx, span := startQuery(ctx, "slave", "each", query)
+	start := time.Now()
+	err := each(ctx, queryer(ctx, r.SlaveDB), query, dest, fn, args...)
+	endQuery(span, "slave", "each", start, err)
+	if err != nil {
+		return classify(err)
 	}
 
 	return nil
 }
 
+func each(ctx context.Context, db sqlx.QueryerContext, query string, dest interface{}, fn func() error, args ...interface{}) error {
+	rows, err := db.QueryxContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := rows.StructScan(dest); err != nil {
+			return err
+		}
+		if err := fn(); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
 //type TxFn func(Transaction) error
 //
 //func (r *BaseRepository) WithTransaction(db *sql.DB, fn TxFn) (err error) {
@@ -0,0 +1,23 @@
+package mysql
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestAfterCommit(t *testing.T) {
+	var calls []string
+
+	// without a transaction, functions run right away
+	AfterCommit(context.Background(), func() { calls = append(calls, "now") })
+	assert.Equal(t, []string{"now"}, calls)
+
+	// within one, they wait for it to be committed
+	tx := &transaction{}
+	ctx := context.WithValue(context.Background(), txKey{}, tx)
+	AfterCommit(ctx, func() { calls = append(calls, "first") })
+	AfterCommit(ctx, func() { calls = append(calls, "second") })
+	assert.Equal(t, []string{"now"}, calls)
+	assert.Len(t, tx.afterCommit, 2)
+}
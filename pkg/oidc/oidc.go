@@ -0,0 +1,295 @@
+// Package oidc implements the relying party side of OpenID Connect: the authorization code flow with PKCE,
+// and the verification of the ID tokens it yields.
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/online-shop/pkg/jwk"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxResponseSize bounds the responses read from providers.
+	maxResponseSize = 1 << 20
+	// clockSkew is how long ID tokens are accepted after their expiry, as clocks are never quite in sync.
+	clockSkew = time.Minute
+)
+
+// Config identifies this application to an OpenID provider.
+type Config struct {
+	// Issuer is the URL of the provider, under which its discovery document is served.
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is where the provider sends users back to, with an authorization code.
+	RedirectURL string
+	// Scopes are requested along with the mandatory "openid" scope. Defaults to "email" and "profile".
+	Scopes []string
+}
+
+// Claims are the claims of an ID token this package uses.
+type Claims struct {
+	Issuer        string   `json:"iss"`
+	Subject       string   `json:"sub"`
+	Audience      audience `json:"aud"`
+	ExpiresAt     int64    `json:"exp"`
+	Nonce         string   `json:"nonce"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"email_verified"`
+	Name          string   `json:"name"`
+}
+
+// Valid checks the expiry of the ID token, allowing for some clock skew. It is called when parsing the token.
+func (c Claims) Valid() error {
+	if time.Now().Add(-clockSkew).Unix() > c.ExpiresAt {
+		return errors.New("ID token expired")
+	}
+	return nil
+}
+
+// audience is the "aud" claim, which is either a single client ID or a list of them.
+type audience []string
+
+// UnmarshalJSON decodes either form of the "aud" claim.
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+// contains tells whether the audience includes the given client ID.
+func (a audience) contains(clientID string) bool {
+	for _, id := range a {
+		if id == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// metadata is the part of the discovery document of a provider this package uses.
+type metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Client runs the authorization code flow against an OpenID provider.
+// The discovery document and the keys of the provider are fetched on first use, so that an unavailable
+// provider does not prevent the application from starting.
+type Client struct {
+	config Config
+	http   *http.Client
+
+	mu       sync.Mutex
+	metadata *metadata
+	keys     map[string]jwk.JSONWebKey
+}
+
+// NewClient creates a client of the provider having the given configuration.
+func NewClient(config Config, httpClient *http.Client) *Client {
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"email", "profile"}
+	}
+	return &Client{config: config, http: httpClient}
+}
+
+// AuthCodeURL returns the URL of the provider to send users to. The state is sent back along with the
+// authorization code, the nonce ends up in the ID token, and the challenge is derived from the PKCE verifier
+// with Challenge.
+func (c *Client) AuthCodeURL(ctx context.Context, state, nonce, challenge string) (string, error) {
+	m, err := c.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {c.config.ClientID},
+		"redirect_uri":          {c.config.RedirectURL},
+		"scope":                 {strings.Join(append([]string{"openid"}, c.config.Scopes...), " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {challenge},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(m.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return m.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// Exchange trades an authorization code for an ID token, which is verified and must carry the given nonce.
+func (c *Client) Exchange(ctx context.Context, code, verifier, nonce string) (Claims, error) {
+	m, err := c.discover(ctx)
+	if err != nil {
+		return Claims{}, err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {c.config.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Claims{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(c.config.ClientID), url.QueryEscape(c.config.ClientSecret))
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := c.do(req, &tokens); err != nil {
+		return Claims{}, fmt.Errorf("token request failed: %w", err)
+	}
+	if tokens.IDToken == "" {
+		return Claims{}, errors.New("no ID token in token response")
+	}
+	return c.verify(ctx, tokens.IDToken, nonce)
+}
+
+// verify checks the signature, issuer, audience, expiry and nonce of an ID token.
+func (c *Client) verify(ctx context.Context, idToken, nonce string) (Claims, error) {
+	m, err := c.discover(ctx)
+	if err != nil {
+		return Claims{}, err
+	}
+	var claims Claims
+	parser := jwt.Parser{ValidMethods: []string{jwk.RS256, jwk.ES256}}
+	_, err = parser.ParseWithClaims(idToken, &claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, err := c.key(ctx, kid)
+		if err != nil {
+			return nil, err
+		}
+		if key.Algorithm != "" && key.Algorithm != token.Method.Alg() {
+			return nil, fmt.Errorf("key %s is not meant for %s", kid, token.Method.Alg())
+		}
+		return key.PublicKey()
+	})
+	if err != nil {
+		return Claims{}, fmt.Errorf("invalid ID token: %w", err)
+	}
+
+	switch {
+	case claims.Issuer != m.Issuer:
+		return Claims{}, fmt.Errorf("ID token issued by %q", claims.Issuer)
+	case !claims.Audience.contains(c.config.ClientID):
+		return Claims{}, errors.New("ID token issued to another client")
+	case claims.Subject == "":
+		return Claims{}, errors.New("ID token without subject")
+	case nonce == "" || claims.Nonce != nonce:
+		return Claims{}, errors.New("ID token nonce mismatch")
+	}
+	return claims, nil
+}
+
+// discover fetches the discovery document of the provider, once.
+func (c *Client) discover(ctx context.Context) (*metadata, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.metadata != nil {
+		return c.metadata, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(c.config.Issuer, "/")+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	var m metadata
+	if err := c.do(req, &m); err != nil {
+		return nil, fmt.Errorf("discovery failed: %w", err)
+	}
+	if m.Issuer != c.config.Issuer {
+		return nil, fmt.Errorf("discovery document of %q is issued by %q", c.config.Issuer, m.Issuer)
+	}
+	if m.AuthorizationEndpoint == "" || m.TokenEndpoint == "" || m.JWKSURI == "" {
+		return nil, errors.New("incomplete discovery document")
+	}
+	c.metadata = &m
+	return c.metadata, nil
+}
+
+// key returns the key of the provider having the given ID. The keys are fetched again when the ID is unknown,
+// as providers rotate their keys.
+func (c *Client) key(ctx context.Context, id string) (jwk.JSONWebKey, error) {
+	c.mu.Lock()
+	key, ok := c.keys[id]
+	jwksURI := c.metadata.JWKSURI
+	c.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, jwksURI, nil)
+	if err != nil {
+		return jwk.JSONWebKey{}, err
+	}
+	var set jwk.JSONWebKeySet
+	if err := c.do(req, &set); err != nil {
+		return jwk.JSONWebKey{}, fmt.Errorf("key set request failed: %w", err)
+	}
+	keys := map[string]jwk.JSONWebKey{}
+	for _, k := range set.Keys {
+		if k.Use == "" || k.Use == "sig" {
+			keys[k.KeyID] = k
+		}
+	}
+
+	c.mu.Lock()
+	c.keys = keys
+	c.mu.Unlock()
+	if key, ok = keys[id]; !ok {
+		return jwk.JSONWebKey{}, fmt.Errorf("unknown key %q", id)
+	}
+	return key, nil
+}
+
+// do sends a request expecting a JSON response, which is decoded into v.
+func (c *Client) do(req *http.Request, v interface{}) error {
+	req.Header.Set("Accept", "application/json")
+	client := c.http
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body := io.LimitReader(res.Body, maxResponseSize)
+	if res.StatusCode != http.StatusOK {
+		var e struct {
+			Error       string `json:"error"`
+			Description string `json:"error_description"`
+		}
+		data, _ := ioutil.ReadAll(body)
+		if json.Unmarshal(data, &e) == nil && e.Error != "" {
+			return fmt.Errorf("%s: %s %s", res.Status, e.Error, e.Description)
+		}
+		return errors.New(res.Status)
+	}
+	return json.NewDecoder(body).Decode(v)
+}
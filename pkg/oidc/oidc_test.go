@@ -0,0 +1,130 @@
+package oidc_test
+
+import (
+	"context"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/online-shop/pkg/oidc"
+	"github.com/online-shop/pkg/oidc/oidctest"
+	"github.com/stretchr/testify/assert"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func newTestClient(provider *oidctest.Provider, secret string) *oidc.Client {
+	return oidc.NewClient(oidc.Config{
+		Issuer:       provider.Issuer(),
+		ClientID:     provider.ClientID,
+		ClientSecret: secret,
+		RedirectURL:  "https://shop.test/callback",
+	}, provider.Client())
+}
+
+func TestClient_flow(t *testing.T) {
+	provider := oidctest.NewProvider("shop", "s3cret")
+	defer provider.Close()
+	provider.Login(oidctest.User{Subject: "u1", Email: "demo@example.com", EmailVerified: true, Name: "Demo"})
+	client := newTestClient(provider, "s3cret")
+	ctx := context.Background()
+
+	verifier, err := oidc.NewVerifier()
+	assert.Nil(t, err)
+	authURL, err := client.AuthCodeURL(ctx, "state1", "nonce1", oidc.Challenge(verifier))
+	assert.Nil(t, err)
+	u, _ := url.Parse(authURL)
+	assert.Equal(t, "openid email profile", u.Query().Get("scope"))
+	assert.Equal(t, "S256", u.Query().Get("code_challenge_method"))
+
+	callback, err := provider.Authorize(authURL)
+	assert.Nil(t, err)
+	assert.Equal(t, "state1", callback.Get("state"))
+	code := callback.Get("code")
+	assert.NotEmpty(t, code)
+
+	// the nonce of the ID token must match
+	_, err = client.Exchange(ctx, code, verifier, "other")
+	assert.NotNil(t, err)
+
+	callback, _ = provider.Authorize(authURL)
+	claims, err := client.Exchange(ctx, callback.Get("code"), verifier, "nonce1")
+	assert.Nil(t, err)
+	assert.Equal(t, "u1", claims.Subject)
+	assert.Equal(t, "demo@example.com", claims.Email)
+	assert.True(t, claims.EmailVerified)
+	assert.Equal(t, "Demo", claims.Name)
+
+	// codes are single use
+	_, err = client.Exchange(ctx, callback.Get("code"), verifier, "nonce1")
+	assert.NotNil(t, err)
+}
+
+func TestClient_Exchange_pkce(t *testing.T) {
+	provider := oidctest.NewProvider("shop", "s3cret")
+	defer provider.Close()
+	provider.Login(oidctest.User{Subject: "u1"})
+	client := newTestClient(provider, "s3cret")
+	ctx := context.Background()
+
+	verifier, _ := oidc.NewVerifier()
+	authURL, _ := client.AuthCodeURL(ctx, "state", "nonce", oidc.Challenge(verifier))
+	callback, _ := provider.Authorize(authURL)
+
+	// an intercepted code is useless without the verifier
+	other, _ := oidc.NewVerifier()
+	_, err := client.Exchange(ctx, callback.Get("code"), other, "nonce")
+	assert.NotNil(t, err)
+}
+
+func TestClient_Exchange_clientSecret(t *testing.T) {
+	provider := oidctest.NewProvider("shop", "s3cret")
+	defer provider.Close()
+	provider.Login(oidctest.User{Subject: "u1"})
+	client := newTestClient(provider, "wrong")
+	ctx := context.Background()
+
+	verifier, _ := oidc.NewVerifier()
+	authURL, _ := client.AuthCodeURL(ctx, "state", "nonce", oidc.Challenge(verifier))
+	callback, _ := provider.Authorize(authURL)
+	_, err := client.Exchange(ctx, callback.Get("code"), verifier, "nonce")
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "invalid_client")
+	}
+}
+
+func TestProvider_denied(t *testing.T) {
+	provider := oidctest.NewProvider("shop", "s3cret")
+	defer provider.Close()
+	client := newTestClient(provider, "s3cret")
+
+	authURL, _ := client.AuthCodeURL(context.Background(), "state", "nonce", oidc.Challenge("verifier"))
+	callback, err := provider.Authorize(authURL)
+	assert.Nil(t, err)
+	assert.Equal(t, "access_denied", callback.Get("error"))
+	assert.Empty(t, callback.Get("code"))
+}
+
+func TestClient_discovery(t *testing.T) {
+	provider := oidctest.NewProvider("shop", "s3cret")
+	defer provider.Close()
+
+	// the issuer of the discovery document must be the configured one
+	client := oidc.NewClient(oidc.Config{Issuer: provider.Issuer() + "/", ClientID: "shop"}, provider.Client())
+	_, err := client.AuthCodeURL(context.Background(), "state", "nonce", "challenge")
+	assert.NotNil(t, err)
+}
+
+func TestClaims_Valid(t *testing.T) {
+	assert.Nil(t, oidc.Claims{ExpiresAt: time.Now().Add(time.Minute).Unix()}.Valid())
+	assert.NotNil(t, oidc.Claims{ExpiresAt: time.Now().Add(-time.Hour).Unix()}.Valid())
+	assert.NotNil(t, oidc.Claims{}.Valid())
+	var _ jwt.Claims = oidc.Claims{}
+}
+
+func TestChallenge(t *testing.T) {
+	// BASE64URL(SHA256("abc")), without padding
+	assert.Equal(t, "ungWv48Bz-pBQUDeXa4iI7ADYaOWF3qctBD_YfIAFa0", oidc.Challenge("abc"))
+
+	verifier, err := oidc.NewVerifier()
+	assert.Nil(t, err)
+	assert.Len(t, verifier, 43)
+}
@@ -0,0 +1,72 @@
+// Package pagination selects the pages of lists with the "limit" and "offset" query parameters.
+package pagination
+
+import (
+	"errors"
+	routing "github.com/go-ozzo/ozzo-routing/v2"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"strconv"
+)
+
+const (
+	// DefaultLimit is the number of items of the pages whose limit is not given.
+	DefaultLimit = 20
+	// MaxLimit is the maximum number of items of a page.
+	MaxLimit = 100
+)
+
+// Request selects a page of items.
+type Request struct {
+	// Limit is the maximum number of items of the page, DefaultLimit if unset.
+	Limit  int `json:"limit"`
+	Offset int `json:"offset"`
+}
+
+// FromContext reads the page given by the "limit" and "offset" query parameters of a request.
+func FromContext(c *routing.Context) (Request, error) {
+	var page Request
+	errs := validation.Errors{}
+	for name, value := range map[string]*int{"limit": &page.Limit, "offset": &page.Offset} {
+		if c.Query(name) == "" {
+			continue
+		}
+		n, err := strconv.Atoi(c.Query(name))
+		if err != nil {
+			errs[name] = errors.New("must be an integer")
+		}
+		*value = n
+	}
+	if len(errs) > 0 {
+		return page, errs
+	}
+	return page, page.Validate()
+}
+
+// Validate validates the Request fields.
+func (r Request) Validate() error {
+	return validation.ValidateStruct(&r,
+		validation.Field(&r.Limit, validation.Min(0), validation.Max(MaxLimit)),
+		validation.Field(&r.Offset, validation.Min(0)),
+	)
+}
+
+// PageLimit returns the number of items to return.
+func (r Request) PageLimit() int {
+	if r.Limit == 0 {
+		return DefaultLimit
+	}
+	return r.Limit
+}
+
+// Page returns the page of the given items, out of total items.
+func (r Request) Page(items interface{}, total int) Page {
+	return Page{Items: items, Total: total, Offset: r.Offset, Limit: r.PageLimit()}
+}
+
+// Page is a page of items, along with the total number of items.
+type Page struct {
+	Items  interface{} `json:"items"`
+	Total  int         `json:"total"`
+	Offset int         `json:"offset"`
+	Limit  int         `json:"limit"`
+}
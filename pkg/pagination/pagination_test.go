@@ -0,0 +1,31 @@
+package pagination
+
+import (
+	routing "github.com/go-ozzo/ozzo-routing/v2"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/stretchr/testify/assert"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFromContext(t *testing.T) {
+	read := func(query string) (Request, error) {
+		req := httptest.NewRequest("GET", "/items?"+query, nil)
+		return FromContext(routing.NewContext(httptest.NewRecorder(), req))
+	}
+
+	page, err := read("")
+	assert.Nil(t, err)
+	assert.Equal(t, DefaultLimit, page.PageLimit())
+
+	page, err = read("limit=5&offset=10")
+	assert.Nil(t, err)
+	assert.Equal(t, Request{Limit: 5, Offset: 10}, page)
+	assert.Equal(t, Page{Items: []string{"a"}, Total: 11, Offset: 10, Limit: 5}, page.Page([]string{"a"}, 11))
+
+	_, err = read("limit=x&offset=-1")
+	assert.Contains(t, err.(validation.Errors), "limit")
+	_, err = read("limit=1000&offset=-1")
+	assert.Contains(t, err.(validation.Errors), "limit")
+	assert.Contains(t, err.(validation.Errors), "offset")
+}
@@ -0,0 +1,54 @@
+package password
+
+import (
+	"errors"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+)
+
+// Bcrypt hashes passwords with bcrypt, producing hashes in the modular crypt format, like $2a$12$<salt and hash>.
+// Passwords longer than BcryptMaxLength bytes are refused, as bcrypt ignores the bytes past them.
+type Bcrypt struct {
+	Cost int
+}
+
+// DefaultBcrypt is the bcrypt cost used when bcrypt is the preferred algorithm.
+var DefaultBcrypt = Bcrypt{Cost: 12}
+
+// BcryptMaxLength is the maximum length in bytes of the passwords hashed with bcrypt.
+const BcryptMaxLength = 72
+
+// ErrTooLong means a password is too long for bcrypt.
+var ErrTooLong = errors.New("password too long for bcrypt")
+
+// Hash hashes the given password with a random salt.
+func (b Bcrypt) Hash(password string) (string, error) {
+	if len(password) > BcryptMaxLength {
+		return "", ErrTooLong
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), b.Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// Verify tells whether the given password matches the given hash.
+func (b Bcrypt) Verify(password, hash string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Recognizes tells whether the given hash is a bcrypt hash.
+func (b Bcrypt) Recognizes(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+// Outdated tells whether the given hash was produced with another cost than the current one.
+func (b Bcrypt) Outdated(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost != b.Cost
+}
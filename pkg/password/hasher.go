@@ -0,0 +1,69 @@
+// Package password hashes and checks user passwords.
+package password
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrUnknownFormat means a hash was produced by none of the algorithms of a Hasher.
+var ErrUnknownFormat = errors.New("unknown password hash format")
+
+// Algorithm is a password hashing algorithm producing hashes in the PHC string format, or in the
+// modular crypt format for bcrypt.
+type Algorithm interface {
+	// Hash hashes the given password with a random salt.
+	Hash(password string) (string, error)
+	// Verify tells whether the given password matches the given hash.
+	Verify(password, hash string) (bool, error)
+	// Recognizes tells whether the given hash was produced by this algorithm.
+	Recognizes(hash string) bool
+	// Outdated tells whether the given hash, produced by this algorithm, was produced with other parameters than the current ones.
+	Outdated(hash string) bool
+}
+
+// Hasher hashes passwords with a preferred algorithm, and verifies hashes produced by any of its algorithms,
+// so that hashes can be upgraded when users log in.
+type Hasher struct {
+	preferred  Algorithm
+	algorithms []Algorithm
+
+	dummyOnce sync.Once
+	dummy     string
+}
+
+// NewHasher creates a hasher hashing new passwords with the preferred algorithm. Hashes produced by the
+// other algorithms can still be verified.
+func NewHasher(preferred Algorithm, others ...Algorithm) *Hasher {
+	return &Hasher{preferred: preferred, algorithms: append([]Algorithm{preferred}, others...)}
+}
+
+// Hash hashes the given password with the preferred algorithm.
+func (h *Hasher) Hash(password string) (string, error) {
+	return h.preferred.Hash(password)
+}
+
+// Verify tells whether the given password matches the given hash, and if so whether the hash should be
+// replaced by a new one because it was produced by another algorithm or with outdated parameters.
+func (h *Hasher) Verify(password, hash string) (ok bool, rehash bool, err error) {
+	for _, algorithm := range h.algorithms {
+		if !algorithm.Recognizes(hash) {
+			continue
+		}
+		ok, err := algorithm.Verify(password, hash)
+		if err != nil || !ok {
+			return false, false, err
+		}
+		return true, algorithm != h.preferred || algorithm.Outdated(hash), nil
+	}
+	return false, false, ErrUnknownFormat
+}
+
+// VerifyNothing takes as long as verifying a password against a hash of the preferred algorithm.
+// It is meant for users who do not exist, so that response times do not tell which users do.
+func (h *Hasher) VerifyNothing(password string) {
+	h.dummyOnce.Do(func() {
+		h.dummy, _ = h.preferred.Hash("dummy password")
+	})
+	_, _ = h.preferred.Verify(password, h.dummy)
+}
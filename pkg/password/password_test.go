@@ -0,0 +1,109 @@
+package password
+
+import (
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var (
+	fastArgon2id = Argon2id{Memory: 1024, Time: 1, Threads: 1, SaltLength: 16, KeyLength: 32}
+	fastBcrypt   = Bcrypt{Cost: bcrypt.MinCost}
+)
+
+func TestArgon2id(t *testing.T) {
+	hash, err := fastArgon2id.Hash("secret123")
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(hash, "$argon2id$v=19$m=1024,t=1,p=1$"), hash)
+	assert.True(t, fastArgon2id.Recognizes(hash))
+	assert.False(t, fastArgon2id.Outdated(hash))
+
+	ok, err := fastArgon2id.Verify("secret123", hash)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, _ = fastArgon2id.Verify("secret124", hash)
+	assert.False(t, ok)
+
+	other, _ := fastArgon2id.Hash("secret123")
+	assert.NotEqual(t, hash, other, "salts are random")
+
+	stronger := fastArgon2id
+	stronger.Time = 2
+	assert.True(t, stronger.Outdated(hash))
+	// hashes keep verifying after the parameters changed
+	ok, _ = stronger.Verify("secret123", hash)
+	assert.True(t, ok)
+
+	_, err = fastArgon2id.Verify("secret123", "$argon2id$v=19$garbage")
+	assert.NotNil(t, err)
+}
+
+func TestBcrypt(t *testing.T) {
+	hash, err := fastBcrypt.Hash("secret123")
+	assert.Nil(t, err)
+	assert.True(t, fastBcrypt.Recognizes(hash))
+	assert.False(t, fastBcrypt.Recognizes("$argon2id$v=19$m=1,t=1,p=1$a$b"))
+	assert.False(t, fastBcrypt.Outdated(hash))
+	assert.True(t, Bcrypt{Cost: bcrypt.MinCost + 1}.Outdated(hash))
+
+	ok, err := fastBcrypt.Verify("secret123", hash)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, err = fastBcrypt.Verify("wrong", hash)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	_, err = fastBcrypt.Hash(strings.Repeat("a", 73))
+	assert.Equal(t, ErrTooLong, err)
+}
+
+func TestHasher_Verify(t *testing.T) {
+	hasher := NewHasher(fastArgon2id, fastBcrypt)
+	legacy, _ := fastBcrypt.Hash("secret123")
+	current, _ := hasher.Hash("secret123")
+
+	ok, rehash, err := hasher.Verify("secret123", current)
+	assert.True(t, ok)
+	assert.False(t, rehash)
+	assert.Nil(t, err)
+
+	// hashes of the other algorithms are verified, and should be upgraded
+	ok, rehash, err = hasher.Verify("secret123", legacy)
+	assert.True(t, ok)
+	assert.True(t, rehash)
+	assert.Nil(t, err)
+
+	ok, rehash, _ = hasher.Verify("wrong", legacy)
+	assert.False(t, ok)
+	assert.False(t, rehash)
+
+	_, _, err = hasher.Verify("secret123", "plain text")
+	assert.Equal(t, ErrUnknownFormat, err)
+
+	hasher.VerifyNothing("secret123")
+}
+
+func TestPolicy_Check(t *testing.T) {
+	policy := Policy{MinLength: 10, MaxLength: 20, Breached: map[string]struct{}{"password123": {}}}
+	assert.Nil(t, policy.Check("correct horse"))
+	assert.NotNil(t, policy.Check("short"))
+	assert.NotNil(t, policy.Check(strings.Repeat("a", 21)))
+	assert.NotNil(t, policy.Check("PassWord123"))
+	// lengths count characters, not bytes
+	assert.Nil(t, policy.Check("pässwörtéé"))
+}
+
+func TestLoadBreached(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	assert.Nil(t, ioutil.WriteFile(path, []byte("# top passwords\n123456\n\nPassword1\n"), 0644))
+
+	breached, err := LoadBreached(path)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]struct{}{"123456": {}, "password1": {}}, breached)
+
+	_, err = LoadBreached(filepath.Join(t.TempDir(), "missing.txt"))
+	assert.NotNil(t, err)
+}
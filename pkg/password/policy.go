@@ -0,0 +1,56 @@
+package password
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// Policy is the set of rules new passwords must follow.
+type Policy struct {
+	MinLength int
+	MaxLength int
+	// Breached is the set of passwords known from data breaches, in lower case. They are refused whatever their case.
+	Breached map[string]struct{}
+}
+
+// DefaultPolicy accepts passwords of 8 to 128 characters which are not known from data breaches.
+var DefaultPolicy = Policy{MinLength: 8, MaxLength: 128}
+
+// Check returns a description of the first rule the given password breaks, or nil if it follows them all.
+func (p Policy) Check(password string) error {
+	n := utf8.RuneCountInString(password)
+	if p.MinLength > 0 && n < p.MinLength {
+		return fmt.Errorf("must be at least %d characters long", p.MinLength)
+	}
+	if p.MaxLength > 0 && n > p.MaxLength {
+		return fmt.Errorf("must be at most %d characters long", p.MaxLength)
+	}
+	if _, ok := p.Breached[strings.ToLower(password)]; ok {
+		return fmt.Errorf("is too common, it has appeared in a data breach")
+	}
+	return nil
+}
+
+// LoadBreached loads a list of breached passwords, one per line, such as the lists of most common passwords
+// published by security researchers. Empty lines and lines starting with # are ignored.
+func LoadBreached(path string) (map[string]struct{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	breached := map[string]struct{}{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		breached[strings.ToLower(line)] = struct{}{}
+	}
+	return breached, scanner.Err()
+}
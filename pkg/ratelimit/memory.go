@@ -0,0 +1,62 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps token buckets in process memory. It is suitable for a single server instance.
+type MemoryStore struct {
+	mu      sync.Mutex
+	buckets map[string]*entry
+	now     func() time.Time
+	swept   time.Time
+}
+
+// entry is a bucket along with the limit it was last used with.
+type entry struct {
+	*bucket
+	limit Limit
+}
+
+// sweepInterval is how often the memory store drops buckets which have been refilled completely.
+const sweepInterval = time.Minute
+
+// NewMemoryStore creates a new in-memory store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets: map[string]*entry{},
+		now:     time.Now,
+	}
+}
+
+// Take takes a token from the bucket identified by key.
+func (s *MemoryStore) Take(ctx context.Context, key string, limit Limit) (Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	s.sweep(now)
+
+	e, ok := s.buckets[key]
+	if !ok {
+		e = &entry{bucket: newBucket(now, limit)}
+		s.buckets[key] = e
+	}
+	e.limit = limit
+	return e.take(now, limit), nil
+}
+
+// sweep periodically drops buckets which would be full by now, as they are equivalent to missing ones.
+func (s *MemoryStore) sweep(now time.Time) {
+	if now.Sub(s.swept) < sweepInterval {
+		return
+	}
+	s.swept = now
+	for key, e := range s.buckets {
+		if !e.fullAt(e.limit).After(now) {
+			delete(s.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package ratelimit
+
+import (
+	routing "github.com/go-ozzo/ozzo-routing/v2"
+	"github.com/online-shop/pkg/log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// KeyFunc identifies the client a request is counted against, e.g. by IP address or user ID.
+// An empty key exempts the request from rate limiting.
+type KeyFunc func(c *routing.Context) string
+
+// LimitFunc identifies the client a request is counted against, along with the limit applying to that client.
+// An empty key exempts the request from rate limiting.
+type LimitFunc func(c *routing.Context) (string, Limit)
+
+// ByIP identifies clients by the IP address the request came from.
+func ByIP(c *routing.Context) string {
+	host, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+	if err != nil {
+		return c.Request.RemoteAddr
+	}
+	return host
+}
+
+// Handler returns a middleware that limits the rate of requests per client within the given scope.
+// The scope is typically the name of the route (or group of routes) the middleware is attached to,
+// so that each route gets its own buckets.
+//
+// Requests over the limit are rejected with 429 and a Retry-After header telling how many seconds to wait.
+// If the store fails, the request is let through and the error is logged.
+func Handler(store Store, scope string, limit Limit, key KeyFunc, logger log.Logger) routing.Handler {
+	return HandlerFunc(store, scope, func(c *routing.Context) (string, Limit) {
+		return key(c), limit
+	}, logger)
+}
+
+// HandlerFunc is like Handler, except that the limit may differ from one client to another.
+func HandlerFunc(store Store, scope string, limitFunc LimitFunc, logger log.Logger) routing.Handler {
+	return func(c *routing.Context) error {
+		k, limit := limitFunc(c)
+		if k == "" {
+			return nil
+		}
+
+		result, err := store.Take(c.Request.Context(), scope+":"+k, limit)
+		if err != nil {
+			logger.With(c.Request.Context()).Errorf("rate limit store failed: %v", err)
+			return nil
+		}
+
+		header := c.Response.Header()
+		header.Set("X-RateLimit-Limit", strconv.Itoa(limit.Burst))
+		header.Set("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		if !result.Allowed {
+			logger.With(c.Request.Context(), "scope", scope, "key", k).Infof("rate limit exceeded")
+			header.Set("Retry-After", strconv.Itoa(int(math.Ceil(result.RetryAfter.Seconds()))))
+			return routing.NewHTTPError(http.StatusTooManyRequests)
+		}
+		return nil
+	}
+}
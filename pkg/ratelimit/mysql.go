@@ -0,0 +1,74 @@
+package ratelimit
+
+import (
+	"context"
+	"github.com/online-shop/pkg/mysql"
+	"sync"
+	"time"
+)
+
+// MySQLStore keeps token buckets in the rate_limit table so that they are shared by all server instances.
+type MySQLStore struct {
+	db    *mysql.BaseRepository
+	now   func() time.Time
+	mu    sync.Mutex
+	swept time.Time
+}
+
+// NewMySQLStore creates a new store backed by the rate_limit table.
+func NewMySQLStore(db *mysql.BaseRepository) *MySQLStore {
+	return &MySQLStore{db: db, now: time.Now}
+}
+
+// Take takes a token from the bucket identified by key.
+// A full bucket row is created if it is missing, and the row is then locked for the duration of the update,
+// so that concurrent requests can neither overdraw it nor deadlock on the gap lock of a missing row.
+func (s *MySQLStore) Take(ctx context.Context, key string, limit Limit) (result Result, err error) {
+	now := s.now().UTC()
+	if err := s.sweep(ctx, now); err != nil {
+		return Result{}, err
+	}
+
+	tx, err := s.db.BeginTx(ctx)
+	if err != nil {
+		return Result{}, err
+	}
+	defer func() {
+		err = s.db.EndTx(tx, err)
+	}()
+
+	b := newBucket(now, limit)
+	_, err = tx.ExecContext(ctx, "insert into rate_limit (bucket, tokens, updated_at, full_at) values (?, ?, ?, ?) "+
+		"on duplicate key update bucket = bucket", key, b.tokens, b.updated, b.fullAt(limit))
+	if err != nil {
+		return Result{}, err
+	}
+	err = tx.QueryRowContext(ctx, "select tokens, updated_at from rate_limit where bucket = ? for update", key).
+		Scan(&b.tokens, &b.updated)
+	if err != nil {
+		return Result{}, err
+	}
+
+	result = b.take(now, limit)
+	_, err = tx.ExecContext(ctx, "update rate_limit set tokens = ?, updated_at = ?, full_at = ? where bucket = ?",
+		b.tokens, b.updated, b.fullAt(limit), key)
+	if err != nil {
+		return Result{}, err
+	}
+
+	return result, nil
+}
+
+// sweep periodically deletes buckets which would be full by now, as they are equivalent to missing ones.
+func (s *MySQLStore) sweep(ctx context.Context, now time.Time) error {
+	s.mu.Lock()
+	if now.Sub(s.swept) < sweepInterval {
+		s.mu.Unlock()
+		return nil
+	}
+	s.swept = now
+	s.mu.Unlock()
+
+	_, err := s.db.MasterDB.ExecContext(ctx, "delete from rate_limit where full_at <= ?", now)
+	return err
+}
@@ -0,0 +1,81 @@
+// Package ratelimit provides token bucket rate limiting backed by pluggable stores.
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// Limit describes a token bucket: it holds at most Burst tokens and refills at Rate tokens per second.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// PerMinute returns a limit allowing n requests per minute on average, with bursts of up to burst requests.
+func PerMinute(n, burst int) Limit {
+	return Limit{Rate: float64(n) / 60, Burst: burst}
+}
+
+// PerSecond returns a limit allowing n requests per second on average, with bursts of up to burst requests.
+func PerSecond(n, burst int) Limit {
+	return Limit{Rate: float64(n), Burst: burst}
+}
+
+// Result is the outcome of taking a token from a bucket.
+type Result struct {
+	// Allowed tells whether a token was available.
+	Allowed bool
+	// Remaining is the number of whole tokens left in the bucket.
+	Remaining int
+	// RetryAfter is how long to wait until a token becomes available. It is zero if the request was allowed.
+	RetryAfter time.Duration
+}
+
+// Store keeps the state of token buckets.
+type Store interface {
+	// Take takes a token from the bucket identified by key, creating a full bucket if it does not exist yet.
+	Take(ctx context.Context, key string, limit Limit) (Result, error)
+}
+
+// bucket is the state of a single token bucket.
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// take refills the bucket for the time elapsed since its last update and then tries to take a token from it.
+func (b *bucket) take(now time.Time, limit Limit) Result {
+	if elapsed := now.Sub(b.updated).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(float64(limit.Burst), b.tokens+elapsed*limit.Rate)
+	}
+	b.updated = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return Result{Allowed: true, Remaining: int(b.tokens)}
+	}
+
+	var retryAfter time.Duration
+	if limit.Rate > 0 {
+		retryAfter = time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+	} else {
+		retryAfter = time.Duration(math.MaxInt64)
+	}
+	return Result{Allowed: false, RetryAfter: retryAfter}
+}
+
+// newBucket creates a full bucket for the given limit.
+func newBucket(now time.Time, limit Limit) *bucket {
+	return &bucket{tokens: float64(limit.Burst), updated: now}
+}
+
+// fullAt returns the time at which the bucket will have been refilled completely.
+func (b *bucket) fullAt(limit Limit) time.Time {
+	missing := float64(limit.Burst) - b.tokens
+	if missing <= 0 {
+		return b.updated
+	}
+	return b.updated.Add(time.Duration(missing / limit.Rate * float64(time.Second)))
+}
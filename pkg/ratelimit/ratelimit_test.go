@@ -0,0 +1,107 @@
+package ratelimit
+
+import (
+	"context"
+	routing "github.com/go-ozzo/ozzo-routing/v2"
+	"github.com/online-shop/pkg/log"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLimit(t *testing.T) {
+	assert.Equal(t, Limit{Rate: 0.5, Burst: 5}, PerMinute(30, 5))
+	assert.Equal(t, Limit{Rate: 10, Burst: 20}, PerSecond(10, 20))
+}
+
+func Test_bucket_take(t *testing.T) {
+	now := time.Now()
+	limit := PerSecond(1, 2)
+	b := newBucket(now, limit)
+
+	assert.Equal(t, Result{Allowed: true, Remaining: 1}, b.take(now, limit))
+	assert.Equal(t, Result{Allowed: true, Remaining: 0}, b.take(now, limit))
+	res := b.take(now, limit)
+	assert.False(t, res.Allowed)
+	assert.Equal(t, time.Second, res.RetryAfter)
+
+	res = b.take(now.Add(500*time.Millisecond), limit)
+	assert.False(t, res.Allowed)
+	assert.Equal(t, 500*time.Millisecond, res.RetryAfter)
+
+	assert.True(t, b.take(now.Add(time.Second), limit).Allowed)
+
+	// the bucket never holds more than the burst size
+	assert.Equal(t, Result{Allowed: true, Remaining: 1}, b.take(now.Add(time.Hour), limit))
+}
+
+func Test_bucket_fullAt(t *testing.T) {
+	now := time.Now()
+	limit := PerSecond(2, 4)
+	b := newBucket(now, limit)
+	assert.Equal(t, now, b.fullAt(limit))
+
+	b.take(now, limit)
+	b.take(now, limit)
+	b.take(now, limit)
+	assert.Equal(t, now.Add(1500*time.Millisecond), b.fullAt(limit))
+}
+
+func TestMemoryStore(t *testing.T) {
+	now := time.Now()
+	store := NewMemoryStore()
+	store.now = func() time.Time { return now }
+	limit := PerMinute(60, 1)
+
+	res, err := store.Take(context.Background(), "a", limit)
+	assert.Nil(t, err)
+	assert.True(t, res.Allowed)
+	res, _ = store.Take(context.Background(), "a", limit)
+	assert.False(t, res.Allowed)
+	res, _ = store.Take(context.Background(), "b", limit)
+	assert.True(t, res.Allowed)
+
+	// full buckets are swept
+	now = now.Add(2 * sweepInterval)
+	res, _ = store.Take(context.Background(), "a", limit)
+	assert.True(t, res.Allowed)
+	assert.Len(t, store.buckets, 1)
+}
+
+func TestHandler(t *testing.T) {
+	logger, _ := log.NewForTest()
+	handler := Handler(NewMemoryStore(), "login", PerMinute(1, 2), ByIP, logger)
+
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		res := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/login", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		err := handler(routing.NewContext(res, req))
+		if want == http.StatusOK {
+			assert.Nil(t, err, i)
+			assert.Equal(t, "2", res.Header().Get("X-RateLimit-Limit"))
+		} else if assert.NotNil(t, err) {
+			assert.Equal(t, want, err.(routing.HTTPError).StatusCode())
+			assert.Equal(t, "60", res.Header().Get("Retry-After"))
+		}
+	}
+
+	// other clients are not affected
+	req, _ := http.NewRequest("POST", "/v1/login", nil)
+	req.RemoteAddr = "10.0.0.2:1234"
+	assert.Nil(t, handler(routing.NewContext(httptest.NewRecorder(), req)))
+
+	// requests without a key are exempted
+	exempt := Handler(NewMemoryStore(), "orders", PerMinute(1, 0), func(c *routing.Context) string { return "" }, logger)
+	assert.Nil(t, exempt(routing.NewContext(httptest.NewRecorder(), req)))
+}
+
+func TestByIP(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	assert.Equal(t, "10.0.0.1", ByIP(routing.NewContext(httptest.NewRecorder(), req)))
+	req.RemoteAddr = "10.0.0.1"
+	assert.Equal(t, "10.0.0.1", ByIP(routing.NewContext(httptest.NewRecorder(), req)))
+}
@@ -0,0 +1,95 @@
+// Package routepattern maps request paths back to the route patterns registered with a router,
+// so that requests can be grouped by "/v1/orders/<id>" rather than by every distinct order ID.
+package routepattern
+
+import (
+	routing "github.com/go-ozzo/ozzo-routing/v2"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Unmatched is the pattern reported for requests that do not match any registered route.
+const Unmatched = "unmatched"
+
+// Matcher maps request paths back to the route patterns registered with a router.
+// The patterns are compiled on first use, once all routes have been registered.
+type Matcher struct {
+	once   sync.Once
+	routes map[string][]routePattern
+}
+
+type routePattern struct {
+	path   string
+	re     *regexp.Regexp
+	params int
+}
+
+// Match returns the pattern of the route which handles the given method and path.
+// When several routes match, the one with the fewest parameters wins, mirroring the router's
+// preference for static path segments.
+func (m *Matcher) Match(router *routing.Router, method, path string) string {
+	if router == nil {
+		return Unmatched
+	}
+	m.once.Do(func() {
+		m.routes = map[string][]routePattern{}
+		for _, route := range router.Routes() {
+			if re, params, err := compileRoute(route.Path()); err == nil {
+				m.routes[route.Method()] = append(m.routes[route.Method()], routePattern{route.Path(), re, params})
+			}
+		}
+	})
+
+	best := -1
+	var matched routePattern
+	for _, route := range m.routes[method] {
+		if route.re.MatchString(path) && (best == -1 || route.params < best) {
+			best, matched = route.params, route
+		}
+	}
+	if best == -1 {
+		return Unmatched
+	}
+	return matched.path
+}
+
+// compileRoute converts a route path such as "/v1/orders/<id>" or "/files/<path:.*>" into a regular expression.
+// It also returns the number of parameters found in the path.
+func compileRoute(path string) (*regexp.Regexp, int, error) {
+	var (
+		b      strings.Builder
+		params int
+	)
+	if strings.HasSuffix(path, "*") {
+		path = path[:len(path)-1] + "<:.*>"
+	}
+	b.WriteString("^")
+	for len(path) > 0 {
+		start := strings.Index(path, "<")
+		if start < 0 {
+			b.WriteString(regexp.QuoteMeta(path))
+			break
+		}
+		end := strings.Index(path[start:], ">")
+		if end < 0 {
+			b.WriteString(regexp.QuoteMeta(path))
+			break
+		}
+		end += start
+
+		b.WriteString(regexp.QuoteMeta(path[:start]))
+		token := path[start+1 : end]
+		if i := strings.Index(token, ":"); i >= 0 {
+			b.WriteString("(" + token[i+1:] + ")")
+		} else {
+			b.WriteString("[^/]*")
+		}
+		params++
+		path = path[end+1:]
+	}
+	b.WriteString("$")
+
+	re, err := regexp.Compile(b.String())
+	return re, params, err
+}
@@ -0,0 +1,45 @@
+package routepattern
+
+import (
+	routing "github.com/go-ozzo/ozzo-routing/v2"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestMatcher_Match(t *testing.T) {
+	router := routing.New()
+	router.Get("/v1/orders/<id>")
+	router.Get("/v1/orders/latest")
+	router.Post("/v1/orders")
+
+	m := &Matcher{}
+	assert.Equal(t, Unmatched, m.Match(nil, "GET", "/v1/orders/1"))
+	assert.Equal(t, "/v1/orders/<id>", m.Match(router, "GET", "/v1/orders/1"))
+	assert.Equal(t, "/v1/orders/latest", m.Match(router, "GET", "/v1/orders/latest"))
+	assert.Equal(t, "/v1/orders", m.Match(router, "POST", "/v1/orders"))
+	assert.Equal(t, Unmatched, m.Match(router, "DELETE", "/v1/orders/1"))
+	assert.Equal(t, Unmatched, m.Match(router, "GET", "/v2/orders"))
+}
+
+func Test_compileRoute(t *testing.T) {
+	tests := []struct {
+		path, request string
+		params        int
+		match         bool
+	}{
+		{"/healthz", "/healthz", 0, true},
+		{"/healthz", "/healthzz", 0, false},
+		{"/v1/orders/<id>", "/v1/orders/abc", 1, true},
+		{"/v1/orders/<id>", "/v1/orders/abc/items", 1, false},
+		{`/v1/products/<id:\d+>`, "/v1/products/12", 1, true},
+		{`/v1/products/<id:\d+>`, "/v1/products/ab", 1, false},
+		{"/static/*", "/static/css/app.css", 1, true},
+	}
+	for _, tc := range tests {
+		re, params, err := compileRoute(tc.path)
+		if assert.Nil(t, err, tc.path) {
+			assert.Equal(t, tc.params, params, tc.path)
+			assert.Equal(t, tc.match, re.MatchString(tc.request), tc.path+" "+tc.request)
+		}
+	}
+}
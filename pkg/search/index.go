@@ -0,0 +1,337 @@
+// Package search provides an in-process full-text index with prefix matching, typo tolerance,
+// relevance ranking and faceted counts.
+package search
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Document is a searchable document.
+type Document struct {
+	ID string
+	// Fields maps the names of the text fields of the document to their text.
+	Fields map[string]string
+	// Facets maps the names of facets to the values of the document, such as its categories.
+	Facets map[string][]string
+}
+
+// Query is a search query.
+type Query struct {
+	// Text is the text to search for. Every word must match, exactly, as a prefix or with a typo.
+	// All documents match an empty text.
+	Text string
+	// Filters restricts the results to the documents having one of the given values for every facet.
+	Filters map[string][]string
+	Offset  int
+	// Limit is the maximum number of hits to return. Zero means no limit.
+	Limit int
+}
+
+// Hit is a document matching a query.
+type Hit struct {
+	ID    string
+	Score float64
+}
+
+// Result is the result of a query.
+type Result struct {
+	// Hits are the matching documents of the requested page, by decreasing relevance.
+	Hits []Hit
+	// Total is the number of matching documents.
+	Total int
+	// Facets maps the names of facets to the number of matching documents per value. A facet is counted
+	// ignoring its own filter, so that the counts tell how many results selecting another value would give.
+	Facets map[string]map[string]int
+}
+
+const (
+	// minPrefixLength is the length from which query words match the words they start.
+	minPrefixLength = 2
+	// prefixWeight and typoWeight scale the score of words matched as a prefix or with typos.
+	prefixWeight = 0.7
+	typoWeight   = 0.5
+)
+
+// maxTypos returns the number of typos tolerated in a query word: none in short words, whose typos would match
+// too many words, one from 4 characters and two from 8.
+func maxTypos(word []rune) int {
+	switch {
+	case len(word) >= 8:
+		return 2
+	case len(word) >= 4:
+		return 1
+	}
+	return 0
+}
+
+// indexed is a document as stored in the index.
+type indexed struct {
+	terms  []string
+	facets map[string][]string
+}
+
+// Index is an in-process inverted index. It is safe for concurrent use.
+// Prefix and typo matches scan the whole vocabulary, which suits catalogues of up to tens of thousands of words.
+type Index struct {
+	mu      sync.RWMutex
+	weights map[string]float64
+	docs    map[string]indexed
+	// postings maps every term to the weighted frequency of the term in the documents having it.
+	postings map[string]map[string]float64
+}
+
+// NewIndex creates an empty index. Weights give the importance of matches in the given fields,
+// fields missing from the map having a weight of 1.
+func NewIndex(weights map[string]float64) *Index {
+	return &Index{weights: weights, docs: map[string]indexed{}, postings: map[string]map[string]float64{}}
+}
+
+// Tokenize splits text into lower-case words made of letters and digits.
+func Tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// Put adds a document to the index, replacing the one having the same ID if any.
+func (ix *Index) Put(doc Document) {
+	frequencies := map[string]float64{}
+	for field, text := range doc.Fields {
+		weight, ok := ix.weights[field]
+		if !ok {
+			weight = 1
+		}
+		counts := map[string]int{}
+		for _, term := range Tokenize(text) {
+			counts[term]++
+		}
+		for term, count := range counts {
+			frequencies[term] += weight * (1 + math.Log(float64(count)))
+		}
+	}
+
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.delete(doc.ID)
+	terms := make([]string, 0, len(frequencies))
+	for term, frequency := range frequencies {
+		if ix.postings[term] == nil {
+			ix.postings[term] = map[string]float64{}
+		}
+		ix.postings[term][doc.ID] = frequency
+		terms = append(terms, term)
+	}
+	ix.docs[doc.ID] = indexed{terms: terms, facets: doc.Facets}
+}
+
+// Delete removes a document from the index.
+func (ix *Index) Delete(id string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.delete(id)
+}
+
+// delete removes a document from the index, which must be locked for writing.
+func (ix *Index) delete(id string) {
+	doc, ok := ix.docs[id]
+	if !ok {
+		return
+	}
+	for _, term := range doc.terms {
+		delete(ix.postings[term], id)
+		if len(ix.postings[term]) == 0 {
+			delete(ix.postings, term)
+		}
+	}
+	delete(ix.docs, id)
+}
+
+// Len returns the number of documents in the index.
+func (ix *Index) Len() int {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return len(ix.docs)
+}
+
+// Search returns the documents matching the given query.
+func (ix *Index) Search(q Query) Result {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	scores := ix.match(Tokenize(q.Text))
+	result := Result{Facets: map[string]map[string]int{}}
+	for name := range q.Filters {
+		result.Facets[name] = map[string]int{}
+	}
+	for id, score := range scores {
+		doc := ix.docs[id]
+		failed := ""
+		for name, values := range q.Filters {
+			if !hasAny(doc.facets[name], values) {
+				if failed != "" {
+					// failing two filters, the document counts in no facet
+					failed = "\x00"
+					break
+				}
+				failed = name
+			}
+		}
+		if failed == "\x00" {
+			continue
+		}
+		for name, values := range doc.facets {
+			if failed != "" && failed != name {
+				continue
+			}
+			if result.Facets[name] == nil {
+				result.Facets[name] = map[string]int{}
+			}
+			for _, value := range values {
+				result.Facets[name][value]++
+			}
+		}
+		if failed == "" {
+			result.Hits = append(result.Hits, Hit{ID: id, Score: score})
+		}
+	}
+
+	sort.Slice(result.Hits, func(i, j int) bool {
+		a, b := result.Hits[i], result.Hits[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		return a.ID < b.ID
+	})
+	result.Total = len(result.Hits)
+	if q.Offset >= len(result.Hits) {
+		result.Hits = nil
+	} else {
+		result.Hits = result.Hits[q.Offset:]
+	}
+	if q.Limit > 0 && len(result.Hits) > q.Limit {
+		result.Hits = result.Hits[:q.Limit]
+	}
+	return result
+}
+
+// match returns the scores of the documents matching all the given words, or of all documents if there are none.
+func (ix *Index) match(words []string) map[string]float64 {
+	scores := map[string]float64{}
+	if len(words) == 0 {
+		for id := range ix.docs {
+			scores[id] = 0
+		}
+		return scores
+	}
+
+	for i, word := range words {
+		wordScores := ix.matchWord(word)
+		if i == 0 {
+			scores = wordScores
+			continue
+		}
+		for id, score := range scores {
+			if wordScore, ok := wordScores[id]; ok {
+				scores[id] = score + wordScore
+			} else {
+				delete(scores, id)
+			}
+		}
+	}
+	return scores
+}
+
+// matchWord returns the scores of the documents matching the given word, keeping the best match of each document.
+func (ix *Index) matchWord(word string) map[string]float64 {
+	scores := map[string]float64{}
+	runes := []rune(word)
+	typos := maxTypos(runes)
+	for term, postings := range ix.postings {
+		weight := 0.0
+		switch {
+		case term == word:
+			weight = 1
+		case len(runes) >= minPrefixLength && strings.HasPrefix(term, word):
+			weight = prefixWeight
+		case typos > 0:
+			if d := distance(runes, []rune(term), typos); d <= typos {
+				weight = typoWeight / float64(d)
+			}
+		}
+		if weight == 0 {
+			continue
+		}
+		// rare terms are more relevant than common ones
+		idf := math.Log(1 + float64(len(ix.docs))/float64(len(postings)))
+		for id, frequency := range postings {
+			if score := weight * idf * frequency; score > scores[id] {
+				scores[id] = score
+			}
+		}
+	}
+	return scores
+}
+
+// hasAny tells whether the given values contain any of the wanted ones.
+func hasAny(values, wanted []string) bool {
+	for _, value := range values {
+		for _, w := range wanted {
+			if value == w {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// distance returns the Damerau-Levenshtein distance between two words, counting transpositions of adjacent
+// characters as one typo. Distances above max are not computed exactly: max+1 is returned instead.
+func distance(a, b []rune, max int) int {
+	if d := len(a) - len(b); d > max || -d > max {
+		return max + 1
+	}
+	// rows i-2, i-1 and i of the distance matrix
+	prev2, prev, cur := make([]int, len(b)+1), make([]int, len(b)+1), make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		best := cur[0]
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				cur[j] = min(cur[j], prev2[j-2]+1)
+			}
+			if cur[j] < best {
+				best = cur[j]
+			}
+		}
+		if best > max {
+			return max + 1
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	if prev[len(b)] > max {
+		return max + 1
+	}
+	return prev[len(b)]
+}
+
+func min(values ...int) int {
+	m := values[0]
+	for _, v := range values[1:] {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
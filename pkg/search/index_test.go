@@ -0,0 +1,97 @@
+package search
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// ids returns the IDs of the given hits.
+func ids(hits []Hit) []string {
+	items := []string{}
+	for _, hit := range hits {
+		items = append(items, hit.ID)
+	}
+	return items
+}
+
+func newTestIndex() *Index {
+	ix := NewIndex(map[string]float64{"title": 2})
+	ix.Put(Document{ID: "1", Fields: map[string]string{"title": "Wireless keyboard", "body": "Compact, quiet keyboard."}, Facets: map[string][]string{"color": {"black"}}})
+	ix.Put(Document{ID: "2", Fields: map[string]string{"title": "Mechanical keyboard", "body": "Loud."}, Facets: map[string][]string{"color": {"white", "black"}}})
+	ix.Put(Document{ID: "3", Fields: map[string]string{"title": "Wireless mouse", "body": "Works with any keyboard."}, Facets: map[string][]string{"color": {"white"}}})
+	return ix
+}
+
+func TestTokenize(t *testing.T) {
+	assert.Equal(t, []string{"t", "shirt", "100", "coton", "größe", "m"}, Tokenize("T-Shirt, 100% coton (Größe: M)"))
+	assert.Empty(t, Tokenize(" -- "))
+}
+
+func TestDistance(t *testing.T) {
+	assert.Equal(t, 0, distance([]rune("shirt"), []rune("shirt"), 2))
+	assert.Equal(t, 1, distance([]rune("shirt"), []rune("shrit"), 2), "transpositions are one typo")
+	assert.Equal(t, 1, distance([]rune("shirt"), []rune("shirts"), 2))
+	assert.Equal(t, 2, distance([]rune("keyboard"), []rune("kyebord"), 2))
+	assert.Equal(t, 3, distance([]rune("mouse"), []rune("keyboard"), 2), "distances above the maximum are capped")
+}
+
+func TestIndex_Search(t *testing.T) {
+	ix := newTestIndex()
+
+	result := ix.Search(Query{Text: "keyboard"})
+	assert.Equal(t, []string{"1", "2", "3"}, ids(result.Hits), "matches in weighted fields rank first")
+	assert.Equal(t, 3, result.Total)
+
+	// every word must match
+	assert.Equal(t, []string{"1", "3"}, ids(ix.Search(Query{Text: "wireless keyboard"}).Hits))
+	assert.Equal(t, []string{"2"}, ids(ix.Search(Query{Text: "mechanical keyboard"}).Hits))
+	// prefixes
+	assert.Equal(t, []string{"1", "3"}, ids(ix.Search(Query{Text: "WIRE"}).Hits))
+	assert.Empty(t, ix.Search(Query{Text: "w"}).Hits, "single letters are not prefixes")
+	// typos
+	assert.Equal(t, []string{"3"}, ids(ix.Search(Query{Text: "mosue"}).Hits))
+	assert.Equal(t, []string{"2"}, ids(ix.Search(Query{Text: "mechanicl kyeboard"}).Hits))
+	assert.Empty(t, ix.Search(Query{Text: "lod"}).Hits, "short words must match exactly")
+	// exact matches rank before typos
+	ix.Put(Document{ID: "4", Fields: map[string]string{"title": "Mouse pad"}})
+	ix.Put(Document{ID: "5", Fields: map[string]string{"title": "Moose pad"}})
+	assert.Equal(t, []string{"4", "5"}, ids(ix.Search(Query{Text: "mouse pad"}).Hits))
+
+	// empty texts match all documents
+	result = ix.Search(Query{Offset: 1, Limit: 2})
+	assert.Equal(t, []string{"2", "3"}, ids(result.Hits))
+	assert.Equal(t, 5, result.Total)
+	assert.Empty(t, ix.Search(Query{Offset: 5}).Hits)
+}
+
+func TestIndex_Facets(t *testing.T) {
+	ix := newTestIndex()
+
+	result := ix.Search(Query{Text: "keyboard"})
+	assert.Equal(t, map[string]int{"black": 2, "white": 2}, result.Facets["color"])
+
+	result = ix.Search(Query{Text: "keyboard", Filters: map[string][]string{"color": {"white"}}})
+	assert.Equal(t, []string{"2", "3"}, ids(result.Hits))
+	assert.Equal(t, map[string]int{"black": 2, "white": 2}, result.Facets["color"], "facets ignore their own filter")
+
+	ix.Put(Document{ID: "4", Fields: map[string]string{"title": "Keyboard cover"}, Facets: map[string][]string{"color": {"black"}, "size": {"small"}}})
+	result = ix.Search(Query{Filters: map[string][]string{"color": {"white"}, "size": {"small"}}})
+	assert.Empty(t, result.Hits)
+	assert.Equal(t, map[string]int{"black": 1}, result.Facets["color"])
+	assert.Empty(t, result.Facets["size"])
+}
+
+func TestIndex_PutDelete(t *testing.T) {
+	ix := newTestIndex()
+
+	ix.Put(Document{ID: "1", Fields: map[string]string{"title": "Ergonomic keyboard"}})
+	assert.Equal(t, []string{"3"}, ids(ix.Search(Query{Text: "wireless keyboard"}).Hits), "documents are replaced")
+	assert.Equal(t, []string{"1"}, ids(ix.Search(Query{Text: "ergonomic"}).Hits))
+
+	ix.Delete("1")
+	ix.Delete("unknown")
+	assert.Equal(t, 2, ix.Len())
+	assert.Empty(t, ix.Search(Query{Text: "ergonomic"}).Hits)
+	_, ok := ix.postings["ergonomic"]
+	assert.False(t, ok, "unused terms are removed")
+}
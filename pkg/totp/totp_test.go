@@ -0,0 +1,77 @@
+package totp
+
+import (
+	"encoding/base32"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA1 secret of the RFC 6238 test vectors, "12345678901234567890".
+var rfcSecret = base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestCode(t *testing.T) {
+	// RFC 6238 appendix B, truncated to 6 digits
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tc := range tests {
+		code, err := Code(rfcSecret, Step(time.Unix(tc.unix, 0)))
+		assert.Nil(t, err)
+		assert.Equal(t, tc.code, code, tc.unix)
+	}
+
+	_, err := Code("not base32!", 1)
+	assert.NotNil(t, err)
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step, ok := Validate(rfcSecret, "050471", now, 0)
+	assert.True(t, ok)
+	assert.Equal(t, Step(now), step)
+
+	// the previous and next codes are accepted too
+	_, ok = Validate(rfcSecret, "050471", now.Add(Period), 0)
+	assert.True(t, ok)
+	_, ok = Validate(rfcSecret, "050471", now.Add(-Period), 0)
+	assert.True(t, ok)
+	_, ok = Validate(rfcSecret, "050471", now.Add(2*Period), 0)
+	assert.False(t, ok)
+
+	// a code cannot be used twice
+	_, ok = Validate(rfcSecret, "050471", now, step)
+	assert.False(t, ok)
+
+	_, ok = Validate(rfcSecret, "12345", now, 0)
+	assert.False(t, ok)
+}
+
+func TestGenerateSecret(t *testing.T) {
+	secret, err := GenerateSecret()
+	assert.Nil(t, err)
+	assert.Len(t, secret, 32)
+	other, _ := GenerateSecret()
+	assert.NotEqual(t, secret, other)
+
+	code, err := Code(secret, Step(time.Now()))
+	assert.Nil(t, err)
+	_, ok := Validate(secret, code, time.Now(), 0)
+	assert.True(t, ok)
+}
+
+func TestURI(t *testing.T) {
+	uri := URI("Online Shop", "demo@example.com", "JBSWY3DPEHPK3PXP")
+	assert.True(t, strings.HasPrefix(uri, "otpauth://totp/Online%20Shop:demo@example.com?"), uri)
+	assert.Contains(t, uri, "secret=JBSWY3DPEHPK3PXP")
+	assert.Contains(t, uri, "issuer=Online+Shop")
+}
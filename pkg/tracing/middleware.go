@@ -0,0 +1,45 @@
+package tracing
+
+import (
+	routing "github.com/go-ozzo/ozzo-routing/v2"
+	"github.com/go-ozzo/ozzo-routing/v2/access"
+	"github.com/online-shop/pkg/routepattern"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+)
+
+// Handler returns a middleware that starts a server span for every HTTP request being processed.
+// The span continues the trace described by the W3C traceparent header of the request, if present.
+func Handler(service string) routing.Handler {
+	matcher := &routepattern.Matcher{}
+	return func(c *routing.Context) error {
+		ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+		route := matcher.Match(c.Router(), c.Request.Method, c.Request.URL.Path)
+		ctx, span := StartSpan(ctx, c.Request.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(semconv.HTTPServerAttributesFromHTTPRequest(service, route, c.Request)...),
+		)
+		defer span.End()
+
+		rw := &access.LogResponseWriter{ResponseWriter: c.Response, Status: http.StatusOK}
+		c.Response = rw
+		c.Request = c.Request.WithContext(ctx)
+
+		err := c.Next()
+
+		// errors not yet turned into a response are written by the router after this middleware returns
+		code := rw.Status
+		if httpErr, ok := err.(routing.HTTPError); ok {
+			code = httpErr.StatusCode()
+		} else if err != nil {
+			code = http.StatusInternalServerError
+		}
+		span.SetAttributes(semconv.HTTPAttributesFromHTTPStatusCode(code)...)
+		span.SetStatus(semconv.SpanStatusFromHTTPStatusCode(code))
+
+		return err
+	}
+}
@@ -0,0 +1,98 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	routing "github.com/go-ozzo/ozzo-routing/v2"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func setupTest() *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	Init(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	return exporter
+}
+
+func TestHandler(t *testing.T) {
+	exporter := setupTest()
+
+	router := routing.New()
+	router.Use(Handler("test"))
+	router.Get("/orders/<id>", func(c *routing.Context) error {
+		_, span := StartSpan(c.Request.Context(), "order.Service.Get")
+		span.End()
+		return c.Write("ok")
+	})
+	router.Get("/fail", func(c *routing.Context) error {
+		return errors.New("boom")
+	})
+
+	req, _ := http.NewRequest("GET", "/orders/1", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusOK, res.Code)
+
+	spans := exporter.GetSpans()
+	if assert.Len(t, spans, 2) {
+		child, server := spans[0], spans[1]
+		assert.Equal(t, "order.Service.Get", child.Name)
+		assert.Equal(t, "GET /orders/<id>", server.Name)
+		assert.Equal(t, trace.SpanKindServer, server.SpanKind)
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", server.SpanContext.TraceID().String())
+		assert.Equal(t, "00f067aa0ba902b7", server.Parent.SpanID().String())
+		assert.True(t, server.Parent.IsRemote())
+		assert.Equal(t, server.SpanContext.TraceID(), child.SpanContext.TraceID())
+		assert.Equal(t, server.SpanContext.SpanID(), child.Parent.SpanID())
+	}
+
+	exporter.Reset()
+	req, _ = http.NewRequest("GET", "/fail", nil)
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	spans = exporter.GetSpans()
+	if assert.Len(t, spans, 1) {
+		assert.False(t, spans[0].Parent.IsValid())
+		assert.Equal(t, codes.Error, spans[0].Status.Code)
+	}
+}
+
+func TestRecordError(t *testing.T) {
+	exporter := setupTest()
+
+	_, span := StartSpan(context.Background(), "ok")
+	RecordError(span, nil)
+	span.End()
+	_, span = StartSpan(context.Background(), "failed")
+	RecordError(span, errors.New("boom"))
+	span.End()
+
+	spans := exporter.GetSpans()
+	if assert.Len(t, spans, 2) {
+		assert.Equal(t, codes.Unset, spans[0].Status.Code)
+		assert.Equal(t, codes.Error, spans[1].Status.Code)
+		assert.Equal(t, "boom", spans[1].Status.Description)
+		assert.Len(t, spans[1].Events, 1)
+	}
+}
+
+func TestNewExporter(t *testing.T) {
+	exporter, err := NewExporter(context.Background(), ExporterNone, "")
+	assert.Nil(t, err)
+	assert.Nil(t, exporter)
+
+	exporter, err = NewExporter(context.Background(), ExporterStdout, "")
+	assert.Nil(t, err)
+	assert.NotNil(t, exporter)
+
+	_, err = NewExporter(context.Background(), "zipkin", "")
+	assert.NotNil(t, err)
+
+	assert.NotNil(t, NewProvider(nil, "test", "0.1.0"))
+}